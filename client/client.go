@@ -0,0 +1,471 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/paths"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Time allowed to connect to the daemon when [Config.DialTimeout] is zero.
+const DefaultDialTimeout = 5 * time.Second
+
+// Configuration for [New].
+type Config struct {
+	SocketPath  string        // Unix socket of the daemon. Empty uses the daemon's default socket.
+	DialTimeout time.Duration // Time allowed to connect to the daemon. Zero uses [DefaultDialTimeout].
+}
+
+// Client of a cruxd daemon.
+//
+// Every method connects to the daemon for the duration of one command, so
+// a Client holds no connection and is safe for concurrent use.
+type Client struct {
+	socketPath  string        // Unix socket of the daemon.
+	dialTimeout time.Duration // Time allowed to connect.
+}
+
+// Creates a client of the daemon listening on the configured socket.
+//
+// No connection is made until the first command.
+func New(cfg Config) *Client {
+	c := &Client{socketPath: cfg.SocketPath, dialTimeout: cfg.DialTimeout}
+	if c.socketPath == "" {
+		c.socketPath = paths.Socket("default")
+	}
+	if c.dialTimeout == 0 {
+		c.dialTimeout = DefaultDialTimeout
+	}
+	return c
+}
+
+// Builds a resource, calling progress with each event of the build as the
+// daemon reports it.
+//
+// A nil progress asks the daemon for the result only. The daemon cancels
+// the build when ctx is done, since the connection is closed, unless the
+// request sets Detach; a detached build can be followed again with
+// [Client.BuildAttach].
+//
+// With ContextDir set, the directory is the build context, whether or not
+// the daemon runs on this host. Its tree is described to the daemon with
+// the digest of every file, and the daemon asks for the files as copy
+// steps read them, so files no step copies are never sent. ContextArchive
+// sends the whole directory before the build instead, for daemons that
+// lack the "context-fetch" feature and for detached builds, which cannot
+// fetch files once the client is gone.
+func (c *Client) Build(ctx context.Context, req *BuildRequest, progress func(BuildEvent)) (*BuildResult, error) {
+	if req == nil {
+		req = &BuildRequest{}
+	}
+	var stream func(protocol.Command, json.RawMessage) error
+	if progress != nil {
+		stream = buildEvents(progress)
+	}
+	wire := &buildRequest{BuildRequest: req, Events: progress != nil}
+	if req.ContextDir == "" {
+		return call[BuildResult](ctx, c, protocol.CmdBuild, wire, stream)
+	}
+
+	var err error
+	if wire.Context, err = newContextRequest(req.ContextDir, req.ContextArchive); err != nil {
+		return nil, err
+	}
+	s, err := c.open(ctx, protocol.CmdBuild, wire)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	return receive[BuildResult](s, protocol.CmdBuild, serveContext(s, req.ContextDir, stream))
+}
+
+// Follows a running or recently finished build, calling progress with its
+// recent events and then each new one, and returns the build's result.
+//
+// A nil progress only waits for the result. Closing the connection when ctx
+// is done detaches from the build without affecting it.
+func (c *Client) BuildAttach(ctx context.Context, id string, progress func(BuildEvent)) (*BuildResult, error) {
+	return call[BuildResult](ctx, c, cmdBuildAttach, &buildIDRequest{ID: id}, buildEvents(progress))
+}
+
+// Cancels a running build and waits until it has been torn down.
+func (c *Client) BuildCancel(ctx context.Context, id string) error {
+	_, err := call[struct{}](ctx, c, cmdBuildCancel, &buildIDRequest{ID: id}, nil)
+	return err
+}
+
+// Reports the recently finished builds, most recent first.
+func (c *Client) BuildList(ctx context.Context) ([]BuildRecord, error) {
+	res, err := call[buildListResult](ctx, c, cmdBuildList, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Builds, nil
+}
+
+// Cancels every running build and refuses new ones until [Client.Resume],
+// returning once the canceled builds have been torn down.
+func (c *Client) Drain(ctx context.Context) (*DrainResult, error) {
+	return call[DrainResult](ctx, c, cmdDrain, nil, nil)
+}
+
+// Accepts new builds again after a drain.
+func (c *Client) Resume(ctx context.Context) error {
+	_, err := call[struct{}](ctx, c, cmdResume, nil, nil)
+	return err
+}
+
+// Stops the daemon once the commands it is handling have finished.
+//
+// The daemon answers before it begins shutting down, so a nil error means
+// the shutdown was accepted, not that the daemon has stopped.
+func (c *Client) Shutdown(ctx context.Context) error {
+	_, err := call[struct{}](ctx, c, cmdShutdown, nil, nil)
+	return err
+}
+
+// Reports the status of the daemon.
+func (c *Client) Status(ctx context.Context) (*StatusResult, error) {
+	return call[StatusResult](ctx, c, protocol.CmdStatus, nil, nil)
+}
+
+// Reports what the daemon supports.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	return call[Capabilities](ctx, c, cmdCapabilities, nil, nil)
+}
+
+// Reports the configuration the daemon runs with.
+func (c *Client) Config(ctx context.Context) (*ConfigResult, error) {
+	return call[ConfigResult](ctx, c, cmdConfig, nil, nil)
+}
+
+// Imports an image archive under the tag of a reference and version.
+func (c *Client) ImageImport(ctx context.Context, req *protocol.ImageImportRequest) (*ImageResult, error) {
+	return call[ImageResult](ctx, c, protocol.CmdImageImport, req, nil)
+}
+
+// Starts a container from an imported image.
+func (c *Client) ImageStart(ctx context.Context, req *ImageStartRequest) (*ImageResult, error) {
+	return call[ImageResult](ctx, c, protocol.CmdImageStart, req, nil)
+}
+
+// Removes an imported image and the containers created from it.
+func (c *Client) ImageDestroy(ctx context.Context, req *protocol.ImageDestroyRequest) (*ImageResult, error) {
+	return call[ImageResult](ctx, c, protocol.CmdImageDestroy, req, nil)
+}
+
+// Reports the image tag a reference and version resolve to, and whether
+// the image is present.
+func (c *Client) ResolveTag(ctx context.Context, ref, version string) (*ResolveTagResult, error) {
+	return call[ResolveTagResult](ctx, c, cmdResolveTag, &resolveTagRequest{Ref: ref, Version: version}, nil)
+}
+
+// Stops a container's task, keeping the container.
+func (c *Client) ContainerStop(ctx context.Context, id string) error {
+	_, err := call[struct{}](ctx, c, protocol.CmdContainerStop, &protocol.ContainerStopRequest{ID: id}, nil)
+	return err
+}
+
+// Removes a container and its snapshot.
+func (c *Client) ContainerDestroy(ctx context.Context, id string) error {
+	_, err := call[struct{}](ctx, c, protocol.CmdContainerDestroy, &protocol.ContainerDestroyRequest{ID: id}, nil)
+	return err
+}
+
+// Removes the containers whose ID starts with prefix, such as those of a
+// resource, and returns their IDs.
+func (c *Client) ContainerDestroyPrefix(ctx context.Context, prefix string) ([]string, error) {
+	res, err := call[containerDestroyPrefixResult](ctx, c, cmdContainerDestroyPrefix, &containerDestroyPrefixRequest{Prefix: prefix}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Destroyed, nil
+}
+
+// Reports the state of a container.
+func (c *Client) ContainerStatus(ctx context.Context, id string) (protocol.ContainerState, error) {
+	res, err := call[protocol.ContainerStatusResult](ctx, c, protocol.CmdContainerStatus, &protocol.ContainerStatusRequest{ID: id}, nil)
+	if err != nil {
+		return "", err
+	}
+	return res.Status, nil
+}
+
+// Reports the snapshot mounts that assemble a container's root filesystem
+// on the daemon's host.
+func (c *Client) ContainerMounts(ctx context.Context, id string) ([]Mount, error) {
+	res, err := call[containerMountsResult](ctx, c, cmdContainerMounts, &containerRequest{ID: id}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Mounts, nil
+}
+
+// Runs a command in a container and returns its exit code and output.
+//
+// The output is buffered by the daemon and cut at its exec output limit.
+// A non-zero exit code is not an error.
+func (c *Client) ContainerExec(ctx context.Context, id string, command []string) (*ExecResult, error) {
+	return call[ExecResult](ctx, c, protocol.CmdContainerExec, &protocol.ContainerExecRequest{ID: id, Command: command}, nil)
+}
+
+// Runs a command in a container, writing its output as it is produced,
+// and returns its exit code.
+//
+// The result carries no output, and no limit applies to it. With Stdin
+// set, the call returns once the command exits, without waiting for a read
+// from Stdin in progress. A non-zero exit code is not an error.
+func (c *Client) ContainerExecStream(ctx context.Context, req *ExecStreamRequest) (*ExecResult, error) {
+	interactive := req.Stdin != nil
+	s, err := c.open(ctx, protocol.CmdContainerExec, &containerExecRequest{
+		ContainerExecRequest: protocol.ContainerExecRequest{ID: req.ID, Command: req.Command},
+		Stream:               true,
+		Interactive:          interactive,
+		TTY:                  interactive && req.TTY,
+		Size:                 req.Size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	if interactive {
+		go s.sendInput(req.Stdin)
+		if req.TTY && req.Resize != nil {
+			done := make(chan struct{})
+			defer close(done)
+			go s.sendResizes(req.Resize, done)
+		}
+	}
+	return receive[ExecResult](s, protocol.CmdContainerExec, processOutput(req.Stdout, req.Stderr))
+}
+
+// Replaces a container with one running a newly imported image.
+func (c *Client) ContainerUpdate(ctx context.Context, req *protocol.ContainerUpdateRequest) error {
+	_, err := call[struct{}](ctx, c, protocol.CmdContainerUpdate, req, nil)
+	return err
+}
+
+// Runs a command in a throwaway container started from an OCI image
+// reference, writing its output as it is produced, and returns its exit
+// code.
+//
+// The daemon destroys the container once the command exits or the call
+// ends. A non-zero exit code is not an error.
+func (c *Client) Run(ctx context.Context, req *RunRequest, stdout, stderr io.Writer) (*RunResult, error) {
+	return call[RunResult](ctx, c, cmdRun, req, processOutput(stdout, stderr))
+}
+
+// Removes build cache entries so that the next build executes every step.
+//
+// The resource matches as a prefix of resource names, so "my-app" also
+// clears the entries of "my-app-worker". An empty resource clears the
+// whole cache.
+func (c *Client) CacheClear(ctx context.Context, req *CacheClearRequest) (*CacheClearResult, error) {
+	return call[CacheClearResult](ctx, c, cmdCacheClear, req, nil)
+}
+
+// Returns a stream function that passes build events to progress, which
+// may be nil to drop them.
+func buildEvents(progress func(BuildEvent)) func(protocol.Command, json.RawMessage) error {
+	return func(cmd protocol.Command, payload json.RawMessage) error {
+		if cmd != cmdBuildEvent {
+			return crex.Wrapf(ErrProtocol, "unexpected %s message during build", cmd)
+		}
+		ev, err := protocol.DecodePayload[BuildEvent](payload)
+		if err != nil {
+			return crex.Wrapf(ErrProtocol, "build event: %w", err)
+		}
+		if progress != nil {
+			progress(*ev)
+		}
+		return nil
+	}
+}
+
+// Returns a stream function that writes output messages to stdout and
+// stderr, either of which may be nil to discard the stream. An error
+// writing the output ends the call.
+func processOutput(stdout, stderr io.Writer) func(protocol.Command, json.RawMessage) error {
+	return func(cmd protocol.Command, payload json.RawMessage) error {
+		if cmd != cmdOutput {
+			return crex.Wrapf(ErrProtocol, "unexpected %s message during output", cmd)
+		}
+		chunk, err := protocol.DecodePayload[outputChunk](payload)
+		if err != nil {
+			return crex.Wrapf(ErrProtocol, "output: %w", err)
+		}
+		w := stdout
+		if chunk.Stream == "stderr" {
+			w = stderr
+		}
+		if w == nil {
+			return nil
+		}
+		_, err = w.Write(chunk.Data)
+		return err
+	}
+}
+
+// Connection to the daemon carrying a single command.
+type session struct {
+	ctx    context.Context
+	client *Client
+	conn   net.Conn
+	reader *bufio.Reader
+	stop   func() bool // Releases the context's hold on the connection.
+	mu     sync.Mutex  // Serializes writes to conn.
+}
+
+// Connects to the daemon and sends a command.
+func (c *Client) open(ctx context.Context, cmd protocol.Command, payload any) (*session, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reads and writes block on the connection rather than on ctx, so a
+	// done context expires the connection's deadline to release them.
+	s := &session{ctx: ctx, client: c, conn: conn, reader: bufio.NewReader(conn)}
+	s.stop = context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+
+	if err := s.send(cmd, payload); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Writes one message to the daemon.
+func (s *session) send(cmd protocol.Command, payload any) error {
+	data, err := protocol.Encode(cmd, payload)
+	if err != nil {
+		return crex.Wrapf(ErrProtocol, "encoding %s: %w", cmd, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.conn.Write(append(data, '\n')); err != nil {
+		return s.client.connError(s.ctx, err)
+	}
+	return nil
+}
+
+// Feeds what is read from r to an interactive exec as input messages, and
+// closes the command's stdin once r is exhausted or fails. Sending stops
+// when the connection is closed.
+func (s *session) sendInput(r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if s.send(cmdInput, &inputChunk{Data: buf[:n]}) != nil {
+				return
+			}
+		}
+		if err != nil {
+			s.send(cmdInput, &inputChunk{Close: true})
+			return
+		}
+	}
+}
+
+// Sends each size received from sizes as a resize message until done is
+// closed or sizes is.
+func (s *session) sendResizes(sizes <-chan TerminalSize, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case size, ok := <-sizes:
+			if !ok || s.send(cmdResize, &size) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Closes the connection.
+func (s *session) close() {
+	s.stop()
+	s.conn.Close()
+}
+
+// Sends one command and decodes its result.
+//
+// Messages that arrive before the result are passed to stream, whose error
+// ends the call, or rejected as malformed when stream is nil. A result
+// without a payload, as older daemons send for some commands, decodes to
+// the zero result.
+func call[T any](ctx context.Context, c *Client, cmd protocol.Command, payload any, stream func(protocol.Command, json.RawMessage) error) (*T, error) {
+	s, err := c.open(ctx, cmd, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	return receive[T](s, cmd, stream)
+}
+
+// Reads the messages answering cmd until its result, as described for
+// [call].
+func receive[T any](s *session, cmd protocol.Command, stream func(protocol.Command, json.RawMessage) error) (*T, error) {
+	for {
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, s.client.connError(s.ctx, err)
+		}
+		env, body, err := protocol.Decode(line)
+		if err != nil {
+			return nil, crex.Wrap(ErrProtocol, err)
+		}
+
+		switch env.Command {
+		case protocol.CmdOK:
+			var result T
+			if len(body) > 0 && string(body) != "null" {
+				if err := json.Unmarshal(body, &result); err != nil {
+					return nil, crex.Wrapf(ErrProtocol, "%s result: %w", cmd, err)
+				}
+			}
+			return &result, nil
+		case protocol.CmdError:
+			res, err := protocol.DecodePayload[errorResult](body)
+			if err != nil {
+				return nil, crex.Wrapf(ErrProtocol, "%s error: %w", cmd, err)
+			}
+			return nil, &CommandError{Message: res.Message, Code: res.Code}
+		}
+
+		if stream == nil {
+			return nil, crex.Wrapf(ErrProtocol, "unexpected %s message in response to %s", env.Command, cmd)
+		}
+		if err := stream(env.Command, body); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Connects to the daemon's socket.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: c.dialTimeout}
+	conn, err := d.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		return nil, crex.Wrapf(ErrConnection, "%s: %w", c.socketPath, err)
+	}
+	return conn, nil
+}
+
+// Returns the error of a failed read or write, which is the context's when
+// it expired the connection.
+func (c *Client) connError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return crex.Wrapf(ErrConnection, "%s: %w", c.socketPath, context.Cause(ctx))
+	}
+	return crex.Wrapf(ErrConnection, "%s: %w", c.socketPath, err)
+}
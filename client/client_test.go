@@ -0,0 +1,431 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Starts a daemon stand-in on a socket in a temporary directory that
+// answers each command with the lines reply returns for it, and returns a
+// client of it.
+func newTestClient(t *testing.T, reply func(cmd protocol.Command, payload json.RawMessage) []string) *Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cruxd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err != nil {
+					return
+				}
+				env, payload, err := protocol.Decode(line)
+				if err != nil {
+					return
+				}
+				for _, l := range reply(env.Command, payload) {
+					conn.Write([]byte(l + "\n"))
+				}
+				// Keep the connection open until the client closes it.
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	return New(Config{SocketPath: path})
+}
+
+// Returns the encoded message of a command and payload.
+func message(t *testing.T, cmd protocol.Command, payload any) string {
+	t.Helper()
+	data, err := protocol.Encode(cmd, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStatus(t *testing.T) {
+	c := newTestClient(t, func(cmd protocol.Command, _ json.RawMessage) []string {
+		if cmd != protocol.CmdStatus {
+			t.Errorf("command = %q, want %q", cmd, protocol.CmdStatus)
+		}
+		return []string{`{"command":"ok","payload":{"draining":true,"queued":2}}`}
+	})
+
+	res, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.Draining || res.Queued != 2 {
+		t.Errorf("status = %+v", res)
+	}
+}
+
+func TestBuildProgress(t *testing.T) {
+	c := newTestClient(t, func(cmd protocol.Command, payload json.RawMessage) []string {
+		var req struct {
+			Resource string `json:"resource"`
+			Events   bool   `json:"events"`
+			NoCache  bool   `json:"noCache"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil || !req.Events {
+			t.Errorf("build request %s does not ask for events", payload)
+		}
+		if req.Resource != "my-app" || !req.NoCache {
+			t.Errorf("build request %s lost its fields", payload)
+		}
+		return []string{
+			message(t, cmdBuildEvent, BuildEvent{ID: "build-1", Seq: 1, Kind: "started"}),
+			message(t, cmdBuildEvent, BuildEvent{ID: "build-1", Seq: 2, Kind: "step", Stage: "build", Message: "RUN make"}),
+			`{"command":"ok","payload":{"id":"build-1","archives":["/out/image.tar"]}}`,
+		}
+	})
+
+	var events []BuildEvent
+	res, err := c.Build(context.Background(), &BuildRequest{BuildRequest: protocol.BuildRequest{Resource: "my-app"}, NoCache: true}, func(ev BuildEvent) {
+		events = append(events, ev)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.ID != "build-1" || len(res.Archives) != 1 {
+		t.Errorf("result = %+v", res)
+	}
+	if len(events) != 2 || events[1].Kind != "step" || events[1].Message != "RUN make" {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+func TestBuildAttach(t *testing.T) {
+	c := newTestClient(t, func(cmd protocol.Command, payload json.RawMessage) []string {
+		if cmd != cmdBuildAttach || string(payload) != `{"id":"build-1"}` {
+			t.Errorf("request = %s %s", cmd, payload)
+		}
+		return []string{
+			message(t, cmdBuildEvent, BuildEvent{ID: "build-1", Seq: 1, Kind: "started"}),
+			`{"command":"ok","payload":{"id":"build-1"}}`,
+		}
+	})
+
+	res, err := c.BuildAttach(context.Background(), "build-1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.ID != "build-1" {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		cmd     protocol.Command
+		payload string
+		result  string
+		call    func(c *Client) (any, error)
+		want    any
+	}{
+		{
+			cmd:    cmdBuildList,
+			result: `{"builds":[{"id":"build-1","result":"failed","code":"build-canceled"}]}`,
+			call:   func(c *Client) (any, error) { return c.BuildList(ctx) },
+			want:   []BuildRecord{{ID: "build-1", Result: "failed", Code: "build-canceled"}},
+		},
+		{
+			cmd:    cmdDrain,
+			result: `{"canceled":["build-1"]}`,
+			call:   func(c *Client) (any, error) { return c.Drain(ctx) },
+			want:   &DrainResult{Canceled: []string{"build-1"}},
+		},
+		{
+			cmd:  cmdResume,
+			call: func(c *Client) (any, error) { return nil, c.Resume(ctx) },
+		},
+		{
+			cmd:  cmdShutdown,
+			call: func(c *Client) (any, error) { return nil, c.Shutdown(ctx) },
+		},
+		{
+			cmd:    cmdCapabilities,
+			result: `{"version":1,"features":["run"],"maxMessageSize":1024,"remoteContainerd":true}`,
+			call:   func(c *Client) (any, error) { return c.Capabilities(ctx) },
+			want:   &Capabilities{Version: 1, Features: []string{"run"}, MaxMessageSize: 1024, RemoteContainerd: true},
+		},
+		{
+			cmd:    cmdConfig,
+			result: `{"settings":[{"name":"socket","value":"/run/cruxd.sock","source":"default"}]}`,
+			call:   func(c *Client) (any, error) { return c.Config(ctx) },
+			want:   &ConfigResult{Settings: []ConfigSetting{{Name: "socket", Value: "/run/cruxd.sock", Source: "default"}}},
+		},
+		{
+			cmd:     cmdResolveTag,
+			payload: `{"ref":"app","version":"1.0.0"}`,
+			result:  `{"tag":"app:1.0.0","present":true}`,
+			call:    func(c *Client) (any, error) { return c.ResolveTag(ctx, "app", "1.0.0") },
+			want:    &ResolveTagResult{Tag: "app:1.0.0", Present: true},
+		},
+		{
+			cmd:     cmdContainerMounts,
+			payload: `{"id":"my-app"}`,
+			result:  `{"mounts":[{"type":"overlay","source":"overlay","options":["ro"]}]}`,
+			call:    func(c *Client) (any, error) { return c.ContainerMounts(ctx, "my-app") },
+			want:    []Mount{{Type: "overlay", Source: "overlay", Options: []string{"ro"}}},
+		},
+		{
+			cmd:     cmdContainerDestroyPrefix,
+			payload: `{"prefix":"my-app"}`,
+			result:  `{"destroyed":["my-app-linux-amd64"]}`,
+			call:    func(c *Client) (any, error) { return c.ContainerDestroyPrefix(ctx, "my-app") },
+			want:    []string{"my-app-linux-amd64"},
+		},
+		{
+			cmd:     cmdCacheClear,
+			payload: `{"resource":"my-app","snapshotter":"native"}`,
+			result:  `{"removed":2,"reclaimed":4096}`,
+			call: func(c *Client) (any, error) {
+				return c.CacheClear(ctx, &CacheClearRequest{Resource: "my-app", Snapshotter: "native"})
+			},
+			want: &CacheClearResult{Removed: 2, Reclaimed: 4096},
+		},
+		{
+			cmd:     protocol.CmdImageStart,
+			payload: `"recreate":true,"readiness":{"port":8080}}`,
+			result:  `{"tag":"app:1.0.0","action":"started","id":"my-app"}`,
+			call: func(c *Client) (any, error) {
+				return c.ImageStart(ctx, &ImageStartRequest{
+					ImageStartRequest: protocol.ImageStartRequest{Ref: "app", Version: "1.0.0", ID: "my-app"},
+					Recreate:          true,
+					Readiness:         &Readiness{Port: 8080},
+				})
+			},
+			want: &ImageResult{Tag: "app:1.0.0", Action: "started", ID: "my-app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.cmd), func(t *testing.T) {
+			c := newTestClient(t, func(cmd protocol.Command, payload json.RawMessage) []string {
+				if cmd != tt.cmd {
+					t.Errorf("command = %q, want %q", cmd, tt.cmd)
+				}
+				if !strings.Contains(string(payload), tt.payload) {
+					t.Errorf("payload = %s, want %s", payload, tt.payload)
+				}
+				if tt.result == "" {
+					return []string{`{"command":"ok"}`}
+				}
+				return []string{`{"command":"ok","payload":` + tt.result + `}`}
+			})
+
+			got, err := tt.call(c)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	binary := []byte{0x1f, 0x8b, 0xff}
+	c := newTestClient(t, func(cmd protocol.Command, payload json.RawMessage) []string {
+		if cmd != cmdRun {
+			t.Errorf("command = %q, want %q", cmd, cmdRun)
+		}
+		return []string{
+			message(t, cmdOutput, outputChunk{Stream: "stdout", Data: binary}),
+			message(t, cmdOutput, outputChunk{Stream: "stderr", Data: []byte("warning\n")}),
+			`{"command":"ok","payload":{"exitCode":3}}`,
+		}
+	})
+
+	var stdout, stderr bytes.Buffer
+	res, err := c.Run(context.Background(), &RunRequest{Ref: "alpine:3.21", Command: []string{"sh"}}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.ExitCode != 3 {
+		t.Errorf("exit code = %d, want 3", res.ExitCode)
+	}
+	if !bytes.Equal(stdout.Bytes(), binary) || stderr.String() != "warning\n" {
+		t.Errorf("stdout = %q, stderr = %q", stdout.Bytes(), stderr.String())
+	}
+}
+
+func TestContainerExecStreamInteractive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cruxd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Echoes each input message back as output until stdin is closed.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		line, _ := reader.ReadBytes('\n')
+		_, payload, _ := protocol.Decode(line)
+		var req containerExecRequest
+		if json.Unmarshal(payload, &req) != nil || !req.Stream || !req.Interactive || !req.TTY {
+			t.Errorf("exec request = %s", payload)
+		}
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			env, payload, _ := protocol.Decode(line)
+			if env.Command != cmdInput {
+				continue
+			}
+			chunk, _ := protocol.DecodePayload[inputChunk](payload)
+			if len(chunk.Data) > 0 {
+				data, _ := protocol.Encode(cmdOutput, outputChunk{Stream: "stdout", Data: chunk.Data})
+				conn.Write(append(data, '\n'))
+			}
+			if chunk.Close {
+				conn.Write([]byte(`{"command":"ok","payload":{"ExitCode":0}}` + "\n"))
+				return
+			}
+		}
+	}()
+
+	input := []byte{'l', 's', 0x1b, 0x5b, 0x41, 0xff, '\n'}
+	var stdout bytes.Buffer
+	c := New(Config{SocketPath: path})
+	res, err := c.ContainerExecStream(context.Background(), &ExecStreamRequest{
+		ID:      "my-app",
+		Command: []string{"sh"},
+		Stdout:  &stdout,
+		Stdin:   bytes.NewReader(input),
+		TTY:     true,
+		Size:    &TerminalSize{Width: 80, Height: 24},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.ExitCode != 0 || !bytes.Equal(stdout.Bytes(), input) {
+		t.Errorf("exit code = %d, stdout = %q", res.ExitCode, stdout.Bytes())
+	}
+}
+
+func TestImageImportWithoutResult(t *testing.T) {
+	c := newTestClient(t, func(protocol.Command, json.RawMessage) []string {
+		return []string{`{"command":"ok"}`}
+	})
+
+	res, err := c.ImageImport(context.Background(), &protocol.ImageImportRequest{Ref: "app", Version: "1.0.0", Path: "/tmp/app.tar"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *res != (ImageResult{}) {
+		t.Errorf("result = %+v, want zero", res)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	c := newTestClient(t, func(protocol.Command, json.RawMessage) []string {
+		return []string{`{"command":"error","payload":{"message":"recipe has no stages","code":"invalid-recipe"}}`}
+	})
+
+	_, err := c.Build(context.Background(), &BuildRequest{}, nil)
+	if !errors.Is(err, ErrCommand) {
+		t.Fatalf("err = %v, want ErrCommand", err)
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Code != "invalid-recipe" {
+		t.Errorf("command error = %+v", cmdErr)
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{name: "not json", lines: []string{"not json"}},
+		{name: "bad result", lines: []string{`{"command":"ok","payload":{"queued":"many"}}`}},
+		{name: "bad error", lines: []string{`{"command":"error","payload":"oops"}`}},
+		{name: "unexpected message", lines: []string{`{"command":"build-event","payload":{}}`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(protocol.Command, json.RawMessage) []string { return tt.lines })
+			if _, err := c.Status(context.Background()); !errors.Is(err, ErrProtocol) {
+				t.Errorf("err = %v, want ErrProtocol", err)
+			}
+		})
+	}
+}
+
+func TestConnectionErrors(t *testing.T) {
+	t.Run("no daemon", func(t *testing.T) {
+		c := New(Config{SocketPath: filepath.Join(t.TempDir(), "missing.sock")})
+		if _, err := c.Status(context.Background()); !errors.Is(err, ErrConnection) {
+			t.Errorf("err = %v, want ErrConnection", err)
+		}
+	})
+
+	t.Run("closed before result", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cruxd.sock")
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadBytes('\n')
+			conn.Close()
+		}()
+
+		c := New(Config{SocketPath: path})
+		if _, err := c.Status(context.Background()); !errors.Is(err, ErrConnection) {
+			t.Errorf("err = %v, want ErrConnection", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		c := newTestClient(t, func(protocol.Command, json.RawMessage) []string { return nil })
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := c.Status(ctx)
+		if !errors.Is(err, ErrConnection) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want ErrConnection with context.DeadlineExceeded", err)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Largest chunk of archive sent in one context-data message, well below
+// the daemon's default message size limit once base64-encoded.
+const contextChunkSize = 256 << 10
+
+// Types of the entries in a [contextRequest].
+const (
+	contextFile    = "file"    // Regular file.
+	contextDir     = "dir"     // Directory.
+	contextSymlink = "symlink" // Symbolic link.
+)
+
+// Describes the build context in dir for the daemon.
+//
+// Unless the whole context is sent as an archive, every file, directory,
+// and symbolic link below dir is advertised, with the size and digest of
+// each file, so that the daemon can ask for the files it needs and check
+// what it receives. Other entries, such as sockets, are left out, as the
+// daemon skips them in contexts on its own host.
+func newContextRequest(dir string, archive bool) (*contextRequest, error) {
+	if archive {
+		return &contextRequest{Archive: true}, nil
+	}
+
+	var entries []contextEntry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		e := contextEntry{Path: filepath.ToSlash(rel), Mode: chmodBits(info.Mode()), ModTime: info.ModTime()}
+		switch {
+		case info.IsDir():
+			e.Type = contextDir
+		case info.Mode()&fs.ModeSymlink != 0:
+			e.Type = contextSymlink
+			e.Mode = 0
+			if e.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			e.Type = contextFile
+			e.Size = info.Size()
+			if e.Digest, err = fileDigest(p); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, crex.Wrap(ErrContext, err)
+	}
+	return &contextRequest{Entries: entries}, nil
+}
+
+// Returns the SHA-256 of a file's contents, as "sha256:<hex>".
+func fileDigest(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the permission bits of mode as given to chmod, including setuid,
+// setgid, and sticky.
+func chmodBits(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+// Returns a stream function that answers the daemon's context-fetch
+// messages from dir and passes other messages to next, which may be nil to
+// reject them.
+func serveContext(s *session, dir string, next func(protocol.Command, json.RawMessage) error) func(protocol.Command, json.RawMessage) error {
+	return func(cmd protocol.Command, payload json.RawMessage) error {
+		if cmd != cmdContextFetch {
+			if next == nil {
+				return crex.Wrapf(ErrProtocol, "unexpected %s message during build", cmd)
+			}
+			return next(cmd, payload)
+		}
+		req, err := protocol.DecodePayload[contextFetchRequest](payload)
+		if err != nil {
+			return crex.Wrapf(ErrProtocol, "context fetch: %w", err)
+		}
+		return s.sendContext(dir, req)
+	}
+}
+
+// Sends the archive answering a context fetch as context-data messages.
+//
+// A file that cannot be read ends the archive with the error, which fails
+// the build on the daemon's side, rather than the call.
+func (s *session) sendContext(dir string, req *contextFetchRequest) error {
+	chunks := &chunkWriter{s: s}
+	w := bufio.NewWriterSize(chunks, contextChunkSize)
+	var err error
+	if req.All {
+		err = writeContextArchive(w, dir)
+	} else {
+		err = writeContextFiles(w, dir, req.Paths)
+	}
+	if chunks.err != nil {
+		return chunks.err
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if chunks.err != nil {
+		return chunks.err
+	}
+	if err != nil {
+		return s.send(cmdContextData, &contextChunk{Error: err.Error()})
+	}
+	return s.send(cmdContextData, &contextChunk{Done: true})
+}
+
+// Writes a tar archive of the regular files at paths, relative to dir.
+//
+// The files are opened through an [os.Root], so a path that leads out of
+// dir, by its name or through a symbolic link, fails.
+func writeContextFiles(w io.Writer, dir string, paths []string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	tw := tar.NewWriter(w)
+	for _, p := range paths {
+		if err := writeContextFile(tw, root, p); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Writes one regular file of the context to an archive.
+func writeContextFile(tw *tar.Writer, root *os.Root, p string) error {
+	f, err := root.Open(filepath.FromSlash(p))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return &fs.PathError{Op: "send", Path: p, Err: fs.ErrInvalid}
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     p,
+		Mode:     int64(chmodBits(info.Mode())),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, info.Size())
+	return err
+}
+
+// Writes a tar archive of the whole context in dir: its directories,
+// regular files, and symbolic links.
+func writeContextArchive(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case info.IsDir(), info.Mode().IsRegular():
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Sends what is written to it as context-data messages of at most
+// [contextChunkSize] bytes each.
+type chunkWriter struct {
+	s   *session
+	err error // First error sending a message, which ends the call.
+}
+
+// Sends p in as many messages as it takes.
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), contextChunkSize)]
+		if w.err = w.s.send(cmdContextData, &contextChunk{Data: chunk}); w.err != nil {
+			return n, w.err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
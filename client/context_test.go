@@ -0,0 +1,214 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Writes a small build context into a temporary directory and returns it.
+func writeTestContext(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "app.go"), []byte("package app\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src", filepath.Join(dir, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(dir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Reads the context-data messages of one archive and returns its entries
+// by name: the contents of files, "-> target" for symbolic links, and "/"
+// for directories. Returns the error the client sent instead, if any.
+func readContextArchive(t *testing.T, reader *bufio.Reader) (map[string]string, string) {
+	t.Helper()
+	var archive bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Errorf("read context data: %v", err)
+			return nil, ""
+		}
+		env, payload, _ := protocol.Decode(line)
+		if env.Command != cmdContextData {
+			t.Errorf("message = %s, want context data", env.Command)
+			continue
+		}
+		chunk, _ := protocol.DecodePayload[contextChunk](payload)
+		archive.Write(chunk.Data)
+		if chunk.Error != "" {
+			return nil, chunk.Error
+		}
+		if chunk.Done {
+			break
+		}
+	}
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(&archive)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, ""
+		}
+		if err != nil {
+			t.Errorf("read archive: %v", err)
+			return entries, ""
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			data, _ := io.ReadAll(tr)
+			entries[header.Name] = string(data)
+		case tar.TypeSymlink:
+			entries[header.Name] = "-> " + header.Linkname
+		case tar.TypeDir:
+			entries[header.Name] = "/"
+		}
+	}
+}
+
+// Starts a daemon stand-in that passes the build request it receives and
+// the connection to serve, and returns a client of it.
+func newContextTestClient(t *testing.T, serve func(req *buildRequest, conn net.Conn, reader *bufio.Reader)) *Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cruxd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		line, _ := reader.ReadBytes('\n')
+		_, payload, _ := protocol.Decode(line)
+		var req buildRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			t.Errorf("build request = %s", payload)
+			return
+		}
+		serve(&req, conn, reader)
+	}()
+
+	return New(Config{SocketPath: path})
+}
+
+// Sends a context-fetch message on conn.
+func sendFetch(t *testing.T, conn net.Conn, req contextFetchRequest) {
+	t.Helper()
+	conn.Write([]byte(message(t, cmdContextFetch, req) + "\n"))
+}
+
+func TestBuildContextFetch(t *testing.T) {
+	dir := writeTestContext(t)
+	sum := sha256.Sum256([]byte("package app\n"))
+
+	c := newContextTestClient(t, func(req *buildRequest, conn net.Conn, reader *bufio.Reader) {
+		if req.Context == nil || req.Context.Archive {
+			t.Errorf("context = %+v", req.Context)
+			return
+		}
+		var paths []string
+		for _, e := range req.Context.Entries {
+			paths = append(paths, e.Path+":"+e.Type)
+		}
+		if want := []string{"etc:symlink", "go.mod:file", "lib:symlink", "src:dir", "src/app.go:file"}; !slices.Equal(paths, want) {
+			t.Errorf("entries = %v, want %v", paths, want)
+			return
+		}
+		if e := req.Context.Entries[4]; e.Size != 12 || e.Mode != 0o640 || e.Digest != "sha256:"+hex.EncodeToString(sum[:]) {
+			t.Errorf("src/app.go entry = %+v", e)
+		}
+		if e := req.Context.Entries[2]; e.Link != "src" {
+			t.Errorf("lib entry = %+v", e)
+		}
+
+		sendFetch(t, conn, contextFetchRequest{Paths: []string{"go.mod", "src/app.go"}})
+		files, sendErr := readContextArchive(t, reader)
+		if want := map[string]string{"go.mod": "module app\n", "src/app.go": "package app\n"}; sendErr != "" || !maps.Equal(files, want) {
+			t.Errorf("fetched %v, %q, want %v", files, sendErr, want)
+		}
+
+		// A path leading out of the context through a link is refused.
+		sendFetch(t, conn, contextFetchRequest{Paths: []string{"etc/passwd"}})
+		if files, sendErr := readContextArchive(t, reader); sendErr == "" {
+			t.Errorf("fetched %v from outside the context", files)
+		}
+
+		conn.Write([]byte(`{"command":"ok","payload":{"id":"build-1","context":{"files":2,"size":23,"fetched":2,"transferred":3072,"saved":0}}}` + "\n"))
+	})
+
+	res, err := c.Build(context.Background(), &BuildRequest{ContextDir: dir}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Context == nil || res.Context.Fetched != 2 || res.Context.Transferred != 3072 {
+		t.Errorf("result = %+v", res)
+	}
+}
+
+func TestBuildContextArchive(t *testing.T) {
+	dir := writeTestContext(t)
+
+	c := newContextTestClient(t, func(req *buildRequest, conn net.Conn, reader *bufio.Reader) {
+		if req.Context == nil || !req.Context.Archive || len(req.Context.Entries) > 0 {
+			t.Errorf("context = %+v", req.Context)
+			return
+		}
+		sendFetch(t, conn, contextFetchRequest{All: true})
+		entries, sendErr := readContextArchive(t, reader)
+		want := map[string]string{
+			"etc":        "-> /etc",
+			"go.mod":     "module app\n",
+			"lib":        "-> src",
+			"src":        "/",
+			"src/app.go": "package app\n",
+		}
+		if sendErr != "" || !maps.Equal(entries, want) {
+			t.Errorf("archive = %v, %q, want %v", entries, sendErr, want)
+		}
+		conn.Write([]byte(`{"command":"ok","payload":{"id":"build-1"}}` + "\n"))
+	})
+
+	if _, err := c.Build(context.Background(), &BuildRequest{ContextDir: dir, ContextArchive: true}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBuildContextUnreadable(t *testing.T) {
+	c := New(Config{SocketPath: filepath.Join(t.TempDir(), "cruxd.sock")})
+	_, err := c.Build(context.Background(), &BuildRequest{ContextDir: filepath.Join(t.TempDir(), "missing")}, nil)
+	if !errors.Is(err, ErrContext) {
+		t.Errorf("err = %v, want ErrContext", err)
+	}
+}
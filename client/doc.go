@@ -0,0 +1,45 @@
+// Package client talks to a running cruxd daemon.
+//
+// The daemon speaks newline-delimited JSON envelopes over a Unix domain
+// socket, see [protocol]. A [Client] hides that framing behind one typed
+// method per command: each call connects to the socket, sends the request,
+// reads the messages the daemon streams back until the final result, and
+// closes the connection. Calls are independent, so a Client is safe for
+// concurrent use.
+//
+// A command the daemon rejects fails with a [*CommandError] carrying the
+// daemon's message and, where the daemon classifies it, a machine-readable
+// code. Failures to reach the daemon wrap [ErrConnection], and responses
+// that cannot be decoded wrap [ErrProtocol]. A call gives up when its
+// context is done.
+//
+// Requests and results extend those of [protocol] with the daemon's own
+// fields, such as [BuildRequest] with its build arguments, secrets, and
+// push target. Commands that stream, such as builds, [Client.Run], and
+// [Client.ContainerExecStream], deliver what the daemon streams to a
+// callback or writer as it arrives and return the final result.
+//
+// A build reads its context from the daemon's host unless
+// [BuildRequest.ContextDir] names a directory on the client's, in which
+// case the client serves the files the daemon asks for while the build
+// runs, so that only the files copy steps read are transferred.
+//
+// Example usage:
+//
+//	c := client.New(client.Config{})
+//
+//	result, err := c.Build(ctx, &client.BuildRequest{
+//	    BuildRequest: protocol.BuildRequest{
+//	        Recipe:   recipe,
+//	        Resource: "my-app",
+//	        Output:   "/tmp/build",
+//	    },
+//	    Args: map[string]string{"VERSION": "1.2.3"},
+//	}, func(ev client.BuildEvent) {
+//	    fmt.Println(ev.Kind, ev.Stage, ev.Message)
+//	})
+//	if err != nil {
+//	    return err
+//	}
+//	fmt.Println(result.Output)
+package client
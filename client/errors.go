@@ -0,0 +1,34 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrConnection = errors.New("daemon connection failed")
+	ErrProtocol   = errors.New("malformed daemon response")
+	ErrCommand    = errors.New("daemon command failed")
+	ErrContext    = errors.New("build context unreadable")
+)
+
+// A command the daemon answered with an error.
+//
+// Matches [ErrCommand] with [errors.Is].
+type CommandError struct {
+	Message string // Error message of the daemon.
+	Code    string // Machine-readable code such as "invalid-recipe". Empty when the daemon gives none.
+}
+
+// Returns the daemon's message, with its code when there is one.
+func (e *CommandError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+	}
+	return e.Message
+}
+
+// Returns [ErrCommand].
+func (e *CommandError) Unwrap() error {
+	return ErrCommand
+}
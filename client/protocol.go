@@ -0,0 +1,442 @@
+package client
+
+import (
+	"io"
+	"time"
+
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Commands of the daemon that are not part of [protocol].
+const (
+	cmdRun                    protocol.Command = "run"                      // Run a command in a throwaway container.
+	cmdOutput                 protocol.Command = "output"                   // A chunk of streamed process output.
+	cmdInput                  protocol.Command = "input"                    // A chunk of input for an interactive exec.
+	cmdResize                 protocol.Command = "resize"                   // A new terminal size for an interactive exec.
+	cmdContainerMounts        protocol.Command = "container-mounts"         // Report the snapshot mounts of a container.
+	cmdContainerDestroyPrefix protocol.Command = "container-destroy-prefix" // Destroy the containers whose ID starts with a prefix.
+	cmdCacheClear             protocol.Command = "cache-clear"              // Remove build cache entries.
+	cmdResolveTag             protocol.Command = "resolve-tag"              // Report the image tag a reference resolves to.
+	cmdCapabilities           protocol.Command = "capabilities"             // Report what the daemon supports.
+	cmdConfig                 protocol.Command = "config"                   // Report the daemon's effective configuration.
+	cmdBuildEvent             protocol.Command = "build-event"              // A progress event of a running build.
+	cmdBuildAttach            protocol.Command = "build-attach"             // Stream the progress of a running build.
+	cmdBuildCancel            protocol.Command = "build-cancel"             // Cancel a running build.
+	cmdBuildList              protocol.Command = "build-list"               // Report the recently finished builds.
+	cmdDrain                  protocol.Command = "drain"                    // Cancel every running build and refuse new ones.
+	cmdResume                 protocol.Command = "resume"                   // Accept new builds again after a drain.
+	cmdShutdown               protocol.Command = "shutdown"                 // Stop the daemon once in-flight commands finish.
+	cmdContextFetch           protocol.Command = "context-fetch"            // A request for files of the build context.
+	cmdContextData            protocol.Command = "context-data"             // A chunk of a tar archive of build context files.
+)
+
+// Build request of [Client.Build].
+//
+// Extends [protocol.BuildRequest] with the daemon's build options. Fields
+// left zero keep the daemon's defaults. When RecipeDocument is set the
+// daemon parses it instead of using the pre-parsed Recipe.
+type BuildRequest struct {
+	protocol.BuildRequest
+	RecipeDocument        string                 `json:"recipeDocument,omitempty"`        // Raw YAML or JSON recipe, parsed by the daemon.
+	RecipeVersion         int                    `json:"recipeVersion,omitempty"`         // Recipe schema version. Zero means unspecified.
+	AppendEntrypoint      []string               `json:"appendEntrypoint,omitempty"`      // Arguments appended to the output image's entrypoint.
+	Cmd                   []string               `json:"cmd,omitempty"`                   // OCI cmd for the output image.
+	KeepCmd               bool                   `json:"keepCmd,omitempty"`               // Keep the base image's cmd when the entrypoint is replaced.
+	PlatformConfig        map[string]ImageConfig `json:"platformConfig,omitempty"`        // Entrypoint and cmd settings per target platform, overriding the ones above.
+	Args                  map[string]string      `json:"args,omitempty"`                  // Build arguments, overriding those in ArgsFile.
+	ArgsFile              string                 `json:"argsFile,omitempty"`              // KEY=VALUE file of build arguments relative to the build context.
+	SourceDateEpoch       *int64                 `json:"sourceDateEpoch,omitempty"`       // Unix time set as SOURCE_DATE_EPOCH for run steps.
+	ReadOnlyRootfs        bool                   `json:"readOnlyRootfs,omitempty"`        // Run steps with a read-only root filesystem.
+	StrictStderr          bool                   `json:"strictStderr,omitempty"`          // Fail run steps that write to stderr.
+	AnnotateLayers        bool                   `json:"annotateLayers,omitempty"`        // Annotate exported layers with their source stage.
+	Labels                map[string]string      `json:"labels,omitempty"`                // Labels of the output image's config.
+	Tags                  []string               `json:"tags,omitempty"`                  // References the output image is named by in its archives.
+	Compression           string                 `json:"compression,omitempty"`           // Layer compression, "gzip" (the default) or "zstd".
+	CompressionLevel      int                    `json:"compressionLevel,omitempty"`      // Layer compression level. Zero uses containerd's default.
+	Squash                bool                   `json:"squash,omitempty"`                // Export the output image as a single layer.
+	MemoryContext         bool                   `json:"memoryContext,omitempty"`         // Copy the build context to the daemon's tmpfs before the build.
+	AllowPlatformFallback bool                   `json:"allowPlatformFallback,omitempty"` // Export the first manifest when the base image lacks the target platform.
+	Snapshotter           string                 `json:"snapshotter,omitempty"`           // containerd snapshotter for the build, instead of the daemon's.
+	NoCache               bool                   `json:"noCache,omitempty"`               // Execute every step instead of reusing cached results.
+	CacheClear            bool                   `json:"cacheClear,omitempty"`            // Remove the resource's cached results before building.
+	DNSSearch             []string               `json:"dnsSearch,omitempty"`             // Search domains of build containers, replacing the host's.
+	DNSOptions            []string               `json:"dnsOptions,omitempty"`            // Resolver options of build containers, such as "ndots:2".
+	DigestFilename        bool                   `json:"digestFilename,omitempty"`        // Name archives sha256-<hex>.tar after the image digest instead of image.tar.
+	ExportFormat          string                 `json:"exportFormat,omitempty"`          // Archive layout, "oci" (the default) or "docker" for the legacy docker save layout.
+	Rlimits               []Rlimit               `json:"rlimits,omitempty"`               // Resource limits for processes in build containers.
+	AddCapabilities       []string               `json:"addCapabilities,omitempty"`       // Linux capabilities granted to build containers.
+	DropCapabilities      []string               `json:"dropCapabilities,omitempty"`      // Linux capabilities removed from build containers.
+	SeccompProfile        string                 `json:"seccompProfile,omitempty"`        // Seccomp profile for build containers.
+	AppArmorProfile       string                 `json:"appArmorProfile,omitempty"`       // AppArmor profile for build containers.
+	CopyChown             string                 `json:"copyChown,omitempty"`             // Default "UID:GID" ownership of copied files.
+	CopySymlinks          string                 `json:"copySymlinks,omitempty"`          // "preserve" (default) or "follow" symbolic links inside copied directories.
+	StrictCopyModes       bool                   `json:"strictCopyModes,omitempty"`       // Fail copies of setuid, setgid, or world-writable files.
+	AllowUndefinedVars    bool                   `json:"allowUndefinedVars,omitempty"`    // Expand undefined variables in commands, copy paths, and workdirs to nothing.
+	Hostname              string                 `json:"hostname,omitempty"`              // Hostname of every stage container. Defaults to the stage name.
+	OutputSampling        *OutputSampling        `json:"outputSampling,omitempty"`        // Limits the run output streamed as events. Nil streams all of it.
+	Detach                bool                   `json:"detach,omitempty"`                // Keep building if the client disconnects.
+	Push                  string                 `json:"push,omitempty"`                  // Registry reference the output image is pushed to.
+	PushOnly              bool                   `json:"pushOnly,omitempty"`              // Push without writing image.tar.
+	Secrets               []Secret               `json:"secrets,omitempty"`               // Secrets mounted into build containers, by ID.
+	BreakAt               *Breakpoint            `json:"breakAt,omitempty"`               // Stage and step at which to pause the build.
+	ExportStages          []string               `json:"exportStages,omitempty"`          // Stages, by name or 1-based index, also exported to the output's debug directory.
+	MaxDuration           string                 `json:"maxDuration,omitempty"`           // Go duration such as "30m". Can only lower the daemon's limit.
+	ContextDir            string                 `json:"-"`                               // Directory on this host sent as the build context, replacing Root.
+	ContextArchive        bool                   `json:"-"`                               // Send all of ContextDir before the build instead of the files copy steps read.
+
+	Stages map[string]StageOptions `json:"stages,omitempty"` // Per-stage settings keyed by stage name or 1-based index.
+}
+
+// Build request with the extensions the client sets itself.
+type buildRequest struct {
+	*BuildRequest
+	Events  bool            `json:"events,omitempty"`  // Stream build-event messages before the result.
+	Context *contextRequest `json:"context,omitempty"` // Build context sent from ContextDir.
+}
+
+// Build context kept on this host, sent in place of a root on the daemon's
+// host.
+type contextRequest struct {
+	Entries []contextEntry `json:"entries,omitempty"` // Files, directories, and symbolic links of the context.
+	Archive bool           `json:"archive,omitempty"` // Send the whole context up front instead of the files copy steps read.
+}
+
+// File, directory, or symbolic link advertised in a [contextRequest].
+type contextEntry struct {
+	Path    string    `json:"path"`             // Slash-separated path from the context root.
+	Type    string    `json:"type"`             // "file", "dir", or "symlink".
+	Mode    uint32    `json:"mode,omitempty"`   // Permission bits as given to chmod, including setuid, setgid, and sticky.
+	Size    int64     `json:"size,omitempty"`   // Size of a file in bytes.
+	Digest  string    `json:"digest,omitempty"` // SHA-256 of a file's contents, as "sha256:<hex>".
+	Link    string    `json:"link,omitempty"`   // Target of a symbolic link.
+	ModTime time.Time `json:"modTime"`          // Modification time of a file or directory.
+}
+
+// Payload of a context-fetch message.
+type contextFetchRequest struct {
+	Paths []string `json:"paths,omitempty"` // Files to send, relative to the context root and slash-separated.
+	All   bool     `json:"all,omitempty"`   // Send the whole context instead of Paths.
+}
+
+// Payload of a context-data message. The chunk with Done or Error set is
+// the last of its archive.
+type contextChunk struct {
+	Data  []byte `json:"data,omitempty"`  // Next bytes of the archive.
+	Done  bool   `json:"done,omitempty"`  // The archive is complete.
+	Error string `json:"error,omitempty"` // Why the archive could not be sent.
+}
+
+// Entrypoint and cmd settings of the output image for one platform in a
+// [BuildRequest].
+type ImageConfig struct {
+	Entrypoint       []string `json:"entrypoint,omitempty"`       // Replaces the request's entrypoint.
+	AppendEntrypoint []string `json:"appendEntrypoint,omitempty"` // Replaces the request's appendEntrypoint.
+	Cmd              []string `json:"cmd,omitempty"`              // Replaces the request's cmd.
+	KeepCmd          *bool    `json:"keepCmd,omitempty"`          // Replaces the request's keepCmd.
+}
+
+// A resource limit in a [BuildRequest].
+type Rlimit struct {
+	Type string `json:"type"` // Limit name such as "nofile".
+	Soft uint64 `json:"soft"` // Soft limit.
+	Hard uint64 `json:"hard"` // Hard limit.
+}
+
+// A secret reference in a [BuildRequest].
+//
+// Only the ID travels in the request. The daemon resolves the value from its
+// configured secret source.
+type Secret struct {
+	ID     string `json:"id"`               // Secret identifier.
+	Target string `json:"target,omitempty"` // Absolute path in the container. Defaults to /run/secrets/<id>.
+}
+
+// Output sampling thresholds of a [BuildRequest].
+type OutputSampling struct {
+	HeadLines int   `json:"headLines,omitempty"` // Lines of each stream streamed before sampling starts.
+	HeadBytes int64 `json:"headBytes,omitempty"` // Bytes of each stream streamed before sampling starts.
+	TailLines int   `json:"tailLines,omitempty"` // Last lines of each stream streamed when the step ends.
+}
+
+// A debugging breakpoint in a [BuildRequest].
+type Breakpoint struct {
+	Stage string `json:"stage"` // Stage name, or 1-based index for unnamed stages.
+	Step  int    `json:"step"`  // 1-based index of the last step to execute.
+}
+
+// Per-stage settings in a [BuildRequest].
+type StageOptions struct {
+	Cleanup     []string          `json:"cleanup,omitempty"`     // Absolute paths removed before the stage is committed.
+	AllowStderr []int             `json:"allowStderr,omitempty"` // 1-based steps exempt from StrictStderr.
+	From        map[string]string `json:"from,omitempty"`        // Base image per target platform, overriding the recipe's from.
+	MemoryLimit int64             `json:"memoryLimit,omitempty"` // Most memory in bytes the stage's steps may use together.
+	CPUs        float64           `json:"cpus,omitempty"`        // CPUs' worth of time the stage's steps may use.
+	Verify      []string          `json:"verify,omitempty"`      // Commands that must succeed in the finished stage before it is exported.
+}
+
+// Request to cancel or follow a running build.
+type buildIDRequest struct {
+	ID string `json:"id"` // Build ID from the build's first event.
+}
+
+// Progress event of a build, passed to the progress function of
+// [Client.Build].
+type BuildEvent struct {
+	ID       string `json:"id"`                 // Build ID.
+	Seq      int    `json:"seq"`                // Sequence number within the build.
+	Time     string `json:"time"`               // RFC 3339 timestamp.
+	Kind     string `json:"kind"`               // What happened, such as "started", "queued", "pull", or "step".
+	Platform string `json:"platform,omitempty"` // Platform being built.
+	Stage    string `json:"stage,omitempty"`    // Stage label.
+	Message  string `json:"message,omitempty"`  // Detail such as the step being run, or a line of step output.
+	Stream   string `json:"stream,omitempty"`   // Stream of an output event, "stdout" or "stderr".
+	Current  int64  `json:"current,omitempty"`  // Bytes of a pull event's item transferred so far.
+	Total    int64  `json:"total,omitempty"`    // Size of a pull event's item in bytes. Zero when unknown.
+}
+
+// Result of [Client.Build].
+type BuildResult struct {
+	protocol.BuildResult
+	ID        string         `json:"id"`                  // Build ID.
+	Container string         `json:"container,omitempty"` // Container left running at a breakpoint, if the build paused.
+	Pushed    string         `json:"pushed,omitempty"`    // Reference and digest of the pushed image, if any.
+	Archives  []string       `json:"archives,omitempty"`  // Paths of the exported archives, one per platform.
+	Context   *ContextStats  `json:"context,omitempty"`   // Transfer of the build context sent from ContextDir, if any.
+	Warnings  []BuildWarning `json:"warnings,omitempty"`  // Non-fatal issues found during the build.
+}
+
+// How much of the build context sent from [BuildRequest.ContextDir] was
+// transferred to the daemon.
+type ContextStats struct {
+	Files       int   `json:"files"`       // Regular files in the context.
+	Size        int64 `json:"size"`        // Bytes of file data in the context.
+	Fetched     int   `json:"fetched"`     // Files transferred to the daemon.
+	Transferred int64 `json:"transferred"` // Bytes of archive sent.
+	Saved       int64 `json:"saved"`       // Bytes of archive not sent because no step read the files.
+}
+
+// Non-fatal issue reported in a [BuildResult].
+type BuildWarning struct {
+	Code    string            `json:"code"`              // Kind of issue, such as "unsafe-file-mode".
+	Message string            `json:"message"`           // Human-readable description.
+	Context map[string]string `json:"context,omitempty"` // Details such as the path, stage, or platform concerned.
+}
+
+// Result of [Client.Status].
+type StatusResult struct {
+	protocol.StatusResult
+	Draining bool `json:"draining,omitempty"` // Whether the daemon refuses new builds.
+	Queued   int  `json:"queued,omitempty"`   // Builds waiting for a free slot.
+}
+
+// Result of the image commands.
+//
+// Older daemons answer image commands without a result, in which case
+// every field is empty.
+type ImageResult struct {
+	Tag        string `json:"tag"`                  // Containerd image tag.
+	Digest     string `json:"digest,omitempty"`     // Digest of the image. Empty when a destroyed tag did not exist.
+	Action     string `json:"action"`               // What the command did, such as "imported" or "reused".
+	ID         string `json:"id,omitempty"`         // Container ID, for [Client.ImageStart].
+	Containers int    `json:"containers,omitempty"` // Containers removed with the image, for [Client.ImageDestroy].
+}
+
+// Result of [Client.ContainerExec].
+type ExecResult struct {
+	protocol.ContainerExecResult
+	StdoutTruncated bool `json:"stdoutTruncated,omitempty"` // Stdout holds only the first bytes of the output.
+	StderrTruncated bool `json:"stderrTruncated,omitempty"` // Stderr holds only the first bytes of the output.
+}
+
+// Request of [Client.CacheClear].
+type CacheClearRequest struct {
+	Resource    string `json:"resource,omitempty"`    // Resource name or prefix, such as "my-app". Empty clears the whole cache.
+	Snapshotter string `json:"snapshotter,omitempty"` // containerd snapshotter holding the entries, instead of the daemon's.
+}
+
+// Result of [Client.CacheClear].
+type CacheClearResult struct {
+	Removed   int   `json:"removed"`         // Cache entries removed.
+	InUse     int   `json:"inUse,omitempty"` // Matching entries kept because a container still uses them.
+	Reclaimed int64 `json:"reclaimed"`       // Bytes freed by the removed entries.
+}
+
+// Request of [Client.ImageStart].
+//
+// Extends [protocol.ImageStartRequest] with the settings of the started
+// container.
+type ImageStartRequest struct {
+	protocol.ImageStartRequest
+	Hostname  string     `json:"hostname,omitempty"`  // Hostname of a newly created container. Empty keeps containerd's default.
+	Recreate  bool       `json:"recreate,omitempty"`  // Replace the container even when it already runs the image.
+	Readiness *Readiness `json:"readiness,omitempty"` // Check the service must pass before the command succeeds. Nil succeeds once the task starts.
+}
+
+// Readiness probe of an [ImageStartRequest].
+type Readiness struct {
+	Command  []string `json:"command,omitempty"`  // Command run in the container, ready once it exits 0.
+	Port     int      `json:"port,omitempty"`     // TCP port of the service, ready once it accepts a connection.
+	Timeout  string   `json:"timeout,omitempty"`  // Go duration the service has to become ready, such as "1m". Empty uses the default.
+	Interval string   `json:"interval,omitempty"` // Go duration between two probes. Empty uses the default.
+}
+
+// Request of [Client.Run].
+type RunRequest struct {
+	Ref      string   `json:"ref"`                // OCI image reference, such as "alpine:3.21".
+	Platform string   `json:"platform,omitempty"` // Target platform. Empty uses the daemon's default.
+	Command  []string `json:"command"`            // Command and arguments to run.
+}
+
+// Result of [Client.Run].
+type RunResult struct {
+	ExitCode int `json:"exitCode"` // Exit code of the command.
+}
+
+// Command and streams of [Client.ContainerExecStream].
+//
+// Output is written to Stdout and Stderr as the command produces it. With
+// Stdin set the exec is interactive: what is read from Stdin is fed to the
+// command's stdin, which is closed once Stdin reaches EOF.
+type ExecStreamRequest struct {
+	ID      string              // Container ID.
+	Command []string            // Command and arguments to run.
+	Stdout  io.Writer           // Receives the command's stdout, or its terminal with TTY. Nil discards it.
+	Stderr  io.Writer           // Receives the command's stderr. Nil discards it.
+	Stdin   io.Reader           // Input of an interactive exec. Nil runs the command without input.
+	TTY     bool                // Run an interactive command on a terminal.
+	Size    *TerminalSize       // Initial size of the terminal. Nil uses containerd's default.
+	Resize  <-chan TerminalSize // New sizes of the terminal while the command runs.
+}
+
+// Size of a terminal.
+type TerminalSize struct {
+	Width  uint16 `json:"width"`  // Columns.
+	Height uint16 `json:"height"` // Rows.
+}
+
+// Container-exec request with the daemon's streaming extensions.
+type containerExecRequest struct {
+	protocol.ContainerExecRequest
+	Stream      bool          `json:"stream,omitempty"`      // Send output as output messages while the command runs.
+	Interactive bool          `json:"interactive,omitempty"` // Also read the command's input from input messages.
+	TTY         bool          `json:"tty,omitempty"`         // Run an interactive command on a terminal.
+	Size        *TerminalSize `json:"size,omitempty"`        // Initial size of the terminal.
+}
+
+// Payload of an output message.
+type outputChunk struct {
+	Stream string `json:"stream"` // Either "stdout" or "stderr".
+	Data   []byte `json:"data"`   // Output bytes as written by the process.
+}
+
+// Payload of an input message.
+type inputChunk struct {
+	Data  []byte `json:"data,omitempty"`  // Bytes written to the command's stdin.
+	Close bool   `json:"close,omitempty"` // Close the command's stdin after Data.
+}
+
+// Request naming a container.
+type containerRequest struct {
+	ID string `json:"id"` // Container ID.
+}
+
+// A snapshot mount reported by [Client.ContainerMounts].
+type Mount struct {
+	Type    string   `json:"type"`              // Filesystem type.
+	Source  string   `json:"source"`            // Mount source on the daemon's host.
+	Options []string `json:"options,omitempty"` // Mount options.
+}
+
+// Result of a container-mounts command.
+type containerMountsResult struct {
+	Mounts []Mount `json:"mounts"` // Mounts that assemble the container's root filesystem.
+}
+
+// Request to destroy the containers of a resource.
+type containerDestroyPrefixRequest struct {
+	Prefix string `json:"prefix"` // Resource name or container ID prefix.
+}
+
+// Result of a container-destroy-prefix command.
+type containerDestroyPrefixResult struct {
+	Destroyed []string `json:"destroyed"` // IDs of the destroyed containers.
+}
+
+// Request for the image tag of a Crucible reference.
+type resolveTagRequest struct {
+	Ref     string `json:"ref"`     // Crucible resource reference.
+	Version string `json:"version"` // Resource version.
+}
+
+// Result of [Client.ResolveTag].
+type ResolveTagResult struct {
+	Tag      string `json:"tag"`      // Containerd image tag computed by [protocol.ImageTag].
+	Present  bool   `json:"present"`  // Whether an image with the tag exists.
+	Unpacked bool   `json:"unpacked"` // Whether the image is unpacked for the daemon's platform.
+}
+
+// What the daemon supports, as reported by [Client.Capabilities].
+//
+// Features lists the optional features by name, such as "run" or
+// "build-queue". A feature that is absent is not supported, and names the
+// client does not know should be ignored.
+type Capabilities struct {
+	Version             int                `json:"version"`                       // Document version, incremented only when a field changes meaning.
+	Features            []string           `json:"features"`                      // Supported optional features.
+	RecipeVersions      RecipeVersionRange `json:"recipeVersions"`                // Accepted recipe schema versions.
+	Compressions        []string           `json:"compressions"`                  // Compression algorithms of exported layers.
+	Platforms           []string           `json:"platforms"`                     // Platforms stage containers can run on.
+	DefaultPlatforms    []string           `json:"defaultPlatforms,omitempty"`    // Platforms built when a request names none. Empty means the daemon's host.
+	MaxMessageSize      int64              `json:"maxMessageSize"`                // Largest accepted message in bytes, newline included.
+	MaxLayerSize        int64              `json:"maxLayerSize,omitempty"`        // Largest committed layer in bytes. Zero means unlimited.
+	MaxBuildDuration    string             `json:"maxBuildDuration,omitempty"`    // Longest a build may run. Empty means unlimited.
+	MaxConcurrentBuilds int                `json:"maxConcurrentBuilds,omitempty"` // Most builds run at once; others wait in a queue. Zero means unlimited.
+	RemoteContainerd    bool               `json:"remoteContainerd,omitempty"`    // Containerd runs on another host, so build, run, and container-exec are refused.
+}
+
+// Range of recipe schema versions in [Capabilities].
+type RecipeVersionRange struct {
+	Min int `json:"min"` // Oldest accepted version.
+	Max int `json:"max"` // Newest accepted version.
+}
+
+// Effective configuration of the daemon, as reported by [Client.Config].
+type ConfigResult struct {
+	Settings []ConfigSetting `json:"settings"` // Settings in a fixed order.
+}
+
+// A single value of a [ConfigResult].
+type ConfigSetting struct {
+	Name     string `json:"name"`               // Setting name, matching the flag without dashes where there is one.
+	Value    any    `json:"value"`              // Effective value after defaults are applied.
+	Source   string `json:"source"`             // "configured", "default", or "derived".
+	Redacted bool   `json:"redacted,omitempty"` // Whether sensitive parts of the value were removed.
+}
+
+// Result of [Client.Drain].
+type DrainResult struct {
+	Canceled []string `json:"canceled,omitempty"` // IDs of the builds the drain canceled.
+}
+
+// A finished build reported by [Client.BuildList].
+type BuildRecord struct {
+	ID        string   `json:"id"`                  // Build ID.
+	Resource  string   `json:"resource,omitempty"`  // Resource name of the request.
+	Platforms []string `json:"platforms,omitempty"` // Target platforms. Empty means the daemon's host.
+	Started   string   `json:"started"`             // RFC 3339 time the daemon received the build.
+	Finished  string   `json:"finished"`            // RFC 3339 time the build finished.
+	Result    string   `json:"result"`              // "succeeded", "failed", or "canceled".
+	Error     string   `json:"error,omitempty"`     // Error message of a build that did not succeed.
+	Code      string   `json:"code,omitempty"`      // Machine-readable code of the error.
+}
+
+// Result of a build-list command.
+type buildListResult struct {
+	Builds []BuildRecord `json:"builds"` // Finished builds, most recent first.
+}
+
+// Error payload of a [protocol.CmdError] response.
+type errorResult struct {
+	protocol.ErrorResult
+	Code string `json:"code,omitempty"` // Machine-readable error code, if any.
+}
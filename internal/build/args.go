@@ -0,0 +1,255 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+// Valid build argument names, the same as portable shell variable names.
+var argNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Returns the build arguments for a build.
+//
+// Arguments are read from file, a path relative to root, and then
+// overlaid with args, so that values given explicitly in the request win
+// over the file. An empty file name reads nothing. The file must stay within
+// root, even through symbolic links. The caller's map is not modified.
+func loadArgs(root, file string, args map[string]string) (map[string]string, error) {
+	merged := make(map[string]string, len(args))
+	if file != "" {
+		path, err := contextPath(root, file)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, crex.Wrapf(ErrInvalidOptions, "args file %q: %w", file, err)
+		}
+		fileArgs, err := parseArgs(data)
+		if err != nil {
+			return nil, crex.Wrapf(ErrInvalidOptions, "args file %q: %w", file, err)
+		}
+		maps.Copy(merged, fileArgs)
+	}
+
+	for name := range args {
+		if !argNamePattern.MatchString(name) {
+			return nil, crex.Wrapf(ErrInvalidOptions, "invalid build argument name %q", name)
+		}
+	}
+	maps.Copy(merged, args)
+	return merged, nil
+}
+
+// Restricts build arguments to those a recipe declares.
+//
+// With no declarations every argument is kept. Otherwise the result holds
+// each declared argument, with its value from args or else its default, and
+// an argument declared without a default must be given. Arguments the
+// recipe does not declare are dropped with a warning, so a misspelled name
+// is noticed instead of silently having no effect. The caller's map is not
+// modified.
+func declareArgs(declared map[string]*string, args map[string]string, warn *warnings) (map[string]string, error) {
+	if declared == nil {
+		return args, nil
+	}
+
+	result := make(map[string]string, len(declared))
+	for _, name := range slices.Sorted(maps.Keys(declared)) {
+		if value, ok := args[name]; ok {
+			result[name] = value
+			continue
+		}
+		if declared[name] == nil {
+			return nil, crex.Wrapf(ErrInvalidOptions, "build argument %s is required by the recipe", name)
+		}
+		result[name] = *declared[name]
+	}
+	for _, name := range slices.Sorted(maps.Keys(args)) {
+		if _, ok := declared[name]; !ok {
+			warn.add(WarnUndeclaredArg, fmt.Sprintf("build argument %s is not declared by the recipe and was ignored", name),
+				map[string]string{"arg": name})
+		}
+	}
+	return result, nil
+}
+
+// Resolves a path relative to the build context, failing if it is absolute
+// or leads outside of root once symbolic links are followed.
+func contextPath(root, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", crex.Wrapf(ErrInvalidOptions, "%q must be relative to the build context", name)
+	}
+
+	base, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", crex.Wrap(ErrInvalidOptions, err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(base, name))
+	if err != nil {
+		return "", crex.Wrap(ErrInvalidOptions, err)
+	}
+
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", crex.Wrapf(ErrInvalidOptions, "%q is outside the build context", name)
+	}
+	return path, nil
+}
+
+// Parses KEY=VALUE lines.
+//
+// Blank lines and lines starting with "#" are skipped, and an optional
+// "export " prefix is ignored. Unquoted values are trimmed and end at a " #"
+// comment. Values in single quotes are taken literally. Values in double
+// quotes may use the escapes \", \\, \$, \n, and \t. A later line for the
+// same key replaces the earlier one.
+func parseArgs(data []byte) (map[string]string, error) {
+	args := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		name, raw, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !argNamePattern.MatchString(name) {
+			return nil, crex.Wrapf(ErrInvalidOptions, "line %d: expected KEY=VALUE", n)
+		}
+
+		value, err := parseArgValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, crex.Wrapf(ErrInvalidOptions, "line %d: %w", n, err)
+		}
+		args[name] = value
+	}
+	if err := s.Err(); err != nil {
+		return nil, crex.Wrap(ErrInvalidOptions, err)
+	}
+	return args, nil
+}
+
+// Decodes the value part of a KEY=VALUE line.
+func parseArgValue(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+
+	quote := raw[0]
+	if quote != '"' && quote != '\'' {
+		if i := strings.Index(raw, " #"); i >= 0 {
+			raw = raw[:i]
+		}
+		return strings.TrimSpace(raw), nil
+	}
+
+	end := closingQuote(raw, quote)
+	if end < 0 {
+		return "", crex.Wrapf(ErrInvalidOptions, "unterminated %c quote", quote)
+	}
+	if rest := strings.TrimSpace(raw[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", crex.Wrapf(ErrInvalidOptions, "unexpected %q after closing quote", rest)
+	}
+
+	body := raw[1:end]
+	if quote == '\'' {
+		return body, nil
+	}
+	return unescapeArg(body), nil
+}
+
+// Returns the index of the quote that closes raw[0], or -1. Inside double
+// quotes a backslash escapes the next character.
+func closingQuote(raw string, quote byte) int {
+	for i := 1; i < len(raw); i++ {
+		switch {
+		case quote == '"' && raw[i] == '\\':
+			i++
+		case raw[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// Replaces the escapes allowed in double-quoted values. Unknown escapes are
+// kept as written.
+func unescapeArg(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\', '$':
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// Returns a copy of the recipe with build arguments substituted into the
+// from of every stage.
+//
+// References of the form $NAME or ${NAME} are replaced by the argument's
+// value, so that a build argument can select the base image, for instance
+// a debug variant with extra tooling. A stage cannot be built without its
+// base, so a reference to an undefined argument is an error rather than
+// being replaced by an empty string. The recipe passed in is not modified.
+func expandBases(recipe *manifest.Recipe, args map[string]string) (*manifest.Recipe, error) {
+	expanded := *recipe
+	expanded.Stages = slices.Clone(recipe.Stages)
+	for i, stage := range expanded.Stages {
+		from, err := expandFrom(stage.From, args)
+		if err != nil {
+			return nil, crex.Wrapf(ErrInvalidRecipe, "stage %s: %w", stageLabel(stage.Name, i), err)
+		}
+		if from != stage.From {
+			slog.Debug("expanded stage base", "stage", stageLabel(stage.Name, i), "from", from)
+		}
+		expanded.Stages[i].From = from
+	}
+	return &expanded, nil
+}
+
+// Substitutes build arguments into a base image reference.
+func expandFrom(from string, args map[string]string) (string, error) {
+	var missing []string
+	expanded := os.Expand(from, func(name string) string {
+		value, ok := args[name]
+		if !ok && !slices.Contains(missing, name) {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", crex.Wrapf(ErrInvalidRecipe, "from %q uses undefined build arguments %s", from, strings.Join(missing, ", "))
+	}
+	if expanded == "" {
+		return "", crex.Wrapf(ErrInvalidRecipe, "from %q expands to an empty base", from)
+	}
+	return expanded, nil
+}
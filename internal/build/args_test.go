@@ -0,0 +1,254 @@
+package build
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "plain",
+			input: "VERSION=1.2.3\nGIT_SHA=abc123\n",
+			want:  map[string]string{"VERSION": "1.2.3", "GIT_SHA": "abc123"},
+		},
+		{
+			name:  "comments and blank lines",
+			input: "# release settings\n\nVERSION=1.2.3 # bumped by CI\n",
+			want:  map[string]string{"VERSION": "1.2.3"},
+		},
+		{
+			name:  "export prefix",
+			input: "export MODE=release\n",
+			want:  map[string]string{"MODE": "release"},
+		},
+		{
+			name:  "double quotes",
+			input: `GREETING="hello # world\n\"x\""` + "\n",
+			want:  map[string]string{"GREETING": "hello # world\n\"x\""},
+		},
+		{
+			name:  "single quotes",
+			input: `PATTERN='a\nb $HOME'` + "\n",
+			want:  map[string]string{"PATTERN": `a\nb $HOME`},
+		},
+		{
+			name:  "empty value",
+			input: "EMPTY=\n",
+			want:  map[string]string{"EMPTY": ""},
+		},
+		{
+			name:  "equals in value",
+			input: "FLAGS=-X main.version=1\n",
+			want:  map[string]string{"FLAGS": "-X main.version=1"},
+		},
+		{
+			name:  "later line wins",
+			input: "A=1\nA=2\n",
+			want:  map[string]string{"A": "2"},
+		},
+		{name: "missing equals", input: "VERSION\n", wantErr: true},
+		{name: "invalid name", input: "1VERSION=1\n", wantErr: true},
+		{name: "unterminated quote", input: `A="open` + "\n", wantErr: true},
+		{name: "text after quote", input: `A="x" y` + "\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseArgs([]byte(tt.input))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidOptions) {
+					t.Fatalf("expected ErrInvalidOptions, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("parseArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadArgs(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "build.args"), []byte("VERSION=1.0\nMODE=debug\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside.args")
+	if err := os.WriteFile(outside, []byte("A=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link.args")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		args    map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "none", want: map[string]string{}},
+		{name: "file only", file: "build.args", want: map[string]string{"VERSION": "1.0", "MODE": "debug"}},
+		{
+			name: "request overrides file",
+			file: "build.args",
+			args: map[string]string{"MODE": "release", "GIT_SHA": "abc"},
+			want: map[string]string{"VERSION": "1.0", "MODE": "release", "GIT_SHA": "abc"},
+		},
+		{name: "invalid request name", args: map[string]string{"BAD-NAME": "x"}, wantErr: true},
+		{name: "missing file", file: "missing.args", wantErr: true},
+		{name: "absolute path", file: outside, wantErr: true},
+		{name: "parent directory", file: "../outside.args", wantErr: true},
+		{name: "symlink out of context", file: "link.args", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadArgs(root, tt.file, tt.args)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidOptions) {
+					t.Fatalf("expected ErrInvalidOptions, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("loadArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeclareArgs(t *testing.T) {
+	dev := "dev"
+	declared := map[string]*string{"VERSION": &dev, "COMMIT": nil}
+
+	warn := &warnings{}
+	got, err := declareArgs(declared, map[string]string{"COMMIT": "abc123", "VERSON": "1.0"}, warn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := map[string]string{"VERSION": "dev", "COMMIT": "abc123"}; !maps.Equal(got, want) {
+		t.Errorf("args = %v, want %v", got, want)
+	}
+	if w := warn.all(); len(w) != 1 || w[0].Code != WarnUndeclaredArg || w[0].Context["arg"] != "VERSON" {
+		t.Errorf("warnings = %v, want one undeclared-arg warning for VERSON", w)
+	}
+
+	got, err = declareArgs(declared, map[string]string{"COMMIT": "abc123", "VERSION": "1.0"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["VERSION"] != "1.0" {
+		t.Errorf("VERSION = %q, want the given value to override the default", got["VERSION"])
+	}
+
+	if _, err := declareArgs(declared, nil, nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("missing required argument error = %v, want ErrInvalidOptions", err)
+	}
+
+	args := map[string]string{"ANY": "x"}
+	if got, err := declareArgs(nil, args, nil); err != nil || !maps.Equal(got, args) {
+		t.Errorf("no declarations = %v, %v, want args unchanged", got, err)
+	}
+}
+
+func TestExpandBases(t *testing.T) {
+	input := &manifest.Recipe{Stages: []manifest.Stage{
+		{Name: "build", From: "golang:1.25"},
+		{From: "${BASE}"},
+	}}
+
+	tests := []struct {
+		name    string
+		args    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "debug base", args: map[string]string{"BASE": "busybox:debug"}, want: "busybox:debug"},
+		{name: "prod base", args: map[string]string{"BASE": "gcr.io/distroless/static"}, want: "gcr.io/distroless/static"},
+		{name: "undefined", args: map[string]string{"OTHER": "alpine"}, wantErr: true},
+		{name: "empty", args: map[string]string{"BASE": ""}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandBases(input, tt.args)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRecipe) {
+					t.Fatalf("expected ErrInvalidRecipe, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			src, err := (&recipe{}).resolveImageSource(got.Stages[1])
+			if err != nil {
+				t.Fatalf("resolveImageSource: %v", err)
+			}
+			if src.Value != tt.want {
+				t.Errorf("pulled base = %q, want %q", src.Value, tt.want)
+			}
+			if got.Stages[0].From != "golang:1.25" {
+				t.Errorf("literal base changed to %q", got.Stages[0].From)
+			}
+		})
+	}
+
+	if input.Stages[1].From != "${BASE}" {
+		t.Errorf("input recipe modified: %q", input.Stages[1].From)
+	}
+}
+
+func TestExpandFrom(t *testing.T) {
+	args := map[string]string{"REGISTRY": "registry.example.com", "TAG": "3.21"}
+
+	tests := []struct {
+		from    string
+		want    string
+		wantErr bool
+	}{
+		{from: "alpine:3.21", want: "alpine:3.21"},
+		{from: "${REGISTRY}/alpine:${TAG}", want: "registry.example.com/alpine:3.21"},
+		{from: "alpine:$TAG", want: "alpine:3.21"},
+		{from: "${REGISTRY}/${IMAGE}:${VARIANT}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			got, err := expandFrom(tt.from, args)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "IMAGE, VARIANT") {
+					t.Fatalf("expected undefined IMAGE, VARIANT error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expandFrom(%q) = %q, want %q", tt.from, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package build
+
+import (
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+// A point at which a build pauses for debugging.
+//
+// The build executes the stage's steps up to and including Step, then stops
+// without cleaning up or exporting the stage. The container is left running
+// so that it can be inspected with exec, and its ID is reported in
+// [Result.Container]. Later stages and platforms are not built. The caller
+// owns the paused container and is responsible for destroying it; the
+// daemon keeps it across restarts.
+type Breakpoint struct {
+	Stage string // Stage key, as in [Options.Stages].
+	Step  int    // 1-based index of the last top-level step to execute.
+}
+
+// Reports whether the breakpoint is set on the given stage.
+func (b *Breakpoint) matches(name string, index int) bool {
+	return b != nil && b.Stage == stageKey(name, index)
+}
+
+// Checks that a breakpoint refers to an existing stage and step.
+//
+// Steps are counted at the top level of the stage, so a platform group
+// counts as a single step.
+func validateBreakpoint(b *Breakpoint, recipe *manifest.Recipe) error {
+	if b == nil {
+		return nil
+	}
+	for i, stage := range recipe.Stages {
+		if !b.matches(stage.Name, i) {
+			continue
+		}
+		if b.Step < 1 || b.Step > len(stage.Steps) {
+			return crex.Wrapf(ErrInvalidOptions, "breakpoint step %d out of range for stage %s with %d steps", b.Step, stageLabel(stage.Name, i), len(stage.Steps))
+		}
+		return nil
+	}
+	return crex.Wrapf(ErrInvalidOptions, "breakpoint stage %q not found", b.Stage)
+}
@@ -0,0 +1,40 @@
+package build
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestValidateBreakpoint(t *testing.T) {
+	recipe := &manifest.Recipe{Stages: []manifest.Stage{
+		{Name: "builder", Steps: []manifest.Step{{Run: "make"}, {Run: "make test"}}},
+		{Steps: []manifest.Step{{Run: "true"}}},
+	}}
+
+	tests := []struct {
+		name    string
+		bp      *Breakpoint
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "named stage", bp: &Breakpoint{Stage: "builder", Step: 2}},
+		{name: "unnamed stage by index", bp: &Breakpoint{Stage: "2", Step: 1}},
+		{name: "unknown stage", bp: &Breakpoint{Stage: "runtime", Step: 1}, wantErr: true},
+		{name: "step zero", bp: &Breakpoint{Stage: "builder", Step: 0}, wantErr: true},
+		{name: "step past end", bp: &Breakpoint{Stage: "builder", Step: 3}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBreakpoint(tt.bp, recipe)
+			if tt.wantErr && !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("expected ErrInvalidOptions, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
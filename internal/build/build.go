@@ -2,29 +2,183 @@ package build
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log/slog"
 	"os"
-	goruntime "runtime"
+	"path/filepath"
 
 	"github.com/cruciblehq/crex"
 	"github.com/cruciblehq/cruxd/internal/runtime"
 	"github.com/cruciblehq/spec/manifest"
 	"github.com/cruciblehq/spec/paths"
+	dref "github.com/distribution/reference"
 )
 
 // Controls recipe execution.
 type Options struct {
-	Recipe     *manifest.Recipe // Recipe to execute.
-	Resource   string           // Resource name, used as a prefix for container IDs.
-	Output     string           // Directory for the exported image.
-	Root       string           // Project root, for resolving copy sources.
-	Entrypoint []string         // OCI entrypoint for the output image (services only).
-	Platforms  []string         // Target platforms (e.g., ["linux/amd64"]). Defaults to host.
+	Recipe                *manifest.Recipe        // Recipe to execute.
+	RecipeVersion         int                     // Schema version the recipe was written for. Zero means unspecified.
+	Resource              string                  // Resource name, used as a prefix for container IDs.
+	BuildID               string                  // Unique ID of the build, part of every stage container's ID and label. Empty generates one.
+	Daemon                string                  // Identifies the daemon running the build, such as its socket path, in the [runtime.DaemonLabel] of stage containers. Empty sets no label.
+	Output                string                  // Directory for the exported image.
+	Push                  string                  // Registry reference the output image is pushed to. Empty pushes nothing.
+	PushOnly              bool                    // Push the output image without writing image.tar or creating Output. Requires Push.
+	Root                  string                  // Project root, for resolving copy sources.
+	Context               *RemoteContext          // Project root kept on the client's host, fetched as copy steps read it. Replaces Root, which must be empty.
+	MemoryContext         string                  // Directory on a tmpfs to copy the project root into before the build. Empty reads it in place.
+	MemoryContextLimit    int64                   // Largest project root in bytes copied to MemoryContext. Larger ones are read in place. Zero means unlimited.
+	Entrypoint            []string                // OCI entrypoint for the output image (services only). Replaces the base's and clears its cmd unless KeepCmd is set.
+	AppendEntrypoint      []string                // Arguments appended to the output image's entrypoint.
+	Cmd                   []string                // OCI cmd for the output image. Empty keeps the base's unless Entrypoint clears it.
+	KeepCmd               bool                    // Keep the base image's cmd when Entrypoint is set.
+	PlatformConfigs       map[string]ImageConfig  // Entrypoint and cmd settings per target platform, overriding the ones above.
+	Platforms             []string                // Target platforms (e.g., ["linux/amd64"]). Defaults to host.
+	Args                  map[string]string       // Build arguments, set as environment variables for run steps.
+	DeclaredArgs          map[string]*string      // Build arguments the recipe accepts, with their defaults or nil if required. Nil accepts any.
+	SourceDateEpoch       *int64                  // Unix time set as SOURCE_DATE_EPOCH for run steps. Build arguments and step env override it. Nil sets none.
+	ArgsFile              string                  // File of KEY=VALUE build arguments relative to Root. Entries in Args take precedence.
+	Stages                map[string]StageOptions // Per-stage settings keyed by stage name, or 1-based index for unnamed stages.
+	MaxLayerSize          int64                   // Maximum size in bytes of an exported layer. Zero means unlimited.
+	RequireDigest         bool                    // Reject OCI base images that are not pinned by digest.
+	AllowPlatformFallback bool                    // Export the first manifest of a multi-platform base when none matches the target platform.
+	DigestFilename        bool                    // Name each archive sha256-<hex>.tar after its image digest instead of image.tar.
+	ExportFormat          runtime.ExportFormat    // Layout of the exported archives. Empty writes OCI archives.
+	Compression           runtime.Compression     // Algorithm the output image's layer is compressed with. Empty uses gzip.
+	CompressionLevel      int                     // Level the output image's layer is compressed at. Zero uses containerd's default.
+	Squash                bool                    // Export the output image as a single layer holding its whole root filesystem, base image included.
+	ReadOnlyRootfs        bool                    // Run steps with a read-only root filesystem, leaving only the paths the steps write to writable.
+	StrictStderr          bool                    // Fail run steps that write to stderr even when they exit 0. Steps can be exempted with [StageOptions.AllowStderr].
+	AnnotateLayers        bool                    // Annotate each exported layer in the image manifest with the stage that produced it.
+	Labels                map[string]string       // Labels merged into the output image's config, overriding the base image's.
+	RecipeLabels          map[string]string       // Labels the recipe sets on the output image. Labels overrides them.
+	Tags                  []string                // References the output image is named by in its archives, such as "app:latest". Empty names it after its base.
+	Rlimits               []runtime.Rlimit        // Resource limits for processes in stage containers. Empty keeps the container defaults.
+	AddCapabilities       []string                // Linux capabilities granted to stage containers beyond containerd's defaults.
+	DropCapabilities      []string                // Linux capabilities removed from stage containers.
+	SeccompProfile        string                  // Seccomp profile for stage containers as a path, inline JSON, or "unconfined". Empty uses containerd's default.
+	AppArmorProfile       string                  // AppArmor profile stage containers run under, which must be loaded, or "unconfined". Empty uses containerd's default.
+	Hostname              string                  // Hostname of every stage container. Empty names each after its stage.
+	DNSSearch             []string                // Search domains of stage containers, replacing the host's. Empty keeps the host's.
+	DNSOptions            []string                // Resolver options of stage containers, such as "ndots:2", replacing the host's. Empty keeps the host's.
+	CopyChown             string                  // Default "UID:GID" ownership of copied files. Copy steps override it with --chown.
+	CopySymlinks          SymlinkPolicy           // How copies treat symbolic links inside host directories. Empty preserves them.
+	StrictCopyModes       bool                    // Fail host copies of setuid, setgid, or world-writable files instead of warning.
+	AllowUndefinedVars    bool                    // Expand "${NAME}" references to undefined variables in commands, copy paths, and workdirs to nothing instead of failing.
+	Secrets               []SecretMount           // Secrets mounted read-only into stage containers.
+	SecretSource          SecretSource            // Where secret IDs are resolved.
+	BreakAt               *Breakpoint             // Stage and step at which to pause the build for debugging. Nil runs to completion.
+	ExportStages          []string                // Stage keys, as in Stages, also exported to a debug directory, including transient stages.
+	Progress              ProgressFunc            // Receives progress events as the build runs. Nil reports none.
+	OutputSampling        OutputSampling          // Limits the run step output reported to Progress. The zero value reports all of it.
+	StageRetries          int                     // Times a stage is rebuilt in a fresh container after an infrastructure error. Zero disables retries.
+	Snapshotter           string                  // containerd snapshotter for the build's images and containers. Empty uses the runtime's.
+	NoCache               bool                    // Execute every step instead of reusing results from the build cache.
+	CacheClear            bool                    // Remove the resource's build cache entries before building, see [runtime.Runtime.ClearCache].
+}
+
+// Settings for a single stage that extend the recipe's stage definition.
+type StageOptions struct {
+	Cleanup     []string          // Absolute paths removed from the container before it is committed.
+	AllowStderr []int             // 1-based top-level steps exempt from [Options.StrictStderr].
+	From        map[string]string // Base image per target platform, replacing the recipe's from when that platform is built.
+	MemoryLimit int64             // Most memory in bytes the stage's steps may use together. Zero means unlimited.
+	CPUs        float64           // CPUs' worth of time the stage's steps may use, such as 1.5. Zero means unlimited.
+	Verify      []string          // Commands run with the stage's shell after its steps and before export. A failure fails the build.
+}
+
+// Collects the settings applied to every stage container.
+func (o Options) containerOptions() runtime.ContainerOptions {
+	return runtime.ContainerOptions{
+		Rlimits:          o.Rlimits,
+		AddCapabilities:  o.AddCapabilities,
+		DropCapabilities: o.DropCapabilities,
+		SeccompProfile:   o.SeccompProfile,
+		AppArmorProfile:  o.AppArmorProfile,
+		Hostname:         o.Hostname,
+		Labels:           o.stageLabels(),
+	}
+}
+
+// Returns the labels of every stage container: the build's ID and, when
+// set, the daemon running it.
+func (o Options) stageLabels() map[string]string {
+	labels := map[string]string{runtime.BuildLabel: o.BuildID}
+	if o.Daemon != "" {
+		labels[runtime.DaemonLabel] = o.Daemon
+	}
+	return labels
 }
 
 // Returned after successful recipe execution.
 type Result struct {
-	Output string // Directory containing the exported image.
+	Output    string    // Directory containing the exported image.
+	Pushed    string    // Reference and digest of the pushed image, when [Options.Push] is set.
+	Container string    // ID of the container left running at [Options.BreakAt], if the build paused.
+	Archives  []string  // Paths of the exported archives, one per platform unless the build was push-only.
+	Warnings  []Warning // Non-fatal issues found during the build, in the order they were found.
+}
+
+// Returns a new unique build ID, such as "build-4f9c2a7e01b3d85c".
+func NewID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", crex.Wrap(ErrBuild, err)
+	}
+	return "build-" + hex.EncodeToString(b[:]), nil
+}
+
+// Checks the push settings of a build.
+//
+// Each platform is committed as its own image, and pushing them one after
+// the other to the same reference would leave only the last, so pushes are
+// limited to single-platform builds.
+func validatePush(ref string, pushOnly bool, platforms []string) error {
+	if ref == "" {
+		if pushOnly {
+			return crex.Wrapf(ErrInvalidOptions, "push-only build needs a push reference")
+		}
+		return nil
+	}
+	if _, err := dref.ParseNormalizedNamed(ref); err != nil {
+		return crex.Wrapf(ErrInvalidOptions, "push reference %q: %w", ref, err)
+	}
+	if len(platforms) > 1 {
+		return crex.Wrapf(ErrInvalidOptions, "pushing is only supported for single-platform builds, got %v", platforms)
+	}
+	return nil
+}
+
+// Checks that every tag of the output image is a reference without a digest.
+func validateTags(tags []string) error {
+	for _, tag := range tags {
+		named, err := dref.ParseNormalizedNamed(tag)
+		if err != nil {
+			return crex.Wrapf(ErrInvalidOptions, "tag %q: %w", tag, err)
+		}
+		if _, ok := named.(dref.Canonical); ok {
+			return crex.Wrapf(ErrInvalidOptions, "tag %q must not include a digest", tag)
+		}
+	}
+	return nil
+}
+
+// Resolves symbolic links in the project root.
+//
+// The root is resolved once, before anything reads from it, so that the
+// whole build sees the same directory even if the link is changed while it
+// runs, and so that paths checked against the root compare equal to the
+// resolved paths below it. An empty root is left as is.
+func resolveRoot(root string) (string, error) {
+	if root == "" {
+		return "", nil
+	}
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", crex.Wrapf(ErrInvalidOptions, "build context: %w", err)
+	}
+	return resolved, nil
 }
 
 // Executes a recipe against the container runtime.
@@ -32,21 +186,200 @@ type Result struct {
 // Stages are built in declaration order. Each stage starts a container from
 // its base image, executes the stage's steps, and the non-transient stage is
 // exported as the final image to the output directory.
+//
+// Stage containers are set up and changed through mounts and process I/O
+// on containerd's host, so a runtime connected to a remote containerd is
+// refused with [runtime.ErrRemote] before anything is pulled.
 func Run(ctx context.Context, rt *runtime.Runtime, opts Options) (*Result, error) {
+	if err := checkRecipeVersion(opts.RecipeVersion); err != nil {
+		return nil, err
+	}
+	if err := validateRecipe(opts.Recipe); err != nil {
+		return nil, err
+	}
+	if err := validateStageOptions(opts.Stages); err != nil {
+		return nil, err
+	}
 	if len(opts.Platforms) == 0 {
-		opts.Platforms = []string{"linux/" + goruntime.GOARCH}
+		opts.Platforms = []string{runtime.DefaultPlatform()}
+	}
+	if err := validateFromOverrides(opts.Stages, opts.Platforms, opts.RequireDigest); err != nil {
+		return nil, err
+	}
+	if err := validateImageConfigs(opts.PlatformConfigs, opts.Platforms); err != nil {
+		return nil, err
+	}
+	if err := validateTags(opts.Tags); err != nil {
+		return nil, err
+	}
+	if err := validatePush(opts.Push, opts.PushOnly, opts.Platforms); err != nil {
+		return nil, err
+	}
+	if err := opts.ExportFormat.Validate(); err != nil {
+		return nil, crex.Wrap(ErrInvalidOptions, err)
+	}
+	if err := opts.Compression.Validate(opts.CompressionLevel); err != nil {
+		return nil, crex.Wrap(ErrInvalidOptions, err)
+	}
+	if err := opts.containerOptions().Validate(); err != nil {
+		return nil, crex.Wrap(ErrInvalidOptions, err)
+	}
+	if _, err := parseOwner(opts.CopyChown); err != nil {
+		return nil, crex.Wrap(ErrInvalidOptions, err)
+	}
+	if err := opts.CopySymlinks.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateSecretMounts(opts.Secrets); err != nil {
+		return nil, err
+	}
+	if err := validateDNS(opts.DNSSearch, opts.DNSOptions); err != nil {
+		return nil, err
+	}
+	if err := opts.OutputSampling.validate(); err != nil {
+		return nil, err
+	}
+	if _, ok := opts.Labels[""]; ok {
+		return nil, crex.Wrapf(ErrInvalidOptions, "image label with an empty key")
+	}
+	opts.Labels = imageLabels(opts.RecipeLabels, opts.Labels)
+	if err := validateBreakpoint(opts.BreakAt, opts.Recipe); err != nil {
+		return nil, err
+	}
+	if err := validateDebugExports(opts.ExportStages, opts.Recipe); err != nil {
+		return nil, err
+	}
+	if opts.BuildID == "" {
+		id, err := NewID()
+		if err != nil {
+			return nil, err
+		}
+		opts.BuildID = id
+	}
+	if opts.SourceDateEpoch != nil && *opts.SourceDateEpoch < 0 {
+		return nil, crex.Wrapf(ErrInvalidOptions, "source date epoch %d must not be negative", *opts.SourceDateEpoch)
+	}
+	if opts.StageRetries < 0 {
+		return nil, crex.Wrapf(ErrInvalidOptions, "stage retries %d must not be negative", opts.StageRetries)
+	}
+	if rt.Remote() {
+		return nil, crex.Wrapf(runtime.ErrRemote, "build")
+	}
+	if err := rt.CheckAppArmorProfile(opts.AppArmorProfile); err != nil {
+		return nil, crex.Wrap(ErrInvalidOptions, err)
+	}
+	if opts.Snapshotter != "" {
+		if err := rt.CheckSnapshotter(ctx, opts.Snapshotter); err != nil {
+			return nil, crex.Wrap(ErrInvalidOptions, err)
+		}
+		rt = rt.WithSnapshotter(opts.Snapshotter)
+	}
+	if opts.CacheClear && opts.Resource == "" {
+		return nil, crex.Wrapf(ErrInvalidOptions, "clearing the build cache needs a resource")
+	}
+	if opts.Context != nil {
+		if opts.Root != "" || opts.MemoryContext != "" {
+			return nil, crex.Wrapf(ErrInvalidOptions, "a build context sent by the client replaces the root and the memory context")
+		}
+		opts.Root = opts.Context.Dir()
+	}
+	root, err := resolveRoot(opts.Root)
+	if err != nil {
+		return nil, err
+	}
+	opts.Root = root
+	if err := opts.Context.fetch(ctx, []string{ignoreFile, opts.ArgsFile}, nil, false); err != nil {
+		return nil, err
+	}
+
+	warn := &warnings{}
+	args, err := loadArgs(opts.Root, opts.ArgsFile, opts.Args)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Args, err = declareArgs(opts.DeclaredArgs, args, warn); err != nil {
+		return nil, err
+	}
+
+	recipe, err := expandBases(opts.Recipe, opts.Args)
+	if err != nil {
+		return nil, err
+	}
+	opts.Recipe = recipe
+	if opts.RequireDigest {
+		if err := validatePinnedBases(opts.Recipe); err != nil {
+			return nil, err
+		}
 	}
 
 	slog.Info("executing recipe",
 		"resource", opts.Resource,
+		"build", opts.BuildID,
 		"output", opts.Output,
 		"stages", len(opts.Recipe.Stages),
 		"platforms", opts.Platforms,
+		"snapshotter", rt.Snapshotter(),
 	)
 
-	if err := os.MkdirAll(opts.Output, paths.DefaultDirMode); err != nil {
-		return nil, crex.Wrap(ErrFileSystemOperation, err)
+	if !opts.PushOnly {
+		if err := os.MkdirAll(opts.Output, paths.DefaultDirMode); err != nil {
+			return nil, crex.Wrap(ErrFileSystemOperation, err)
+		}
+	}
+
+	ignore, err := loadIgnore(opts.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MemoryContext != "" {
+		staged, err := materializeContext(opts.Root, opts.MemoryContext, opts.MemoryContextLimit, warn)
+		if err != nil {
+			return nil, err
+		}
+		if staged != "" {
+			defer os.RemoveAll(staged)
+			opts.Root = staged
+		}
 	}
 
-	return newRecipe(rt, opts).build(ctx, opts.Recipe.Stages)
+	secretDir, secretMounts, err := stageSecrets(opts.SecretSource, opts.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	if secretDir != "" {
+		defer os.RemoveAll(secretDir)
+	}
+
+	dnsDir, dnsMount, err := stageResolvConf(opts.DNSSearch, opts.DNSOptions)
+	if err != nil {
+		return nil, err
+	}
+	if dnsDir != "" {
+		defer os.RemoveAll(dnsDir)
+	}
+
+	// The cache is cleared only once nothing is left to reject the build, so
+	// that a request that fails validation leaves the cache as it was.
+	if opts.CacheClear {
+		cleared, err := rt.ClearCache(ctx, opts.Resource)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("cleared build cache",
+			"resource", opts.Resource,
+			"removed", cleared.Removed,
+			"in-use", cleared.InUse,
+			"reclaimed", cleared.Reclaimed,
+		)
+	}
+
+	r := newRecipe(rt, opts)
+	r.ignore = ignore
+	r.warnings = warn
+	r.ctrOpts.Mounts = append(r.ctrOpts.Mounts, secretMounts...)
+	if dnsMount != nil {
+		r.ctrOpts.Mounts = append(r.ctrOpts.Mounts, *dnsMount)
+	}
+	return r.build(ctx, opts.Recipe.Stages)
 }
@@ -0,0 +1,139 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestValidatePush(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       string
+		pushOnly  bool
+		platforms []string
+		wantErr   bool
+	}{
+		{name: "no push", platforms: []string{"linux/amd64", "linux/arm64"}},
+		{name: "push", ref: "registry.example.com/app:1.0", platforms: []string{"linux/amd64"}},
+		{name: "push only", ref: "registry.example.com/app:1.0", pushOnly: true, platforms: []string{"linux/amd64"}},
+		{name: "push only without reference", pushOnly: true, platforms: []string{"linux/amd64"}, wantErr: true},
+		{name: "invalid reference", ref: "Registry/App", platforms: []string{"linux/amd64"}, wantErr: true},
+		{name: "multiple platforms", ref: "app:1.0", platforms: []string{"linux/amd64", "linux/arm64"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePush(tt.ref, tt.pushOnly, tt.platforms)
+			if tt.wantErr && !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("expected ErrInvalidOptions, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	if err := validateTags([]string{"app:latest", "registry.example.com/team/app:1.2.3", "app"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tag := range []string{"Not A Tag", "app@sha256:" + strings.Repeat("a", 64)} {
+		if err := validateTags([]string{"app:latest", tag}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("validateTags(%q) error = %v, want ErrInvalidOptions", tag, err)
+		}
+	}
+}
+
+func TestStageLabels(t *testing.T) {
+	got := Options{BuildID: "b1", Daemon: "/run/cruxd/cruxd.sock"}.stageLabels()
+	if len(got) != 2 || got[runtime.BuildLabel] != "b1" || got[runtime.DaemonLabel] != "/run/cruxd/cruxd.sock" {
+		t.Errorf("stageLabels() = %v", got)
+	}
+	if got := (Options{BuildID: "b1"}).stageLabels(); len(got) != 1 {
+		t.Errorf("stageLabels() without a daemon = %v", got)
+	}
+}
+
+func TestRunPushOnlySkipsOutput(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "out")
+	opts := Options{
+		Recipe:        &manifest.Recipe{Stages: []manifest.Stage{{From: "alpine:3.21"}}},
+		Root:          t.TempDir(),
+		Output:        output,
+		Push:          "registry.example.com/app:1.0",
+		PushOnly:      true,
+		MemoryContext: filepath.Join(t.TempDir(), "missing"),
+	}
+
+	// Staging the context in a missing directory fails after the point
+	// where the output directory would have been created.
+	if _, err := Run(context.Background(), &runtime.Runtime{}, opts); !errors.Is(err, ErrFileSystemOperation) {
+		t.Fatalf("err = %v, want ErrFileSystemOperation", err)
+	}
+	if _, err := os.Stat(output); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("push-only build created its output directory: %v", err)
+	}
+}
+
+func TestRunRemote(t *testing.T) {
+	rt, err := runtime.New("tcp://127.0.0.1:1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	opts := Options{
+		Recipe: &manifest.Recipe{Stages: []manifest.Stage{{From: "alpine:3.21"}}},
+		Root:   t.TempDir(),
+		Output: t.TempDir(),
+	}
+	if _, err := Run(context.Background(), rt, opts); !errors.Is(err, runtime.ErrRemote) {
+		t.Errorf("err = %v, want ErrRemote", err)
+	}
+}
+
+func TestRunCacheClearAfterValidation(t *testing.T) {
+	required := map[string]*string{"VERSION": nil}
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "missing args file", opts: Options{ArgsFile: "missing.env"}},
+		{name: "missing required arg", opts: Options{DeclaredArgs: required}},
+		{name: "undefined base arg", opts: Options{Recipe: &manifest.Recipe{Stages: []manifest.Stage{{From: "${BASE}"}}}}},
+		{name: "unpinned base", opts: Options{RequireDigest: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Resource = "my-app"
+			opts.Root = t.TempDir()
+			opts.Output = t.TempDir()
+			opts.CacheClear = true
+			if opts.Recipe == nil {
+				opts.Recipe = &manifest.Recipe{Stages: []manifest.Stage{{From: "alpine:3.21"}}}
+			}
+
+			// The runtime has no containerd client, so clearing the cache
+			// would panic instead of returning the validation error.
+			defer func() {
+				if p := recover(); p != nil {
+					t.Fatalf("cache cleared before validation failed: %v", p)
+				}
+			}()
+			if _, err := Run(context.Background(), &runtime.Runtime{}, opts); err == nil {
+				t.Fatal("expected a validation error")
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+// Version of the cache key scheme. Changing what a key covers must change
+// the version, so that entries recorded under the old scheme never match.
+const cacheKeyVersion = "cruxd-step-cache-v1"
+
+// Build cache keys of the steps of one stage container.
+//
+// Each key identifies the container's filesystem after a step: it hashes
+// the key of the state before the step together with everything the step's
+// outcome depends on. A chain starts from the base image, so two stages
+// share keys only for as long as they share a base and a prefix of steps.
+// The keys of finished stages are kept by container ID, so that a copy from
+// a stage depends on that stage's final state.
+//
+// Steps whose keys have entries are skipped without touching the container.
+// Only the entry of the last of a run of skipped steps is restored, when the
+// next step has to execute or the stage ends, so an unchanged prefix of a
+// stage, or a whole unchanged stage, costs a single restore. A build that
+// failed part way through therefore resumes from the first step that did
+// not complete when it is run again.
+//
+// A nil cache computes no keys. A cache whose chain broke, because a step's
+// inputs could not be hashed, computes none for the rest of the stage.
+type stepCache struct {
+	key      string            // Key of the container's current state. Empty once the chain broke.
+	pending  string            // Key of the entry the container must be restored to before it is used, if any.
+	final    map[string]string // Final keys of finished stages by container ID, shared across stages.
+	resource string            // Resource the entries are recorded and reused for, see [runtime.Runtime.ClearCache].
+}
+
+// Holds the build cache entries of a stage container. Satisfied by
+// [runtime.Container].
+type checkpointStore interface {
+	Cached(ctx context.Context, key, resource string) (bool, error)
+	Restore(ctx context.Context, key string) (bool, error)
+	Checkpoint(ctx context.Context, key, resource string) error
+}
+
+// Starts a chain of keys from a stage's base image.
+//
+// writable lists the paths kept writable under a read-only root
+// filesystem, which are created before the first step and so are part of
+// every state of the chain. It is empty when writes are not restricted.
+// The resource is not part of the keys, so resources share entries.
+func newStepCache(baseDigest, platform, resource string, writable []string, final map[string]string) *stepCache {
+	h := sha256.New()
+	hashFields(h, cacheKeyVersion, baseDigest, platform)
+	hashFields(h, writable...)
+	return &stepCache{key: hex.EncodeToString(h.Sum(nil)), final: final, resource: resource}
+}
+
+// Returns the key of the state after a run or copy step, or "" when the
+// step cannot be cached.
+//
+// A run step is keyed on its command and on the shell, working directory,
+// and environment it runs with. Secrets are identified by nothing but their
+// mount, so a step that reads a secret is not rerun when only the secret's
+// value changes. A copy step is keyed on its copy string and the settings
+// that change how files are copied, and on its source: for a host copy,
+// the exact archive the copy sends, including file contents, modes,
+// ownership, and modification times; for a cross-stage copy, the final key
+// of the source stage. A source that cannot be read breaks the chain, and
+// the copy then reports the error itself.
+func (c *stepCache) next(step manifest.Step, resolved *stepState, buildCtx string, stages map[string]*runtime.Container) string {
+	if c == nil || c.key == "" {
+		return ""
+	}
+
+	h := sha256.New()
+	hashFields(h, c.key, resolved.shell, resolved.workdir, strconv.FormatBool(resolved.strictStderr))
+	for _, k := range slices.Sorted(maps.Keys(resolved.env)) {
+		hashFields(h, k, resolved.env[k])
+	}
+
+	if step.Run != "" {
+		hashFields(h, "run", step.Run)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	own := resolved.copyOwner
+	ownership := ""
+	if own != nil {
+		ownership = strconv.Itoa(own.uid) + ":" + strconv.Itoa(own.gid)
+	}
+	hashFields(h, "copy", step.Copy, ownership, strconv.FormatBool(resolved.followLinks), strconv.FormatBool(resolved.strictModes))
+
+	source, err := c.copySource(step.Copy, resolved, buildCtx, stages)
+	if err != nil {
+		slog.Debug("build cache disabled for the rest of the stage", "copy", step.Copy, "error", err)
+		c.key = ""
+		return ""
+	}
+	hashFields(h, source)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns a digest of what a copy step reads. Inline copies read nothing
+// but their copy string and return "". A copy with several sources or a
+// glob pattern is keyed on the paths its sources expand to and the digest
+// of each.
+func (c *stepCache) copySource(copyStr string, resolved *stepState, buildCtx string, stages map[string]*runtime.Container) (string, error) {
+	if _, ok, err := parseInlineCopy(copyStr, resolved.workdir); ok || err != nil {
+		return "", err
+	}
+
+	srcs, dest, err := parseCopy(copyStr, resolved.workdir)
+	if err != nil {
+		return "", err
+	}
+	attrs, _, _ := splitCopyFlags(copyStr)
+	if attrs.own == nil {
+		attrs.own = resolved.copyOwner
+	}
+	if len(srcs) == 1 && !isGlob(srcs[0]) {
+		return c.sourceDigest(srcs[0], dest, buildCtx, attrs, resolved, stages)
+	}
+
+	sources, err := expandCopySources(srcs, buildCtx, resolved.ignore)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, src := range sources {
+		into, err := multiCopyDest(src, dest, buildCtx)
+		if err != nil {
+			return "", err
+		}
+		digest, err := c.sourceDigest(src, into, buildCtx, attrs, resolved, stages)
+		if err != nil {
+			return "", err
+		}
+		hashFields(h, src, digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns a digest of a single source of a copy to dest.
+func (c *stepCache) sourceDigest(src, dest, buildCtx string, attrs copyAttrs, resolved *stepState, stages map[string]*runtime.Container) (string, error) {
+	if stage, path, ok := parseStageCopy(src); ok {
+		ctr, found := stages[stage]
+		if !found {
+			return "", crex.Wrapf(ErrCopy, "unknown stage %q", stage)
+		}
+		key, found := c.final[ctr.ID()]
+		if !found {
+			return "", crex.Wrapf(ErrCopy, "stage %q has no cache key", stage)
+		}
+		return key + ":" + path, nil
+	}
+
+	return hostSourceDigest(src, dest, buildCtx, attrs, resolved.ignore, resolved.followLinks)
+}
+
+// Returns the SHA-256 of the archive a host copy sends into the container.
+//
+// The archive is written exactly as [executeHostCopy] writes it, so any
+// change to the source that would change the copied files changes the
+// digest. Unsafe modes are only logged here; the copy itself decides
+// whether they fail.
+func hostSourceDigest(src, dest, buildCtx string, attrs copyAttrs, ignore *ignoreRules, followLinks bool) (string, error) {
+	hostSrc := src
+	if !filepath.IsAbs(hostSrc) {
+		hostSrc = filepath.Join(buildCtx, hostSrc)
+	}
+
+	info, err := os.Stat(hostSrc)
+	if err != nil {
+		return "", err
+	}
+
+	_, name := hostCopyTarget(src, dest, info.IsDir())
+
+	h := sha256.New()
+	tw := tar.NewWriter(h)
+	if err := writeHostSource(tw, hostSrc, name, info, attrs, ignore.scope(buildCtx, hostSrc), followLinks, modeCheck{}); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Reports whether the step with the given key can be skipped because the
+// cache has an entry for it, in which case the chain moves on to the entry
+// and the container is restored to it by the next [stepCache.flush]. An
+// empty key never hits.
+func (c *stepCache) hit(ctx context.Context, store checkpointStore, key string) (bool, error) {
+	if c == nil || key == "" {
+		return false, nil
+	}
+	found, err := store.Cached(ctx, key, c.resource)
+	if err != nil || !found {
+		return false, err
+	}
+	c.key = key
+	c.pending = key
+	return true, nil
+}
+
+// Restores the container to the entry of the last skipped step, if it has
+// not been restored yet. Must be called before the container is used.
+func (c *stepCache) flush(ctx context.Context, store checkpointStore) error {
+	if c == nil || c.pending == "" {
+		return nil
+	}
+	key := c.pending
+	c.pending = ""
+
+	found, err := store.Restore(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return crex.Wrapf(runtime.ErrRuntime, "build cache entry %s was removed during the build", key)
+	}
+	return nil
+}
+
+// Records the container's state after a step as the entry for key and
+// moves the chain on to it.
+func (c *stepCache) record(ctx context.Context, store checkpointStore, key string) error {
+	if err := store.Checkpoint(ctx, key, c.resource); err != nil {
+		return err
+	}
+	c.advance(key)
+	return nil
+}
+
+// Moves the chain on to the state a step produced.
+func (c *stepCache) advance(key string) {
+	if c != nil {
+		c.key = key
+	}
+}
+
+// Records the key of a finished stage, once cleanup removed its paths, for
+// copies from it.
+func (c *stepCache) finish(id string, cleanup []string) {
+	if c == nil || c.key == "" {
+		return
+	}
+	h := sha256.New()
+	hashFields(h, c.key, "cleanup")
+	hashFields(h, cleanup...)
+	c.final[id] = hex.EncodeToString(h.Sum(nil))
+}
+
+// Writes each field to h prefixed with its length, so that no two lists of
+// fields hash alike.
+func hashFields(h hash.Hash, fields ...string) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(fields)))
+	h.Write(n[:])
+	for _, f := range fields {
+		binary.BigEndian.PutUint64(n[:], uint64(len(f)))
+		h.Write(n[:])
+		h.Write([]byte(f))
+	}
+}
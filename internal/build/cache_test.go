@@ -0,0 +1,309 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestStepCacheKeys(t *testing.T) {
+	base := func() *stepCache {
+		return newStepCache("sha256:base", "linux/amd64", "my-app", nil, map[string]string{})
+	}
+	state := func(env map[string]string) *stepState {
+		s := newStepState()
+		s.workdir = "/src"
+		for k, v := range env {
+			s.env[k] = v
+		}
+		return s
+	}
+	run := manifest.Step{Run: "make"}
+	want := base().next(run, state(nil), "", nil)
+	if want == "" {
+		t.Fatal("run step has no key")
+	}
+
+	tests := []struct {
+		name  string
+		cache *stepCache
+		step  manifest.Step
+		state *stepState
+		same  bool
+	}{
+		{name: "identical", cache: base(), step: run, state: state(nil), same: true},
+		{name: "command", cache: base(), step: manifest.Step{Run: "make install"}, state: state(nil)},
+		{name: "environment", cache: base(), step: run, state: state(map[string]string{"CGO_ENABLED": "0"})},
+		{name: "base image", cache: newStepCache("sha256:other", "linux/amd64", "my-app", nil, nil), step: run, state: state(nil)},
+		{name: "platform", cache: newStepCache("sha256:base", "linux/arm64", "my-app", nil, nil), step: run, state: state(nil)},
+		{name: "writable paths", cache: newStepCache("sha256:base", "linux/amd64", "my-app", []string{"/src"}, nil), step: run, state: state(nil)},
+		{name: "copy instead of run", cache: base(), step: manifest.Step{Copy: "<<EOF /src/f\nmake\nEOF"}, state: state(nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cache.next(tt.step, tt.state, "", nil)
+			if got == "" {
+				t.Fatal("no key")
+			}
+			if (got == want) != tt.same {
+				t.Errorf("key %s, first key %s, want same = %v", got, want, tt.same)
+			}
+		})
+	}
+
+	chained := base()
+	chained.advance(want)
+	if chained.next(run, state(nil), "", nil) == want {
+		t.Error("repeating a step after itself has the same key")
+	}
+
+	var off *stepCache
+	if key := off.next(run, state(nil), "", nil); key != "" {
+		t.Errorf("nil cache returned key %q", key)
+	}
+}
+
+func TestStepCacheHostCopy(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "src", "main.go")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	step := manifest.Step{Copy: "src /app"}
+	key := func() string {
+		return newStepCache("sha256:base", "linux/amd64", "my-app", nil, nil).next(step, newStepState(), dir, nil)
+	}
+
+	write("package main")
+	first := key()
+	if first == "" {
+		t.Fatal("host copy has no key")
+	}
+	if key() != first {
+		t.Error("unchanged source changed the key")
+	}
+
+	write("package main // edited")
+	if key() == first {
+		t.Error("changed contents kept the key")
+	}
+
+	write("package main")
+	if err := os.Chmod(file, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if key() == first {
+		t.Error("changed mode kept the key")
+	}
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key() != first {
+		t.Error("restored source did not restore the key")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "src", "new.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key() == first {
+		t.Error("added file kept the key")
+	}
+
+	cache := newStepCache("sha256:base", "linux/amd64", "my-app", nil, nil)
+	if got := cache.next(manifest.Step{Copy: "missing /app"}, newStepState(), dir, nil); got != "" {
+		t.Errorf("unreadable source returned key %q", got)
+	}
+	if got := cache.next(manifest.Step{Run: "make"}, newStepState(), dir, nil); got != "" {
+		t.Errorf("step after a broken chain returned key %q", got)
+	}
+}
+
+func TestStepCacheStageCopy(t *testing.T) {
+	final := map[string]string{}
+	builder := &runtime.Container{}
+	stages := map[string]*runtime.Container{"builder": builder}
+	step := manifest.Step{Copy: "builder:/out/app /usr/local/bin/app"}
+
+	first := newStepCache("sha256:builder", "linux/amd64", "my-app", nil, final)
+	first.advance("after-build")
+	first.finish(builder.ID(), nil)
+	before := newStepCache("sha256:base", "linux/amd64", "my-app", nil, final).next(step, newStepState(), "", stages)
+	if before == "" {
+		t.Fatal("stage copy has no key")
+	}
+
+	first.advance("after-rebuild")
+	first.finish(builder.ID(), nil)
+	if after := newStepCache("sha256:base", "linux/amd64", "my-app", nil, final).next(step, newStepState(), "", stages); after == before {
+		t.Error("changed source stage kept the key")
+	}
+
+	unknown := newStepCache("sha256:base", "linux/amd64", "my-app", nil, map[string]string{})
+	if got := unknown.next(step, newStepState(), "", stages); got != "" {
+		t.Errorf("copy from a stage without a key returned %q", got)
+	}
+}
+
+// Holds cache entries in memory and records restores and the resources
+// entries were recorded or reused for.
+type fakeCheckpoints struct {
+	entries   map[string]bool
+	restored  []string
+	resources []string
+}
+
+func (f *fakeCheckpoints) Cached(_ context.Context, key, resource string) (bool, error) {
+	f.resources = append(f.resources, resource)
+	return f.entries[key], nil
+}
+
+func (f *fakeCheckpoints) Checkpoint(_ context.Context, key, resource string) error {
+	f.resources = append(f.resources, resource)
+	f.entries[key] = true
+	return nil
+}
+
+func (f *fakeCheckpoints) Restore(_ context.Context, key string) (bool, error) {
+	if !f.entries[key] {
+		return false, nil
+	}
+	f.restored = append(f.restored, key)
+	return true, nil
+}
+
+// Runs the steps of each stage the way executeOperation and buildStage
+// drive the cache, stopping at the step failAt names. Returns the steps
+// executed, as "stage/step".
+func simulateCachedBuild(t *testing.T, store *fakeCheckpoints, stages [][]string, failAt string) []string {
+	t.Helper()
+	ctx := context.Background()
+	final := map[string]string{}
+	var executed []string
+	for s, commands := range stages {
+		cache := newStepCache("sha256:base", "linux/amd64", "my-app", nil, final)
+		for i, command := range commands {
+			step := manifest.Step{Run: command}
+			key := cache.next(step, newStepState().resolve(step), "", nil)
+			hit, err := cache.hit(ctx, store, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hit {
+				continue
+			}
+			if err := cache.flush(ctx, store); err != nil {
+				t.Fatal(err)
+			}
+			name := fmt.Sprintf("%d/%d", s+1, i+1)
+			if name == failAt {
+				return executed
+			}
+			executed = append(executed, name)
+			if err := cache.record(ctx, store, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cache.flush(ctx, store); err != nil {
+			t.Fatal(err)
+		}
+		cache.finish(fmt.Sprintf("stage-%d", s+1), nil)
+	}
+	return executed
+}
+
+func TestStepCacheResume(t *testing.T) {
+	stages := [][]string{
+		{"apk add go", "go build"},
+		{"apk add ca-certificates"},
+		{"go test ./...", "go vet ./...", "strip app"},
+	}
+	store := &fakeCheckpoints{entries: map[string]bool{}}
+
+	first := simulateCachedBuild(t, store, stages, "3/2")
+	if want := []string{"1/1", "1/2", "2/1", "3/1"}; !slices.Equal(first, want) {
+		t.Fatalf("failed build executed %v, want %v", first, want)
+	}
+
+	second := simulateCachedBuild(t, store, stages, "")
+	if want := []string{"3/2", "3/3"}; !slices.Equal(second, want) {
+		t.Errorf("rerun executed %v, want %v", second, want)
+	}
+	if len(store.restored) != 3 {
+		t.Errorf("rerun restored %d entries, want one per stage: %v", len(store.restored), store.restored)
+	}
+
+	store.restored = nil
+	if third := simulateCachedBuild(t, store, stages, ""); len(third) != 0 {
+		t.Errorf("unchanged build executed %v", third)
+	}
+	if len(store.restored) != 3 {
+		t.Errorf("unchanged build restored %v, want the last entry of each stage", store.restored)
+	}
+
+	changed := slices.Clone(stages)
+	changed[1] = []string{"apk add ca-certificates tzdata"}
+	if got, want := simulateCachedBuild(t, store, changed, ""), []string{"2/1"}; !slices.Equal(got, want) {
+		t.Errorf("build with a changed stage executed %v, want %v", got, want)
+	}
+}
+
+func TestStepCacheFlushRemovedEntry(t *testing.T) {
+	ctx := context.Background()
+	store := &fakeCheckpoints{entries: map[string]bool{"k": true}}
+	cache := newStepCache("sha256:base", "linux/amd64", "my-app", nil, map[string]string{})
+	if hit, err := cache.hit(ctx, store, "k"); !hit || err != nil {
+		t.Fatalf("hit = %v, %v", hit, err)
+	}
+	delete(store.entries, "k")
+	if err := cache.flush(ctx, store); !errors.Is(err, runtime.ErrRuntime) {
+		t.Errorf("flush after the entry was removed = %v, want ErrRuntime", err)
+	}
+
+	var off *stepCache
+	if hit, err := off.hit(ctx, store, "k"); hit || err != nil {
+		t.Errorf("nil cache hit = %v, %v", hit, err)
+	}
+	if err := off.flush(ctx, store); err != nil {
+		t.Errorf("nil cache flush = %v", err)
+	}
+}
+
+func TestStepCacheResource(t *testing.T) {
+	store := &fakeCheckpoints{entries: map[string]bool{}}
+	simulateCachedBuild(t, store, [][]string{{"apk add go", "go build"}}, "")
+	simulateCachedBuild(t, store, [][]string{{"apk add go"}}, "")
+
+	if len(store.resources) != 5 {
+		t.Fatalf("store saw resources %v, want a lookup and a checkpoint per executed step and a lookup per hit", store.resources)
+	}
+	for _, resource := range store.resources {
+		if resource != "my-app" {
+			t.Errorf("entry used for resource %q, want my-app", resource)
+		}
+	}
+
+	clear(store.entries)
+	if got, want := simulateCachedBuild(t, store, [][]string{{"apk add go", "go build"}}, ""), []string{"1/1", "1/2"}; !slices.Equal(got, want) {
+		t.Errorf("build after the cache was cleared executed %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+// Removes a stage's cleanup paths from the container.
+//
+// Runs after the stage's last step and before the container is stopped and
+// committed, so temporary files and caches created during the build never
+// reach the exported layer. Missing paths are not an error.
+func cleanupStage(ctx context.Context, ctr *runtime.Container, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if err := ctr.RemoveAll(ctx, paths...); err != nil {
+		return crex.Wrapf(ErrBuild, "cleanup: %w", err)
+	}
+	return nil
+}
+
+// Checks the per-stage settings before any container is started.
+func validateStageOptions(stages map[string]StageOptions) error {
+	for key, opts := range stages {
+		if err := validateCleanupPaths(opts.Cleanup); err != nil {
+			return crex.Wrapf(ErrInvalidRecipe, "stage %q: %w", key, err)
+		}
+		limits := runtime.ContainerOptions{MemoryLimit: opts.MemoryLimit, CPUs: opts.CPUs}
+		if err := limits.Validate(); err != nil {
+			return crex.Wrapf(ErrInvalidOptions, "stage %q: %w", key, err)
+		}
+		if slices.ContainsFunc(opts.Verify, func(c string) bool { return strings.TrimSpace(c) == "" }) {
+			return crex.Wrapf(ErrInvalidOptions, "stage %q: empty verify command", key)
+		}
+	}
+	return nil
+}
+
+// Checks that cleanup paths are absolute and do not target the root.
+//
+// Relative paths would depend on the working directory of the cleanup
+// process, and removing "/" would empty the image, so both are rejected.
+func validateCleanupPaths(paths []string) error {
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			return crex.Wrapf(ErrBuild, "cleanup path %q must be absolute", path)
+		}
+		if filepath.Clean(path) == "/" {
+			return crex.Wrapf(ErrBuild, "cleanup path %q would remove the root filesystem", path)
+		}
+	}
+	return nil
+}
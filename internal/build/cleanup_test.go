@@ -0,0 +1,51 @@
+package build
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateCleanupPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "absolute paths", paths: []string{"/tmp/cache", "/root/.npm"}},
+		{name: "relative path", paths: []string{"cache"}, wantErr: true},
+		{name: "root", paths: []string{"/"}, wantErr: true},
+		{name: "root with dots", paths: []string{"/tmp/.."}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCleanupPaths(tt.paths)
+			if tt.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateStageOptions(t *testing.T) {
+	err := validateStageOptions(map[string]StageOptions{
+		"build": {Cleanup: []string{"/tmp"}},
+		"2":     {Cleanup: []string{"relative"}},
+	})
+	if !errors.Is(err, ErrInvalidRecipe) {
+		t.Fatalf("err = %v, want ErrInvalidRecipe", err)
+	}
+}
+
+func TestStageKey(t *testing.T) {
+	if got := stageKey("build", 0); got != "build" {
+		t.Fatalf("stageKey(build, 0) = %q, want build", got)
+	}
+	if got := stageKey("", 2); got != "3" {
+		t.Fatalf("stageKey(\"\", 2) = %q, want 3", got)
+	}
+}
@@ -3,27 +3,157 @@ package build
 import (
 	"archive/tar"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/cruciblehq/crex"
 	"github.com/cruciblehq/cruxd/internal/runtime"
 )
 
+// Flag of a copy string that sets the ownership of the copied files.
+const chownFlag = "--chown="
+
+// Permission bits of a tar header's mode, including setuid, setgid, and
+// sticky.
+const permBits = 07777
+
+// How copy steps treat symbolic links inside a copied host directory.
+type SymlinkPolicy string
+
+const (
+	SymlinksPreserve SymlinkPolicy = "preserve" // Copy links as links. The default.
+	SymlinksFollow   SymlinkPolicy = "follow"   // Copy what links point to in their place.
+)
+
+// Checks that the policy is one of the known values or empty.
+func (p SymlinkPolicy) validate() error {
+	switch p {
+	case "", SymlinksPreserve, SymlinksFollow:
+		return nil
+	}
+	return crex.Wrapf(ErrInvalidOptions, "unknown symlink policy %q", p)
+}
+
+// How host copies treat files with unsafe modes; see [modeCheck.check].
+type modeCheck struct {
+	strict bool      // Fail the copy instead of warning.
+	warn   *warnings // Collects the warnings. Nil only logs them.
+}
+
+// Numeric ownership applied to copied files.
+type owner struct {
+	uid int
+	gid int
+}
+
+// Overrides applied to every entry of a copy, from its flags. Nil fields
+// leave the entries as the source has them.
+type copyAttrs struct {
+	own  *owner // Ownership from --chown, or the recipe's default owner.
+	mode *int64 // Permission bits from --chmod.
+}
+
+// Applies the overrides to a tar header. The mode is not applied to
+// symbolic links, whose permissions are never used.
+func (a copyAttrs) apply(header *tar.Header) {
+	a.own.apply(header)
+	if a.mode != nil && header.Typeflag != tar.TypeSymlink {
+		header.Mode = header.Mode&^permBits | *a.mode
+	}
+}
+
+// Reports whether any override is set.
+func (a copyAttrs) set() bool {
+	return a.own != nil || a.mode != nil
+}
+
+// Settings shared by every source of a copy step.
+type copyOptions struct {
+	buildCtx    string                        // Directory host sources are resolved relative to.
+	stages      map[string]*runtime.Container // Named stage containers cross-stage sources are read from.
+	owner       *owner                        // Owner of the copied files when the copy has no --chown.
+	ignore      *ignoreRules                  // Rules leaving entries of host directories out.
+	followLinks bool                          // Whether links inside host directories are followed.
+	modes       modeCheck                     // How host files with unsafe modes are handled.
+}
+
 // Executes a copy operation, transferring files into the container.
 //
 // The copy string has the format "src dest" for host copies, or "stage:src
-// dest" for cross-stage copies. Host sources are resolved relative to the
-// build context. Cross-stage sources are read from a named stage container's
-// filesystem.
-func executeCopy(ctx context.Context, ctr *runtime.Container, copyStr, workdir, buildCtx string, stages map[string]*runtime.Container) error {
-	src, dest, err := parseCopy(copyStr, workdir)
+// dest" for cross-stage copies, optionally preceded by "--chown=UID:GID"
+// and "--chmod=MODE". Several sources may precede dest, and host sources
+// may be glob patterns; [expandCopySources] describes how dest is treated
+// in that case. A string with a "<<WORD" token in place of src writes its
+// own contents to dest instead; see [parseInlineCopy].
+//
+// Host sources are resolved relative to the build context. Cross-stage
+// sources are read from a named stage container's filesystem. Copied files
+// are owned by the flag's owner, or by opts.owner when the flag is absent.
+// With neither, host files keep their numeric owner and group on the host
+// and stage files keep their ownership in the source stage. Likewise,
+// --chmod sets the permissions of every copied file and directory, and
+// without it they are kept from the source. Symbolic links inside host
+// directories are followed when opts.followLinks is set. Entries of host
+// directories that match opts.ignore are left out. Host files with unsafe
+// modes are handled as opts.modes says.
+func executeCopy(ctx context.Context, ctr *runtime.Container, copyStr, workdir string, opts copyOptions) error {
+	inline, ok, err := parseInlineCopy(copyStr, workdir)
+	if err != nil {
+		return crex.Wrap(ErrCopy, err)
+	}
+	if ok {
+		if inline.own == nil {
+			inline.own = opts.owner
+		}
+		return executeInlineCopy(ctx, ctr, inline, opts.modes)
+	}
+
+	attrs, _, err := splitCopyFlags(copyStr)
+	if err != nil {
+		return crex.Wrap(ErrCopy, err)
+	}
+	if attrs.own == nil {
+		attrs.own = opts.owner
+	}
+
+	srcs, dest, err := parseCopy(copyStr, workdir)
+	if err != nil {
+		return crex.Wrap(ErrCopy, err)
+	}
+	if len(srcs) == 1 && !isGlob(srcs[0]) {
+		return copyOne(ctx, ctr, srcs[0], dest, attrs, opts)
+	}
+
+	sources, err := expandCopySources(srcs, opts.buildCtx, opts.ignore)
 	if err != nil {
+		return err
+	}
+	if err := ctr.MkdirAll(ctx, dest); err != nil {
 		return crex.Wrap(ErrCopy, err)
 	}
+	for _, src := range sources {
+		into, err := multiCopyDest(src, dest, opts.buildCtx)
+		if err != nil {
+			return crex.Wrap(ErrCopy, err)
+		}
+		if err := copyOne(ctx, ctr, src, into, attrs, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// Copies a single host or cross-stage source to dest.
+func copyOne(ctx context.Context, ctr *runtime.Container, src, dest string, attrs copyAttrs, opts copyOptions) error {
 	// Ensure the destination parent directory exists.
 	destDir := filepath.Dir(dest)
 	if destDir != "" {
@@ -34,51 +164,98 @@ func executeCopy(ctx context.Context, ctr *runtime.Container, copyStr, workdir,
 
 	// Cross-stage copy: "stage:path".
 	if stage, path, ok := parseStageCopy(src); ok {
-		return executeStageCopy(ctx, ctr, stages, stage, path, dest)
+		return executeStageCopy(ctx, ctr, opts.stages, stage, path, dest, attrs)
 	}
 
-	return executeHostCopy(ctx, ctr, src, dest, buildCtx)
+	return executeHostCopy(ctx, ctr, src, dest, attrs, opts)
 }
 
 // Copies a file or directory from the host into the container.
-func executeHostCopy(ctx context.Context, ctr *runtime.Container, src, dest, buildCtx string) error {
-	if !filepath.IsAbs(src) {
-		src = filepath.Join(buildCtx, src)
+//
+// A file is written to dest. For a directory, see [hostCopyTarget] for how
+// a trailing slash on src decides whether the directory itself or only its
+// contents are copied. A source that is itself a symbolic link is always
+// followed; opts.followLinks applies to the links inside a copied
+// directory. Ignore rules apply to what is inside a copied directory, never
+// to src itself, so a source named explicitly is always copied.
+func executeHostCopy(ctx context.Context, ctr *runtime.Container, src, dest string, attrs copyAttrs, opts copyOptions) error {
+	hostSrc := src
+	if !filepath.IsAbs(hostSrc) {
+		hostSrc = filepath.Join(opts.buildCtx, hostSrc)
 	}
 
-	info, err := os.Stat(src)
+	info, err := os.Stat(hostSrc)
 	if err != nil {
 		return crex.Wrap(ErrCopy, err)
 	}
 
+	destDir, name := hostCopyTarget(src, dest, info.IsDir())
+	if destDir != filepath.Dir(dest) {
+		if err := ctr.MkdirAll(ctx, destDir); err != nil {
+			return crex.Wrap(ErrCopy, err)
+		}
+	}
+
 	pr, pw := io.Pipe()
 
+	errc := make(chan error, 1)
 	go func() {
 		tw := tar.NewWriter(pw)
-		var writeErr error
-
-		if info.IsDir() {
-			writeErr = writeDirToTar(tw, src, filepath.Base(dest))
-		} else {
-			writeErr = writeFileToTar(tw, src, filepath.Base(dest))
-		}
-
+		writeErr := writeHostSource(tw, hostSrc, name, info, attrs, opts.ignore.scope(opts.buildCtx, hostSrc), opts.followLinks, opts.modes)
 		tw.Close()
 		pw.CloseWithError(writeErr)
+		errc <- writeErr
 	}()
 
-	if err := ctr.CopyTo(ctx, pr, filepath.Dir(dest)); err != nil {
-		return crex.Wrap(ErrCopy, err)
+	copyErr := ctr.CopyTo(ctx, pr, destDir)
+
+	// Unblock the writer if the container stopped reading early, whether it
+	// failed or tar exited before consuming the archive's trailing padding.
+	pr.CloseWithError(copyErr)
+
+	// A failure to read the source also fails or truncates the extraction,
+	// so it is reported in preference to the container's error.
+	writeErr := <-errc
+	if writeErr != nil && (copyErr != nil || !errors.Is(writeErr, io.ErrClosedPipe)) {
+		return crex.Wrap(ErrCopy, writeErr)
+	}
+	if copyErr != nil {
+		return crex.Wrap(ErrCopy, copyErr)
 	}
 
 	return nil
 }
 
+// Writes the file or directory tree of a host copy to a tar writer under
+// the given archive name.
+func writeHostSource(tw *tar.Writer, hostSrc, name string, info os.FileInfo, attrs copyAttrs, scope ignoreScope, followLinks bool, modes modeCheck) error {
+	if info.IsDir() {
+		return writeDirToTar(tw, hostSrc, name, attrs, scope, followLinks, modes)
+	}
+	return writeFileToTar(tw, hostSrc, name, attrs, modes)
+}
+
+// Returns the container directory a host copy is extracted into and the
+// archive name of the copied file or directory.
+//
+// Directories follow rsync-style semantics. A source ending in a slash, or
+// naming "." such as the build context root, copies the directory's
+// contents into dest: "src/ /app" produces /app/main.go. Without the slash
+// the directory itself is copied into dest: "src /app" produces
+// /app/src/main.go. A file is always written to dest itself.
+func hostCopyTarget(src, dest string, isDir bool) (destDir, name string) {
+	if isDir && !strings.HasSuffix(src, "/") && filepath.Base(src) != "." {
+		return dest, filepath.Base(src)
+	}
+	return filepath.Dir(dest), filepath.Base(dest)
+}
+
 // Copies a path from a named stage container into the target container.
 //
 // The tar stream is piped directly from the source container's CopyFrom
-// to the target container's CopyTo.
-func executeStageCopy(ctx context.Context, ctr *runtime.Container, stages map[string]*runtime.Container, stage, path, dest string) error {
+// to the target container's CopyTo. When an owner or mode is given, the
+// entries are rewritten to it on the way through.
+func executeStageCopy(ctx context.Context, ctr *runtime.Container, stages map[string]*runtime.Container, stage, path, dest string, attrs copyAttrs) error {
 	srcCtr, ok := stages[stage]
 	if !ok {
 		return crex.Wrapf(ErrCopy, "unknown stage %q", stage)
@@ -92,14 +269,42 @@ func executeStageCopy(ctx context.Context, ctr *runtime.Container, stages map[st
 		pw.Close()
 	}()
 
-	if err := ctr.CopyTo(ctx, pr, filepath.Dir(dest)); err != nil {
-		return crex.Wrap(ErrCopy, err)
+	if attrs.set() {
+		src := pr
+		var cw *io.PipeWriter
+		pr, cw = io.Pipe()
+		go func() {
+			err := rewriteTar(cw, src, attrs)
+			src.CloseWithError(err)
+			cw.CloseWithError(err)
+		}()
 	}
 
-	if err := <-errc; err != nil {
-		return crex.Wrap(ErrCopy, err)
+	dstErr := ctr.CopyTo(ctx, pr, filepath.Dir(dest))
+	if dstErr != nil {
+		// Unblock the source if the destination stopped reading early.
+		pr.CloseWithError(dstErr)
 	}
+	srcErr := <-errc
 
+	return stageCopyError(stage, path, dest, srcErr, dstErr)
+}
+
+// Describes the failure of a cross-stage copy.
+//
+// Each side of the copy can fail: the source stage archiving path, or the
+// target container extracting it. When the source fails, the target usually
+// fails too because its input ends early, so the source error is reported
+// as the cause. Returns nil when neither side failed.
+func stageCopyError(stage, path, dest string, srcErr, dstErr error) error {
+	switch {
+	case errors.Is(srcErr, runtime.ErrPathNotFound):
+		return crex.Wrapf(ErrCopy, "stage %q has no %s, check that the stage produces it: %w", stage, path, srcErr)
+	case srcErr != nil:
+		return crex.Wrapf(ErrCopy, "reading %s from stage %q: %w", path, stage, srcErr)
+	case dstErr != nil:
+		return crex.Wrapf(ErrCopy, "writing %s:%s to %s: %w", stage, path, dest, dstErr)
+	}
 	return nil
 }
 
@@ -123,39 +328,233 @@ func parseStageCopy(src string) (stage, path string, ok bool) {
 
 // Parses a copy string into source and destination paths.
 //
-// The string must contain exactly two whitespace-separated tokens. If dest
-// is not absolute, it is joined with workdir.
-func parseCopy(s, workdir string) (src, dest string, err error) {
-	parts := strings.Fields(s)
-	if len(parts) != 2 {
-		return "", "", crex.Wrapf(ErrCopy, "missing source or destination in %q", s)
+// Apart from the flags handled by [splitCopyFlags], the string must contain
+// at least two whitespace-separated tokens: one or more sources followed by
+// the destination. If dest is not absolute, it is joined with workdir.
+func parseCopy(s, workdir string) (srcs []string, dest string, err error) {
+	_, parts, err := splitCopyFlags(s)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(parts) < 2 {
+		return nil, "", crex.Wrapf(ErrCopy, "missing source or destination in %q", s)
 	}
 
-	src = parts[0]
-	dest = parts[1]
+	srcs = parts[:len(parts)-1]
+	dest = parts[len(parts)-1]
 
 	if !filepath.IsAbs(dest) {
 		if workdir == "" {
-			return "", "", crex.Wrapf(ErrCopy, "relative dest %q requires workdir", dest)
+			return nil, "", crex.Wrapf(ErrCopy, "relative dest %q requires workdir", dest)
 		}
 		dest = filepath.Join(workdir, dest)
 	}
 
-	return src, dest, nil
+	return srcs, dest, nil
+}
+
+// Reports whether a copy source is a glob pattern, in the syntax of
+// [filepath.Match].
+func isGlob(src string) bool {
+	return strings.ContainsAny(src, "*?[")
+}
+
+// Expands the glob patterns among the sources of a copy.
+//
+// This applies to copies with several sources or a glob pattern among
+// them, whose dest is always a directory that every source is copied into,
+// however many paths the patterns match; see [multiCopyDest]. A pattern is
+// matched relative to the build context unless it is absolute, and its
+// matches are listed in lexical order, leaving out paths the ignore rules
+// exclude. A pattern that matches nothing fails the copy. Cross-stage
+// sources and plain paths are kept as they are.
+func expandCopySources(srcs []string, buildCtx string, ignore *ignoreRules) ([]string, error) {
+	var sources []string
+	for _, src := range srcs {
+		if _, _, ok := parseStageCopy(src); ok || !isGlob(src) {
+			sources = append(sources, src)
+			continue
+		}
+
+		pattern := src
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(buildCtx, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, crex.Wrapf(ErrCopy, "invalid pattern %q: %w", src, err)
+		}
+
+		found := false
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, crex.Wrap(ErrCopy, err)
+			}
+			if ignore.scope(buildCtx, match).excluded(info.IsDir()) {
+				continue
+			}
+			if !filepath.IsAbs(src) {
+				if match, err = filepath.Rel(buildCtx, match); err != nil {
+					return nil, crex.Wrap(ErrCopy, err)
+				}
+			}
+			sources = append(sources, match)
+			found = true
+		}
+		if !found {
+			return nil, crex.Wrapf(ErrCopy, "%q matches nothing in the build context", src)
+		}
+	}
+	return sources, nil
+}
+
+// Returns the destination that one source of a multi-source copy is
+// copied to, given the directory dest they are all copied into.
+//
+// Files and cross-stage paths keep their name inside dest. Directories are
+// copied as if dest were their only destination, so "src" lands in
+// dest/src and "src/" has its contents copied into dest; see
+// [hostCopyTarget].
+func multiCopyDest(src, dest, buildCtx string) (string, error) {
+	if _, p, ok := parseStageCopy(src); ok {
+		return filepath.Join(dest, path.Base(p)), nil
+	}
+	hostSrc := src
+	if !filepath.IsAbs(hostSrc) {
+		hostSrc = filepath.Join(buildCtx, hostSrc)
+	}
+	info, err := os.Stat(hostSrc)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return dest, nil
+	}
+	return filepath.Join(dest, filepath.Base(src)), nil
+}
+
+// Returns the destination of a regular or inline copy string.
+func copyDest(s, workdir string) (string, error) {
+	inline, ok, err := parseInlineCopy(s, workdir)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return inline.dest, nil
+	}
+	_, dest, err := parseCopy(s, workdir)
+	return dest, err
+}
+
+// Separates the leading flags of a copy string from its paths.
+//
+// The flags are "--chown=UID:GID" and "--chmod=MODE". Returns the overrides
+// they set and the remaining tokens.
+func splitCopyFlags(s string) (copyAttrs, []string, error) {
+	parts := strings.Fields(s)
+	var attrs copyAttrs
+	for len(parts) > 0 && strings.HasPrefix(parts[0], "--") {
+		if value, ok := strings.CutPrefix(parts[0], chownFlag); ok {
+			own, err := parseOwner(value)
+			if err != nil {
+				return copyAttrs{}, nil, err
+			}
+			attrs.own = own
+		} else if value, ok := strings.CutPrefix(parts[0], chmodFlag); ok {
+			mode, err := parseMode(value)
+			if err != nil {
+				return copyAttrs{}, nil, err
+			}
+			attrs.mode = &mode
+		} else {
+			return copyAttrs{}, nil, crex.Wrapf(ErrCopy, "unknown flag %q in %q", parts[0], s)
+		}
+		parts = parts[1:]
+	}
+	return attrs, parts, nil
+}
+
+// Parses an ownership of the form "UID:GID", or a lone "UID" that is used
+// for the group too. Returns nil for an empty string.
+//
+// Only numeric IDs are accepted, because names would have to be resolved
+// against the container's /etc/passwd and /etc/group.
+func parseOwner(s string) (*owner, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, g, found := strings.Cut(s, ":")
+	if !found {
+		g = u
+	}
+	uid, err := strconv.ParseUint(u, 10, 31)
+	if err != nil {
+		return nil, crex.Wrapf(ErrCopy, "invalid owner %q: user must be a numeric ID", s)
+	}
+	gid, err := strconv.ParseUint(g, 10, 31)
+	if err != nil {
+		return nil, crex.Wrapf(ErrCopy, "invalid owner %q: group must be a numeric ID", s)
+	}
+	return &owner{uid: int(uid), gid: int(gid)}, nil
+}
+
+// Sets the ownership of a tar header. A nil owner leaves it unchanged.
+//
+// The user and group names are cleared so that extraction uses the numeric
+// IDs instead of looking the names up in the container.
+func (o *owner) apply(header *tar.Header) {
+	if o == nil {
+		return
+	}
+	header.Uid = o.uid
+	header.Gid = o.gid
+	header.Uname = ""
+	header.Gname = ""
+}
+
+// Copies a tar stream from r to w, applying the overrides to every entry.
+//
+// Anything after the end of the archive, such as block padding, is read and
+// discarded so that the writer feeding r is never blocked.
+func rewriteTar(w io.Writer, r io.Reader, attrs copyAttrs) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return err
+			}
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		attrs.apply(header)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
 }
 
 // Writes a single file to a tar writer with the given archive name.
-func writeFileToTar(tw *tar.Writer, hostPath, name string) error {
+func writeFileToTar(tw *tar.Writer, hostPath, name string, attrs copyAttrs, modes modeCheck) error {
 	info, err := os.Stat(hostPath)
 	if err != nil {
 		return err
 	}
-
-	header, err := tar.FileInfoHeader(info, "")
+	header, err := hostHeader(info, name, "")
 	if err != nil {
 		return err
 	}
-	header.Name = name
+	attrs.apply(header)
+	if err := modes.check(header); err != nil {
+		return err
+	}
 
 	if err := tw.WriteHeader(header); err != nil {
 		return err
@@ -172,34 +571,95 @@ func writeFileToTar(tw *tar.Writer, hostPath, name string) error {
 }
 
 // Writes a directory tree to a tar writer rooted at the given archive prefix.
-func writeDirToTar(tw *tar.Writer, hostDir, prefix string) error {
-	return filepath.WalkDir(hostDir, func(path string, d os.DirEntry, err error) error {
+//
+// The directory itself is always read through, even when hostDir is a
+// symbolic link. Links inside the tree are stored as links unless follow is
+// set, in which case the file or directory they point to is copied in their
+// place. A followed link that leads back to a directory already being
+// copied fails with [ErrSymlinkLoop], since the copy would never end.
+// Entries below hostDir that the scope's ignore rules exclude are skipped,
+// along with everything inside them; links are matched as links, whether
+// or not they are followed. Entries with unsafe modes are checked as in
+// [modeCheck.check].
+func writeDirToTar(tw *tar.Writer, hostDir, prefix string, attrs copyAttrs, scope ignoreScope, follow bool, modes modeCheck) error {
+	info, err := os.Stat(hostDir)
+	if err != nil {
+		return err
+	}
+	return writeTree(tw, hostDir, prefix, info, attrs, scope, follow, modes, nil)
+}
+
+// Writes hostPath and, for a directory, everything below it. The ancestors
+// are the resolved directories above hostPath, tracked only when following
+// links.
+func writeTree(tw *tar.Writer, hostPath, archivePath string, info os.FileInfo, attrs copyAttrs, scope ignoreScope, follow bool, modes modeCheck, ancestors []string) error {
+	if follow && info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(hostPath)
+		if errors.Is(err, syscall.ELOOP) {
+			return crex.Wrapf(ErrSymlinkLoop, "%s: %w", hostPath, err)
+		}
 		if err != nil {
 			return err
 		}
+		info = target
+	}
 
-		relPath, err := filepath.Rel(hostDir, path)
+	if info.IsDir() && follow {
+		resolved, err := filepath.EvalSymlinks(hostPath)
 		if err != nil {
 			return err
 		}
+		if slices.Contains(ancestors, resolved) {
+			return crex.Wrapf(ErrSymlinkLoop, "%s leads back to %s", hostPath, resolved)
+		}
+		ancestors = append(ancestors, resolved)
+	}
 
-		archivePath := filepath.ToSlash(filepath.Join(prefix, relPath))
-		return writeTarEntry(tw, path, archivePath, d)
-	})
-}
+	if err := writeTarEntry(tw, hostPath, archivePath, info, attrs, modes); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
 
-// Writes a single file or directory entry to a tar writer.
-func writeTarEntry(tw *tar.Writer, hostPath, archivePath string, d os.DirEntry) error {
-	info, err := d.Info()
+	entries, err := os.ReadDir(hostPath)
 	if err != nil {
 		return err
 	}
+	for _, e := range entries {
+		child, err := e.Info()
+		if err != nil {
+			return err
+		}
+		childScope := scope.child(e.Name())
+		if childScope.excluded(child.IsDir()) {
+			continue
+		}
+		if err := writeTree(tw, filepath.Join(hostPath, e.Name()), path.Join(archivePath, e.Name()), child, attrs, childScope, follow, modes, ancestors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	header, err := tar.FileInfoHeader(info, "")
+// Writes a single file, directory, or symbolic link entry to a tar writer.
+func writeTarEntry(tw *tar.Writer, hostPath, archivePath string, info os.FileInfo, attrs copyAttrs, modes modeCheck) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(hostPath); err != nil {
+			return err
+		}
+	}
+
+	header, err := hostHeader(info, archivePath, link)
 	if err != nil {
 		return err
 	}
-	header.Name = archivePath
+	attrs.apply(header)
+	if err := modes.check(header); err != nil {
+		return err
+	}
 
 	if err := tw.WriteHeader(header); err != nil {
 		return err
@@ -217,3 +677,65 @@ func writeTarEntry(tw *tar.Writer, hostPath, archivePath string, d os.DirEntry)
 
 	return nil
 }
+
+// Returns the tar header of a host file under the given archive name.
+//
+// The header keeps the file's mode and its numeric owner and group. The
+// user and group names looked up on the host are dropped, since extraction
+// would otherwise map them through the container's /etc/passwd and
+// /etc/group, where the same names may stand for other IDs or not exist.
+func hostHeader(info os.FileInfo, name, link string) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	header.Uname = ""
+	header.Gname = ""
+	return header, nil
+}
+
+// Reports a copied file whose mode is unsafe to ship in an image.
+//
+// The mode is taken from the file's tar header once the copy's --chmod has
+// been applied, so it is the mode the file lands with in the container.
+// Setuid and setgid files run with their owner's privileges, and anyone in
+// the container can replace a world-writable file, so either is rarely
+// meant to land in a production image. World-writable directories with the
+// sticky bit, such as /tmp, are the usual exception and are accepted. Such
+// files are logged and recorded as a build warning, or fail with
+// [ErrUnsafeFileMode] when the check is strict. Symbolic links always carry
+// full permissions and are not checked.
+func (m modeCheck) check(header *tar.Header) error {
+	name, mode := header.Name, header.FileInfo().Mode()
+	problems := unsafeModeBits(mode)
+	if len(problems) == 0 {
+		return nil
+	}
+	description := fmt.Sprintf("%s is %s (%s)", name, strings.Join(problems, " and "), mode)
+	if m.strict {
+		return crex.Wrapf(ErrUnsafeFileMode, "%s", description)
+	}
+	slog.Warn("copied file has unsafe mode", "path", name, "mode", mode.String(), "bits", problems)
+	m.warn.add(WarnUnsafeFileMode, "copied file "+description, map[string]string{"path": name, "mode": mode.String()})
+	return nil
+}
+
+// Returns the unsafe bits set in mode, in the order setuid, setgid,
+// world-writable.
+func unsafeModeBits(mode os.FileMode) []string {
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	var problems []string
+	if mode&os.ModeSetuid != 0 {
+		problems = append(problems, "setuid")
+	}
+	if mode&os.ModeSetgid != 0 {
+		problems = append(problems, "setgid")
+	}
+	if mode.Perm()&0002 != 0 && !(mode.IsDir() && mode&os.ModeSticky != 0) {
+		problems = append(problems, "world-writable")
+	}
+	return problems
+}
@@ -1,7 +1,18 @@
 package build
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
 )
 
 func TestParseCopy(t *testing.T) {
@@ -10,6 +21,7 @@ func TestParseCopy(t *testing.T) {
 		input   string
 		workdir string
 		src     string
+		srcs    []string // Expected sources when there are several; src otherwise.
 		dest    string
 		wantErr bool
 	}{
@@ -31,13 +43,30 @@ func TestParseCopy(t *testing.T) {
 			input:   "file.txt out/",
 			wantErr: true,
 		},
+		{
+			name:  "chown flag",
+			input: "--chown=1000:1000 file.txt /opt/file.txt",
+			src:   "file.txt",
+			dest:  "/opt/file.txt",
+		},
+		{
+			name:    "unknown flag",
+			input:   "--mode=0644 file.txt /opt/file.txt",
+			wantErr: true,
+		},
 		{
 			name:    "missing destination",
 			input:   "file.txt",
 			wantErr: true,
 		},
 		{
-			name:    "too many tokens",
+			name:  "multiple sources",
+			input: "a.txt b.txt /opt/",
+			srcs:  []string{"a.txt", "b.txt"},
+			dest:  "/opt/",
+		},
+		{
+			name:    "multiple sources with relative dest and no workdir",
 			input:   "a b c",
 			wantErr: true,
 		},
@@ -50,7 +79,7 @@ func TestParseCopy(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			src, dest, err := parseCopy(tt.input, tt.workdir)
+			srcs, dest, err := parseCopy(tt.input, tt.workdir)
 			if tt.wantErr {
 				if err == nil {
 					t.Fatal("expected error, got nil")
@@ -60,7 +89,16 @@ func TestParseCopy(t *testing.T) {
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
-			assertParseCopy(t, src, dest, tt.src, tt.dest)
+			if tt.srcs != nil {
+				if !slices.Equal(srcs, tt.srcs) || dest != tt.dest {
+					t.Errorf("parseCopy = (%q, %q), want (%q, %q)", srcs, dest, tt.srcs, tt.dest)
+				}
+				return
+			}
+			if len(srcs) != 1 {
+				t.Fatalf("srcs = %q, want one source", srcs)
+			}
+			assertParseCopy(t, srcs[0], dest, tt.src, tt.dest)
 		})
 	}
 }
@@ -75,6 +113,88 @@ func assertParseCopy(t *testing.T, gotSrc, gotDest, wantSrc, wantDest string) {
 	}
 }
 
+func TestExpandCopySources(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{"a.txt", "b.txt", "notes.md", "docs/guide.txt", "skip.txt"} {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignore, err := parseIgnore([]byte("skip.txt\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		srcs    []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "glob", srcs: []string{"*.txt"}, want: []string{"a.txt", "b.txt"}},
+		{name: "nested glob", srcs: []string{"docs/*.txt"}, want: []string{"docs/guide.txt"}},
+		{name: "plain paths", srcs: []string{"notes.md", "docs"}, want: []string{"notes.md", "docs"}},
+		{name: "mixed", srcs: []string{"notes.md", "*.txt", "build:/out/app"}, want: []string{"notes.md", "a.txt", "b.txt", "build:/out/app"}},
+		{name: "absolute glob", srcs: []string{filepath.Join(root, "a.*")}, want: []string{filepath.Join(root, "a.txt")}},
+		{name: "no match", srcs: []string{"*.go"}, wantErr: true},
+		{name: "only ignored matches", srcs: []string{"skip.*"}, wantErr: true},
+		{name: "bad pattern", srcs: []string{"[a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandCopySources(tt.srcs, root, ignore)
+			if tt.wantErr {
+				if !errors.Is(err, ErrCopy) {
+					t.Fatalf("err = %v, want ErrCopy", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sources = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiCopyDest(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{src: "a.txt", want: "/dest/a.txt"},
+		{src: "src", want: "/dest"},
+		{src: "build:/out/app", want: "/dest/app"},
+	}
+	for _, tt := range tests {
+		got, err := multiCopyDest(tt.src, "/dest", root)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.src, err)
+		}
+		if got != tt.want {
+			t.Errorf("multiCopyDest(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+	// A directory copied into dest as itself lands in dest/src.
+	if destDir, name := hostCopyTarget("src", "/dest", true); destDir != "/dest" || name != "src" {
+		t.Errorf("directory target = (%q, %q)", destDir, name)
+	}
+}
+
 func TestParseStageCopy(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -130,3 +250,581 @@ func TestParseStageCopy(t *testing.T) {
 		})
 	}
 }
+
+func TestStageCopyError(t *testing.T) {
+	missing := fmt.Errorf("/app/bin/server: %w", runtime.ErrPathNotFound)
+	extract := errors.New("tar extract into /usr/local/bin failed with exit code 1 (unexpected EOF)")
+	archive := errors.New("tar archive of /app/bin failed with exit code 2 (permission denied)")
+
+	tests := []struct {
+		name     string
+		srcErr   error
+		dstErr   error
+		wantErr  error
+		contains []string
+	}{
+		{name: "success"},
+		{
+			name:     "missing source path",
+			srcErr:   missing,
+			dstErr:   extract,
+			wantErr:  runtime.ErrPathNotFound,
+			contains: []string{`stage "build"`, "/app/bin/server"},
+		},
+		{
+			name:     "source archive failure",
+			srcErr:   archive,
+			dstErr:   extract,
+			wantErr:  ErrCopy,
+			contains: []string{"reading /app/bin/server", "permission denied"},
+		},
+		{
+			name:     "destination extract failure",
+			dstErr:   extract,
+			wantErr:  ErrCopy,
+			contains: []string{"writing build:/app/bin/server to /usr/local/bin/server", "unexpected EOF"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := stageCopyError("build", "/app/bin/server", "/usr/local/bin/server", tt.srcErr, tt.dstErr)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) || !errors.Is(err, ErrCopy) {
+				t.Fatalf("err = %v, want %v and ErrCopy", err, tt.wantErr)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(err.Error(), s) {
+					t.Errorf("error %q does not contain %q", err, s)
+				}
+			}
+		})
+	}
+}
+
+func TestHostCopyTarget(t *testing.T) {
+	tests := []struct {
+		name        string
+		src         string
+		dest        string
+		isDir       bool
+		wantDestDir string
+		wantName    string
+	}{
+		{name: "directory itself", src: "src", dest: "/app", isDir: true, wantDestDir: "/app", wantName: "src"},
+		{name: "nested directory itself", src: "cmd/server", dest: "/app", isDir: true, wantDestDir: "/app", wantName: "server"},
+		{name: "directory contents", src: "src/", dest: "/app", isDir: true, wantDestDir: "/", wantName: "app"},
+		{name: "nested directory contents", src: "src/", dest: "/opt/app", isDir: true, wantDestDir: "/opt", wantName: "app"},
+		{name: "context root", src: ".", dest: "/app", isDir: true, wantDestDir: "/", wantName: "app"},
+		{name: "dot suffix", src: "src/.", dest: "/app", isDir: true, wantDestDir: "/", wantName: "app"},
+		{name: "file", src: "main.go", dest: "/app/main.go", wantDestDir: "/app", wantName: "main.go"},
+		{name: "renamed file", src: "config.prod.yaml", dest: "/etc/app.yaml", wantDestDir: "/etc", wantName: "app.yaml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destDir, name := hostCopyTarget(tt.src, tt.dest, tt.isDir)
+			if destDir != tt.wantDestDir || name != tt.wantName {
+				t.Errorf("hostCopyTarget(%q, %q) = (%q, %q), want (%q, %q)", tt.src, tt.dest, destDir, name, tt.wantDestDir, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestWriteDirToTar(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(dir, "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pkg", "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{name: "directory itself", src: "src", want: []string{"src", "src/pkg", "src/pkg/main.go"}},
+		{name: "directory contents", src: "src/", want: []string{"app", "app/pkg", "app/pkg/main.go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, prefix := hostCopyTarget(tt.src, "/app", true)
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := writeDirToTar(tw, dir, prefix, copyAttrs{}, ignoreScope{}, false, modeCheck{}); err != nil {
+				t.Fatal(err)
+			}
+			tw.Close()
+
+			var names []string
+			tr := tar.NewReader(&buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, h.Name)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("entries = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    *owner
+		wantErr bool
+	}{
+		{input: ""},
+		{input: "1000:1000", want: &owner{uid: 1000, gid: 1000}},
+		{input: "1000:50", want: &owner{uid: 1000, gid: 50}},
+		{input: "0:0", want: &owner{}},
+		{input: "65534", want: &owner{uid: 65534, gid: 65534}},
+		{input: "app:app", wantErr: true},
+		{input: "1000:", wantErr: true},
+		{input: "-1:0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseOwner(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseOwner(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitCopyFlags(t *testing.T) {
+	attrs, parts, err := splitCopyFlags("--chown=1000:100 --chmod=0750 src /app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attrs.own == nil || *attrs.own != (owner{uid: 1000, gid: 100}) {
+		t.Errorf("owner = %+v", attrs.own)
+	}
+	if attrs.mode == nil || *attrs.mode != 0750 {
+		t.Errorf("mode = %v", attrs.mode)
+	}
+	if !slices.Equal(parts, []string{"src", "/app"}) {
+		t.Errorf("parts = %v", parts)
+	}
+
+	attrs, _, err = splitCopyFlags("src /app")
+	if err != nil || attrs.set() {
+		t.Errorf("no flag: attrs = %+v, err = %v", attrs, err)
+	}
+
+	for _, s := range []string{"--chmod=0999 src /app", "--chmod=rwx src /app", "--mode=0644 src /app"} {
+		if _, _, err := splitCopyFlags(s); err == nil {
+			t.Errorf("splitCopyFlags(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestCopyPreservesSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tool"), []byte("#!/bin/sh"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "tool"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("tool", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := writeDirToTar(tw, dir, "app", copyAttrs{}, ignoreScope{}, false, modeCheck{}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	headers := make(map[string]*tar.Header)
+	for _, h := range tarHeaders(t, &buf) {
+		headers[h.Name] = h
+	}
+	tool := headers["app/tool"]
+	if tool == nil || tool.Mode&permBits != 0750 {
+		t.Fatalf("tool = %+v, want mode 0750", tool)
+	}
+	if tool.Uid != os.Getuid() || tool.Gid != os.Getgid() {
+		t.Errorf("tool owned by %d:%d, want the host's %d:%d", tool.Uid, tool.Gid, os.Getuid(), os.Getgid())
+	}
+	if tool.Uname != "" || tool.Gname != "" {
+		t.Errorf("tool names %q:%q not cleared", tool.Uname, tool.Gname)
+	}
+	if link := headers["app/link"]; link == nil || link.Typeflag != tar.TypeSymlink || link.Linkname != "tool" {
+		t.Errorf("link = %+v, want a symlink to tool", link)
+	}
+}
+
+func TestCopyAttrsMode(t *testing.T) {
+	mode := int64(0700)
+	attrs := copyAttrs{mode: &mode}
+
+	tests := []struct {
+		name   string
+		header tar.Header
+		want   int64
+	}{
+		{name: "file", header: tar.Header{Typeflag: tar.TypeReg, Mode: 0644}, want: 0700},
+		{name: "setuid dropped", header: tar.Header{Typeflag: tar.TypeReg, Mode: 04755}, want: 0700},
+		{name: "directory", header: tar.Header{Typeflag: tar.TypeDir, Mode: 040755}, want: 040700},
+		{name: "symlink untouched", header: tar.Header{Typeflag: tar.TypeSymlink, Mode: 0777}, want: 0777},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.header
+			attrs.apply(&h)
+			if h.Mode != tt.want {
+				t.Errorf("mode = %o, want %o", h.Mode, tt.want)
+			}
+		})
+	}
+}
+
+// Returns the uid and gid of each tar entry, keyed by name.
+func tarOwners(t *testing.T, r io.Reader) map[string][2]int {
+	t.Helper()
+	owners := make(map[string][2]int)
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return owners
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Uname != "" || h.Gname != "" {
+			t.Errorf("%s: names %q:%q not cleared", h.Name, h.Uname, h.Gname)
+		}
+		owners[h.Name] = [2]int{h.Uid, h.Gid}
+	}
+}
+
+func TestCopyOwnership(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(file, []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	own := &owner{uid: 1000, gid: 1001}
+
+	var dirTar bytes.Buffer
+	tw := tar.NewWriter(&dirTar)
+	if err := writeDirToTar(tw, dir, "app", copyAttrs{own: own}, ignoreScope{}, false, modeCheck{}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	for name, ids := range tarOwners(t, bytes.NewReader(dirTar.Bytes())) {
+		if ids != [2]int{1000, 1001} {
+			t.Errorf("directory copy: %s owned by %v", name, ids)
+		}
+	}
+
+	var fileTar bytes.Buffer
+	tw = tar.NewWriter(&fileTar)
+	if err := writeFileToTar(tw, file, "main.go", copyAttrs{own: own}, modeCheck{}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	if ids := tarOwners(t, &fileTar)["main.go"]; ids != [2]int{1000, 1001} {
+		t.Errorf("file copy: owned by %v", ids)
+	}
+
+	var rewritten bytes.Buffer
+	if err := rewriteTar(&rewritten, &dirTar, copyAttrs{own: &owner{uid: 2000, gid: 2000}}); err != nil {
+		t.Fatal(err)
+	}
+	owners := tarOwners(t, &rewritten)
+	if len(owners) != 2 {
+		t.Fatalf("rewritten archive has %d entries, want 2", len(owners))
+	}
+	for name, ids := range owners {
+		if ids != [2]int{2000, 2000} {
+			t.Errorf("stage copy: %s owned by %v", name, ids)
+		}
+	}
+}
+
+// Returns the headers of a tar archive in order.
+func tarHeaders(t *testing.T, r io.Reader) []*tar.Header {
+	t.Helper()
+	var headers []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, h)
+	}
+}
+
+func TestWriteDirToTarSymlinks(t *testing.T) {
+	root := t.TempDir()
+	shared := filepath.Join(root, "shared")
+	if err := os.MkdirAll(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(shared, "lib.go"), []byte("package lib"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(root, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../shared", filepath.Join(src, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlinked copy source is read through under either policy.
+	linked := filepath.Join(root, "linked")
+	if err := os.Symlink("src", linked); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		follow bool
+		want   []string
+	}{
+		{name: "preserve", want: []string{"app", "app/lib -> ../shared"}},
+		{name: "follow", follow: true, want: []string{"app", "app/lib", "app/lib/lib.go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := writeDirToTar(tw, linked, "app", copyAttrs{}, ignoreScope{}, tt.follow, modeCheck{}); err != nil {
+				t.Fatal(err)
+			}
+			tw.Close()
+
+			var got []string
+			for _, h := range tarHeaders(t, &buf) {
+				name := h.Name
+				if h.Typeflag == tar.TypeSymlink {
+					name += " -> " + h.Linkname
+				}
+				got = append(got, name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteDirToTarSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "a", "up")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("self", filepath.Join(dir, "self")); err != nil {
+		t.Fatal(err)
+	}
+
+	tw := tar.NewWriter(io.Discard)
+	if err := writeDirToTar(tw, dir, "app", copyAttrs{}, ignoreScope{}, false, modeCheck{}); err != nil {
+		t.Fatalf("preserving links: unexpected error: %v", err)
+	}
+
+	err := writeDirToTar(tar.NewWriter(io.Discard), dir, "app", copyAttrs{}, ignoreScope{}, true, modeCheck{})
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("following links: expected ErrSymlinkLoop, got %v", err)
+	}
+}
+
+func TestResolveRoot(t *testing.T) {
+	dir := t.TempDir()
+	want, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "context")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolveRoot(link)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != want {
+		t.Errorf("resolveRoot(%q) = %q, want %q", link, got, want)
+	}
+
+	if got, err := resolveRoot(""); err != nil || got != "" {
+		t.Errorf("resolveRoot(\"\") = %q, %v", got, err)
+	}
+	if _, err := resolveRoot(filepath.Join(dir, "missing")); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected ErrInvalidOptions, got %v", err)
+	}
+}
+
+func TestUnsafeModeBits(t *testing.T) {
+	tests := []struct {
+		name string
+		mode os.FileMode
+		want []string
+	}{
+		{name: "regular", mode: 0755},
+		{name: "setuid", mode: os.ModeSetuid | 0755, want: []string{"setuid"}},
+		{name: "setgid", mode: os.ModeSetgid | 0755, want: []string{"setgid"}},
+		{name: "world-writable", mode: 0666, want: []string{"world-writable"}},
+		{name: "setuid and world-writable", mode: os.ModeSetuid | 0777, want: []string{"setuid", "world-writable"}},
+		{name: "sticky directory", mode: os.ModeDir | os.ModeSticky | 0777},
+		{name: "world-writable directory", mode: os.ModeDir | 0777, want: []string{"world-writable"}},
+		{name: "symlink", mode: os.ModeSymlink | 0777},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unsafeModeBits(tt.mode); !slices.Equal(got, tt.want) {
+				t.Errorf("unsafeModeBits(%s) = %v, want %v", tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteDirToTarUnsafeModes(t *testing.T) {
+	tests := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{name: "setuid", mode: os.ModeSetuid | 0755},
+		{name: "world-writable", mode: 0666},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "tool")
+			if err := os.WriteFile(file, []byte("#!/bin/sh\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(file, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			warn := &warnings{}
+			if err := writeDirToTar(tw, dir, "app", copyAttrs{}, ignoreScope{}, false, modeCheck{warn: warn}); err != nil {
+				t.Fatalf("non-strict: unexpected error: %v", err)
+			}
+			tw.Close()
+			if got := warn.all(); len(got) != 1 || got[0].Code != WarnUnsafeFileMode || got[0].Context["path"] != "app/tool" {
+				t.Errorf("warnings = %+v, want one %s warning for app/tool", got, WarnUnsafeFileMode)
+			}
+
+			tr := tar.NewReader(&buf)
+			var found bool
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if header.Name == "app/tool" {
+					found = true
+					if got := header.FileInfo().Mode(); got != tt.mode {
+						t.Errorf("archived mode = %s, want %s", got, tt.mode)
+					}
+				}
+			}
+			if !found {
+				t.Fatal("app/tool missing from archive")
+			}
+
+			err := writeDirToTar(tar.NewWriter(io.Discard), dir, "app", copyAttrs{}, ignoreScope{}, false, modeCheck{strict: true})
+			if !errors.Is(err, ErrUnsafeFileMode) {
+				t.Errorf("strict directory copy: expected ErrUnsafeFileMode, got %v", err)
+			}
+			err = writeFileToTar(tar.NewWriter(io.Discard), file, "tool", copyAttrs{}, modeCheck{strict: true})
+			if !errors.Is(err, ErrUnsafeFileMode) {
+				t.Errorf("strict file copy: expected ErrUnsafeFileMode, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCopyModesCheckedAfterChmod(t *testing.T) {
+	mode := func(m int64) *int64 { return &m }
+
+	tests := []struct {
+		name     string
+		source   os.FileMode
+		chmod    *int64
+		wantWarn bool
+	}{
+		{name: "chmod adds setuid", source: 0755, chmod: mode(04755), wantWarn: true},
+		{name: "chmod makes world-writable", source: 0644, chmod: mode(0777), wantWarn: true},
+		{name: "chmod fixes world-writable", source: 0666, chmod: mode(0644)},
+		{name: "unsafe source kept", source: 0666, wantWarn: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "tool")
+			if err := os.WriteFile(file, []byte("#!/bin/sh\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(file, tt.source); err != nil {
+				t.Fatal(err)
+			}
+			attrs := copyAttrs{mode: tt.chmod}
+
+			warn := &warnings{}
+			if err := writeDirToTar(tar.NewWriter(io.Discard), dir, "app", attrs, ignoreScope{}, false, modeCheck{warn: warn}); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(warn.all()) > 0; got != tt.wantWarn {
+				t.Errorf("directory copy warned = %v, want %v: %+v", got, tt.wantWarn, warn.all())
+			}
+
+			err := writeFileToTar(tar.NewWriter(io.Discard), file, "tool", attrs, modeCheck{strict: true})
+			if got := errors.Is(err, ErrUnsafeFileMode); got != tt.wantWarn {
+				t.Errorf("strict file copy = %v, want unsafe %v", err, tt.wantWarn)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package build
+
+import "github.com/cruciblehq/spec/manifest"
+
+// Reports whether steps run no commands.
+//
+// Copies, modifiers, and platform groups made of them only touch the
+// container's filesystem, which the runtime can do from the host, so a
+// stage of such steps is built in a container without a running task; see
+// [runtime.Runtime.CreateImage]. A single run step anywhere, including in a
+// platform group for another platform, keeps the stage on the task-based
+// path.
+func copyOnly(steps []manifest.Step) bool {
+	for _, step := range steps {
+		if step.Run != "" {
+			return false
+		}
+		if !copyOnly(step.Steps) {
+			return false
+		}
+	}
+	return true
+}
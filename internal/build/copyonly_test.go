@@ -0,0 +1,30 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestCopyOnly(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []manifest.Step
+		want  bool
+	}{
+		{name: "no steps", want: true},
+		{name: "copies", steps: []manifest.Step{{Copy: "bin /usr/local/bin"}, {Copy: "build:/out/app /app"}}, want: true},
+		{name: "copies and modifiers", steps: []manifest.Step{{Workdir: "/app"}, {Copy: ". ."}}, want: true},
+		{name: "run", steps: []manifest.Step{{Copy: ". ."}, {Run: "make"}}},
+		{name: "copy group", steps: []manifest.Step{{Steps: []manifest.Step{{Copy: ". ."}}}}, want: true},
+		{name: "run in group", steps: []manifest.Step{{Copy: ". ."}, {Steps: []manifest.Step{{Run: "make"}}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := copyOnly(tt.steps); got != tt.want {
+				t.Errorf("copyOnly() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
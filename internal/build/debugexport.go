@@ -0,0 +1,68 @@
+package build
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+	"github.com/cruciblehq/spec/paths"
+)
+
+// Subdirectory of a platform's output that debug exports are written to.
+const debugExportDir = "debug"
+
+// A stage container waiting to be exported for debugging.
+type debugExport struct {
+	ctr *runtime.Container // Stage container.
+	key string             // Stage key, naming the export directory.
+}
+
+// Checks that every stage listed for a debug export exists in the recipe.
+func validateDebugExports(keys []string, recipe *manifest.Recipe) error {
+	known := make([]string, len(recipe.Stages))
+	for i, stage := range recipe.Stages {
+		known[i] = stageKey(stage.Name, i)
+	}
+	for _, key := range keys {
+		if !slices.Contains(known, key) {
+			return crex.Wrapf(ErrInvalidOptions, "debug export stage %q not found", key)
+		}
+	}
+	return nil
+}
+
+// Exports the stages set aside for debugging on one platform.
+//
+// Exporting stops a container, and later stages may still copy from an
+// earlier one, so the exports run once every stage of the platform is
+// built. Each stage container therefore survives until then, which it does
+// anyway since containers are only destroyed when the build ends. The
+// image of a stage is written to debug/<key>/image.tar below the
+// platform's output with the base image's configuration, unaffected by the
+// entrypoint settings of the final image.
+func (r *recipe) exportDebugStages(ctx context.Context, exports []debugExport, output string) error {
+	for _, e := range exports {
+		dir := filepath.Join(output, debugExportDir, e.key)
+		if err := os.MkdirAll(dir, paths.DefaultDirMode); err != nil {
+			return crex.Wrap(ErrFileSystemOperation, err)
+		}
+		if err := e.ctr.Stop(ctx); err != nil {
+			return crex.Wrap(runtime.ErrRuntime, err)
+		}
+
+		opts := runtime.ExportOptions{AllowPlatformFallback: r.allowFallback}
+		if r.annotate {
+			opts.LayerAnnotations = map[string]string{layerStageAnnotation: e.key}
+		}
+		if _, err := e.ctr.Export(ctx, dir, opts); err != nil {
+			return crex.Wrapf(runtime.ErrRuntime, "debug export of stage %q: %w", e.key, err)
+		}
+		slog.Info("exported stage for debugging", "stage", e.key, "output", dir)
+	}
+	return nil
+}
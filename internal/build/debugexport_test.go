@@ -0,0 +1,39 @@
+package build
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestValidateDebugExports(t *testing.T) {
+	recipe := &manifest.Recipe{Stages: []manifest.Stage{
+		{Name: "builder", From: "golang:1.25", Transient: true},
+		{From: "alpine:3.21"},
+	}}
+
+	tests := []struct {
+		name    string
+		keys    []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "transient stage by name", keys: []string{"builder"}},
+		{name: "unnamed stage by index", keys: []string{"2"}},
+		{name: "named stage by index", keys: []string{"1"}, wantErr: true},
+		{name: "unknown stage", keys: []string{"builder", "tests"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDebugExports(tt.keys, recipe)
+			if tt.wantErr && !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("expected ErrInvalidOptions, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package build
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+// Resolver configuration of the daemon's host, the base of the resolv.conf
+// given to stage containers.
+var hostResolvConf = "/etc/resolv.conf"
+
+// Path of the resolver configuration inside stage containers.
+const containerResolvConf = "/etc/resolv.conf"
+
+// Valid search domains: dot-separated labels of letters, digits, and inner
+// hyphens, at most 63 characters each.
+var searchDomainPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// Longest search domain the resolver accepts.
+const maxSearchDomainLength = 253
+
+// Resolver options accepted in [Options.DNSOptions], mapped to the range of
+// their value. Options without a value map to nil.
+var resolverOptions = map[string]*[2]int{
+	"ndots":                 {0, 15},
+	"timeout":               {1, 30},
+	"attempts":              {1, 5},
+	"rotate":                nil,
+	"edns0":                 nil,
+	"single-request":        nil,
+	"single-request-reopen": nil,
+	"no-tld-query":          nil,
+	"use-vc":                nil,
+	"no-reload":             nil,
+	"trust-ad":              nil,
+	"no-aaaa":               nil,
+	"inet6":                 nil,
+	"debug":                 nil,
+}
+
+// Checks search domains and resolver options for stage containers.
+//
+// Options are written as in resolv.conf, such as "ndots:2" or "rotate".
+// Unknown options and values outside the resolver's range are rejected
+// rather than silently ignored by the resolver in the container.
+func validateDNS(search, options []string) error {
+	for _, d := range search {
+		if len(d) > maxSearchDomainLength || !searchDomainPattern.MatchString(d) {
+			return crex.Wrapf(ErrInvalidOptions, "invalid DNS search domain %q", d)
+		}
+	}
+	for _, o := range options {
+		name, value, hasValue := strings.Cut(o, ":")
+		limits, ok := resolverOptions[name]
+		if !ok {
+			return crex.Wrapf(ErrInvalidOptions, "unknown DNS option %q", o)
+		}
+		if limits == nil {
+			if hasValue {
+				return crex.Wrapf(ErrInvalidOptions, "DNS option %q takes no value", name)
+			}
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if !hasValue || err != nil || n < limits[0] || n > limits[1] {
+			return crex.Wrapf(ErrInvalidOptions, "DNS option %q needs a value between %d and %d", name, limits[0], limits[1])
+		}
+	}
+	return nil
+}
+
+// Returns the host's resolver configuration with its search domains and
+// options replaced.
+//
+// Nameservers and any other directives of the host are kept. The search
+// and domain lines are dropped when search is not empty, and the options
+// lines when options is not empty, so that the given values take effect
+// instead of being merged with the host's.
+func resolvConf(host []byte, search, options []string) []byte {
+	var out bytes.Buffer
+	for line := range strings.Lines(string(host)) {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			if (fields[0] == "search" || fields[0] == "domain") && len(search) > 0 {
+				continue
+			}
+			if fields[0] == "options" && len(options) > 0 {
+				continue
+			}
+		}
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+	if len(search) > 0 {
+		out.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	if len(options) > 0 {
+		out.WriteString("options " + strings.Join(options, " ") + "\n")
+	}
+	return out.Bytes()
+}
+
+// Writes the resolver configuration of stage containers to a host file for
+// bind-mounting over the host's resolv.conf.
+//
+// Returns the directory holding the file, which the caller must remove
+// once the build is done, and the read-only mount that exposes it. Nothing
+// is staged when both search and options are empty, leaving containers
+// with the host's resolv.conf.
+func stageResolvConf(search, options []string) (string, *runtime.Mount, error) {
+	if len(search) == 0 && len(options) == 0 {
+		return "", nil, nil
+	}
+
+	host, err := os.ReadFile(hostResolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return "", nil, crex.Wrap(ErrFileSystemOperation, err)
+	}
+
+	dir, err := os.MkdirTemp("", "cruxd-dns-")
+	if err != nil {
+		return "", nil, crex.Wrap(ErrFileSystemOperation, err)
+	}
+
+	// The directory is private, but the file must be readable by steps
+	// that run as a non-root user.
+	file := filepath.Join(dir, "resolv.conf")
+	if err := os.WriteFile(file, resolvConf(host, search, options), 0444); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, crex.Wrap(ErrFileSystemOperation, err)
+	}
+
+	return dir, &runtime.Mount{Source: file, Destination: containerResolvConf, ReadOnly: true}, nil
+}
@@ -0,0 +1,108 @@
+package build
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDNS(t *testing.T) {
+	tests := []struct {
+		name    string
+		search  []string
+		options []string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "search domains", search: []string{"corp.example.com", "svc"}},
+		{name: "options", options: []string{"ndots:2", "timeout:3", "rotate", "edns0"}},
+		{name: "bad domain", search: []string{"corp..example"}, wantErr: true},
+		{name: "domain with space", search: []string{"a b"}, wantErr: true},
+		{name: "unknown option", options: []string{"fast"}, wantErr: true},
+		{name: "missing value", options: []string{"ndots"}, wantErr: true},
+		{name: "value out of range", options: []string{"ndots:16"}, wantErr: true},
+		{name: "non-numeric value", options: []string{"attempts:many"}, wantErr: true},
+		{name: "value on flag", options: []string{"rotate:1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDNS(tt.search, tt.options)
+			if tt.wantErr && !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("expected ErrInvalidOptions, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestResolvConf(t *testing.T) {
+	host := "# generated\nnameserver 10.0.0.2\nsearch home.lan\noptions timeout:1\nnameserver 10.0.0.3"
+
+	tests := []struct {
+		name    string
+		search  []string
+		options []string
+		want    string
+	}{
+		{
+			name:    "search and options",
+			search:  []string{"corp.example.com", "svc"},
+			options: []string{"ndots:2"},
+			want:    "# generated\nnameserver 10.0.0.2\nnameserver 10.0.0.3\nsearch corp.example.com svc\noptions ndots:2\n",
+		},
+		{
+			name:   "search only keeps host options",
+			search: []string{"corp.example.com"},
+			want:   "# generated\nnameserver 10.0.0.2\noptions timeout:1\nnameserver 10.0.0.3\nsearch corp.example.com\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(resolvConf([]byte(host), tt.search, tt.options)); got != tt.want {
+				t.Errorf("resolvConf() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStageResolvConf(t *testing.T) {
+	host := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(host, []byte("nameserver 10.0.0.2\nsearch home.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := hostResolvConf
+	hostResolvConf = host
+	defer func() { hostResolvConf = saved }()
+
+	dir, mount, err := stageResolvConf([]string{"corp.example.com"}, []string{"ndots:2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if mount.Destination != "/etc/resolv.conf" || !mount.ReadOnly {
+		t.Errorf("mount = %+v", mount)
+	}
+	data, err := os.ReadFile(mount.Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"nameserver 10.0.0.2\n", "search corp.example.com\n", "options ndots:2\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("resolv.conf lacks %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "home.lan") {
+		t.Errorf("host search domain kept:\n%s", data)
+	}
+
+	if dir, mount, err := stageResolvConf(nil, nil); dir != "" || mount != nil || err != nil {
+		t.Errorf("stageResolvConf(nil, nil) = %q, %v, %v", dir, mount, err)
+	}
+}
@@ -11,6 +11,29 @@
 // (environment variables, working directory, shell) is accumulated across
 // steps within a stage and reset between stages.
 //
+// Clients may declare the recipe schema version they wrote the recipe for.
+// Recipes outside [MinRecipeVersion] through [MaxRecipeVersion] are rejected
+// with [ErrUnsupportedRecipeVersion] before any container is started, rather
+// than being executed with fields the daemon does not understand.
+//
+// Secrets are referenced by ID and resolved by the daemon through a
+// [SecretSource], so their values never appear in the recipe or the request.
+// Resolved secrets are bind-mounted read-only into stage containers and are
+// never part of an exported layer.
+//
+// Build arguments come from [Options.Args] and an optional KEY=VALUE file in
+// the build context. They seed the environment of every stage, so run steps
+// see them as variables and env modifiers can override them. They are not
+// recorded in the exported image. A recipe document may declare the
+// arguments it accepts with their defaults, in which case arguments it does
+// not declare are ignored with a warning. It may also set labels on the
+// output image, which labels given with the build override.
+//
+// The build context is usually a directory on the daemon's host named by
+// [Options.Root]. A client on another host can instead advertise its
+// context as a [RemoteContext], from which each copy step fetches only the
+// files it reads, or send the whole context up front for [ExtractContext].
+//
 // Example usage:
 //
 //	result, err := build.Run(ctx, rt, build.Options{
@@ -3,8 +3,18 @@ package build
 import "errors"
 
 var (
-	ErrBuild               = errors.New("build failed")
-	ErrCommandFailed       = errors.New("command failed")
-	ErrFileSystemOperation = errors.New("file system operation failed")
-	ErrCopy                = errors.New("copy failed")
+	ErrBuild                    = errors.New("build failed")
+	ErrCommandFailed            = errors.New("command failed")
+	ErrCommandNotFound          = errors.New("command not found")
+	ErrMemoryLimitExceeded      = errors.New("killed: memory limit exceeded")
+	ErrVerifyFailed             = errors.New("verification failed")
+	ErrFileSystemOperation      = errors.New("file system operation failed")
+	ErrCopy                     = errors.New("copy failed")
+	ErrSymlinkLoop              = errors.New("symlink loop")
+	ErrUnsafeFileMode           = errors.New("unsafe file mode")
+	ErrInvalidRecipe            = errors.New("invalid recipe")
+	ErrUnsupportedRecipeVersion = errors.New("unsupported recipe version")
+	ErrInvalidOptions           = errors.New("invalid build options")
+	ErrSecret                   = errors.New("secret unavailable")
+	ErrContextTransfer          = errors.New("build context transfer failed")
 )
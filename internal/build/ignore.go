@@ -0,0 +1,175 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+)
+
+// Name of the file at the build context root listing paths that host
+// copies leave out.
+const ignoreFile = ".cruxignore"
+
+// Patterns of a .cruxignore file, in file order.
+type ignoreRules struct {
+	patterns []ignorePattern
+}
+
+// A single line of a .cruxignore file.
+type ignorePattern struct {
+	segments []string // Slash-separated parts, where "**" matches any number of directories.
+	negate   bool     // Whether a match re-includes the path ("!" prefix).
+	dirOnly  bool     // Whether only directories match (trailing "/").
+}
+
+// Reads the .cruxignore file at the root of the build context.
+//
+// Returns nil when the context has no such file.
+func loadIgnore(root string) (*ignoreRules, error) {
+	data, err := os.ReadFile(filepath.Join(root, ignoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, crex.Wrap(ErrFileSystemOperation, err)
+	}
+	return parseIgnore(data)
+}
+
+// Parses gitignore-style patterns, one per line.
+//
+// Blank lines and lines starting with "#" are skipped, and a leading
+// backslash escapes a literal "#" or "!". A pattern starting with "!"
+// re-includes paths an earlier pattern excluded, and one ending in "/"
+// matches directories only. A pattern containing a slash other than a
+// trailing one is matched against the whole path from the context root;
+// any other pattern matches a file or directory of that name at any depth.
+// Within a segment, "*", "?", and character classes work as in [path.Match],
+// and a "**" segment matches any number of directories.
+func parseIgnore(data []byte) (*ignoreRules, error) {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if rest, ok := strings.CutPrefix(text, "!"); ok {
+			p.negate = true
+			text = rest
+		} else if strings.HasPrefix(text, `\`) {
+			text = text[1:]
+		}
+		if rest, ok := strings.CutSuffix(text, "/"); ok {
+			p.dirOnly = true
+			text = rest
+		}
+
+		anchored := strings.Contains(text, "/")
+		text = strings.TrimPrefix(text, "/")
+		if text == "" {
+			return nil, crex.Wrapf(ErrInvalidRecipe, "%s line %d: empty pattern", ignoreFile, line)
+		}
+
+		p.segments = strings.Split(text, "/")
+		for _, seg := range p.segments {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, crex.Wrapf(ErrInvalidRecipe, "%s line %d: invalid pattern %q", ignoreFile, line, scanner.Text())
+			}
+		}
+		if !anchored {
+			p.segments = append([]string{"**"}, p.segments...)
+		}
+		rules.patterns = append(rules.patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, crex.Wrap(ErrInvalidRecipe, err)
+	}
+	return &rules, nil
+}
+
+// Reports whether a path, relative to the context root and slash-separated,
+// is left out of copies. The last pattern that matches decides. Nil rules
+// exclude nothing.
+func (r *ignoreRules) excludes(rel string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	excluded := false
+	for _, p := range r.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(p.segments, parts) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// Reports whether the pattern segments match the path parts in full.
+func matchSegments(segments, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+	if segments[0] == "**" {
+		// A trailing "**" matches what is inside a directory, not the
+		// directory itself.
+		if len(segments) == 1 {
+			return len(parts) > 0
+		}
+		for i := range len(parts) + 1 {
+			if matchSegments(segments[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(segments[0], parts[0])
+	return ok && matchSegments(segments[1:], parts[1:])
+}
+
+// Position of a copied host path relative to the build context, for
+// matching it against [ignoreRules].
+type ignoreScope struct {
+	rules *ignoreRules
+	rel   string // Slash-separated path from the context root, "." for the root.
+}
+
+// Returns the scope of a host path, or a scope that excludes nothing when
+// the path lies outside the context or there are no rules.
+func (r *ignoreRules) scope(buildCtx, hostPath string) ignoreScope {
+	if r == nil {
+		return ignoreScope{}
+	}
+	rel, err := filepath.Rel(buildCtx, hostPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ignoreScope{}
+	}
+	return ignoreScope{rules: r, rel: filepath.ToSlash(rel)}
+}
+
+// Returns the scope of the entry name inside the scope's directory.
+func (s ignoreScope) child(name string) ignoreScope {
+	if s.rules == nil {
+		return s
+	}
+	return ignoreScope{rules: s.rules, rel: path.Join(s.rel, name)}
+}
+
+// Reports whether the entry of the scope is left out of copies.
+func (s ignoreScope) excluded(isDir bool) bool {
+	return s.rules.excludes(s.rel, isDir)
+}
@@ -0,0 +1,139 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIgnoreRulesExcludes(t *testing.T) {
+	rules, err := parseIgnore([]byte(`# build output
+.git
+node_modules/
+/dist
+*.log
+!keep.log
+docs/**/*.tmp
+build/**
+\#notes
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{path: ".git", isDir: true, want: true},
+		{path: "sub/.git", isDir: true, want: true},
+		{path: "node_modules", isDir: true, want: true},
+		{path: "web/node_modules", isDir: true, want: true},
+		{path: "node_modules", isDir: false, want: false},
+		{path: "dist", isDir: true, want: true},
+		{path: "web/dist", isDir: true, want: false},
+		{path: "app.log", want: true},
+		{path: "logs/app.log", want: true},
+		{path: "keep.log", want: false},
+		{path: "logs/keep.log", want: false},
+		{path: "docs/a.tmp", want: true},
+		{path: "docs/a/b/c.tmp", want: true},
+		{path: "a.tmp", want: false},
+		{path: "build", isDir: true, want: false},
+		{path: "build/out.o", want: true},
+		{path: "#notes", want: true},
+		{path: "main.go", want: false},
+	}
+	for _, tt := range tests {
+		if got := rules.excludes(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("excludes(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+
+	var none *ignoreRules
+	if none.excludes(".git", true) {
+		t.Error("nil rules exclude a path")
+	}
+}
+
+func TestParseIgnoreInvalid(t *testing.T) {
+	for _, data := range []string{"[abc\n", "/\n", "!\n"} {
+		if _, err := parseIgnore([]byte(data)); !errors.Is(err, ErrInvalidRecipe) {
+			t.Errorf("parseIgnore(%q) = %v, want ErrInvalidRecipe", data, err)
+		}
+	}
+}
+
+func TestLoadIgnore(t *testing.T) {
+	dir := t.TempDir()
+	rules, err := loadIgnore(dir)
+	if err != nil || rules != nil {
+		t.Fatalf("without a file: rules = %v, err = %v", rules, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ignoreFile), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err = loadIgnore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.excludes("app.log", false) {
+		t.Error("pattern from the file not applied")
+	}
+}
+
+func TestWriteDirToTarIgnore(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{"src/main.go", "src/debug.log", "src/.git/HEAD", "node_modules/x/index.js", "README.md"} {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules, err := parseIgnore([]byte(".git\nnode_modules/\n/src/*.log\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{name: "context root", src: root, want: []string{"app", "app/README.md", "app/src", "app/src/main.go"}},
+		{name: "subdirectory", src: filepath.Join(root, "src"), want: []string{"app", "app/main.go"}},
+		{name: "ignored directory named explicitly", src: filepath.Join(root, "node_modules"), want: []string{"app", "app/x", "app/x/index.js"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := writeDirToTar(tw, tt.src, "app", copyAttrs{}, rules.scope(root, tt.src), false, modeCheck{}); err != nil {
+				t.Fatal(err)
+			}
+			tw.Close()
+
+			var names []string
+			for _, h := range tarHeaders(t, &buf) {
+				names = append(names, h.Name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("entries = %v, want %v", names, tt.want)
+			}
+		})
+	}
+
+	if scope := rules.scope(root, t.TempDir()); scope.rules != nil {
+		t.Error("a source outside the context is matched against its rules")
+	}
+}
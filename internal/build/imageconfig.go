@@ -0,0 +1,54 @@
+package build
+
+import (
+	"slices"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+// Process settings of the output image for one target platform, such as a
+// wrapper binary that differs between architectures.
+//
+// Each field that is set replaces the build-wide setting of the same name
+// when the platform is exported; fields left empty keep it.
+type ImageConfig struct {
+	Entrypoint       []string // Replaces [Options.Entrypoint].
+	AppendEntrypoint []string // Replaces [Options.AppendEntrypoint].
+	Cmd              []string // Replaces [Options.Cmd].
+	KeepCmd          *bool    // Replaces [Options.KeepCmd].
+}
+
+// Applies the platform's process settings to the export options of its
+// output image. Without settings for the platform opts are left as they
+// are, so every platform shares the build-wide settings.
+func (r *recipe) applyImageConfig(opts *runtime.ExportOptions, platform string) {
+	cfg, ok := r.platformCfg[platform]
+	if !ok {
+		return
+	}
+	if len(cfg.Entrypoint) > 0 {
+		opts.Entrypoint = cfg.Entrypoint
+	}
+	if len(cfg.AppendEntrypoint) > 0 {
+		opts.AppendEntrypoint = cfg.AppendEntrypoint
+	}
+	if len(cfg.Cmd) > 0 {
+		opts.Cmd = cfg.Cmd
+	}
+	if cfg.KeepCmd != nil {
+		opts.KeepCmd = *cfg.KeepCmd
+	}
+}
+
+// Checks that every per-platform image config names one of the platforms
+// being built, since settings for any other platform would never be used
+// and most likely hide a typo.
+func validateImageConfigs(configs map[string]ImageConfig, platforms []string) error {
+	for platform := range configs {
+		if !slices.Contains(platforms, platform) {
+			return crex.Wrapf(ErrInvalidOptions, "image config for %s, which is not being built (%v)", platform, platforms)
+		}
+	}
+	return nil
+}
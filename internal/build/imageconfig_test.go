@@ -0,0 +1,75 @@
+package build
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+func TestApplyImageConfig(t *testing.T) {
+	keep := true
+	r := &recipe{platformCfg: map[string]ImageConfig{
+		"linux/arm64": {Entrypoint: []string{"/usr/bin/wrapper-arm64"}, KeepCmd: &keep},
+		"linux/s390x": {Cmd: []string{"--big-endian"}},
+	}}
+	shared := runtime.ExportOptions{Entrypoint: []string{"/usr/bin/wrapper"}, Cmd: []string{"serve"}}
+
+	tests := []struct {
+		platform       string
+		wantEntrypoint []string
+		wantCmd        []string
+		wantKeepCmd    bool
+	}{
+		{platform: "linux/amd64", wantEntrypoint: []string{"/usr/bin/wrapper"}, wantCmd: []string{"serve"}},
+		{platform: "linux/arm64", wantEntrypoint: []string{"/usr/bin/wrapper-arm64"}, wantCmd: []string{"serve"}, wantKeepCmd: true},
+		{platform: "linux/s390x", wantEntrypoint: []string{"/usr/bin/wrapper"}, wantCmd: []string{"--big-endian"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			opts := shared
+			r.applyImageConfig(&opts, tt.platform)
+			if !slices.Equal(opts.Entrypoint, tt.wantEntrypoint) {
+				t.Errorf("entrypoint = %v, want %v", opts.Entrypoint, tt.wantEntrypoint)
+			}
+			if !slices.Equal(opts.Cmd, tt.wantCmd) {
+				t.Errorf("cmd = %v, want %v", opts.Cmd, tt.wantCmd)
+			}
+			if opts.KeepCmd != tt.wantKeepCmd {
+				t.Errorf("keep cmd = %v, want %v", opts.KeepCmd, tt.wantKeepCmd)
+			}
+		})
+	}
+
+	if shared.Entrypoint[0] != "/usr/bin/wrapper" {
+		t.Errorf("shared entrypoint modified: %v", shared.Entrypoint)
+	}
+}
+
+func TestValidateImageConfigs(t *testing.T) {
+	platforms := []string{"linux/amd64", "linux/arm64"}
+
+	tests := []struct {
+		name    string
+		configs map[string]ImageConfig
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "built platform", configs: map[string]ImageConfig{"linux/arm64": {Cmd: []string{"serve"}}}},
+		{name: "platform not built", configs: map[string]ImageConfig{"linux/riscv64": {Cmd: []string{"serve"}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateImageConfigs(tt.configs, platforms)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("validateImageConfigs() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("error = %v, want ErrInvalidOptions", err)
+			}
+		})
+	}
+}
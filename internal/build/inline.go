@@ -0,0 +1,175 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+const (
+	heredocPrefix     = "<<"       // Token prefix that marks an inline copy and names its delimiter.
+	chmodFlag         = "--chmod=" // Flag of an inline copy that sets the file's mode.
+	defaultInlineMode = 0644       // Mode of inline files without --chmod.
+)
+
+// A file whose contents are given in the recipe rather than read from the
+// build context.
+type inlineFile struct {
+	dest    string // Absolute path of the file in the container.
+	mode    int64  // Permission bits, including setuid, setgid, and sticky.
+	own     *owner // Ownership from --chown, or nil when absent.
+	content []byte // Literal contents of the file.
+}
+
+// Parses an inline copy string, in the manner of a shell heredoc.
+//
+// The first line holds optional "--chown=UID:GID" and "--chmod=MODE" flags,
+// a "<<WORD" token naming the delimiter, and the destination path. The
+// lines that follow, up to a line consisting of WORD alone, are the file's
+// contents, each ending in a newline:
+//
+//	--chmod=0755 <<EOF /usr/local/bin/hello
+//	#!/bin/sh
+//	echo hello
+//	EOF
+//
+// Returns false when the first line has no "<<" token, in which case s is a
+// regular copy string for [parseCopy]. A relative dest is joined with
+// workdir.
+func parseInlineCopy(s, workdir string) (*inlineFile, bool, error) {
+	header, body, _ := strings.Cut(s, "\n")
+	fields := strings.Fields(header)
+
+	var f inlineFile
+	f.mode = defaultInlineMode
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		if value, ok := strings.CutPrefix(fields[0], chmodFlag); ok {
+			mode, err := parseMode(value)
+			if err != nil {
+				return nil, true, err
+			}
+			f.mode = mode
+		} else if value, ok := strings.CutPrefix(fields[0], chownFlag); ok {
+			own, err := parseOwner(value)
+			if err != nil {
+				return nil, true, err
+			}
+			f.own = own
+		} else {
+			return nil, false, nil
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], heredocPrefix) {
+		return nil, false, nil
+	}
+	delim := strings.TrimPrefix(fields[0], heredocPrefix)
+	if delim == "" {
+		return nil, true, crex.Wrapf(ErrCopy, "missing delimiter after %q in %q", heredocPrefix, header)
+	}
+	if len(fields) != 2 {
+		return nil, true, crex.Wrapf(ErrCopy, "inline copy %q needs exactly one destination", header)
+	}
+
+	dest := fields[1]
+	if strings.HasSuffix(dest, "/") {
+		return nil, true, crex.Wrapf(ErrCopy, "inline copy destination %q must name a file", dest)
+	}
+	if !filepath.IsAbs(dest) {
+		if workdir == "" {
+			return nil, true, crex.Wrapf(ErrCopy, "relative dest %q requires workdir", dest)
+		}
+		dest = filepath.Join(workdir, dest)
+	}
+	f.dest = dest
+
+	content, err := heredocBody(body, delim)
+	if err != nil {
+		return nil, true, err
+	}
+	f.content = content
+
+	return &f, true, nil
+}
+
+// Returns the lines of body before the line equal to delim, each ending in
+// a newline.
+func heredocBody(body, delim string) ([]byte, error) {
+	var buf bytes.Buffer
+	for body != "" {
+		line, rest, _ := strings.Cut(body, "\n")
+		if line == delim {
+			return buf.Bytes(), nil
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		body = rest
+	}
+	return nil, crex.Wrapf(ErrCopy, "inline copy is missing terminating %q", delim)
+}
+
+// Parses an octal file mode such as "0755". Only permission bits along with
+// setuid, setgid, and sticky are accepted.
+func parseMode(s string) (int64, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, crex.Wrapf(ErrCopy, "invalid mode %q: must be octal, such as 0644", s)
+	}
+	return int64(mode), nil
+}
+
+// Writes an inline file to a tar writer as a single regular file entry.
+//
+// The entry is named after the base of the destination, for extraction into
+// its parent directory. A nil owner leaves the entry owned by root. A mode
+// that is unsafe to ship is handled as modes says.
+func writeInlineFile(tw *tar.Writer, f *inlineFile, modes modeCheck) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.Base(f.dest),
+		Mode:     f.mode,
+		Size:     int64(len(f.content)),
+	}
+	f.own.apply(header)
+	if err := modes.check(header); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(f.content)
+	return err
+}
+
+// Writes an inline file into the container.
+//
+// The archive is built in memory, since its contents already are, and
+// extracted through [runtime.Container.CopyTo] like any other copy. Nothing
+// is written to the host filesystem.
+func executeInlineCopy(ctx context.Context, ctr *runtime.Container, f *inlineFile, modes modeCheck) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := writeInlineFile(tw, f, modes); err != nil {
+		return crex.Wrap(ErrCopy, err)
+	}
+	if err := tw.Close(); err != nil {
+		return crex.Wrap(ErrCopy, err)
+	}
+
+	destDir := filepath.Dir(f.dest)
+	if err := ctr.MkdirAll(ctx, destDir); err != nil {
+		return crex.Wrap(ErrCopy, err)
+	}
+	if err := ctr.CopyTo(ctx, &buf, destDir); err != nil {
+		return crex.Wrap(ErrCopy, err)
+	}
+	return nil
+}
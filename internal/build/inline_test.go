@@ -0,0 +1,141 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestParseInlineCopy(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		workdir string
+		want    *inlineFile
+		notOK   bool
+		wantErr bool
+	}{
+		{
+			name:  "basic",
+			input: "<<EOF /etc/motd\nhello\nworld\nEOF",
+			want:  &inlineFile{dest: "/etc/motd", mode: 0644, content: []byte("hello\nworld\n")},
+		},
+		{
+			name:  "mode and owner",
+			input: "--chmod=0755 --chown=1000:100 <<END /usr/local/bin/hi\n#!/bin/sh\necho hi\nEND\n",
+			want:  &inlineFile{dest: "/usr/local/bin/hi", mode: 0755, own: &owner{uid: 1000, gid: 100}, content: []byte("#!/bin/sh\necho hi\n")},
+		},
+		{
+			name:    "relative dest",
+			input:   "<<EOF conf.ini\nx=1\nEOF",
+			workdir: "/app",
+			want:    &inlineFile{dest: "/app/conf.ini", mode: 0644, content: []byte("x=1\n")},
+		},
+		{
+			name:  "empty body",
+			input: "<<EOF /empty\nEOF",
+			want:  &inlineFile{dest: "/empty", mode: 0644},
+		},
+		{
+			name:  "delimiter only on its own line",
+			input: "<<EOF /f\n EOF\nEOF",
+			want:  &inlineFile{dest: "/f", mode: 0644, content: []byte(" EOF\n")},
+		},
+		{name: "regular copy", input: "src /app", notOK: true},
+		{name: "regular copy with chown", input: "--chown=1:1 src /app", notOK: true},
+		{name: "missing terminator", input: "<<EOF /f\nhello", wantErr: true},
+		{name: "missing delimiter", input: "<< /f\nhello\n", wantErr: true},
+		{name: "missing dest", input: "<<EOF\nhello\nEOF", wantErr: true},
+		{name: "directory dest", input: "<<EOF /etc/\nhello\nEOF", wantErr: true},
+		{name: "relative dest without workdir", input: "<<EOF f\nEOF", wantErr: true},
+		{name: "invalid mode", input: "--chmod=rwx <<EOF /f\nEOF", wantErr: true},
+		{name: "mode out of range", input: "--chmod=17777 <<EOF /f\nEOF", wantErr: true},
+		{name: "invalid owner", input: "--chown=root <<EOF /f\nEOF", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := parseInlineCopy(tt.input, tt.workdir)
+			if tt.wantErr {
+				if !errors.Is(err, ErrCopy) {
+					t.Fatalf("expected ErrCopy, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok == tt.notOK {
+				t.Fatalf("ok = %v, want %v", ok, !tt.notOK)
+			}
+			if tt.notOK {
+				return
+			}
+			if got.dest != tt.want.dest || got.mode != tt.want.mode || !bytes.Equal(got.content, tt.want.content) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if (got.own == nil) != (tt.want.own == nil) || (got.own != nil && *got.own != *tt.want.own) {
+				t.Errorf("owner = %+v, want %+v", got.own, tt.want.own)
+			}
+		})
+	}
+}
+
+func TestWriteInlineFile(t *testing.T) {
+	f, _, err := parseInlineCopy("--chmod=0600 --chown=1000:1000 <<EOF /root/.netrc\nmachine example.com\nEOF", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := writeInlineFile(tw, f, modeCheck{}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	tr := tar.NewReader(&buf)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != ".netrc" || h.Typeflag != tar.TypeReg {
+		t.Errorf("entry = %q (type %c)", h.Name, h.Typeflag)
+	}
+	if h.Mode != 0600 {
+		t.Errorf("mode = %o, want 600", h.Mode)
+	}
+	if h.Uid != 1000 || h.Gid != 1000 {
+		t.Errorf("owner = %d:%d, want 1000:1000", h.Uid, h.Gid)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "machine example.com\n" {
+		t.Errorf("content = %q", data)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected a single entry, got %v", err)
+	}
+}
+
+func TestWriteInlineFileUnsafeMode(t *testing.T) {
+	f, _, err := parseInlineCopy("--chmod=4755 <<EOF /usr/local/bin/tool\n#!/bin/sh\nEOF", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warn := &warnings{}
+	if err := writeInlineFile(tar.NewWriter(io.Discard), f, modeCheck{warn: warn}); err != nil {
+		t.Fatal(err)
+	}
+	if got := warn.all(); len(got) != 1 || got[0].Code != WarnUnsafeFileMode || got[0].Context["path"] != "tool" {
+		t.Errorf("warnings = %+v, want one %s warning for tool", got, WarnUnsafeFileMode)
+	}
+	if err := writeInlineFile(tar.NewWriter(io.Discard), f, modeCheck{strict: true}); !errors.Is(err, ErrUnsafeFileMode) {
+		t.Errorf("strict inline copy = %v, want ErrUnsafeFileMode", err)
+	}
+}
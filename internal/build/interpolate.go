@@ -0,0 +1,106 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+// Replaces each "${NAME}" in s with the value of NAME in env.
+//
+// "$${" stands for a literal "${". A "$" not followed by "{" is kept as it
+// is, so paths holding a lone dollar sign need no escaping. A name must be
+// made of letters, digits, and underscores and not start with a digit. An
+// undefined name fails unless allowUndefined is set, in which case it is
+// replaced with nothing.
+func expandVars(s string, env map[string]string, allowUndefined bool) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		switch {
+		case strings.HasPrefix(s, "$${"):
+			b.WriteString("${")
+			s = s[3:]
+		case strings.HasPrefix(s, "${"):
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return "", crex.Wrapf(ErrInvalidRecipe, "unterminated variable reference in %q", s)
+			}
+			name := s[2:end]
+			if !validVarName(name) {
+				return "", crex.Wrapf(ErrInvalidRecipe, "invalid variable name %q", name)
+			}
+			value, ok := env[name]
+			if !ok && !allowUndefined {
+				return "", crex.Wrapf(ErrInvalidRecipe, "undefined variable %q", name)
+			}
+			b.WriteString(value)
+			s = s[end+1:]
+		default:
+			b.WriteByte('$')
+			s = s[1:]
+		}
+	}
+}
+
+// Reports whether name can be referenced as "${name}".
+func validVarName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Expands variable references in the working directory, command, and copy
+// string of a resolved step against the environment the step runs with,
+// which starts from the build arguments. Returns the step with its command
+// and copy string expanded; the resolved state's working directory is
+// expanded in place.
+//
+// Only the first line of a copy string is expanded, so the contents of an
+// inline copy are written as given. A command that refers to a variable it
+// sets itself writes "$${NAME}" or "$NAME", which are left to the shell.
+func (s *stepState) expand(step manifest.Step) (manifest.Step, error) {
+	workdir, err := expandVars(s.workdir, s.env, s.allowUndefined)
+	if err != nil {
+		return step, fmt.Errorf("workdir: %w", err)
+	}
+	s.workdir = workdir
+
+	if step.Run != "" {
+		if step.Run, err = expandVars(step.Run, s.env, s.allowUndefined); err != nil {
+			return step, fmt.Errorf("run: %w", err)
+		}
+	}
+
+	if step.Copy != "" {
+		header, body, multiline := strings.Cut(step.Copy, "\n")
+		header, err = expandVars(header, s.env, s.allowUndefined)
+		if err != nil {
+			return step, fmt.Errorf("copy: %w", err)
+		}
+		if multiline {
+			header += "\n" + body
+		}
+		step.Copy = header
+	}
+	return step, nil
+}
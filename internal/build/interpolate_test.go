@@ -0,0 +1,107 @@
+package build
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestExpandVars(t *testing.T) {
+	env := map[string]string{"APP": "web", "VERSION": "1.2", "EMPTY": ""}
+
+	tests := []struct {
+		in             string
+		allowUndefined bool
+		want           string
+		wantErr        bool
+	}{
+		{in: "/srv/app", want: "/srv/app"},
+		{in: "/srv/${APP}", want: "/srv/web"},
+		{in: "${APP}-${VERSION}.tar", want: "web-1.2.tar"},
+		{in: "/opt/${EMPTY}bin", want: "/opt/bin"},
+		{in: "/srv/$APP", want: "/srv/$APP"},
+		{in: "cost$", want: "cost$"},
+		{in: "$${APP}", want: "${APP}"},
+		{in: "/srv/${MISSING}", wantErr: true},
+		{in: "/srv/${MISSING}/x", allowUndefined: true, want: "/srv//x"},
+		{in: "/srv/${APP", wantErr: true},
+		{in: "/srv/${}", wantErr: true},
+		{in: "/srv/${1APP}", wantErr: true},
+		{in: "/srv/${APP-x}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := expandVars(tt.in, env, tt.allowUndefined)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidRecipe) {
+				t.Errorf("expandVars(%q) error = %v, want ErrInvalidRecipe", tt.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandVars(%q): unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandVars(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStepStateExpand(t *testing.T) {
+	state := newStepState()
+	state.env["DEST"] = "/etc/app"
+	state.workdir = "${DEST}/data"
+
+	step, err := state.expand(manifest.Step{Copy: "<<EOF ${DEST}/config\nname: ${NAME}\nEOF"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.workdir != "/etc/app/data" {
+		t.Errorf("workdir = %q, want %q", state.workdir, "/etc/app/data")
+	}
+	if want := "<<EOF /etc/app/config\nname: ${NAME}\nEOF"; step.Copy != want {
+		t.Errorf("copy = %q, want %q", step.Copy, want)
+	}
+
+	step, err = state.expand(manifest.Step{Run: "install -d ${DEST} && for f in *; do cp $f $${DEST}; done"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "install -d /etc/app && for f in *; do cp $f ${DEST}; done"; step.Run != want {
+		t.Errorf("run = %q, want %q", step.Run, want)
+	}
+
+	for _, step := range []manifest.Step{{Copy: "a ${NAME}"}, {Run: "echo ${NAME}"}} {
+		_, err := state.expand(step)
+		if !errors.Is(err, ErrInvalidRecipe) {
+			t.Errorf("undefined variable error = %v, want ErrInvalidRecipe", err)
+		}
+		if err != nil && strings.Count(err.Error(), ErrInvalidRecipe.Error()) != 1 {
+			t.Errorf("error = %q, want the sentinel once", err)
+		}
+	}
+}
+
+func TestWritablePathsExpandsVars(t *testing.T) {
+	state := newStepState()
+	state.env["PREFIX"] = "/opt/tool"
+	steps := []manifest.Step{
+		{Workdir: "${PREFIX}/src"},
+		{Copy: "bin ${PREFIX}/bin/tool"},
+	}
+
+	got, err := writablePaths(steps, nil, state)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"/opt/tool/bin", "/opt/tool/src"}; !slices.Equal(got, want) {
+		t.Fatalf("writablePaths = %v, want %v", got, want)
+	}
+	if state.workdir != "" {
+		t.Errorf("state workdir = %q, want it unchanged", state.workdir)
+	}
+}
@@ -0,0 +1,128 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cruciblehq/crex"
+)
+
+// Copies the build context into a fresh directory under dir.
+//
+// Copy steps read every source from the build context, so serving them from
+// a tmpfs such as /dev/shm avoids repeated disk reads on copy-heavy builds.
+// The copy costs as much memory as the context is large, so contexts with
+// more than limit bytes of file data are left in place, with a warning
+// recorded in warn, and an empty path is returned. A limit of zero means no
+// limit. Otherwise returns the new context directory, which the caller must
+// remove once the build is done.
+//
+// Regular files keep their mode and modification time, and symbolic links
+// are copied as links. Other file types, such as sockets, are skipped since
+// copy steps cannot transfer them either.
+func materializeContext(root, dir string, limit int64, warn *warnings) (string, error) {
+	size, err := contextSize(root)
+	if err != nil {
+		return "", crex.Wrap(ErrFileSystemOperation, err)
+	}
+	if limit > 0 && size > limit {
+		slog.Warn("build context too large for memory, reading it from disk", "size", size, "limit", limit)
+		warn.add(WarnMemoryContextSize, fmt.Sprintf("build context of %d bytes exceeds the memory context limit of %d bytes and was read from disk", size, limit),
+			map[string]string{"size": strconv.FormatInt(size, 10), "limit": strconv.FormatInt(limit, 10)})
+		return "", nil
+	}
+
+	staged, err := os.MkdirTemp(dir, "cruxd-context-")
+	if err != nil {
+		return "", crex.Wrap(ErrFileSystemOperation, err)
+	}
+	if err := copyTree(root, staged); err != nil {
+		os.RemoveAll(staged)
+		return "", crex.Wrap(ErrFileSystemOperation, err)
+	}
+
+	slog.Debug("build context copied to memory", "path", staged, "size", size)
+	return staged, nil
+}
+
+// Returns the total size of the regular files under root.
+func contextSize(root string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Recreates the tree at src under dst, which must exist.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+}
+
+// Copies a regular file, creating dst with the given permissions.
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,77 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaterializeContext(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "src", "pkg"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(root, "src", "pkg", "main.go")
+	if err := os.WriteFile(main, []byte("package main\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(main, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src/pkg/main.go", filepath.Join(root, "link.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	staged, err := materializeContext(root, t.TempDir(), 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if staged == "" {
+		t.Fatal("context was not copied")
+	}
+
+	info, err := os.Stat(filepath.Join(staged, "src", "pkg", "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("main.go mode = %v, mtime = %v", info.Mode().Perm(), info.ModTime())
+	}
+	if info, err := os.Stat(filepath.Join(staged, "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("run.sh: info = %v, err = %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(staged, "src")); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("src: info = %v, err = %v", info, err)
+	}
+	if link, err := os.Readlink(filepath.Join(staged, "link.go")); err != nil || link != "src/pkg/main.go" {
+		t.Errorf("link.go = %q, err = %v", link, err)
+	}
+}
+
+func TestMaterializeContextOverLimit(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "big.bin"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	warn := &warnings{}
+
+	staged, err := materializeContext(root, dir, 1024, warn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if staged != "" {
+		t.Errorf("context over the limit was copied to %s", staged)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("staging directory not empty: %v", entries)
+	}
+	if got := warn.all(); len(got) != 1 || got[0].Code != WarnMemoryContextSize || got[0].Context["size"] != "4096" {
+		t.Errorf("warnings = %+v, want one %s warning", got, WarnMemoryContextSize)
+	}
+}
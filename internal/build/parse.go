@@ -0,0 +1,230 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+	"unicode"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/manifest"
+	dref "github.com/distribution/reference"
+	"gopkg.in/yaml.v3"
+)
+
+// Range of recipe schema versions this daemon can execute.
+//
+// The version is bumped whenever the meaning of an existing recipe field
+// changes or a field is added that older daemons would silently ignore. A
+// daemon accepts every version in [MinRecipeVersion, MaxRecipeVersion], so
+// upgrading the daemon never breaks recipes written for an older schema
+// until the minimum is raised, which only happens in a major release.
+const (
+	MinRecipeVersion = 1
+	MaxRecipeVersion = 1
+)
+
+// Top-level keys of a recipe document that are read by the daemon and are
+// not part of [manifest.Recipe].
+const (
+	argsKey   = "args"   // Build arguments the recipe accepts.
+	labelsKey = "labels" // Labels of the output image.
+)
+
+// Prefixes of the label keys the daemon sets itself, which recipes may not
+// use so that their labels never collide with the daemon's.
+var reservedLabelPrefixes = []string{"io.cruciblehq.cruxd.", "io.github.cruciblehq.cruxd."}
+
+// Settings of a recipe document beyond the [manifest.Recipe] itself.
+type RecipeSettings struct {
+	Args   map[string]*string // Declared build arguments, for [Options.DeclaredArgs]. Nil when none are declared.
+	Labels map[string]string  // Labels of the output image, for [Options.RecipeLabels].
+}
+
+// Parses a raw recipe document into a [manifest.Recipe] and the settings it
+// declares beside it.
+//
+// The document may be YAML or JSON, since JSON is a subset of YAML. It is
+// decoded generically and then re-encoded as JSON so the result is identical
+// to a recipe that a client would have sent pre-parsed in the build request.
+// Unknown fields are rejected, so a document written against a newer schema
+// fails with a message naming the offending field instead of having that
+// field silently ignored.
+//
+// An optional top-level "args" mapping names the build arguments the recipe
+// accepts, each with its default value or null for an argument the build
+// must be given. The declarations are returned in [RecipeSettings.Args],
+// and are nil when the document has no such mapping.
+//
+// An optional top-level "labels" mapping sets OCI labels on the output
+// image. Keys under the daemon's own namespaces are rejected, see
+// [reservedLabelPrefixes].
+func ParseRecipe(data []byte) (*manifest.Recipe, RecipeSettings, error) {
+	var settings RecipeSettings
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, settings, crex.Wrap(ErrInvalidRecipe, err)
+	}
+	if doc == nil {
+		return nil, settings, crex.Wrapf(ErrInvalidRecipe, "empty recipe document")
+	}
+
+	if fields, ok := doc.(map[string]any); ok {
+		if raw, ok := fields[argsKey]; ok {
+			var err error
+			if settings.Args, err = parseArgDeclarations(raw); err != nil {
+				return nil, settings, err
+			}
+			delete(fields, argsKey)
+		}
+		if raw, ok := fields[labelsKey]; ok {
+			var err error
+			if settings.Labels, err = parseLabels(raw); err != nil {
+				return nil, settings, err
+			}
+			delete(fields, labelsKey)
+		}
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, settings, crex.Wrap(ErrInvalidRecipe, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	var recipe manifest.Recipe
+	if err := dec.Decode(&recipe); err != nil {
+		return nil, settings, crex.Wrap(ErrInvalidRecipe, err)
+	}
+
+	if err := validateRecipe(&recipe); err != nil {
+		return nil, settings, err
+	}
+
+	return &recipe, settings, nil
+}
+
+// Decodes the "args" mapping of a recipe document.
+//
+// Defaults may be written as strings, numbers, or booleans, which YAML
+// decodes to different types, and are all kept as their string form.
+func parseArgDeclarations(raw any) (map[string]*string, error) {
+	fields, ok := raw.(map[string]any)
+	if !ok {
+		return nil, crex.Wrapf(ErrInvalidRecipe, "%s must be a mapping of argument names to defaults", argsKey)
+	}
+
+	declared := make(map[string]*string, len(fields))
+	for name, value := range fields {
+		if !argNamePattern.MatchString(name) {
+			return nil, crex.Wrapf(ErrInvalidRecipe, "%s: invalid build argument name %q", argsKey, name)
+		}
+		switch v := value.(type) {
+		case nil:
+			declared[name] = nil
+		case string, bool, int, float64:
+			s := fmt.Sprint(v)
+			declared[name] = &s
+		default:
+			return nil, crex.Wrapf(ErrInvalidRecipe, "%s: default of %s must be a scalar", argsKey, name)
+		}
+	}
+	return declared, nil
+}
+
+// Decodes the "labels" mapping of a recipe document.
+//
+// Keys must be non-empty and free of whitespace, and are best written in
+// reverse-DNS form such as "org.opencontainers.image.source". Values may be
+// scalars of any type and are kept as their string form, like argument
+// defaults.
+func parseLabels(raw any) (map[string]string, error) {
+	fields, ok := raw.(map[string]any)
+	if !ok {
+		return nil, crex.Wrapf(ErrInvalidRecipe, "%s must be a mapping of label keys to values", labelsKey)
+	}
+
+	labels := make(map[string]string, len(fields))
+	for key, value := range fields {
+		if key == "" || strings.ContainsFunc(key, unicode.IsSpace) {
+			return nil, crex.Wrapf(ErrInvalidRecipe, "%s: invalid label key %q", labelsKey, key)
+		}
+		for _, prefix := range reservedLabelPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				return nil, crex.Wrapf(ErrInvalidRecipe, "%s: label key %q is reserved for the daemon", labelsKey, key)
+			}
+		}
+		switch v := value.(type) {
+		case string, bool, int, float64:
+			labels[key] = fmt.Sprint(v)
+		default:
+			return nil, crex.Wrapf(ErrInvalidRecipe, "%s: value of %s must be a scalar", labelsKey, key)
+		}
+	}
+	return labels, nil
+}
+
+// Returns the labels of the output image: the recipe's, overridden by the
+// ones given with the build. Neither map is modified.
+func imageLabels(recipe, build map[string]string) map[string]string {
+	if len(recipe) == 0 {
+		return build
+	}
+	merged := maps.Clone(recipe)
+	maps.Copy(merged, build)
+	return merged
+}
+
+// Checks that a recipe schema version is within the supported range.
+//
+// Zero means the client did not declare a version. Such clients predate
+// version negotiation and always produce [MinRecipeVersion] recipes.
+func checkRecipeVersion(version int) error {
+	if version == 0 {
+		return nil
+	}
+	if version < MinRecipeVersion || version > MaxRecipeVersion {
+		return crex.Wrapf(ErrUnsupportedRecipeVersion, "version %d, supported versions are %d through %d", version, MinRecipeVersion, MaxRecipeVersion)
+	}
+	return nil
+}
+
+// Checks the structural requirements the build relies on.
+func validateRecipe(recipe *manifest.Recipe) error {
+	if recipe == nil {
+		return crex.Wrapf(ErrInvalidRecipe, "missing recipe")
+	}
+	if len(recipe.Stages) == 0 {
+		return crex.Wrapf(ErrInvalidRecipe, "recipe has no stages")
+	}
+	return nil
+}
+
+// Checks that every OCI base image is pinned by digest.
+//
+// References such as "alpine@sha256:..." or "alpine:3.21@sha256:..." pass;
+// a bare tag such as "alpine:3.21" can be moved to different content and is
+// rejected. File sources are local archives and are not checked.
+func validatePinnedBases(recipe *manifest.Recipe) error {
+	for i, stage := range recipe.Stages {
+		src, err := stage.ParseFrom()
+		if err != nil {
+			return crex.Wrapf(ErrInvalidRecipe, "stage %s: %w", stageLabel(stage.Name, i), err)
+		}
+		if src.Type != manifest.SourceOCI {
+			continue
+		}
+		named, err := dref.ParseNormalizedNamed(src.Value)
+		if err != nil {
+			return crex.Wrapf(ErrInvalidRecipe, "stage %s: invalid base %q: %w", stageLabel(stage.Name, i), src.Value, err)
+		}
+		if _, ok := named.(dref.Canonical); !ok {
+			return crex.Wrapf(ErrInvalidRecipe, "stage %s: base %q must be pinned by digest (name@sha256:...)", stageLabel(stage.Name, i), src.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package build
+
+import (
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestParseRecipe(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		stages  int
+		wantErr bool
+	}{
+		{
+			name:   "json document",
+			input:  `{"stages": [{"name": "build", "from": "alpine:3.21", "steps": [{"run": "true"}]}]}`,
+			stages: 1,
+		},
+		{
+			name:   "yaml document",
+			input:  "stages:\n  - name: build\n    from: alpine:3.21\n  - from: alpine:3.21\n",
+			stages: 2,
+		},
+		{
+			name:    "empty document",
+			input:   "",
+			wantErr: true,
+		},
+		{
+			name:    "no stages",
+			input:   `{"stages": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			input:   `{"stages": [{"from": "alpine:3.21"}], "unknown": true}`,
+			wantErr: true,
+		},
+		{
+			name:    "malformed document",
+			input:   `{"stages": [`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recipe, _, err := ParseRecipe([]byte(tt.input))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRecipe) {
+					t.Fatalf("err = %v, want ErrInvalidRecipe", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(recipe.Stages) != tt.stages {
+				t.Fatalf("len(stages) = %d, want %d", len(recipe.Stages), tt.stages)
+			}
+		})
+	}
+}
+
+func TestParseRecipeArgs(t *testing.T) {
+	recipe, settings, err := ParseRecipe([]byte(`{
+		"args": {"VERSION": "dev", "COMMIT": null, "JOBS": 4, "DEBUG": false},
+		"stages": [{"from": "alpine:3.21"}]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recipe.Stages) != 1 {
+		t.Fatalf("len(stages) = %d, want 1", len(recipe.Stages))
+	}
+
+	declared := settings.Args
+	want := map[string]string{"VERSION": "dev", "JOBS": "4", "DEBUG": "false"}
+	if len(declared) != 4 || declared["COMMIT"] != nil {
+		t.Fatalf("declared = %v, want 4 arguments with COMMIT required", declared)
+	}
+	for name, value := range want {
+		if got := declared[name]; got == nil || *got != value {
+			t.Errorf("default of %s = %v, want %q", name, got, value)
+		}
+	}
+
+	_, settings, err = ParseRecipe([]byte(`{"stages": [{"from": "alpine:3.21"}]}`))
+	if err != nil || settings.Args != nil {
+		t.Fatalf("declared = %v, %v, want nil", settings.Args, err)
+	}
+
+	for _, doc := range []string{
+		`{"args": ["VERSION"], "stages": [{"from": "alpine:3.21"}]}`,
+		`{"args": {"1X": "a"}, "stages": [{"from": "alpine:3.21"}]}`,
+		`{"args": {"X": {"a": 1}}, "stages": [{"from": "alpine:3.21"}]}`,
+	} {
+		if _, _, err := ParseRecipe([]byte(doc)); !errors.Is(err, ErrInvalidRecipe) {
+			t.Errorf("ParseRecipe(%s) error = %v, want ErrInvalidRecipe", doc, err)
+		}
+	}
+}
+
+func TestParseRecipeLabels(t *testing.T) {
+	_, settings, err := ParseRecipe([]byte(`{
+		"labels": {"org.opencontainers.image.source": "https://example.com/app", "com.example.revision": 3},
+		"stages": [{"from": "alpine:3.21"}]
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"org.opencontainers.image.source": "https://example.com/app", "com.example.revision": "3"}
+	if !maps.Equal(settings.Labels, want) {
+		t.Errorf("labels = %v, want %v", settings.Labels, want)
+	}
+
+	for _, doc := range []string{
+		`{"labels": ["a"], "stages": [{"from": "alpine:3.21"}]}`,
+		`{"labels": {"": "a"}, "stages": [{"from": "alpine:3.21"}]}`,
+		`{"labels": {"com.example key": "a"}, "stages": [{"from": "alpine:3.21"}]}`,
+		`{"labels": {"com.example.list": ["a"]}, "stages": [{"from": "alpine:3.21"}]}`,
+		`{"labels": {"io.cruciblehq.cruxd.build": "x"}, "stages": [{"from": "alpine:3.21"}]}`,
+	} {
+		if _, _, err := ParseRecipe([]byte(doc)); !errors.Is(err, ErrInvalidRecipe) {
+			t.Errorf("ParseRecipe(%s) error = %v, want ErrInvalidRecipe", doc, err)
+		}
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	recipe := map[string]string{"com.example.team": "web", "com.example.tier": "frontend"}
+	build := map[string]string{"com.example.tier": "backend", "com.example.commit": "abc123"}
+
+	got := imageLabels(recipe, build)
+	want := map[string]string{"com.example.team": "web", "com.example.tier": "backend", "com.example.commit": "abc123"}
+	if !maps.Equal(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+	if recipe["com.example.tier"] != "frontend" {
+		t.Error("recipe labels modified")
+	}
+	if got := imageLabels(nil, build); !maps.Equal(got, build) {
+		t.Errorf("labels without recipe labels = %v", got)
+	}
+}
+
+func TestCheckRecipeVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		wantErr bool
+	}{
+		{name: "unspecified", version: 0},
+		{name: "minimum", version: MinRecipeVersion},
+		{name: "maximum", version: MaxRecipeVersion},
+		{name: "too new", version: MaxRecipeVersion + 1, wantErr: true},
+		{name: "negative", version: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRecipeVersion(tt.version)
+			if tt.wantErr {
+				if !errors.Is(err, ErrUnsupportedRecipeVersion) {
+					t.Fatalf("err = %v, want ErrUnsupportedRecipeVersion", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidatePinnedBases(t *testing.T) {
+	const digest = "sha256:4bcff63911fcb4448bd4fdacec207030997caf25e9bea4045fa6c8c44de311d1"
+
+	tests := []struct {
+		name    string
+		from    []string
+		wantErr bool
+	}{
+		{name: "digest", from: []string{"alpine@" + digest}},
+		{name: "tag and digest", from: []string{"docker.io/library/alpine:3.21@" + digest}},
+		{name: "tag", from: []string{"alpine:3.21"}, wantErr: true},
+		{name: "untagged", from: []string{"alpine"}, wantErr: true},
+		{name: "second stage tagged", from: []string{"golang@" + digest, "alpine:3.21"}, wantErr: true},
+		{name: "malformed", from: []string{"Alpine@sha256:bad"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recipe := &manifest.Recipe{}
+			for _, from := range tt.from {
+				recipe.Stages = append(recipe.Stages, manifest.Stage{From: from})
+			}
+			err := validatePinnedBases(recipe)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRecipe) {
+					t.Fatalf("err = %v, want ErrInvalidRecipe", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package build
+
+import (
+	"log/slog"
+	"slices"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/manifest"
+	dref "github.com/distribution/reference"
+)
+
+// Returns the stage as built for a platform.
+//
+// A base set for the platform in [StageOptions.From] replaces the recipe's
+// from, so that a broken variant of the base can be swapped out for one
+// platform while the others keep the recipe's base. Without an override
+// the stage is returned unchanged.
+func (r *recipe) platformStage(stage manifest.Stage, index int, platform string) manifest.Stage {
+	from, ok := r.stageOptions(stage.Name, index).From[platform]
+	if !ok {
+		return stage
+	}
+	slog.Info("using platform base override", "stage", stageLabel(stage.Name, index), "platform", platform, "from", from)
+	stage.From = from
+	return stage
+}
+
+// Checks the per-platform base overrides of the stage settings.
+//
+// Every override must name one of the platforms being built, since an
+// override for any other platform would never be used and most likely
+// hides a typo. The base must parse like the recipe's own from, and must be
+// pinned by digest when pinned is set.
+func validateFromOverrides(stages map[string]StageOptions, platforms []string, pinned bool) error {
+	for key, opts := range stages {
+		for platform, from := range opts.From {
+			if !slices.Contains(platforms, platform) {
+				return crex.Wrapf(ErrInvalidOptions, "stage %q: base override for %s, which is not being built (%v)", key, platform, platforms)
+			}
+			if err := validateBase(from, pinned); err != nil {
+				return crex.Wrapf(ErrInvalidOptions, "stage %q, platform %s: %w", key, platform, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that a base reference parses, and for OCI references that it is
+// a valid image name pinned by digest when pinned is set.
+func validateBase(from string, pinned bool) error {
+	if from == "" {
+		return crex.Wrapf(ErrInvalidOptions, "empty base")
+	}
+	src, err := manifest.Stage{From: from}.ParseFrom()
+	if err != nil {
+		return err
+	}
+	if src.Type != manifest.SourceOCI {
+		return nil
+	}
+	named, err := dref.ParseNormalizedNamed(src.Value)
+	if err != nil {
+		return crex.Wrapf(ErrInvalidOptions, "invalid base %q: %w", src.Value, err)
+	}
+	if _, ok := named.(dref.Canonical); pinned && !ok {
+		return crex.Wrapf(ErrInvalidOptions, "base %q must be pinned by digest (name@sha256:...)", src.Value)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package build
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestPlatformStage(t *testing.T) {
+	r := &recipe{stageOpts: map[string]StageOptions{
+		"build": {From: map[string]string{"linux/arm64": "golang:1.25-bookworm"}},
+	}}
+	stages := []manifest.Stage{
+		{Name: "build", From: "golang:1.25-alpine"},
+		{From: "alpine:3.21"},
+	}
+
+	tests := []struct {
+		platform string
+		want     []string
+	}{
+		{platform: "linux/amd64", want: []string{"golang:1.25-alpine", "alpine:3.21"}},
+		{platform: "linux/arm64", want: []string{"golang:1.25-bookworm", "alpine:3.21"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			for i, stage := range stages {
+				if got := r.platformStage(stage, i, tt.platform).From; got != tt.want[i] {
+					t.Errorf("stage %d from = %q, want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	if stages[0].From != "golang:1.25-alpine" {
+		t.Errorf("recipe stage modified: from = %q", stages[0].From)
+	}
+}
+
+func TestValidateFromOverrides(t *testing.T) {
+	platforms := []string{"linux/amd64", "linux/arm64"}
+	pinnedRef := "alpine@sha256:" + "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+
+	tests := []struct {
+		name    string
+		from    map[string]string
+		pinned  bool
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "built platform", from: map[string]string{"linux/arm64": "debian:bookworm"}},
+		{name: "platform not built", from: map[string]string{"linux/riscv64": "debian:bookworm"}, wantErr: true},
+		{name: "empty base", from: map[string]string{"linux/arm64": ""}, wantErr: true},
+		{name: "invalid reference", from: map[string]string{"linux/arm64": "Debian:Bookworm"}, wantErr: true},
+		{name: "unpinned when required", from: map[string]string{"linux/arm64": "debian:bookworm"}, pinned: true, wantErr: true},
+		{name: "pinned when required", from: map[string]string{"linux/arm64": pinnedRef}, pinned: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stages := map[string]StageOptions{"build": {From: tt.from}}
+			err := validateFromOverrides(stages, platforms, tt.pinned)
+			if tt.wantErr && !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("expected ErrInvalidOptions, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
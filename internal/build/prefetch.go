@@ -0,0 +1,110 @@
+package build
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+// A base image being prepared in the background.
+type pendingImage struct {
+	done chan struct{}  // Closed once preparation finishes.
+	img  *runtime.Image // Prepared image, valid after done is closed.
+	err  error          // Preparation error, valid after done is closed.
+}
+
+// Builds n stages in order, preparing each stage's base image in the
+// background while the stage before it builds.
+//
+// Importing or pulling and unpacking a base image is independent of the
+// containers of earlier stages, so only the first stage waits for its base
+// from the start. prepare returns the base image of stage i, and build
+// builds stage i on it, returning false to stop after the stage, such as at
+// a breakpoint. The first error of either is returned. An error building a
+// stage wins over one preparing the next stage's base meanwhile, and the
+// preparation still running when the pipeline stops is canceled and waited
+// for, so that no transfer outlives the build.
+func prefetchStages(ctx context.Context, n int, prepare func(context.Context, int) (*runtime.Image, error), build func(context.Context, int, *runtime.Image) (bool, error)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var next *pendingImage
+	defer func() {
+		if next != nil {
+			cancel()
+			next.wait()
+		}
+	}()
+
+	if n > 0 {
+		next = prepareAsync(ctx, 0, prepare)
+	}
+	for i := range n {
+		base, err := next.wait()
+		next = nil
+		if err != nil {
+			return err
+		}
+		if i+1 < n {
+			next = prepareAsync(ctx, i+1, prepare)
+		}
+
+		more, err := build(ctx, i, base)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts preparing the base image of stage i in the background. Call
+// [pendingImage.wait] to collect the result.
+func prepareAsync(ctx context.Context, i int, prepare func(context.Context, int) (*runtime.Image, error)) *pendingImage {
+	p := &pendingImage{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.img, p.err = prepare(ctx, i)
+	}()
+	return p
+}
+
+// Blocks until the image is prepared and returns it.
+func (p *pendingImage) wait() (*runtime.Image, error) {
+	<-p.done
+	return p.img, p.err
+}
+
+// Imports or pulls and unpacks the base image of a stage, reporting the
+// transfer's progress as [EventPull] events.
+func (r *recipe) prepareImage(ctx context.Context, stage manifest.Stage, platform string) (*runtime.Image, error) {
+	src, err := r.resolveImageSource(stage)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := r.rt
+	if progress := r.pullProgress(platform); progress != nil {
+		rt = rt.WithTransferProgress(progress)
+	}
+
+	start := time.Now()
+	var img *runtime.Image
+	switch src.Type {
+	case manifest.SourceFile:
+		img, err = rt.PrepareImage(ctx, src.Value, platform)
+	case manifest.SourceOCI:
+		img, err = rt.PrepareImageFromOCI(ctx, src.Value, platform)
+	default:
+		return nil, crex.Wrapf(ErrBuild, "unsupported source type %q", src.Type)
+	}
+	if err != nil {
+		return nil, crex.Wrap(runtime.ErrRuntime, err)
+	}
+	slog.Debug("base image prepared", "from", stage.From, "platform", platform, "duration", time.Since(start))
+
+	return img, nil
+}
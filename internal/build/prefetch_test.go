@@ -0,0 +1,131 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+func TestPrefetchStagesConcurrent(t *testing.T) {
+	const n = 3
+	images := make([]*runtime.Image, n)
+	preparing := make([]chan struct{}, n)
+	for i := range n {
+		images[i] = &runtime.Image{}
+		preparing[i] = make(chan struct{})
+	}
+
+	var built []int
+	err := prefetchStages(context.Background(), n,
+		func(_ context.Context, i int) (*runtime.Image, error) {
+			close(preparing[i])
+			return images[i], nil
+		},
+		func(_ context.Context, i int, base *runtime.Image) (bool, error) {
+			if base != images[i] {
+				t.Errorf("stage %d built on the base of another stage", i)
+			}
+			// The next stage's base is prepared while this one builds.
+			if i+1 < n {
+				select {
+				case <-preparing[i+1]:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("base of stage %d not prepared while stage %d builds", i+1, i)
+				}
+			}
+			built = append(built, i)
+			return true, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(built) != n {
+		t.Errorf("built stages = %v, want %d", built, n)
+	}
+}
+
+func TestPrefetchStagesCancel(t *testing.T) {
+	buildErr := errors.New("step 1 failed")
+	var canceled atomic.Bool
+
+	err := prefetchStages(context.Background(), 3,
+		func(ctx context.Context, i int) (*runtime.Image, error) {
+			if i == 0 {
+				return &runtime.Image{}, nil
+			}
+			<-ctx.Done()
+			canceled.Store(true)
+			return nil, ctx.Err()
+		},
+		func(context.Context, int, *runtime.Image) (bool, error) {
+			return false, buildErr
+		})
+	if !errors.Is(err, buildErr) {
+		t.Fatalf("err = %v, want the build error", err)
+	}
+	if !canceled.Load() {
+		t.Error("returned before the pending preparation was canceled")
+	}
+}
+
+func TestPrefetchStagesErrors(t *testing.T) {
+	buildErr := errors.New("step 1 failed")
+	prepareErr := errors.New("pull failed")
+
+	t.Run("build error wins", func(t *testing.T) {
+		failed := make(chan struct{})
+		err := prefetchStages(context.Background(), 2,
+			func(_ context.Context, i int) (*runtime.Image, error) {
+				if i == 0 {
+					return &runtime.Image{}, nil
+				}
+				close(failed)
+				return nil, prepareErr
+			},
+			func(context.Context, int, *runtime.Image) (bool, error) {
+				<-failed
+				return false, buildErr
+			})
+		if !errors.Is(err, buildErr) || errors.Is(err, prepareErr) {
+			t.Errorf("err = %v, want only the build error", err)
+		}
+	})
+
+	t.Run("prepare error stops", func(t *testing.T) {
+		var builds atomic.Int32
+		err := prefetchStages(context.Background(), 2,
+			func(_ context.Context, i int) (*runtime.Image, error) {
+				if i == 1 {
+					return nil, prepareErr
+				}
+				return &runtime.Image{}, nil
+			},
+			func(context.Context, int, *runtime.Image) (bool, error) {
+				builds.Add(1)
+				return true, nil
+			})
+		if !errors.Is(err, prepareErr) {
+			t.Errorf("err = %v, want the prepare error", err)
+		}
+		if builds.Load() != 1 {
+			t.Errorf("stages built = %d, want 1", builds.Load())
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		var builds atomic.Int32
+		err := prefetchStages(context.Background(), 3,
+			func(context.Context, int) (*runtime.Image, error) { return &runtime.Image{}, nil },
+			func(context.Context, int, *runtime.Image) (bool, error) {
+				builds.Add(1)
+				return false, nil
+			})
+		if err != nil || builds.Load() != 1 {
+			t.Errorf("err = %v, stages built = %d, want nil and 1", err, builds.Load())
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+// Kind of a build progress [Event].
+type EventKind string
+
+const (
+	EventPlatform EventKind = "platform" // Building for a platform started.
+	EventStage    EventKind = "stage"    // A stage container started.
+	EventStep     EventKind = "step"     // A run or copy operation started.
+	EventVerify   EventKind = "verify"   // A stage's verification command started.
+	EventExport   EventKind = "export"   // The output image is being committed and exported.
+	EventOutput   EventKind = "output"   // A line of output written by a run step.
+	EventCached   EventKind = "cached"   // A step was skipped and its result taken from the build cache.
+	EventOmitted  EventKind = "omitted"  // Output lines of a run step were left out by [OutputSampling].
+	EventPull     EventKind = "pull"     // Progress of pulling or importing a base image.
+)
+
+// A progress report from a running build.
+type Event struct {
+	Kind     EventKind // What happened.
+	Platform string    // Platform being built.
+	Stage    string    // Label of the stage, empty for platform events.
+	Message  string    // Human-readable detail, such as the command being run, or the line of output.
+	Stream   string    // Stream of an output event, "stdout" or "stderr".
+	Current  int64     // Bytes of a pull event's item transferred so far.
+	Total    int64     // Size of a pull event's item in bytes. Zero when unknown.
+}
+
+// Receives progress events. It is called synchronously from the build, so
+// it must return quickly. Output events of a step's stdout and stderr are
+// reported from separate goroutines, so it must be safe for concurrent use.
+type ProgressFunc func(Event)
+
+// Reports an event to the build's progress function, if there is one.
+func (r *recipe) emit(ev Event) {
+	if r.progress != nil {
+		r.progress(ev)
+	}
+}
+
+// Returns a progress function for the steps of a stage, which fills in the
+// platform and stage of each event.
+func (r *recipe) stageProgress(platform, stage string) ProgressFunc {
+	if r.progress == nil {
+		return nil
+	}
+	return func(ev Event) {
+		ev.Platform = platform
+		ev.Stage = stage
+		r.progress(ev)
+	}
+}
+
+// Returns a transfer progress function reporting the pull or import of a
+// base image for a platform as [EventPull] events, or nil when the build
+// has no progress function.
+func (r *recipe) pullProgress(platform string) runtime.TransferProgressFunc {
+	if r.progress == nil {
+		return nil
+	}
+	return func(p runtime.TransferProgress) {
+		r.progress(Event{
+			Kind:     EventPull,
+			Platform: platform,
+			Message:  pullMessage(p),
+			Current:  p.Current,
+			Total:    p.Total,
+		})
+	}
+}
+
+// Returns the message of a pull event, such as "alpine:3.21: downloading
+// sha256:4abc... 42%".
+func pullMessage(p runtime.TransferProgress) string {
+	msg := fmt.Sprintf("%s: %s %s", p.Image, p.Event, p.Item)
+	if p.Total > 0 {
+		msg += fmt.Sprintf(" %d%%", p.Current*100/p.Total)
+	}
+	return msg
+}
+
+// Longest line reported in one output event. Longer lines are split.
+const maxOutputLine = 64 << 10
+
+// Limits how much output of a run step is reported as progress events.
+//
+// Each stream of a step is reported in full until it exceeds HeadLines or
+// HeadBytes. Later lines are held back, and when the step ends an
+// [EventOmitted] event tells how many were left out, followed by the last
+// TailLines of them. Only the events are affected: the output a failing
+// step's error carries is kept in full. The zero value reports everything.
+type OutputSampling struct {
+	HeadLines int   // Lines of each stream reported before sampling starts. Zero means no line limit.
+	HeadBytes int64 // Bytes of each stream reported before sampling starts. Zero means no byte limit.
+	TailLines int   // Last lines of each stream reported once the step ends.
+}
+
+// Reports whether any output is left out.
+func (s OutputSampling) enabled() bool {
+	return s.HeadLines > 0 || s.HeadBytes > 0
+}
+
+// Checks that no threshold is negative.
+func (s OutputSampling) validate() error {
+	if s.HeadLines < 0 || s.HeadBytes < 0 || s.TailLines < 0 {
+		return crex.Wrapf(ErrInvalidOptions, "output sampling thresholds must not be negative")
+	}
+	return nil
+}
+
+// Reports output of a run step as one [EventOutput] per line.
+//
+// Output is split at newlines, which are not included in the events, and
+// an incomplete last line is held until more output arrives or the writer
+// is flushed. Lines beyond the head of the output are sampled as described
+// by [OutputSampling].
+type outputEmitter struct {
+	progress ProgressFunc   // Receives the events.
+	stream   string         // Stream the output comes from.
+	pending  []byte         // Start of a line not yet terminated.
+	sample   OutputSampling // Thresholds past which lines are held back.
+	lines    int            // Lines reported as they were written.
+	bytes    int64          // Bytes of the lines reported as they were written.
+	sampling bool           // Whether the head has been reported and lines are held back.
+	tail     []string       // Most recent lines held back, at most sample.TailLines.
+	omitted  int            // Lines held back and dropped from tail.
+}
+
+// Reports the complete lines in p.
+func (w *outputEmitter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.report(w.pending[:i])
+		w.pending = w.pending[i+1:]
+	}
+	for len(w.pending) >= maxOutputLine {
+		w.report(w.pending[:maxOutputLine])
+		w.pending = w.pending[maxOutputLine:]
+	}
+	// Keep the unterminated rest from pinning the whole buffer.
+	w.pending = append([]byte(nil), w.pending...)
+	return len(p), nil
+}
+
+// Reports any incomplete last line, then the lines held back by sampling.
+func (w *outputEmitter) Flush() {
+	if len(w.pending) > 0 {
+		w.report(w.pending)
+		w.pending = nil
+	}
+	if w.omitted > 0 {
+		w.progress(Event{Kind: EventOmitted, Stream: w.stream, Message: fmt.Sprintf("%d lines omitted", w.omitted)})
+		w.omitted = 0
+	}
+	for _, line := range w.tail {
+		w.progress(Event{Kind: EventOutput, Stream: w.stream, Message: line})
+	}
+	w.tail = nil
+}
+
+// Reports a single line, or holds it back once the head of the output has
+// been reported.
+func (w *outputEmitter) report(line []byte) {
+	if !w.sampling && w.sample.enabled() {
+		overLines := w.sample.HeadLines > 0 && w.lines >= w.sample.HeadLines
+		overBytes := w.sample.HeadBytes > 0 && w.bytes+int64(len(line)) > w.sample.HeadBytes
+		w.sampling = overLines || overBytes
+	}
+	if !w.sampling {
+		w.lines++
+		w.bytes += int64(len(line))
+		w.progress(Event{Kind: EventOutput, Stream: w.stream, Message: string(line)})
+		return
+	}
+
+	if w.sample.TailLines == 0 {
+		w.omitted++
+		return
+	}
+	w.tail = append(w.tail, string(line))
+	if len(w.tail) > w.sample.TailLines {
+		w.tail = w.tail[1:]
+		w.omitted++
+	}
+}
+
+// Returns the message of a step event: the run command or copy string,
+// cut to its first line.
+func stepMessage(step string, isCopy bool) string {
+	line, _, multi := strings.Cut(step, "\n")
+	if multi {
+		line += " ..."
+	}
+	if isCopy {
+		return fmt.Sprintf("copy %s", line)
+	}
+	return fmt.Sprintf("run %s", line)
+}
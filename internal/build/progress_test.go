@@ -0,0 +1,147 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+func TestStepMessage(t *testing.T) {
+	tests := []struct {
+		step   string
+		isCopy bool
+		want   string
+	}{
+		{step: "go build ./...", want: "run go build ./..."},
+		{step: "apk add git\napk add make", want: "run apk add git ..."},
+		{step: "src/ /app", isCopy: true, want: "copy src/ /app"},
+	}
+
+	for _, tt := range tests {
+		if got := stepMessage(tt.step, tt.isCopy); got != tt.want {
+			t.Errorf("stepMessage(%q, %v) = %q, want %q", tt.step, tt.isCopy, got, tt.want)
+		}
+	}
+}
+
+func TestStageProgress(t *testing.T) {
+	if (&recipe{}).stageProgress("linux/amd64", "build") != nil {
+		t.Error("progress function returned without a build progress function")
+	}
+
+	var got []Event
+	r := &recipe{progress: func(ev Event) { got = append(got, ev) }}
+	r.stageProgress("linux/arm64", "build")(Event{Kind: EventStep, Message: "run make"})
+
+	want := Event{Kind: EventStep, Platform: "linux/arm64", Stage: "build", Message: "run make"}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("events = %+v, want [%+v]", got, want)
+	}
+}
+
+func TestPullProgress(t *testing.T) {
+	if (&recipe{}).pullProgress("linux/amd64") != nil {
+		t.Error("pull progress function returned without a build progress function")
+	}
+
+	var got []Event
+	r := &recipe{progress: func(ev Event) { got = append(got, ev) }}
+	progress := r.pullProgress("linux/arm64")
+	progress(runtime.TransferProgress{Image: "alpine:3.21", Item: "sha256:4abc", Event: "downloading", Current: 512, Total: 2048})
+	progress(runtime.TransferProgress{Image: "alpine:3.21", Item: "sha256:5def", Event: "waiting"})
+
+	want := []Event{
+		{Kind: EventPull, Platform: "linux/arm64", Message: "alpine:3.21: downloading sha256:4abc 25%", Current: 512, Total: 2048},
+		{Kind: EventPull, Platform: "linux/arm64", Message: "alpine:3.21: waiting sha256:5def"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+}
+
+func TestOutputEmitter(t *testing.T) {
+	var got []Event
+	w := &outputEmitter{
+		progress: func(ev Event) { got = append(got, ev) },
+		stream:   "stderr",
+	}
+
+	w.Write([]byte("compiling a\ncompil"))
+	w.Write([]byte("ing b\n\nlinking"))
+	if len(got) != 3 {
+		t.Fatalf("got %d events before flush, want 3", len(got))
+	}
+	w.Flush()
+	w.Flush()
+
+	want := []string{"compiling a", "compiling b", "", "linking"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i, ev := range got {
+		if ev.Kind != EventOutput || ev.Stream != "stderr" || ev.Message != want[i] {
+			t.Errorf("event %d = %+v, want output %q", i, ev, want[i])
+		}
+	}
+}
+
+func TestOutputEmitterSplitsLongLines(t *testing.T) {
+	var got []Event
+	w := &outputEmitter{progress: func(ev Event) { got = append(got, ev) }, stream: "stdout"}
+
+	w.Write(bytes.Repeat([]byte("x"), maxOutputLine+10))
+	w.Flush()
+
+	if len(got) != 2 || len(got[0].Message) != maxOutputLine || len(got[1].Message) != 10 {
+		t.Errorf("got %d events for a long line", len(got))
+	}
+}
+
+func TestOutputEmitterSampling(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample OutputSampling
+		want   []string
+	}{
+		{name: "disabled", want: []string{"1", "2", "3", "4", "5", "6"}},
+		{name: "head and tail", sample: OutputSampling{HeadLines: 2, TailLines: 2}, want: []string{"1", "2", "2 lines omitted", "5", "6"}},
+		{name: "head only", sample: OutputSampling{HeadLines: 2}, want: []string{"1", "2", "4 lines omitted"}},
+		{name: "byte limit", sample: OutputSampling{HeadBytes: 3, TailLines: 1}, want: []string{"1", "2", "3", "2 lines omitted", "6"}},
+		{name: "under threshold", sample: OutputSampling{HeadLines: 6, TailLines: 2}, want: []string{"1", "2", "3", "4", "5", "6"}},
+		{name: "tail covers the rest", sample: OutputSampling{HeadLines: 4, TailLines: 5}, want: []string{"1", "2", "3", "4", "5", "6"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			w := &outputEmitter{
+				progress: func(ev Event) {
+					if ev.Stream != "stdout" {
+						t.Errorf("event %+v from the wrong stream", ev)
+					}
+					got = append(got, ev.Message)
+				},
+				stream: "stdout",
+				sample: tt.sample,
+			}
+			w.Write([]byte("1\n2\n3\n4\n5\n6"))
+			w.Flush()
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputSamplingValidate(t *testing.T) {
+	if err := (OutputSampling{HeadLines: 10, TailLines: 5}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (OutputSampling{HeadLines: -1}).validate(); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("error = %v, want ErrInvalidOptions", err)
+	}
+}
@@ -0,0 +1,109 @@
+package build
+
+import (
+	"context"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+// Makes the container's root filesystem read-only except for the paths the
+// stage's steps write to, and returns those paths.
+func restrictWrites(ctx context.Context, ctr *runtime.Container, steps []manifest.Step, cleanup []string, state *stepState) ([]string, error) {
+	writable, err := writablePaths(steps, cleanup, state)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctr.RestrictWrites(ctx, writable); err != nil {
+		return nil, crex.Wrap(runtime.ErrRuntime, err)
+	}
+	return writable, nil
+}
+
+// Collects the directories a stage is expected to write to.
+//
+// Used when the root filesystem is read-only. The writable set contains the
+// effective workdir of every operation, the destination directory of every
+// copy, and the parent directory of every cleanup path. Modifiers are
+// tracked exactly as during execution so the set matches what the steps
+// will do. Nested paths are folded into their closest writable ancestor.
+// A stage that needs to write to "/" itself cannot be restricted and is
+// rejected. Variables in paths are expanded against the environment of
+// state, which is not modified.
+func writablePaths(steps []manifest.Step, cleanup []string, state *stepState) ([]string, error) {
+	set := make(map[string]struct{})
+
+	walk := newStepState()
+	maps.Copy(walk.env, state.env)
+	walk.allowUndefined = state.allowUndefined
+	if err := collectWritable(steps, walk, set); err != nil {
+		return nil, err
+	}
+	for _, path := range cleanup {
+		set[filepath.Dir(filepath.Clean(path))] = struct{}{}
+	}
+
+	if _, ok := set["/"]; ok {
+		return nil, crex.Wrapf(ErrBuild, "stage writes to / which cannot stay writable under a read-only root filesystem")
+	}
+
+	return foldPaths(set), nil
+}
+
+// Walks the steps, adding the directories each operation writes to.
+func collectWritable(steps []manifest.Step, state *stepState, set map[string]struct{}) error {
+	for i, step := range steps {
+		switch {
+		case len(step.Steps) > 0:
+			state.apply(step)
+			if err := collectWritable(step.Steps, state, set); err != nil {
+				return err
+			}
+
+		case step.Run != "" || step.Copy != "":
+			resolved := state.resolve(step)
+			step, err := resolved.expand(step)
+			if err != nil {
+				return crex.Wrapf(ErrBuild, "step %d: %w", i+1, err)
+			}
+			if resolved.workdir != "" {
+				set[filepath.Clean(resolved.workdir)] = struct{}{}
+			}
+			if step.Copy != "" {
+				dest, err := copyDest(step.Copy, resolved.workdir)
+				if err != nil {
+					return crex.Wrapf(ErrBuild, "step %d: %w", i+1, err)
+				}
+				set[filepath.Dir(dest)] = struct{}{}
+			}
+
+		default:
+			state.apply(step)
+		}
+	}
+	return nil
+}
+
+// Returns the paths in sorted order with any path nested under another
+// path in the set removed.
+func foldPaths(set map[string]struct{}) []string {
+	all := make([]string, 0, len(set))
+	for path := range set {
+		all = append(all, path)
+	}
+	slices.Sort(all)
+
+	var folded []string
+	for _, path := range all {
+		if n := len(folded); n > 0 && strings.HasPrefix(path, folded[n-1]+"/") {
+			continue
+		}
+		folded = append(folded, path)
+	}
+	return folded
+}
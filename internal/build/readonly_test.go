@@ -0,0 +1,64 @@
+package build
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestWritablePaths(t *testing.T) {
+	steps := []manifest.Step{
+		{Workdir: "/app"},
+		{Run: "make"},
+		{Copy: "config.yaml /etc/app/config.yaml"},
+		{Copy: "bin out/bin", Workdir: "/srv"},
+		{Run: "go test ./...", Workdir: "/app/src"},
+	}
+
+	got, err := writablePaths(steps, []string{"/root/.cache"}, newStepState())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"/app", "/etc/app", "/root", "/srv"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("writablePaths = %v, want %v", got, want)
+	}
+}
+
+func TestWritablePathsGroup(t *testing.T) {
+	steps := []manifest.Step{
+		{Workdir: "/opt", Steps: []manifest.Step{{Run: "true"}}},
+		{Run: "true"},
+	}
+
+	got, err := writablePaths(steps, nil, newStepState())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(got, []string{"/opt"}) {
+		t.Fatalf("writablePaths = %v, want [/opt]", got)
+	}
+}
+
+func TestWritablePathsRoot(t *testing.T) {
+	steps := []manifest.Step{{Copy: "file /file"}}
+	if _, err := writablePaths(steps, nil, newStepState()); err == nil {
+		t.Fatal("expected error for a copy into /, got nil")
+	}
+}
+
+func TestFoldPaths(t *testing.T) {
+	set := map[string]struct{}{
+		"/app":     {},
+		"/app/bin": {},
+		"/apple":   {},
+		"/var/lib": {},
+	}
+	got := foldPaths(set)
+	want := []string{"/app", "/apple", "/var/lib"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("foldPaths = %v, want %v", got, want)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/cruciblehq/crex"
@@ -17,24 +20,122 @@ import (
 
 // Holds shared state for building all stages of a recipe.
 type recipe struct {
-	rt         *runtime.Runtime     // Container runtime for image and container operations.
-	resource   string               // Resource name, used as a prefix for container IDs.
-	output     string               // Output directory for the final build artifact.
-	context    string               // Directory containing the manifest, root for resolving copy sources.
-	entrypoint []string             // OCI entrypoint to set on the output image (services only).
-	platforms  []string             // Target platforms to build for.
-	containers []*runtime.Container // All stage containers across all platforms, destroyed after the build completes.
+	rt             *runtime.Runtime         // Container runtime for image and container operations.
+	resource       string                   // Resource name, used as a prefix for container IDs.
+	output         string                   // Output directory for the final build artifact.
+	context        string                   // Directory containing the manifest, root for resolving copy sources.
+	entrypoint     []string                 // OCI entrypoint to set on the output image (services only).
+	appendEntry    []string                 // Arguments appended to the output image's entrypoint.
+	cmd            []string                 // OCI cmd to set on the output image.
+	keepCmd        bool                     // Whether the base cmd survives an entrypoint replacement.
+	platformCfg    map[string]ImageConfig   // Entrypoint and cmd settings overriding the ones above, per platform.
+	platforms      []string                 // Target platforms to build for.
+	args           map[string]string        // Build arguments, the initial environment of every stage.
+	epoch          *int64                   // Value of SOURCE_DATE_EPOCH for run steps, nil for none.
+	stageOpts      map[string]StageOptions  // Per-stage settings keyed by [stageKey].
+	maxLayer       int64                    // Maximum size in bytes of an exported layer. Zero means unlimited.
+	allowFallback  bool                     // Whether export may fall back to the first manifest of a base image index.
+	byDigest       bool                     // Whether archives are named after the digest of their image.
+	format         runtime.ExportFormat     // Layout of the exported archives.
+	readOnly       bool                     // Whether stage containers run with a read-only root filesystem.
+	strictStderr   bool                     // Whether run steps fail when they write to stderr.
+	copyOwner      *owner                   // Default ownership of copied files, nil to keep the source's.
+	ignore         *ignoreRules             // Patterns of the context's .cruxignore, nil when it has none.
+	remote         *RemoteContext           // Fetches the context from the client, nil when it is on the daemon's host.
+	warnings       *warnings                // Non-fatal issues found so far, nil to only log them.
+	followLinks    bool                     // Whether copies follow symbolic links inside host directories.
+	strictModes    bool                     // Whether host copies of files with unsafe modes fail.
+	allowUndefined bool                     // Whether undefined variables in commands, copy paths, and workdirs expand to nothing.
+	stageRetries   int                      // Times a stage is rebuilt after an infrastructure error.
+	noCache        bool                     // Whether the build cache is bypassed.
+	cacheKeys      map[string]string        // Final build cache keys of finished stages by container ID.
+	exportStages   []string                 // Keys of the stages also exported for debugging.
+	buildID        string                   // Unique ID of the build, the last part of every container ID.
+	debug          []debugExport            // Stages of the current platform waiting for a debug export.
+	annotate       bool                     // Whether exported layers are annotated with their source stage.
+	labels         map[string]string        // Labels of the output image's config.
+	tags           []string                 // References the output image is named by in its archives.
+	compression    runtime.Compression      // Algorithm the output image's layer is compressed with.
+	level          int                      // Level the output image's layer is compressed at, zero for the default.
+	squash         bool                     // Whether the output image is exported as a single layer.
+	push           string                   // Registry reference the output image is pushed to.
+	pushOnly       bool                     // Whether image.tar is skipped when pushing.
+	pushed         string                   // Reference and digest of the pushed image.
+	archives       []string                 // Paths of the archives written, in platform order.
+	progress       ProgressFunc             // Receives progress events, nil for none.
+	sampling       OutputSampling           // Limits the run output reported as progress events.
+	ctrOpts        runtime.ContainerOptions // Settings applied to every stage container.
+	breakAt        *Breakpoint              // Where to pause the build, if anywhere.
+	paused         *runtime.Container       // Container left running at the breakpoint, excluded from cleanup.
+	containers     []*runtime.Container     // All stage containers across all platforms, destroyed after the build completes.
 }
 
+// Environment variable through which toolchains that support reproducible
+// builds take the timestamp to embed in their output.
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// Sets the environment every stage starts with.
+//
+// SOURCE_DATE_EPOCH is set first, when configured, so that a build argument
+// of the same name, and after it any step env, takes precedence.
+func (r *recipe) initEnv(env map[string]string) {
+	if r.epoch != nil {
+		env[sourceDateEpochEnv] = strconv.FormatInt(*r.epoch, 10)
+	}
+	maps.Copy(env, r.args)
+}
+
+// Layer annotation naming the stage that produced an exported layer, keyed
+// as in [Options.Stages].
+const layerStageAnnotation = "io.github.cruciblehq.cruxd.layer.stage"
+
 // Creates a new [recipe] from the given options.
+//
+// The options must have been validated by [Run].
 func newRecipe(rt *runtime.Runtime, opts Options) *recipe {
+	copyOwner, _ := parseOwner(opts.CopyChown)
 	return &recipe{
-		rt:         rt,
-		resource:   opts.Resource,
-		output:     opts.Output,
-		context:    opts.Root,
-		entrypoint: opts.Entrypoint,
-		platforms:  opts.Platforms,
+		rt:             rt,
+		resource:       opts.Resource,
+		output:         opts.Output,
+		context:        opts.Root,
+		remote:         opts.Context,
+		entrypoint:     opts.Entrypoint,
+		appendEntry:    opts.AppendEntrypoint,
+		cmd:            opts.Cmd,
+		keepCmd:        opts.KeepCmd,
+		platformCfg:    opts.PlatformConfigs,
+		platforms:      opts.Platforms,
+		args:           opts.Args,
+		epoch:          opts.SourceDateEpoch,
+		stageOpts:      opts.Stages,
+		maxLayer:       opts.MaxLayerSize,
+		allowFallback:  opts.AllowPlatformFallback,
+		byDigest:       opts.DigestFilename,
+		format:         opts.ExportFormat,
+		readOnly:       opts.ReadOnlyRootfs,
+		strictStderr:   opts.StrictStderr,
+		copyOwner:      copyOwner,
+		followLinks:    opts.CopySymlinks == SymlinksFollow,
+		strictModes:    opts.StrictCopyModes,
+		allowUndefined: opts.AllowUndefinedVars,
+		stageRetries:   opts.StageRetries,
+		noCache:        opts.NoCache,
+		cacheKeys:      make(map[string]string),
+		exportStages:   opts.ExportStages,
+		buildID:        opts.BuildID,
+		annotate:       opts.AnnotateLayers,
+		labels:         opts.Labels,
+		tags:           opts.Tags,
+		compression:    opts.Compression,
+		level:          opts.CompressionLevel,
+		squash:         opts.Squash,
+		push:           opts.Push,
+		pushOnly:       opts.PushOnly,
+		progress:       opts.Progress,
+		sampling:       opts.OutputSampling,
+		ctrOpts:        opts.containerOptions(),
+		breakAt:        opts.BreakAt,
 	}
 }
 
@@ -53,30 +154,60 @@ func (r *recipe) build(ctx context.Context, recipeStages []manifest.Stage) (*Res
 		if err := r.buildPlatform(ctx, recipeStages, platform); err != nil {
 			return nil, err
 		}
+		if r.paused != nil {
+			slog.Info("build paused at breakpoint", "container", r.paused.ID(), "stage", r.breakAt.Stage, "step", r.breakAt.Step)
+			return &Result{Output: r.output, Container: r.paused.ID(), Warnings: r.warnings.all()}, nil
+		}
 	}
 
-	return &Result{Output: r.output}, nil
+	return &Result{Output: r.output, Pushed: r.pushed, Archives: r.archives, Warnings: r.warnings.all()}, nil
 }
 
 // Builds all stages of the recipe for a single platform.
 //
 // Each platform maintains its own set of named stage containers for
 // cross-stage copy lookups. The output is written to a platform-specific
-// subdirectory when building for multiple platforms.
+// subdirectory when building for multiple platforms, and not at all for a
+// push-only build, whose debug exports create the directories they need.
+// Each stage's base image is prepared in the background while the previous
+// stage builds.
 func (r *recipe) buildPlatform(ctx context.Context, recipeStages []manifest.Stage, platform string) error {
 	slog.Info("building platform", "platform", platform)
+	r.emit(Event{Kind: EventPlatform, Platform: platform})
 
 	output := r.platformOutput(platform)
-	if err := os.MkdirAll(output, paths.DefaultDirMode); err != nil {
-		return crex.Wrap(ErrFileSystemOperation, err)
+	if !r.pushOnly {
+		if err := os.MkdirAll(output, paths.DefaultDirMode); err != nil {
+			return crex.Wrap(ErrFileSystemOperation, err)
+		}
 	}
 
 	stages := make(map[string]*runtime.Container)
+	r.debug = nil
 
-	for i, stage := range recipeStages {
-		if err := r.buildStage(ctx, stage, i, platform, output, stages); err != nil {
-			return crex.Wrapf(ErrBuild, "platform %s, stage %s: %w", platform, stageLabel(stage.Name, i), err)
-		}
+	stageErr := func(i int, err error) error {
+		return crex.Wrapf(ErrBuild, "platform %s, stage %s: %w", platform, stageLabel(recipeStages[i].Name, i), err)
+	}
+	err := prefetchStages(ctx, len(recipeStages),
+		func(ctx context.Context, i int) (*runtime.Image, error) {
+			img, err := r.prepareImage(ctx, r.platformStage(recipeStages[i], i, platform), platform)
+			if err != nil {
+				return nil, stageErr(i, err)
+			}
+			return img, nil
+		},
+		func(ctx context.Context, i int, base *runtime.Image) (bool, error) {
+			if err := r.buildStageWithRetry(ctx, recipeStages[i], i, platform, output, stages, base); err != nil {
+				return false, stageErr(i, err)
+			}
+			return r.paused == nil, nil
+		})
+	if err != nil || r.paused != nil {
+		return err
+	}
+
+	if err := r.exportDebugStages(ctx, r.debug, output); err != nil {
+		return crex.Wrapf(ErrBuild, "platform %s: %w", platform, err)
 	}
 
 	return nil
@@ -84,16 +215,42 @@ func (r *recipe) buildPlatform(ctx context.Context, recipeStages []manifest.Stag
 
 // Builds a single stage of a recipe for a specific platform.
 //
-// Resolves the stage's base image, starts a build container, executes the
-// stage's steps, then commits the result. Non-transient stages are exported
-// to the output directory.
-func (r *recipe) buildStage(ctx context.Context, stage manifest.Stage, index int, platform, output string, stages map[string]*runtime.Container) error {
+// Starts a build container from the prepared base image, executes the
+// stage's steps, runs its verification commands, then commits the result.
+// Non-transient stages are exported to the output directory. A stage
+// holding the breakpoint stops after the breakpoint's step and is neither
+// cleaned up nor exported. A stage that runs no commands gets a container
+// without a task; see [copyOnly].
+func (r *recipe) buildStage(ctx context.Context, stage manifest.Stage, index int, platform, output string, stages map[string]*runtime.Container, base *runtime.Image) error {
 	label := stageLabel(stage.Name, index)
 	slog.Info(fmt.Sprintf("building stage %s", label), "platform", platform)
+	r.emit(Event{Kind: EventStage, Platform: platform, Stage: label, Message: stage.From})
+
+	opts := r.stageOptions(stage.Name, index)
+
+	id := r.containerID(stage.Name, index, platform)
+	ctrOpts := r.ctrOpts
+	if ctrOpts.Hostname == "" {
+		ctrOpts.Hostname = stageHostname(stage.Name, id)
+	}
+	ctrOpts.MemoryLimit = opts.MemoryLimit
+	ctrOpts.CPUs = opts.CPUs
+
+	// Copy-only stages skip the task unless they stop at a breakpoint,
+	// where the container is left running for debugging, or have commands
+	// to verify them with.
+	idle := copyOnly(stage.Steps) && len(opts.Verify) == 0 && !r.breakAt.matches(stage.Name, index)
 
-	ctr, err := r.startStageContainer(ctx, stage, index, platform)
+	var ctr *runtime.Container
+	var err error
+	if idle {
+		slog.Debug("building copy-only stage without a task", "stage", label)
+		ctr, err = r.rt.CreateImage(ctx, base, id, ctrOpts)
+	} else {
+		ctr, err = r.rt.StartImage(ctx, base, id, ctrOpts)
+	}
 	if err != nil {
-		return err
+		return crex.Wrap(runtime.ErrRuntime, err)
 	}
 
 	r.containers = append(r.containers, ctr)
@@ -101,40 +258,84 @@ func (r *recipe) buildStage(ctx context.Context, stage manifest.Stage, index int
 		stages[stage.Name] = ctr
 	}
 
-	if err := executeSteps(ctx, ctr, stage.Steps, newStepState(), r.context, stages); err != nil {
-		return err
+	state := newStepState()
+	r.initEnv(state.env)
+	state.allowUndefined = r.allowUndefined
+	state.strictStderr = r.strictStderr
+	state.copyOwner = r.copyOwner
+	state.ignore = r.ignore
+	state.remote = r.remote
+	state.warnings = r.warnings
+	state.followLinks = r.followLinks
+	state.strictModes = r.strictModes
+	state.allowStderr = opts.AllowStderr
+	state.progress = r.stageProgress(platform, label)
+	state.sampling = r.sampling
+
+	var writable []string
+	if r.readOnly && !idle {
+		if writable, err = restrictWrites(ctx, ctr, stage.Steps, opts.Cleanup, state); err != nil {
+			return err
+		}
+	}
+	if !r.noCache {
+		state.cache = newStepCache(base.Digest(), platform, r.resource, writable, r.cacheKeys)
 	}
 
-	if !stage.Transient {
-		return r.exportStage(ctx, ctr, output)
+	if r.breakAt.matches(stage.Name, index) {
+		if err := executeSteps(ctx, ctr, stage.Steps[:r.breakAt.Step], state, r.context, stages); err != nil {
+			return err
+		}
+		if err := state.cache.flush(ctx, ctr); err != nil {
+			return err
+		}
+		if err := ctr.MarkPaused(ctx); err != nil {
+			return err
+		}
+		r.paused = ctr
+		return nil
 	}
 
-	return nil
-}
+	if err := executeSteps(ctx, ctr, stage.Steps, state, r.context, stages); err != nil {
+		return err
+	}
+	if err := state.cache.flush(ctx, ctr); err != nil {
+		return err
+	}
 
-// Resolves the base image source and starts the stage container.
-func (r *recipe) startStageContainer(ctx context.Context, stage manifest.Stage, index int, platform string) (*runtime.Container, error) {
-	src, err := r.resolveImageSource(stage)
+	if err := cleanupStage(ctx, ctr, opts.Cleanup); err != nil {
+		return err
+	}
+	state.cache.finish(ctr.ID(), opts.Cleanup)
+
+	// Verification runs with the shell, working directory, and environment
+	// the steps left behind.
+	err = verifyStage(ctx, opts.Verify, func(ctx context.Context, command string) (*runtime.ExecResult, error) {
+		r.emit(Event{Kind: EventVerify, Platform: platform, Stage: label, Message: command})
+		return runStep(ctx, ctr, command, state)
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	id := r.containerID(stage.Name, index, platform)
-
-	var ctr *runtime.Container
-	switch src.Type {
-	case manifest.SourceFile:
-		ctr, err = r.rt.StartContainer(ctx, src.Value, id, platform)
-	case manifest.SourceOCI:
-		ctr, err = r.rt.StartContainerFromOCI(ctx, src.Value, id, platform)
-	default:
-		return nil, crex.Wrapf(ErrBuild, "unsupported source type %q", src.Type)
+	key := stageKey(stage.Name, index)
+	if !stage.Transient {
+		r.emit(Event{Kind: EventExport, Platform: platform, Stage: label})
+		if err := r.exportStage(ctx, ctr, key, platform, output); err != nil {
+			return err
+		}
 	}
-	if err != nil {
-		return nil, crex.Wrap(runtime.ErrRuntime, err)
+
+	if slices.Contains(r.exportStages, key) {
+		r.debug = append(r.debug, debugExport{ctr: ctr, key: key})
 	}
 
-	return ctr, nil
+	return nil
+}
+
+// Returns the settings for a stage, or the zero value when none were given.
+func (r *recipe) stageOptions(name string, index int) StageOptions {
+	return r.stageOpts[stageKey(name, index)]
 }
 
 // Resolves the stage's base image source.
@@ -156,38 +357,120 @@ func (r *recipe) resolveImageSource(stage manifest.Stage) (manifest.Source, erro
 }
 
 // Stops the container and exports it as the final image.
-func (r *recipe) exportStage(ctx context.Context, ctr *runtime.Container, output string) error {
+//
+// When layer annotations are enabled, the committed layer is annotated with
+// the key of the stage that produced it. The image config carries the
+// platform's entrypoint and cmd settings, see [ImageConfig]. With a push
+// reference the image is pushed from containerd's content store, and the
+// archive is written only unless the build is push-only.
+func (r *recipe) exportStage(ctx context.Context, ctr *runtime.Container, stage, platform, output string) error {
 	if err := ctr.Stop(ctx); err != nil {
 		return crex.Wrap(runtime.ErrRuntime, err)
 	}
 
-	if err := ctr.Export(ctx, output, r.entrypoint); err != nil {
+	opts := runtime.ExportOptions{
+		Entrypoint:            r.entrypoint,
+		AppendEntrypoint:      r.appendEntry,
+		Cmd:                   r.cmd,
+		KeepCmd:               r.keepCmd,
+		MaxLayerSize:          r.maxLayer,
+		AllowPlatformFallback: r.allowFallback,
+		DigestFilename:        r.byDigest,
+		Format:                r.format,
+		Labels:                r.labels,
+		Tags:                  r.tags,
+		Compression:           r.compression,
+		CompressionLevel:      r.level,
+		Squash:                r.squash,
+	}
+	r.applyImageConfig(&opts, platform)
+	if r.annotate {
+		opts.LayerAnnotations = map[string]string{layerStageAnnotation: stage}
+	}
+
+	if r.push != "" {
+		archive := output
+		if r.pushOnly {
+			archive = ""
+		}
+		digest, path, err := r.rt.Push(ctx, ctr, r.push, archive, opts)
+		if err != nil {
+			return crex.Wrap(runtime.ErrRuntime, err)
+		}
+		r.pushed = r.push + "@" + digest
+		if path != "" {
+			r.archives = append(r.archives, path)
+		}
+		return nil
+	}
+
+	path, err := ctr.Export(ctx, output, opts)
+	if err != nil {
 		return crex.Wrap(runtime.ErrRuntime, err)
 	}
+	r.archives = append(r.archives, path)
 
 	return nil
 }
 
-// Destroys all stage containers.
+// Destroys all stage containers except one paused at a breakpoint.
 func (r *recipe) destroyContainers(ctx context.Context) {
 	for _, ctr := range r.containers {
-		ctr.Destroy(ctx)
+		if ctr != r.paused {
+			ctr.Destroy(ctx)
+		}
 	}
 }
 
-// Returns a unique container ID for a stage, scoped to this resource and platform.
+// Returns a unique container ID for a stage, scoped to this build, resource,
+// and platform.
 //
 // If resource namescontain any slashes (e.g., "crucible/runtime-go"), they are
 // replaced with dashes to ensure the resulting container ID is valid. The stage
 // name is included when available for readability; otherwise, the 1-based stage
-// index is used.
+// index is used. The build ID comes last, so that concurrent builds of the same
+// resource never replace each other's containers while the IDs still start
+// with the resource and platform for [runtime.Runtime.DestroyByPrefix].
 func (r *recipe) containerID(name string, index int, platform string) string {
 	resource := protocol.ContainerID(r.resource)
 	slug := platformSlug(platform)
+	build := protocol.ContainerID(r.buildID)
 	if name != "" {
-		return fmt.Sprintf("%s-%s-stage-%s", resource, slug, name)
+		return fmt.Sprintf("%s-%s-stage-%s-%s", resource, slug, name, build)
+	}
+	return fmt.Sprintf("%s-%s-stage-%d-%s", resource, slug, index+1, build)
+}
+
+// Returns the default hostname of a stage container.
+//
+// The stage name is used when the stage has one, and the container ID
+// otherwise, so that logs written inside the container identify the stage.
+// Characters a hostname cannot contain are replaced with hyphens and the
+// result is cut to a single 63-character label.
+func stageHostname(name, id string) string {
+	host := name
+	if host == "" {
+		host = id
+	}
+
+	host = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		}
+		return '-'
+	}, host)
+	if len(host) > 63 {
+		host = host[:63]
 	}
-	return fmt.Sprintf("%s-%s-stage-%d", resource, slug, index+1)
+
+	host = strings.Trim(host, "-")
+	if host == "" {
+		return "build"
+	}
+	return host
 }
 
 // Returns the output directory for a specific platform.
@@ -209,6 +492,17 @@ func platformSlug(platform string) string {
 	return strings.ReplaceAll(platform, "/", "-")
 }
 
+// Returns the key identifying a stage in [Options.Stages].
+//
+// Named stages are keyed by name. Unnamed stages are keyed by their 1-based
+// index, matching the position shown in build errors.
+func stageKey(name string, index int) string {
+	if name != "" {
+		return name
+	}
+	return strconv.Itoa(index + 1)
+}
+
 // Returns a label for a stage, preferring the name when available and falling
 // back to the 1-based index.
 func stageLabel(name string, index int) string {
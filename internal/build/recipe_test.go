@@ -0,0 +1,107 @@
+package build
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestStageHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want string
+	}{
+		{name: "builder", id: "app-linux-amd64-stage-builder", want: "builder"},
+		{id: "app-linux-amd64-stage-1", want: "app-linux-amd64-stage-1"},
+		{name: "Go_Build", want: "go-build"},
+		{name: "-tools.", want: "tools"},
+		{name: "__", want: "build"},
+		{name: strings.Repeat("x", 70), want: strings.Repeat("x", 63)},
+	}
+
+	for _, tt := range tests {
+		if got := stageHostname(tt.name, tt.id); got != tt.want {
+			t.Errorf("stageHostname(%q, %q) = %q, want %q", tt.name, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestContainerIDPerBuild(t *testing.T) {
+	first := newRecipe(nil, Options{Resource: "crucible/runtime-go", BuildID: "build-0000000000000001"})
+	second := newRecipe(nil, Options{Resource: "crucible/runtime-go", BuildID: "build-0000000000000002"})
+
+	stages := []struct {
+		name  string
+		index int
+	}{
+		{name: "builder", index: 0},
+		{index: 1},
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range []*recipe{first, second} {
+		for _, platform := range []string{"linux/amd64", "linux/arm64"} {
+			for _, s := range stages {
+				id := r.containerID(s.name, s.index, platform)
+				if seen[id] {
+					t.Errorf("container ID %q used twice", id)
+				}
+				seen[id] = true
+
+				prefix := "crucible-runtime-go-" + platformSlug(platform) + "-stage-"
+				if !strings.HasPrefix(id, prefix) || !strings.HasSuffix(id, "-"+r.buildID) {
+					t.Errorf("container ID %q does not start with %q and end with the build ID", id, prefix)
+				}
+			}
+		}
+	}
+}
+
+func TestSourceDateEpochEnv(t *testing.T) {
+	epoch := int64(1700000000)
+
+	tests := []struct {
+		name  string
+		opts  Options
+		step  manifest.Step
+		want  string
+		unset bool
+	}{
+		{name: "set", opts: Options{SourceDateEpoch: &epoch}, want: "SOURCE_DATE_EPOCH=1700000000"},
+		{name: "zero", opts: Options{SourceDateEpoch: new(int64)}, want: "SOURCE_DATE_EPOCH=0"},
+		{name: "unset", unset: true},
+		{
+			name: "build argument wins",
+			opts: Options{SourceDateEpoch: &epoch, Args: map[string]string{"SOURCE_DATE_EPOCH": "42"}},
+			want: "SOURCE_DATE_EPOCH=42",
+		},
+		{
+			name: "step env wins",
+			opts: Options{SourceDateEpoch: &epoch},
+			step: manifest.Step{Env: map[string]string{"SOURCE_DATE_EPOCH": "7"}},
+			want: "SOURCE_DATE_EPOCH=7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newStepState()
+			newRecipe(nil, tt.opts).initEnv(state.env)
+
+			tt.step.Run = "make"
+			env := state.resolve(tt.step).environ()
+			if tt.unset {
+				if slices.ContainsFunc(env, func(kv string) bool { return strings.HasPrefix(kv, "SOURCE_DATE_EPOCH=") }) {
+					t.Errorf("env = %v, want no SOURCE_DATE_EPOCH", env)
+				}
+				return
+			}
+			if !slices.Contains(env, tt.want) {
+				t.Errorf("env = %v, want %q", env, tt.want)
+			}
+		})
+	}
+}
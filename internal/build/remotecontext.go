@@ -0,0 +1,660 @@
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cruciblehq/crex"
+)
+
+// Prefix of the file digests in a [ContextEntry].
+const contextDigestPrefix = "sha256:"
+
+// Size of a tar block, the unit archive headers and contents are padded to.
+const tarBlockSize = 512
+
+// Longest chain of symbolic links followed when resolving a path of a
+// [RemoteContext], as the kernel allows.
+const maxLinkHops = 40
+
+// File, directory, or symbolic link of a build context kept on the client's
+// host, as the client advertises it for a [RemoteContext].
+type ContextEntry struct {
+	Path    string      // Slash-separated path from the context root.
+	Mode    fs.FileMode // File type and permissions.
+	Size    int64       // Size of a regular file in bytes.
+	Digest  string      // SHA-256 of a regular file's contents, as "sha256:<hex>".
+	Link    string      // Target of a symbolic link.
+	ModTime time.Time   // Modification time of a regular file or directory.
+}
+
+// Transfers files of a [RemoteContext] from the client that holds them.
+//
+// Fetch returns a tar archive holding the regular files at paths, which are
+// relative to the context root and slash-separated, in any order. Only the
+// names and contents of the archive's entries are used; everything else
+// about a file is taken from its [ContextEntry].
+type ContextFetcher interface {
+	Fetch(ctx context.Context, paths []string) (io.ReadCloser, error)
+}
+
+// How much of a build context sent by the client was transferred.
+type ContextStats struct {
+	Files       int   // Regular files in the context.
+	Size        int64 // Bytes of file data in the context.
+	Fetched     int   // Files transferred to the daemon.
+	Transferred int64 // Bytes of archive received for them, headers included.
+	FullSize    int64 // Bytes an archive of the whole context takes.
+}
+
+// Returns the archive bytes not transferred because the files were not
+// needed.
+func (s ContextStats) Saved() int64 {
+	return max(s.FullSize-s.Transferred, 0)
+}
+
+// Build context whose files stay on the client's host until a copy step
+// needs them.
+//
+// The client advertises the context's tree up front, and its directories
+// and symbolic links are recreated in a staging directory right away. A
+// regular file is fetched through the [ContextFetcher] the first time a
+// copy step reads it, whether the step names it, a directory holding it,
+// or a glob pattern matching it, so files no step copies, such as
+// node_modules or .git, are never transferred, and neither are files the
+// context's .cruxignore leaves out of the copied directories. Every fetched
+// file is checked against its advertised size and digest. Once fetched, a
+// file is read from the staging directory like the files of a context on
+// the daemon's host.
+type RemoteContext struct {
+	dir      string                  // Staging directory the context is recreated in.
+	entries  map[string]ContextEntry // Advertised entries by path.
+	children map[string][]string     // Paths of the entries in each directory, "." for the root, sorted.
+	fetcher  ContextFetcher          // Transfers files from the client.
+
+	mu      sync.Mutex      // Serializes fetches and protects fetched and stats.
+	fetched map[string]bool // Regular files already in the staging directory.
+	stats   ContextStats    // Transfer so far.
+}
+
+// Creates a remote context from the entries the client advertised,
+// recreating its directories and symbolic links in dir, which must be an
+// existing empty directory.
+//
+// Every entry must be a regular file with a digest, a directory, or a
+// symbolic link, at a clean relative path whose parent is an advertised
+// directory. A tree that breaks these rules fails with [ErrInvalidOptions].
+func NewRemoteContext(dir string, entries []ContextEntry, fetcher ContextFetcher) (*RemoteContext, error) {
+	c := &RemoteContext{
+		dir:      dir,
+		entries:  make(map[string]ContextEntry, len(entries)),
+		children: make(map[string][]string),
+		fetcher:  fetcher,
+		fetched:  make(map[string]bool),
+	}
+	for _, e := range entries {
+		if err := validateContextEntry(e); err != nil {
+			return nil, err
+		}
+		if _, ok := c.entries[e.Path]; ok {
+			return nil, crex.Wrapf(ErrInvalidOptions, "build context entry %q advertised twice", e.Path)
+		}
+		c.entries[e.Path] = e
+	}
+
+	for p, e := range c.entries {
+		parent := path.Dir(p)
+		if pe, ok := c.entries[parent]; parent != "." && (!ok || !pe.Mode.IsDir()) {
+			return nil, crex.Wrapf(ErrInvalidOptions, "build context entry %q is not inside an advertised directory", p)
+		}
+		c.children[parent] = append(c.children[parent], p)
+		c.stats.FullSize += tarEntrySize(e)
+		if e.Mode.IsRegular() {
+			c.stats.Files++
+			c.stats.Size += e.Size
+		}
+	}
+	c.stats.FullSize += 2 * tarBlockSize
+	for _, names := range c.children {
+		slices.Sort(names)
+	}
+
+	if err := c.stage(); err != nil {
+		return nil, crex.Wrap(ErrFileSystemOperation, err)
+	}
+	return c, nil
+}
+
+// Checks that an advertised entry can be recreated as described.
+func validateContextEntry(e ContextEntry) error {
+	if e.Path == "" || e.Path == "." || path.IsAbs(e.Path) || path.Clean(e.Path) != e.Path || e.Path == ".." || strings.HasPrefix(e.Path, "../") {
+		return crex.Wrapf(ErrInvalidOptions, "invalid build context path %q", e.Path)
+	}
+	switch {
+	case e.Mode.IsRegular():
+		sum, ok := strings.CutPrefix(e.Digest, contextDigestPrefix)
+		if !ok || len(sum) != 2*sha256.Size || e.Size < 0 {
+			return crex.Wrapf(ErrInvalidOptions, "build context file %q needs a size and a %s digest", e.Path, contextDigestPrefix)
+		}
+	case e.Mode.IsDir():
+	case e.Mode&fs.ModeSymlink != 0:
+		if e.Link == "" {
+			return crex.Wrapf(ErrInvalidOptions, "build context link %q has no target", e.Path)
+		}
+	default:
+		return crex.Wrapf(ErrInvalidOptions, "build context entry %q is not a file, directory, or symbolic link", e.Path)
+	}
+	return nil
+}
+
+// Recreates the directories and symbolic links of the context in its
+// staging directory, giving the directories their advertised times once
+// everything inside them exists.
+func (c *RemoteContext) stage() error {
+	paths := slices.Sorted(maps.Keys(c.entries))
+	for _, p := range paths {
+		e := c.entries[p]
+		target := c.hostPath(p)
+		switch {
+		case e.Mode.IsDir():
+			if err := os.Mkdir(target, e.Mode.Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, fileMode(e.Mode)); err != nil {
+				return err
+			}
+		case e.Mode&fs.ModeSymlink != 0:
+			if err := os.Symlink(e.Link, target); err != nil {
+				return err
+			}
+		}
+	}
+	slices.Reverse(paths)
+	return c.restoreDirTimes(paths)
+}
+
+// Returns the staging directory, which stands in for the build context
+// root.
+func (c *RemoteContext) Dir() string {
+	return c.dir
+}
+
+// Returns how much of the context has been transferred so far.
+func (c *RemoteContext) Stats() ContextStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Fetches the files a copy step reads from the client, unless they were
+// fetched for an earlier step.
+//
+// Sources are selected the way the copy reads them: see [expandCopySources]
+// for glob patterns and [writeDirToTar] for directories, where the ignore
+// rules apply and followLinks decides whether the targets of links are
+// read. A source outside the context fails the copy, since it would be read
+// from the daemon's host. Inline copies read nothing. A nil context fetches
+// nothing.
+func (c *RemoteContext) fetchCopy(ctx context.Context, copyStr, workdir string, ignore *ignoreRules, followLinks bool) error {
+	if c == nil {
+		return nil
+	}
+	if _, ok, err := parseInlineCopy(copyStr, workdir); ok || err != nil {
+		return nil
+	}
+	srcs, _, err := parseCopy(copyStr, workdir)
+	if err != nil {
+		return nil
+	}
+	for _, src := range srcs {
+		if _, _, ok := parseStageCopy(src); ok {
+			continue
+		}
+		if rel := path.Clean(filepath.ToSlash(src)); path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return crex.Wrapf(ErrCopy, "%q is outside the build context sent by the client", src)
+		}
+	}
+	return c.fetch(ctx, srcs, ignore, followLinks)
+}
+
+// Fetches the regular files under the given sources that are not in the
+// staging directory yet. See [RemoteContext.fetchCopy].
+//
+// Cross-stage sources, sources outside the context, and paths the context
+// does not have are skipped, leaving it to the reader to report them.
+func (c *RemoteContext) fetch(ctx context.Context, srcs []string, ignore *ignoreRules, followLinks bool) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	want := make(map[string]bool)
+	for _, src := range srcs {
+		if _, _, ok := parseStageCopy(src); ok || src == "" {
+			continue
+		}
+		rel := path.Clean(filepath.ToSlash(src))
+		if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if !isGlob(rel) {
+			c.selectPath(rel, ignore, followLinks, want)
+			continue
+		}
+		for _, match := range c.glob(rel) {
+			if resolved, ok := c.resolve(match); ok && !ignore.excludes(match, c.isDir(resolved)) {
+				c.selectPath(match, ignore, followLinks, want)
+			}
+		}
+	}
+
+	var paths []string
+	for p := range want {
+		if !c.fetched[p] {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	slices.Sort(paths)
+
+	slog.Debug("fetching build context files", "files", len(paths))
+	r, err := c.fetcher.Fetch(ctx, paths)
+	if err != nil {
+		return crex.Wrap(ErrContextTransfer, err)
+	}
+	defer r.Close()
+	if err := c.receive(r, paths); err != nil {
+		return crex.Wrap(ErrContextTransfer, err)
+	}
+	return nil
+}
+
+// Adds the regular files a copy of p reads to want: p itself, or what is
+// inside it for a directory. The path p is the one the copy names, which
+// the ignore rules are matched against, and may lead through links.
+func (c *RemoteContext) selectPath(p string, ignore *ignoreRules, followLinks bool, want map[string]bool) {
+	resolved, ok := c.resolve(p)
+	if !ok {
+		return
+	}
+	if c.isDir(resolved) {
+		c.selectTree(p, resolved, ignore, followLinks, want, nil)
+		return
+	}
+	if c.entries[resolved].Mode.IsRegular() {
+		want[resolved] = true
+	}
+}
+
+// Adds the regular files under the directory dir to want, leaving out the
+// entries the ignore rules exclude along with everything inside them.
+//
+// Rules are matched against the paths the copy writes, below as, which
+// differ from the entries' own paths inside a directory reached through a
+// link. With followLinks, links are resolved and their targets read in
+// their place, except for a directory already among ancestors, whose copy
+// fails with [ErrSymlinkLoop] anyway.
+func (c *RemoteContext) selectTree(as, dir string, ignore *ignoreRules, followLinks bool, want map[string]bool, ancestors []string) {
+	if slices.Contains(ancestors, dir) {
+		return
+	}
+	ancestors = append(ancestors, dir)
+
+	for _, p := range c.children[dir] {
+		e := c.entries[p]
+		child := path.Join(as, path.Base(p))
+		if ignore.excludes(child, e.Mode.IsDir()) {
+			continue
+		}
+		switch {
+		case e.Mode.IsDir():
+			c.selectTree(child, p, ignore, followLinks, want, ancestors)
+		case e.Mode.IsRegular():
+			want[p] = true
+		case followLinks:
+			target, ok := c.resolve(p)
+			switch {
+			case !ok:
+			case c.isDir(target):
+				c.selectTree(child, target, ignore, followLinks, want, ancestors)
+			case c.entries[target].Mode.IsRegular():
+				want[target] = true
+			}
+		}
+	}
+}
+
+// Returns the paths of the context matching a slash-separated glob
+// pattern, as [filepath.Glob] would find them in the complete context.
+//
+// Each segment of the pattern is matched against the entries of the
+// directories the previous segments matched, following links to them.
+func (c *RemoteContext) glob(pattern string) []string {
+	matches := []string{"."}
+	for _, segment := range strings.Split(pattern, "/") {
+		var next []string
+		for _, m := range matches {
+			dir, ok := c.resolve(m)
+			if !ok || !c.isDir(dir) {
+				continue
+			}
+			for _, p := range c.children[dir] {
+				name := path.Base(p)
+				if ok, _ := path.Match(segment, name); ok {
+					next = append(next, path.Join(m, name))
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// Returns the path of the entry p leads to, following links among its
+// directories and in p itself. Reports false when p leads to nothing the
+// context has, or outside it.
+func (c *RemoteContext) resolve(p string) (string, bool) {
+	for range maxLinkHops {
+		if p == "." {
+			return p, true
+		}
+		parts := strings.Split(p, "/")
+		resolved := "."
+		followed := false
+		for i, part := range parts {
+			next := path.Join(resolved, part)
+			e, ok := c.entries[next]
+			if !ok {
+				return "", false
+			}
+			if e.Mode&fs.ModeSymlink == 0 {
+				resolved = next
+				continue
+			}
+			target := e.Link
+			if path.IsAbs(target) {
+				return "", false
+			}
+			p = path.Join(append([]string{path.Dir(next), target}, parts[i+1:]...)...)
+			if p == ".." || strings.HasPrefix(p, "../") {
+				return "", false
+			}
+			followed = true
+			break
+		}
+		if !followed {
+			return resolved, true
+		}
+	}
+	return "", false
+}
+
+// Reports whether the resolved path p is the root or a directory.
+func (c *RemoteContext) isDir(p string) bool {
+	return p == "." || c.entries[p].Mode.IsDir()
+}
+
+// Writes the files of a fetched archive to the staging directory, checking
+// that it holds the requested files and nothing else.
+func (c *RemoteContext) receive(r io.Reader, paths []string) error {
+	pending := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		pending[p] = true
+	}
+
+	counted := &countingReader{r: r}
+	defer func() { c.stats.Transferred += counted.n }()
+
+	tr := tar.NewReader(counted)
+	parents := make(map[string]bool)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		if !pending[name] || header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("archive holds %q, which was not requested", header.Name)
+		}
+		if err := c.writeFile(c.entries[name], tr); err != nil {
+			return err
+		}
+		delete(pending, name)
+		c.fetched[name] = true
+		c.stats.Fetched++
+		parents[path.Dir(name)] = true
+	}
+	if _, err := io.Copy(io.Discard, counted); err != nil {
+		return err
+	}
+
+	// Writing the files changed the times of their directories.
+	if err := c.restoreDirTimes(slices.Collect(maps.Keys(parents))); err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("archive is missing %d requested files, such as %q", len(pending), slices.Sorted(maps.Keys(pending))[0])
+	}
+	return nil
+}
+
+// Writes a fetched regular file to the staging directory with its
+// advertised mode and time, failing unless its contents match its size and
+// digest.
+func (c *RemoteContext) writeFile(e ContextEntry, r io.Reader) error {
+	target := c.hostPath(e.Path)
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, e.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, e.Size+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && (n != e.Size || contextDigestPrefix+hex.EncodeToString(h.Sum(nil)) != e.Digest) {
+		err = fmt.Errorf("%s does not match its advertised size and digest", e.Path)
+	}
+	if err == nil {
+		err = os.Chmod(target, fileMode(e.Mode))
+	}
+	if err == nil {
+		err = os.Chtimes(target, e.ModTime, e.ModTime)
+	}
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// Gives directories of the context their advertised times, in the order
+// given. The root keeps the staging directory's.
+func (c *RemoteContext) restoreDirTimes(paths []string) error {
+	for _, p := range paths {
+		if e, ok := c.entries[p]; ok && e.Mode.IsDir() {
+			if err := os.Chtimes(c.hostPath(p), e.ModTime, e.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the staging path of a context path.
+func (c *RemoteContext) hostPath(p string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(p))
+}
+
+// Receives a whole build context as a tar archive and extracts it into dir,
+// an existing empty directory, for clients that send the context up front
+// instead of advertising it for a [RemoteContext].
+//
+// Directories, regular files, and symbolic links are extracted with their
+// modes and times, and other entries are skipped as [materializeContext]
+// skips them. Entries that would land outside dir, by their name or
+// through a link extracted before them, fail with [ErrContextTransfer].
+func ExtractContext(dir string, r io.Reader) (ContextStats, error) {
+	var stats ContextStats
+	counted := &countingReader{r: r}
+	tr := tar.NewReader(counted)
+
+	var dirs []*tar.Header
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, crex.Wrap(ErrContextTransfer, err)
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." && header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return stats, crex.Wrapf(ErrContextTransfer, "archive entry %q is outside the build context", header.Name)
+		}
+		if err := checkExtractParent(dir, name); err != nil {
+			return stats, crex.Wrap(ErrContextTransfer, err)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		mode := fileMode(header.FileInfo().Mode())
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, mode.Perm()); err != nil && !errors.Is(err, fs.ErrExist) {
+				return stats, crex.Wrap(ErrContextTransfer, err)
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return stats, crex.Wrap(ErrContextTransfer, err)
+			}
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			if err := extractFile(target, mode, header.ModTime, tr); err != nil {
+				return stats, crex.Wrap(ErrContextTransfer, err)
+			}
+			stats.Files++
+			stats.Size += header.Size
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return stats, crex.Wrap(ErrContextTransfer, err)
+			}
+		}
+	}
+	if _, err := io.Copy(io.Discard, counted); err != nil {
+		return stats, crex.Wrap(ErrContextTransfer, err)
+	}
+
+	// Deepest first, so that setting a directory's time is not undone by
+	// setting one inside it.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dir, filepath.FromSlash(path.Clean(dirs[i].Name)))
+		if err := os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return stats, crex.Wrap(ErrContextTransfer, err)
+		}
+	}
+
+	stats.Fetched = stats.Files
+	stats.Transferred = counted.n
+	stats.FullSize = counted.n
+	return stats, nil
+}
+
+// Checks that the directories above an archive entry exist inside dir as
+// directories rather than links, creating missing ones.
+func checkExtractParent(dir, name string) error {
+	current := dir
+	parent := path.Dir(name)
+	if parent == "." {
+		return nil
+	}
+	for _, part := range strings.Split(parent, "/") {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if err := os.Mkdir(current, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return fmt.Errorf("archive entry %q is not inside a directory", name)
+		}
+	}
+	return nil
+}
+
+// Writes an extracted regular file, replacing an earlier entry of the same
+// name.
+func extractFile(target string, mode fs.FileMode, modTime time.Time, r io.Reader) error {
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, modTime, modTime)
+}
+
+// Returns the permission bits of mode, including setuid, setgid, and
+// sticky, in the form [os.Chmod] takes.
+func fileMode(mode fs.FileMode) fs.FileMode {
+	return mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
+
+// Returns the bytes a context entry takes in a tar archive, ignoring the
+// extended headers of long names.
+func tarEntrySize(e ContextEntry) int64 {
+	size := int64(tarBlockSize)
+	if e.Mode.IsRegular() {
+		size += (e.Size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+	}
+	return size
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Reads from the underlying reader, adding what it returns to the count.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,468 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves the files of a directory as a [ContextFetcher], recording what it
+// was asked for.
+type dirFetcher struct {
+	dir    string     // Directory the context is read from.
+	tamper string     // File whose contents are changed in the archive, if any.
+	calls  [][]string // Paths of each fetch.
+}
+
+// Returns a tar archive of the files at paths.
+func (f *dirFetcher) Fetch(_ context.Context, paths []string) (io.ReadCloser, error) {
+	f.calls = append(f.calls, paths)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, p := range paths {
+		data, err := os.ReadFile(filepath.Join(f.dir, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, err
+		}
+		if p == f.tamper {
+			data = bytes.ToUpper(data)
+		}
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: p, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return nil, err
+		}
+		tw.Write(data)
+	}
+	tw.Close()
+	return io.NopCloser(&buf), nil
+}
+
+// Returns the fetched paths of every call, in order.
+func (f *dirFetcher) fetched() []string {
+	var paths []string
+	for _, call := range f.calls {
+		paths = append(paths, call...)
+	}
+	return paths
+}
+
+// Writes files into dir, creating their directories. Keys ending in "@"
+// are symbolic links to their value.
+func writeContextTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		if link, ok := strings.CutSuffix(name, "@"); ok {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, link)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(data, filepath.Join(dir, link)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns the entries a client would advertise for the context in dir.
+func advertise(t *testing.T, dir string) []ContextEntry {
+	t.Helper()
+	var entries []ContextEntry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		e := ContextEntry{Path: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			e.Link, err = os.Readlink(p)
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			e.Size = int64(len(data))
+			e.Digest = contextDigestPrefix + hex.EncodeToString(sum[:])
+		}
+		entries = append(entries, e)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// Creates a remote context of the files in src, staged in a new directory.
+func newTestRemoteContext(t *testing.T, files map[string]string) (*RemoteContext, *dirFetcher) {
+	t.Helper()
+	src := t.TempDir()
+	writeContextTree(t, src, files)
+	fetcher := &dirFetcher{dir: src}
+	c, err := NewRemoteContext(t.TempDir(), advertise(t, src), fetcher)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c, fetcher
+}
+
+func TestRemoteContextFetchCopy(t *testing.T) {
+	files := map[string]string{
+		"go.mod":                     "module app\n",
+		"main.go":                    "package main\n",
+		"README.md":                  "# app\n",
+		"src/app.go":                 "package app\n",
+		"src/app_test.go":            "package app\n",
+		"src/internal/util.go":       "package internal\n",
+		"src/build/out.bin":          "output",
+		"node_modules/left-pad/a.js": "module.exports = 1\n",
+		".git/HEAD":                  "ref: refs/heads/main\n",
+		"lib@":                       "src/internal",
+		"config/app.yaml":            "port: 80\n",
+		"config/db.yaml":             "host: db\n",
+	}
+	ignore, err := parseIgnore([]byte("build/\n*_test.go\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		copies []string
+		ignore *ignoreRules
+		follow bool
+		want   []string
+	}{
+		{"file", []string{"go.mod /app/"}, nil, false, []string{"go.mod"}},
+		{"directory", []string{"src /app/src"}, nil, false, []string{"src/app.go", "src/app_test.go", "src/build/out.bin", "src/internal/util.go"}},
+		{"ignored", []string{"src /app/src"}, ignore, false, []string{"src/app.go", "src/internal/util.go"}},
+		{"glob", []string{"config/*.yaml /etc/app/"}, nil, false, []string{"config/app.yaml", "config/db.yaml"}},
+		{"several sources", []string{"go.mod main.go /app/"}, nil, false, []string{"go.mod", "main.go"}},
+		{"through a link", []string{"lib/util.go /app/"}, nil, false, []string{"src/internal/util.go"}},
+		{"link kept", []string{". /app"}, ignore, false, []string{"README.md", "config/app.yaml", "config/db.yaml", "go.mod", "main.go", "node_modules/left-pad/a.js", "src/app.go", "src/internal/util.go", ".git/HEAD"}},
+		{"cross-stage", []string{"builder:/out /app"}, nil, false, nil},
+		{"inline", []string{"<<EOF /app/x\nhello\nEOF"}, nil, false, nil},
+		{"fetched once", []string{"src/app.go /app/", "src /app/src", "src/app.go /app/"}, nil, false, []string{"src/app.go", "src/app_test.go", "src/build/out.bin", "src/internal/util.go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fetcher := newTestRemoteContext(t, files)
+			for _, cp := range tt.copies {
+				if err := c.fetchCopy(context.Background(), cp, "/", tt.ignore, tt.follow); err != nil {
+					t.Fatalf("fetchCopy(%q): unexpected error: %v", cp, err)
+				}
+			}
+
+			got := fetcher.fetched()
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("fetched %v, want %v", got, want)
+			}
+			for _, p := range got {
+				data, err := os.ReadFile(filepath.Join(c.Dir(), filepath.FromSlash(p)))
+				if err != nil || string(data) != files[p] {
+					t.Errorf("staged %s = %q, %v, want %q", p, data, err, files[p])
+				}
+			}
+			if stats := c.Stats(); stats.Fetched != len(want) || stats.Files != 11 {
+				t.Errorf("stats = %+v", stats)
+			}
+		})
+	}
+}
+
+func TestRemoteContextStaging(t *testing.T) {
+	src := t.TempDir()
+	writeContextTree(t, src, map[string]string{
+		"src/app.go": "package app\n",
+		"lib@":       "src",
+	})
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chmod(filepath.Join(src, "src"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"src/app.go", "src"} {
+		if err := os.Chtimes(filepath.Join(src, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewRemoteContext(t.TempDir(), advertise(t, src), &dirFetcher{dir: src})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(c.Dir(), "lib")); err != nil || link != "src" {
+		t.Errorf("lib = %q, %v", link, err)
+	}
+	if _, err := os.Lstat(filepath.Join(c.Dir(), "src", "app.go")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("app.go staged before it was fetched: %v", err)
+	}
+
+	if err := c.fetchCopy(context.Background(), "src/app.go /app/", "/", nil, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, p := range []string{"src/app.go", "src"} {
+		info, err := os.Stat(filepath.Join(c.Dir(), p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %v, want %v", p, info.ModTime(), mtime)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(c.Dir(), "src")); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("src: info = %v, err = %v", info, err)
+	}
+}
+
+func TestRemoteContextFetchErrors(t *testing.T) {
+	files := map[string]string{"app.go": "package app\n"}
+
+	t.Run("outside the context", func(t *testing.T) {
+		c, _ := newTestRemoteContext(t, files)
+		for _, cp := range []string{"/etc/passwd /app/", "../secret /app/"} {
+			if err := c.fetchCopy(context.Background(), cp, "/", nil, false); !errors.Is(err, ErrCopy) {
+				t.Errorf("fetchCopy(%q) = %v, want ErrCopy", cp, err)
+			}
+		}
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		c, fetcher := newTestRemoteContext(t, files)
+		fetcher.tamper = "app.go"
+		if err := c.fetchCopy(context.Background(), "app.go /app/", "/", nil, false); !errors.Is(err, ErrContextTransfer) {
+			t.Fatalf("fetchCopy = %v, want ErrContextTransfer", err)
+		}
+		if _, err := os.Lstat(filepath.Join(c.Dir(), "app.go")); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("mismatched file left in the staging directory: %v", err)
+		}
+	})
+
+	t.Run("fetch failure", func(t *testing.T) {
+		c, fetcher := newTestRemoteContext(t, files)
+		fetcher.dir = t.TempDir()
+		if err := c.fetchCopy(context.Background(), "app.go /app/", "/", nil, false); !errors.Is(err, ErrContextTransfer) {
+			t.Errorf("fetchCopy = %v, want ErrContextTransfer", err)
+		}
+	})
+}
+
+func TestNewRemoteContextInvalid(t *testing.T) {
+	digest := contextDigestPrefix + strings.Repeat("0", 64)
+	tests := []struct {
+		name    string
+		entries []ContextEntry
+	}{
+		{"absolute", []ContextEntry{{Path: "/etc", Mode: fs.ModeDir | 0755}}},
+		{"parent", []ContextEntry{{Path: "../x", Mode: 0644, Digest: digest}}},
+		{"unclean", []ContextEntry{{Path: "a//b", Mode: 0644, Digest: digest}}},
+		{"no digest", []ContextEntry{{Path: "a", Mode: 0644}}},
+		{"no link target", []ContextEntry{{Path: "a", Mode: fs.ModeSymlink}}},
+		{"device", []ContextEntry{{Path: "a", Mode: fs.ModeDevice}}},
+		{"duplicate", []ContextEntry{{Path: "a", Mode: fs.ModeDir}, {Path: "a", Mode: fs.ModeDir}}},
+		{"missing parent", []ContextEntry{{Path: "a/b", Mode: 0644, Digest: digest}}},
+		{"file parent", []ContextEntry{{Path: "a", Mode: 0644, Digest: digest}, {Path: "a/b", Mode: 0644, Digest: digest}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRemoteContext(t.TempDir(), tt.entries, &dirFetcher{}); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("NewRemoteContext = %v, want ErrInvalidOptions", err)
+			}
+		})
+	}
+}
+
+// Measures the archive bytes a build saves by fetching only the files its
+// copy steps read, on a synthetic repository laid out like a typical
+// JavaScript service.
+func TestRemoteContextBandwidth(t *testing.T) {
+	files := map[string]string{
+		"package.json": `{"name": "app"}`,
+		".cruxignore":  "**/*.test.js\n",
+	}
+	for i := range 40 {
+		files[fmt.Sprintf("src/module%d.js", i)] = strings.Repeat("export const x = 1;\n", 100)
+		files[fmt.Sprintf("src/module%d.test.js", i)] = strings.Repeat("test('x', () => {});\n", 100)
+	}
+	for i := range 300 {
+		files[fmt.Sprintf("node_modules/dep%d/file%d.js", i%30, i)] = strings.Repeat("x", 8<<10)
+	}
+	for i := range 100 {
+		files[fmt.Sprintf(".git/objects/%02x/object", i)] = strings.Repeat("y", 16<<10)
+	}
+
+	src := t.TempDir()
+	writeContextTree(t, src, files)
+	var full bytes.Buffer
+	if err := writeContextArchive(&full, src); err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := &dirFetcher{dir: src}
+	c, err := NewRemoteContext(t.TempDir(), advertise(t, src), fetcher)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.fetch(context.Background(), []string{ignoreFile}, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	ignore, err := loadIgnore(c.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cp := range []string{"package.json /app/", "src /app/src"} {
+		if err := c.fetchCopy(context.Background(), cp, "/", ignore, false); err != nil {
+			t.Fatalf("fetchCopy(%q): unexpected error: %v", cp, err)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Files != len(files) || stats.Fetched != 42 {
+		t.Errorf("stats = %+v, want %d files with 42 fetched", stats, len(files))
+	}
+	if diff := stats.FullSize - int64(full.Len()); diff < -int64(full.Len())/20 || diff > int64(full.Len())/20 {
+		t.Errorf("estimated full archive of %d bytes, measured %d", stats.FullSize, full.Len())
+	}
+	if stats.Saved() < stats.FullSize*9/10 {
+		t.Errorf("saved %d of %d bytes, want at least 90%%", stats.Saved(), stats.FullSize)
+	}
+	t.Logf("full archive %d bytes, fetched %d of %d files in %d bytes, saved %d bytes (%.1f%%)",
+		full.Len(), stats.Fetched, stats.Files, stats.Transferred, stats.Saved(), 100*float64(stats.Saved())/float64(stats.FullSize))
+}
+
+// Writes a tar archive of the whole context in dir, as a client sending
+// its context up front does.
+func writeContextArchive(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(data)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func TestExtractContext(t *testing.T) {
+	src := t.TempDir()
+	writeContextTree(t, src, map[string]string{
+		"go.mod":          "module app\n",
+		"src/app.go":      "package app\n",
+		"src/lib/util.go": "package lib\n",
+		"link@":           "src/app.go",
+	})
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "src"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := writeContextArchive(&archive, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	stats, err := ExtractContext(dir, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Files != 3 || stats.Fetched != 3 || stats.Transferred != int64(archive.Len()) || stats.Saved() != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "src", "lib", "util.go")); err != nil || string(data) != "package lib\n" {
+		t.Errorf("util.go = %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "link")); err != nil || link != "src/app.go" {
+		t.Errorf("link = %q, %v", link, err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "src")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("src: info = %v, err = %v", info, err)
+	}
+}
+
+func TestExtractContextOutside(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []tar.Header
+	}{
+		{"parent", []tar.Header{{Typeflag: tar.TypeReg, Name: "../evil", Mode: 0644}}},
+		{"absolute", []tar.Header{{Typeflag: tar.TypeReg, Name: "/etc/evil", Mode: 0644}}},
+		{"through a link", []tar.Header{
+			{Typeflag: tar.TypeSymlink, Name: "escape", Linkname: "/tmp"},
+			{Typeflag: tar.TypeReg, Name: "escape/evil", Mode: 0644},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, h := range tt.headers {
+				if err := tw.WriteHeader(&h); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tw.Close()
+
+			if _, err := ExtractContext(t.TempDir(), &buf); !errors.Is(err, ErrContextTransfer) {
+				t.Errorf("ExtractContext = %v, want ErrContextTransfer", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package build
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+// Directory in the container where secrets are mounted when a
+// [SecretMount] has no target.
+const defaultSecretTarget = "/run/secrets"
+
+// Valid secret identifiers. IDs double as file names in [SecretSource.Dir],
+// so they cannot contain path separators or start with a dot.
+var secretIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// Where the daemon looks up secrets referenced by a build.
+//
+// Requests carry only secret IDs, never values. Each ID is resolved against
+// the directory first and then the environment, and the first match wins. A
+// source with neither set resolves nothing, so builds that reference
+// secrets fail.
+type SecretSource struct {
+	Dir       string // Directory holding one file per secret, named by ID.
+	EnvPrefix string // Prefix of environment variables holding secrets.
+}
+
+// A secret made available to run steps as a read-only file.
+type SecretMount struct {
+	ID     string // Secret identifier resolved against the [SecretSource].
+	Target string // Absolute path of the file in the container. Defaults to /run/secrets/<ID>.
+}
+
+// Returns the container path where the secret is mounted.
+func (m SecretMount) target() string {
+	if m.Target != "" {
+		return m.Target
+	}
+	return path.Join(defaultSecretTarget, m.ID)
+}
+
+// Returns the value of a secret.
+//
+// The file <Dir>/<id> is tried first. Failing that, the environment variable
+// named by EnvPrefix followed by the ID in upper case, with "-" and "."
+// replaced by "_", is used. The caller owns the returned slice and should
+// clear it once the value is no longer needed.
+func (s SecretSource) resolve(id string) ([]byte, error) {
+	if s.Dir != "" {
+		data, err := os.ReadFile(filepath.Join(s.Dir, id))
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, crex.Wrapf(ErrSecret, "secret %q: %w", id, err)
+		}
+	}
+
+	if s.EnvPrefix != "" {
+		if v, ok := os.LookupEnv(s.envName(id)); ok {
+			return []byte(v), nil
+		}
+	}
+
+	return nil, crex.Wrapf(ErrSecret, "secret %q not found", id)
+}
+
+// Returns the environment variable that holds a secret.
+func (s SecretSource) envName(id string) string {
+	name := strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(id))
+	return s.EnvPrefix + name
+}
+
+// Checks secret references for invalid IDs and conflicting targets.
+func validateSecretMounts(mounts []SecretMount) error {
+	targets := make(map[string]string, len(mounts))
+	for _, m := range mounts {
+		if !secretIDPattern.MatchString(m.ID) {
+			return crex.Wrapf(ErrInvalidOptions, "invalid secret id %q", m.ID)
+		}
+		target := m.target()
+		if !path.IsAbs(target) || path.Clean(target) == "/" {
+			return crex.Wrapf(ErrInvalidOptions, "secret %q: target %q must be an absolute file path", m.ID, m.Target)
+		}
+		if other, ok := targets[path.Clean(target)]; ok {
+			return crex.Wrapf(ErrInvalidOptions, "secrets %q and %q share target %q", other, m.ID, target)
+		}
+		targets[path.Clean(target)] = m.ID
+	}
+	return nil
+}
+
+// Resolves secrets and stages them as host files for bind-mounting.
+//
+// Each value is written to a temporary directory that only the daemon can
+// enter, and the in-memory copy is cleared right after. The files themselves
+// are world-readable so that steps running as a non-root user can read them
+// through the mount. Returns the
+// directory, which the caller must remove once the build is done, and the
+// read-only mounts that expose the files to stage containers. Nothing is
+// staged when mounts is empty.
+func stageSecrets(src SecretSource, mounts []SecretMount) (string, []runtime.Mount, error) {
+	if len(mounts) == 0 {
+		return "", nil, nil
+	}
+
+	dir, err := os.MkdirTemp("", "cruxd-secrets-")
+	if err != nil {
+		return "", nil, crex.Wrap(ErrFileSystemOperation, err)
+	}
+
+	out := make([]runtime.Mount, 0, len(mounts))
+	for i, m := range mounts {
+		data, err := src.resolve(m.ID)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+
+		file := filepath.Join(dir, strconv.Itoa(i))
+		err = os.WriteFile(file, data, 0444)
+		clear(data)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", nil, crex.Wrap(ErrFileSystemOperation, err)
+		}
+
+		out = append(out, runtime.Mount{Source: file, Destination: m.target(), ReadOnly: true})
+	}
+
+	return dir, out, nil
+}
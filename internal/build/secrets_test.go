@@ -0,0 +1,110 @@
+package build
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretSourceResolve(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "npm-token"), []byte("from-file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CRUXD_TEST_SECRET_NPM_TOKEN", "from-env")
+	t.Setenv("CRUXD_TEST_SECRET_API_KEY", "env-only")
+
+	src := SecretSource{Dir: dir, EnvPrefix: "CRUXD_TEST_SECRET_"}
+
+	tests := []struct {
+		name    string
+		src     SecretSource
+		id      string
+		want    string
+		wantErr bool
+	}{
+		{name: "directory before environment", src: src, id: "npm-token", want: "from-file"},
+		{name: "environment fallback", src: src, id: "api.key", want: "env-only"},
+		{name: "environment only", src: SecretSource{EnvPrefix: src.EnvPrefix}, id: "npm-token", want: "from-env"},
+		{name: "missing", src: src, id: "absent", wantErr: true},
+		{name: "no source", id: "npm-token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.src.resolve(tt.id)
+			if tt.wantErr {
+				if !errors.Is(err, ErrSecret) {
+					t.Fatalf("expected ErrSecret, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("resolve(%q) = %q, want %q", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSecretMounts(t *testing.T) {
+	tests := []struct {
+		name    string
+		mounts  []SecretMount
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "default target", mounts: []SecretMount{{ID: "token"}}},
+		{name: "custom target", mounts: []SecretMount{{ID: "token", Target: "/root/.npmrc"}}},
+		{name: "path in id", mounts: []SecretMount{{ID: "../etc/shadow"}}, wantErr: true},
+		{name: "hidden id", mounts: []SecretMount{{ID: ".token"}}, wantErr: true},
+		{name: "empty id", mounts: []SecretMount{{ID: ""}}, wantErr: true},
+		{name: "relative target", mounts: []SecretMount{{ID: "token", Target: "token"}}, wantErr: true},
+		{name: "shared target", mounts: []SecretMount{{ID: "a", Target: "/run/s"}, {ID: "b", Target: "/run/s/"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSecretMounts(tt.mounts)
+			if tt.wantErr && !errors.Is(err, ErrInvalidOptions) {
+				t.Fatalf("expected ErrInvalidOptions, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStageSecrets(t *testing.T) {
+	t.Setenv("CRUXD_TEST_SECRET_TOKEN", "s3cret")
+	src := SecretSource{EnvPrefix: "CRUXD_TEST_SECRET_"}
+
+	dir, mounts, err := stageSecrets(src, []SecretMount{{ID: "token"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if len(mounts) != 1 {
+		t.Fatalf("got %d mounts, want 1", len(mounts))
+	}
+	m := mounts[0]
+	if m.Destination != "/run/secrets/token" || !m.ReadOnly {
+		t.Errorf("mount = %+v", m)
+	}
+	data, err := os.ReadFile(m.Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "s3cret" {
+		t.Errorf("staged value = %q", data)
+	}
+
+	if _, _, err := stageSecrets(src, []SecretMount{{ID: "missing"}}); !errors.Is(err, ErrSecret) {
+		t.Errorf("expected ErrSecret, got %v", err)
+	}
+}
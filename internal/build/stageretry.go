@@ -0,0 +1,74 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+// Builds a stage, rebuilding it after infrastructure errors.
+//
+// A failed attempt's container is destroyed and the stage starts over in a
+// fresh container from the same base image, up to [Options.StageRetries]
+// more times. Only errors that [retryableStage] accepts are retried; a step
+// that fails on its own merits fails the build on the first attempt.
+func (r *recipe) buildStageWithRetry(ctx context.Context, stage manifest.Stage, index int, platform, output string, stages map[string]*runtime.Container, base *runtime.Image) error {
+	for attempt := 1; ; attempt++ {
+		started := len(r.containers)
+		err := r.buildStage(ctx, stage, index, platform, output, stages, base)
+		if err == nil || attempt > r.stageRetries || ctx.Err() != nil || !retryableStage(err) {
+			return err
+		}
+
+		slog.Warn("retrying stage after infrastructure error",
+			"stage", stageLabel(stage.Name, index),
+			"platform", platform,
+			"attempt", attempt+1,
+			"of", r.stageRetries+1,
+			"error", err,
+		)
+		r.warnings.add(WarnStageRetried, fmt.Sprintf("stage %s was rebuilt after an infrastructure error: %v", stageLabel(stage.Name, index), err),
+			map[string]string{"stage": stageLabel(stage.Name, index), "platform": platform, "attempt": strconv.Itoa(attempt + 1)})
+		for _, ctr := range r.containers[started:] {
+			ctr.Destroy(context.WithoutCancel(ctx))
+		}
+		r.containers = r.containers[:started]
+		delete(stages, stage.Name)
+	}
+}
+
+// Reports whether a stage failure may be an infrastructure hiccup.
+//
+// Errors from containerd ([runtime.ErrRuntime]) such as a snapshot creation
+// race or a shim that failed to start are retried. Failures caused by the
+// recipe or its inputs are not, even when the runtime reports them: a
+// command that fails or cannot be found, a failed copy, a missing path, a
+// layer over the size limit, a base image from a registry that is not
+// allowed, or a base without the target platform would fail the same way
+// again.
+func retryableStage(err error) bool {
+	if !errors.Is(err, runtime.ErrRuntime) {
+		return false
+	}
+	for _, permanent := range []error{
+		ErrCommandFailed,
+		ErrCommandNotFound,
+		ErrCopy,
+		ErrUnsafeFileMode,
+		runtime.ErrPathNotFound,
+		runtime.ErrLayerTooLarge,
+		runtime.ErrRegistryNotAllowed,
+		runtime.ErrPlatformNotFound,
+		runtime.ErrRemote,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
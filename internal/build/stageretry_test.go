@@ -0,0 +1,34 @@
+package build
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+func TestRetryableStage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "runtime error", err: crex.Wrap(runtime.ErrRuntime, errors.New("snapshot already exists")), want: true},
+		{name: "wrapped runtime error", err: crex.Wrapf(ErrBuild, "step 2: %w", crex.Wrap(runtime.ErrRuntime, errors.New("shim died"))), want: true},
+		{name: "command failed", err: crex.Wrapf(ErrBuild, "step 1: %w", crex.Wrapf(ErrCommandFailed, "exit code 2"))},
+		{name: "command not found", err: crex.Wrapf(ErrCommandNotFound, "make")},
+		{name: "copy of runtime error", err: crex.Wrap(ErrCopy, crex.Wrapf(runtime.ErrRuntime, "tar extract failed"))},
+		{name: "layer too large", err: crex.Wrap(runtime.ErrRuntime, crex.Wrapf(runtime.ErrLayerTooLarge, "2 GiB"))},
+		{name: "registry not allowed", err: crex.Wrap(runtime.ErrRuntime, crex.Wrapf(runtime.ErrRegistryNotAllowed, "quay.io"))},
+		{name: "filesystem error", err: crex.Wrap(ErrFileSystemOperation, errors.New("disk full"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryableStage(tt.err); got != tt.want {
+				t.Errorf("retryableStage(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package build
 
 import (
 	"context"
+	"slices"
+	"strings"
 
 	"github.com/cruciblehq/crex"
 	"github.com/cruciblehq/cruxd/internal/runtime"
@@ -9,8 +11,18 @@ import (
 )
 
 // Executes a list of steps in order against the build container.
+//
+// The state's stderr allowlist refers to the steps of the outermost list.
+// It is consumed here, so the steps of a platform group inherit the
+// strictness of the group.
 func executeSteps(ctx context.Context, ctr *runtime.Container, steps []manifest.Step, state *stepState, buildCtx string, stages map[string]*runtime.Container) error {
+	allow := state.allowStderr
+	state.allowStderr = nil
+	strict := state.strictStderr
+	defer func() { state.strictStderr = strict }()
+
 	for i, step := range steps {
+		state.strictStderr = strict && !slices.Contains(allow, i+1)
 		if err := executeStep(ctx, ctr, step, state, buildCtx, stages); err != nil {
 			return crex.Wrapf(ErrBuild, "step %d: %w", i+1, err)
 		}
@@ -42,9 +54,46 @@ func executeStep(ctx context.Context, ctr *runtime.Container, step manifest.Step
 // Executes a run or copy operation with scoped modifier overrides.
 //
 // Step-level modifiers override the persistent state for this operation only.
-// The persistent state is not modified.
+// The persistent state is not modified. With a build cache, a step whose key
+// has an entry is not executed; the container's filesystem is later replaced
+// with the entry, as described by [stepCache]. Otherwise the step is
+// executed and its result recorded under its key.
 func executeOperation(ctx context.Context, ctr *runtime.Container, step manifest.Step, state *stepState, buildCtx string, stages map[string]*runtime.Container) error {
 	resolved := state.resolve(step)
+	step, err := resolved.expand(step)
+	if err != nil {
+		return err
+	}
+
+	if resolved.progress != nil {
+		if step.Run != "" {
+			resolved.progress(Event{Kind: EventStep, Message: stepMessage(step.Run, false)})
+		} else {
+			resolved.progress(Event{Kind: EventStep, Message: stepMessage(step.Copy, true)})
+		}
+	}
+
+	// The cache key reads the sources of a copy, so they are fetched first.
+	if step.Copy != "" {
+		if err := resolved.remote.fetchCopy(ctx, step.Copy, resolved.workdir, resolved.ignore, resolved.followLinks); err != nil {
+			return err
+		}
+	}
+
+	key := resolved.cache.next(step, resolved, buildCtx, stages)
+	hit, err := resolved.cache.hit(ctx, ctr, key)
+	if err != nil {
+		return err
+	}
+	if hit {
+		if resolved.progress != nil {
+			resolved.progress(Event{Kind: EventCached, Message: key})
+		}
+		return nil
+	}
+	if err := resolved.cache.flush(ctx, ctr); err != nil {
+		return err
+	}
 
 	if resolved.workdir != "" {
 		if err := ctr.MkdirAll(ctx, resolved.workdir); err != nil {
@@ -54,19 +103,85 @@ func executeOperation(ctx context.Context, ctr *runtime.Container, step manifest
 
 	switch {
 	case step.Run != "":
-		result, err := ctr.Exec(ctx, resolved.shell, step.Run, resolved.environ(), resolved.workdir)
+		result, err := runStep(ctx, ctr, step.Run, resolved)
 		if err != nil {
 			return err
 		}
-		if result.ExitCode != 0 {
-			return crex.Wrapf(ErrCommandFailed, "exit code %d: %s", result.ExitCode, result.Stderr)
+		if err := checkRunResult(result, step.Run, resolved.strictStderr); err != nil {
+			return err
 		}
 
 	case step.Copy != "":
-		if err := executeCopy(ctx, ctr, step.Copy, resolved.workdir, buildCtx, stages); err != nil {
+		opts := copyOptions{
+			buildCtx:    buildCtx,
+			stages:      stages,
+			owner:       resolved.copyOwner,
+			ignore:      resolved.ignore,
+			followLinks: resolved.followLinks,
+			modes:       modeCheck{strict: resolved.strictModes, warn: resolved.warnings},
+		}
+		if err := executeCopy(ctx, ctr, step.Copy, resolved.workdir, opts); err != nil {
+			return err
+		}
+	}
+
+	if key != "" {
+		if err := resolved.cache.record(ctx, ctr, key); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// Runs the command of a run step.
+//
+// With a progress function, the step's output is reported line by line as
+// it is produced, so that long steps show their progress. Either way the
+// result carries the complete output.
+func runStep(ctx context.Context, ctr *runtime.Container, command string, resolved *stepState) (*runtime.ExecResult, error) {
+	if resolved.progress == nil {
+		return ctr.Exec(ctx, resolved.shell, command, resolved.environ(), resolved.workdir)
+	}
+
+	stdout := &outputEmitter{progress: resolved.progress, stream: "stdout", sample: resolved.sampling}
+	stderr := &outputEmitter{progress: resolved.progress, stream: "stderr", sample: resolved.sampling}
+	defer stdout.Flush()
+	defer stderr.Flush()
+	return ctr.ExecTee(ctx, resolved.shell, command, resolved.environ(), resolved.workdir, stdout, stderr)
+}
+
+// Exit codes POSIX shells use when a command cannot be run.
+const (
+	exitNotExecutable = 126 // The command was found but could not be executed.
+	exitNotFound      = 127 // The command was not found.
+)
+
+// Checks the outcome of a run step.
+//
+// Exit codes 126 and 127, which the shell reports when it cannot run the
+// program, fail with [ErrCommandNotFound] and the attempted command, so a
+// typo is not mistaken for a failing test. Any other non-zero exit code
+// fails with [ErrCommandFailed], or with [ErrMemoryLimitExceeded] when the
+// kernel killed the command for exceeding the stage's memory limit, which
+// otherwise shows only as exit code 137. In strict mode, a step that exits 0
+// but writes anything other than whitespace to stderr fails too, which turns
+// warnings into errors.
+func checkRunResult(result *runtime.ExecResult, command string, strict bool) error {
+	switch result.ExitCode {
+	case exitNotFound:
+		return crex.Wrapf(ErrCommandNotFound, "%q (exit code %d): %s", command, result.ExitCode, result.Stderr)
+	case exitNotExecutable:
+		return crex.Wrapf(ErrCommandNotFound, "%q is not executable (exit code %d): %s", command, result.ExitCode, result.Stderr)
+	}
+	if result.OOMKilled {
+		return crex.Wrapf(ErrMemoryLimitExceeded, "%q (exit code %d): %s", command, result.ExitCode, result.Stderr)
+	}
+	if result.ExitCode != 0 {
+		return crex.Wrapf(ErrCommandFailed, "exit code %d: %s", result.ExitCode, result.Stderr)
+	}
+	if strict && strings.TrimSpace(result.Stderr) != "" {
+		return crex.Wrapf(ErrCommandFailed, "wrote to stderr: %s", result.Stderr)
+	}
+	return nil
+}
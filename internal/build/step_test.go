@@ -0,0 +1,61 @@
+package build
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/manifest"
+)
+
+func TestCheckRunResult(t *testing.T) {
+	warning := &runtime.ExecResult{ExitCode: 0, Stderr: "warning: deprecated flag\n"}
+	clean := &runtime.ExecResult{ExitCode: 0, Stdout: "ok\n", Stderr: "\n"}
+	failed := &runtime.ExecResult{ExitCode: 2, Stderr: "error\n"}
+	notFound := &runtime.ExecResult{ExitCode: 127, Stderr: "sh: mkae: not found\n"}
+	notExecutable := &runtime.ExecResult{ExitCode: 126, Stderr: "sh: ./run.sh: Permission denied\n"}
+	oomKilled := &runtime.ExecResult{ExitCode: 137, OOMKilled: true}
+
+	tests := []struct {
+		name    string
+		result  *runtime.ExecResult
+		strict  bool
+		wantErr error
+	}{
+		{name: "warning tolerated", result: warning},
+		{name: "warning in strict mode", result: warning, strict: true, wantErr: ErrCommandFailed},
+		{name: "whitespace stderr in strict mode", result: clean, strict: true},
+		{name: "non-zero exit", result: failed, wantErr: ErrCommandFailed},
+		{name: "non-zero exit in strict mode", result: failed, strict: true, wantErr: ErrCommandFailed},
+		{name: "exit 127", result: notFound, wantErr: ErrCommandNotFound},
+		{name: "exit 126", result: notExecutable, wantErr: ErrCommandNotFound},
+		{name: "killed for memory", result: oomKilled, wantErr: ErrMemoryLimitExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRunResult(tt.result, "mkae build", tt.strict)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == ErrCommandNotFound && errors.Is(err, ErrCommandFailed) {
+				t.Fatalf("err = %v, should not be ErrCommandFailed", err)
+			}
+		})
+	}
+}
+
+func TestResolveKeepsStrictStderr(t *testing.T) {
+	s := newStepState()
+	s.strictStderr = true
+
+	if !s.resolve(manifest.Step{Run: "make"}).strictStderr {
+		t.Fatal("resolve dropped strictStderr")
+	}
+}
@@ -18,6 +18,20 @@ type stepState struct {
 	shell   string
 	workdir string
 	env     map[string]string
+
+	strictStderr   bool           // Fail run steps that write to stderr, even when they exit 0.
+	allowStderr    []int          // 1-based top-level steps exempt from strictStderr, consumed by executeSteps.
+	copyOwner      *owner         // Ownership of copied files when the copy step sets none. Nil keeps the source's.
+	ignore         *ignoreRules   // Paths of the build context left out of host directory copies, nil for none.
+	remote         *RemoteContext // Fetches host copy sources from the client before they are read, nil for a local context.
+	followLinks    bool           // Follow symbolic links inside copied host directories.
+	strictModes    bool           // Fail host copies of files with unsafe modes instead of warning.
+	allowUndefined bool           // Expand references to undefined variables to nothing instead of failing.
+
+	progress ProgressFunc   // Receives an event for each operation. Shared by resolved states, nil for none.
+	sampling OutputSampling // Limits the run output reported to progress.
+	cache    *stepCache     // Build cache keys of the stage. Shared by resolved states, nil when caching is off.
+	warnings *warnings      // Collects the build's warnings. Shared by resolved states, nil to only log them.
 }
 
 // Creates a new [stepState] with default values.
@@ -49,9 +63,20 @@ func (s *stepState) apply(step manifest.Step) {
 // operation only.
 func (s *stepState) resolve(step manifest.Step) *stepState {
 	resolved := &stepState{
-		shell:   s.shell,
-		workdir: s.workdir,
-		env:     make(map[string]string, len(s.env)+len(step.Env)),
+		shell:          s.shell,
+		workdir:        s.workdir,
+		env:            make(map[string]string, len(s.env)+len(step.Env)),
+		strictStderr:   s.strictStderr,
+		copyOwner:      s.copyOwner,
+		ignore:         s.ignore,
+		remote:         s.remote,
+		followLinks:    s.followLinks,
+		strictModes:    s.strictModes,
+		allowUndefined: s.allowUndefined,
+		progress:       s.progress,
+		sampling:       s.sampling,
+		cache:          s.cache,
+		warnings:       s.warnings,
 	}
 	maps.Copy(resolved.env, s.env)
 	maps.Copy(resolved.env, step.Env)
@@ -0,0 +1,31 @@
+package build
+
+import (
+	"context"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+// Runs a command in a stage container and returns its result.
+type commandRunner func(ctx context.Context, command string) (*runtime.ExecResult, error)
+
+// Runs a stage's verification commands in order.
+//
+// Verification is a smoke test of the finished stage, such as running the
+// built binary with --version. Each command runs like a run step, and the
+// first that fails, whether it cannot be run or exits non-zero, stops the
+// rest and fails with [ErrVerifyFailed]. Stderr output never fails a
+// command, since tools commonly print their version there.
+func verifyStage(ctx context.Context, commands []string, run commandRunner) error {
+	for i, command := range commands {
+		result, err := run(ctx, command)
+		if err != nil {
+			return crex.Wrapf(ErrVerifyFailed, "command %d %q: %w", i+1, command, err)
+		}
+		if err := checkRunResult(result, command, false); err != nil {
+			return crex.Wrapf(ErrVerifyFailed, "command %d %q: %w", i+1, command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+)
+
+func TestVerifyStage(t *testing.T) {
+	results := map[string]*runtime.ExecResult{
+		"app --version":  {ExitCode: 0, Stderr: "app 1.2.3"},
+		"app --selftest": {ExitCode: 1, Stderr: "self test failed"},
+		"missing":        {ExitCode: exitNotFound},
+	}
+	errExec := errors.New("exec failed")
+
+	tests := []struct {
+		name     string
+		commands []string
+		wantRan  []string
+		wantErr  bool
+	}{
+		{name: "none"},
+		{name: "passing", commands: []string{"app --version"}, wantRan: []string{"app --version"}},
+		{
+			name:     "failure stops the rest",
+			commands: []string{"app --version", "app --selftest", "app --version"},
+			wantRan:  []string{"app --version", "app --selftest"},
+			wantErr:  true,
+		},
+		{name: "not found", commands: []string{"missing"}, wantRan: []string{"missing"}, wantErr: true},
+		{name: "exec error", commands: []string{"broken"}, wantRan: []string{"broken"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ran []string
+			run := func(ctx context.Context, command string) (*runtime.ExecResult, error) {
+				ran = append(ran, command)
+				if result, ok := results[command]; ok {
+					return result, nil
+				}
+				return nil, errExec
+			}
+
+			err := verifyStage(context.Background(), tt.commands, run)
+			if tt.wantErr && !errors.Is(err, ErrVerifyFailed) {
+				t.Fatalf("expected ErrVerifyFailed, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(ran, tt.wantRan) {
+				t.Errorf("ran %q, want %q", ran, tt.wantRan)
+			}
+		})
+	}
+}
+
+func TestValidateStageOptionsVerify(t *testing.T) {
+	if err := validateStageOptions(map[string]StageOptions{"app": {Verify: []string{"app --version"}}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := validateStageOptions(map[string]StageOptions{"app": {Verify: []string{" "}}})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("err = %v, want ErrInvalidOptions", err)
+	}
+}
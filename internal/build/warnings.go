@@ -0,0 +1,48 @@
+package build
+
+import (
+	"slices"
+	"sync"
+)
+
+// Codes of the warnings a build reports in [Result.Warnings].
+const (
+	WarnUnsafeFileMode    = "unsafe-file-mode"    // A copied file is setuid, setgid, or world-writable.
+	WarnMemoryContextSize = "memory-context-size" // The context was too large to copy into memory and was read from disk.
+	WarnStageRetried      = "stage-retried"       // A stage was rebuilt after an infrastructure error.
+	WarnUndeclaredArg     = "undeclared-arg"      // A build argument the recipe does not declare was ignored.
+)
+
+// A non-fatal issue found during a build.
+type Warning struct {
+	Code    string            // Kind of issue, one of the Warn constants.
+	Message string            // Human-readable description.
+	Context map[string]string // Details such as the path, stage, or platform concerned.
+}
+
+// Collects the warnings of a build. Safe for concurrent use. A nil
+// collector discards warnings.
+type warnings struct {
+	mu   sync.Mutex
+	list []Warning
+}
+
+// Records a warning.
+func (w *warnings) add(code, message string, context map[string]string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.list = append(w.list, Warning{Code: code, Message: message, Context: context})
+}
+
+// Returns the warnings recorded so far, in the order they were recorded.
+func (w *warnings) all() []Warning {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.list)
+}
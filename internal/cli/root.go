@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/cruciblehq/crex"
@@ -14,14 +15,37 @@ import (
 
 // Represents the root command for the cruxd daemon.
 var RootCmd struct {
-	Quiet   bool       `short:"q" help:"Suppress informational output."`
-	Verbose bool       `short:"v" help:"Enable verbose output."`
-	Debug   bool       `short:"d" help:"Enable debug output."`
-	Socket  string     `short:"s" help:"Override the default Unix socket path." placeholder:"PATH"`
-	PIDFile string     `help:"Override the default PID file path." placeholder:"PATH"`
-	ReadyFD int        `help:"File descriptor to signal readiness on." default:"-1" placeholder:"FD"`
-	Start   StartCmd   `cmd:"" help:"Start the daemon."`
-	Version VersionCmd `cmd:"" help:"Show version information."`
+	Quiet               bool          `short:"q" help:"Suppress informational output."`
+	Verbose             bool          `short:"v" help:"Enable verbose output."`
+	Debug               bool          `short:"d" help:"Enable debug output."`
+	Socket              string        `short:"s" help:"Override the default Unix socket path." placeholder:"PATH"`
+	SocketGroup         string        `help:"Group granted access to the Unix socket." placeholder:"GROUP"`
+	SocketMode          string        `help:"Octal file mode for the Unix socket (0600-0666). Looser modes grant more users control of the daemon." placeholder:"MODE"`
+	PIDFile             string        `help:"Override the default PID file path. Defaults to the --socket path with a .pid extension when that is set." placeholder:"PATH"`
+	ReadyFD             int           `help:"File descriptor to signal readiness on." default:"-1" placeholder:"FD"`
+	ContainerdAddress   string        `help:"Containerd socket path, or tcp://host:port for a containerd on another host. A remote containerd only serves image and container management; builds, run, and exec are refused. Defaults to /run/containerd/containerd.sock." placeholder:"ADDRESS"`
+	ContainerdNamespace string        `help:"Containerd namespace holding the daemon's images and containers. Defaults to cruxd." placeholder:"NAME"`
+	MaxLayerSize        int64         `help:"Maximum size in bytes of a layer committed by a build. Zero means unlimited." placeholder:"BYTES"`
+	SecretDir           string        `help:"Directory holding build secrets, one file per secret ID." placeholder:"PATH"`
+	SecretEnvPrefix     string        `help:"Prefix of environment variables holding build secrets. Looked up after --secret-dir." placeholder:"PREFIX"`
+	DefaultPlatforms    []string      `help:"Comma-separated target platforms for builds that do not specify any. Defaults to the host platform." placeholder:"PLATFORM"`
+	MaxBuildDuration    time.Duration `help:"Longest a build may run before it is cancelled (e.g. 2h). Requests can only lower it. Zero means unlimited." placeholder:"DURATION"`
+	RequireDigest       bool          `help:"Reject builds whose base images are not pinned by digest (name@sha256:...)."`
+	MemoryContextDir    string        `help:"Tmpfs directory (e.g. /dev/shm) that builds may copy their context into for faster copies." placeholder:"PATH"`
+	MemoryContextLimit  int64         `help:"Largest build context in bytes copied to --memory-context-dir. Larger contexts are read from disk. Defaults to 512 MiB." placeholder:"BYTES"`
+	AllowedRegistries   []string      `help:"Comma-separated registry hosts base images may be pulled from (e.g. docker.io,ghcr.io). Defaults to any." placeholder:"HOST"`
+	InsecureRegistries  []string      `help:"Comma-separated registry hosts (e.g. registry.lan:5000) reached over plain HTTP. Other registries always use HTTPS." placeholder:"HOST"`
+	RegistryTimeout     time.Duration `help:"Longest a single pull or push may take before it fails (e.g. 10m). Separate from --max-build-duration. Zero means unlimited." placeholder:"DURATION"`
+	MaxExecOutput       int64         `help:"Most bytes of each of stdout and stderr returned by a container-exec that does not stream. Defaults to 16 MiB." placeholder:"BYTES"`
+	MaxMessageSize      int64         `help:"Largest message in bytes a client may send, such as a build request with an inline recipe. Larger messages are rejected. Defaults to 16 MiB." placeholder:"BYTES"`
+	CompressionWorkers  int           `help:"Most layers compressed at once across all exports, each using about one core. Lower values leave more CPU to running builds but make concurrent exports wait. Defaults to half the CPUs." placeholder:"N"`
+	RegistryAuthFile    string        `help:"Docker client config file (e.g. ~/.docker/config.json) whose registry logins are used for pulls and pushes. Read at startup. Registries without an entry are accessed anonymously." placeholder:"PATH"`
+	ShutdownGracePeriod time.Duration `help:"Longest a shutdown command waits for commands in progress, such as builds, before stopping the daemon under them. Defaults to 30s." placeholder:"DURATION"`
+	BuildHistoryFile    string        `help:"File the last 100 finished builds are recorded in, so that build-list still reports them after a restart. Defaults to keeping them in memory only." placeholder:"PATH"`
+	MaxConcurrentBuilds int           `help:"Most builds run at once. Further builds wait in a queue, in the order they arrive, and report their position. Zero means unlimited." placeholder:"N"`
+	StageRetries        int           `help:"Times a stage is rebuilt in a fresh container after a containerd or other infrastructure error. Failing steps are never retried." placeholder:"N"`
+	Start               StartCmd      `cmd:"" help:"Start the daemon."`
+	Version             VersionCmd    `cmd:"" help:"Show version information."`
 }
 
 // Parses arguments, configures logging, and runs the selected subcommand.
@@ -2,7 +2,10 @@ package cli
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"os"
+	"strconv"
 
 	"github.com/cruciblehq/cruxd/internal/server"
 )
@@ -13,12 +16,41 @@ type StartCmd struct{}
 // Executes the start command.
 //
 // Starts the gRPC server on a Unix domain socket and blocks until the context
-// is cancelled (e.g. via SIGINT or SIGTERM).
+// is cancelled (e.g. via SIGINT or SIGTERM) or a shutdown command stops the
+// daemon.
 func (c *StartCmd) Run(ctx context.Context) error {
+	socketMode, err := parseFileMode(RootCmd.SocketMode)
+	if err != nil {
+		return err
+	}
+
 	srv, err := server.New(server.Config{
-		SocketPath:  RootCmd.Socket,
-		PIDFilePath: RootCmd.PIDFile,
-		ReadyFD:     RootCmd.ReadyFD,
+		SocketPath:          RootCmd.Socket,
+		PIDFilePath:         RootCmd.PIDFile,
+		SocketGroup:         RootCmd.SocketGroup,
+		SocketMode:          socketMode,
+		ReadyFD:             RootCmd.ReadyFD,
+		ContainerdAddress:   RootCmd.ContainerdAddress,
+		ContainerdNamespace: RootCmd.ContainerdNamespace,
+		MaxLayerSize:        RootCmd.MaxLayerSize,
+		SecretDir:           RootCmd.SecretDir,
+		SecretEnvPrefix:     RootCmd.SecretEnvPrefix,
+		DefaultPlatforms:    RootCmd.DefaultPlatforms,
+		MaxBuildDuration:    RootCmd.MaxBuildDuration,
+		AllowedRegistries:   RootCmd.AllowedRegistries,
+		InsecureRegistries:  RootCmd.InsecureRegistries,
+		RequireDigest:       RootCmd.RequireDigest,
+		MemoryContextDir:    RootCmd.MemoryContextDir,
+		MemoryContextLimit:  RootCmd.MemoryContextLimit,
+		StageRetries:        RootCmd.StageRetries,
+		RegistryTimeout:     RootCmd.RegistryTimeout,
+		MaxExecOutput:       RootCmd.MaxExecOutput,
+		MaxMessageSize:      RootCmd.MaxMessageSize,
+		CompressionWorkers:  RootCmd.CompressionWorkers,
+		RegistryAuthFile:    RootCmd.RegistryAuthFile,
+		MaxConcurrentBuilds: RootCmd.MaxConcurrentBuilds,
+		BuildHistoryFile:    RootCmd.BuildHistoryFile,
+		ShutdownGracePeriod: RootCmd.ShutdownGracePeriod,
 	})
 	if err != nil {
 		return err
@@ -30,8 +62,30 @@ func (c *StartCmd) Run(ctx context.Context) error {
 
 	slog.Info("cruxd is running")
 
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+		return srv.Stop()
+	case <-srv.Stopped():
+		return nil
+	}
+}
 
-	slog.Info("shutting down")
-	return srv.Stop()
+// Parses an octal file mode such as "0660".
+//
+// An empty string yields zero, which lets the server apply its default. An
+// explicit zero mode is rejected rather than silently replaced by the
+// default, since it would grant no access at all.
+func parseFileMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: must be octal", s)
+	}
+	if v == 0 {
+		return 0, fmt.Errorf("invalid file mode %q: owner must have read-write access", s)
+	}
+	return os.FileMode(v), nil
 }
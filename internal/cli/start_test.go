@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0660", want: 0660},
+		{in: "600", want: 0600},
+		{in: "0", wantErr: true},
+		{in: "0000", wantErr: true},
+		{in: "0980", wantErr: true},
+		{in: "rw", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseFileMode(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseFileMode(%q) = %#o, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("parseFileMode(%q) = %#o, %v, want %#o", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
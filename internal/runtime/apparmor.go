@@ -0,0 +1,78 @@
+package runtime
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/containerd/containerd/v2/pkg/apparmor"
+	"github.com/cruciblehq/crex"
+)
+
+// Value of [ContainerOptions.AppArmorProfile] that runs containers without
+// AppArmor confinement.
+const AppArmorUnconfined = "unconfined"
+
+// File listing the AppArmor profiles loaded into the kernel, one per line
+// as "name (mode)".
+const appArmorProfilesPath = "/sys/kernel/security/apparmor/profiles"
+
+// Reports whether containers on this host can be confined by AppArmor
+// profiles. A remote containerd's host cannot be inspected, so it is
+// reported as unsupported.
+func (rt *Runtime) AppArmorSupported() bool {
+	return !rt.remote && apparmor.HostSupports()
+}
+
+// Checks that an AppArmor profile can be applied to containers on this
+// host: AppArmor must be enabled and the profile loaded into the kernel.
+//
+// An empty name keeps containerd's default and "unconfined" needs no
+// profile, so neither is checked. With a remote containerd the profile is
+// loaded on containerd's host, which the daemon cannot see, so the check is
+// left to the OCI runtime when the container starts.
+func (rt *Runtime) CheckAppArmorProfile(name string) error {
+	if name == "" || name == AppArmorUnconfined || rt.remote {
+		return nil
+	}
+	if !apparmor.HostSupports() {
+		return crex.Wrapf(ErrRuntime, "AppArmor profile %q requested, but AppArmor is not enabled on this host", name)
+	}
+	f, err := os.Open(appArmorProfilesPath)
+	if err != nil {
+		return crex.Wrapf(ErrRuntime, "reading loaded AppArmor profiles: %w", err)
+	}
+	defer f.Close()
+
+	loaded, err := appArmorProfileLoaded(f, name)
+	if err != nil {
+		return crex.Wrapf(ErrRuntime, "reading loaded AppArmor profiles: %w", err)
+	}
+	if !loaded {
+		return crex.Wrapf(ErrRuntime, "AppArmor profile %q is not loaded", name)
+	}
+	return nil
+}
+
+// Reports whether a profile list in the format of [appArmorProfilesPath]
+// has a profile of the given name.
+func appArmorProfileLoaded(r io.Reader, name string) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		profile, _, _ := strings.Cut(scanner.Text(), " (")
+		if profile == name {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// Checks that an AppArmor profile name is well formed.
+func validateAppArmorProfile(name string) error {
+	if strings.ContainsFunc(name, unicode.IsSpace) {
+		return crex.Wrapf(ErrRuntime, "invalid AppArmor profile name %q", name)
+	}
+	return nil
+}
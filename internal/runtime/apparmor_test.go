@@ -0,0 +1,105 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/apparmor"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestAppArmorProfileLoaded(t *testing.T) {
+	profiles := "docker-default (enforce)\ncri-containerd.apparmor.d (enforce)\n/usr/sbin/cupsd (complain)\n"
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "docker-default", want: true},
+		{name: "/usr/sbin/cupsd", want: true},
+		{name: "docker"},
+		{name: "cruxd-build"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appArmorProfileLoaded(strings.NewReader(profiles), tt.name)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("loaded = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerOptionsSpecOptsAppArmor(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    string
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "custom", profile: "cruxd-build", want: "cruxd-build"},
+		{name: "unconfined", profile: AppArmorUnconfined, want: AppArmorUnconfined},
+		{name: "invalid", profile: "cruxd build", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specOpts, err := ContainerOptions{AppArmorProfile: tt.profile}.specOpts()
+			if tt.wantErr {
+				if !errors.Is(err, ErrRuntime) {
+					t.Fatalf("err = %v, want ErrRuntime", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			spec := &oci.Spec{
+				Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{}},
+				Linux:   &specs.Linux{},
+			}
+			for _, o := range specOpts {
+				if err := o(context.Background(), nil, nil, spec); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if spec.Process.ApparmorProfile != tt.want {
+				t.Errorf("profile = %q, want %q", spec.Process.ApparmorProfile, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAppArmorProfile(t *testing.T) {
+	if !apparmor.HostSupports() {
+		t.Skip("AppArmor is not enabled on this host")
+	}
+	f, err := os.Open(appArmorProfilesPath)
+	if err != nil {
+		t.Skipf("cannot read loaded profiles: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		t.Skip("no AppArmor profiles are loaded")
+	}
+	loaded, _, _ := strings.Cut(scanner.Text(), " (")
+
+	rt := &Runtime{}
+	if err := rt.CheckAppArmorProfile(loaded); err != nil {
+		t.Errorf("loaded profile %q: %v", loaded, err)
+	}
+	if err := rt.CheckAppArmorProfile("cruxd-test-missing-profile"); !errors.Is(err, ErrRuntime) {
+		t.Errorf("missing profile: err = %v, want ErrRuntime", err)
+	}
+}
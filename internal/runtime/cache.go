@@ -0,0 +1,225 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/diff"
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/protocol"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+
+	// Snapshot label holding the build cache key a committed snapshot was
+	// checkpointed under.
+	cacheLabel = "io.github.cruciblehq.cruxd.cache"
+
+	// Prefix of the names of committed snapshots that hold cache entries.
+	cacheSnapshotPrefix = "cruxd-cache-"
+
+	// Prefix of the snapshot labels naming a resource whose builds recorded
+	// or reused a cache entry, followed by the resource's container ID form.
+	// The label holds the time the resource last used the entry.
+	cacheResourceLabelPrefix = "io.github.cruciblehq.cruxd.cache.resource."
+
+	// Label that keeps containerd's garbage collector from removing a
+	// snapshot that nothing else references.
+	gcRootLabel = "containerd.io/gc.root"
+)
+
+// Returns the name of the committed snapshot holding the entry for key.
+func cacheSnapshotName(key string) string {
+	return cacheSnapshotPrefix + key
+}
+
+// Returns the label recording that resource uses a cache entry.
+func cacheResourceLabel(resource string) string {
+	return cacheResourceLabelPrefix + protocol.ContainerID(resource)
+}
+
+// Records the container's filesystem as the build cache entry for key,
+// labeled as used by resource.
+//
+// The container's active snapshot is committed under a name derived from
+// key and a new active snapshot is prepared on top of it, so the container
+// carries on from the same state. The task must be stopped for the commit
+// and is started again afterwards, which ends any process still running in
+// it. When another build has already recorded the same key, nothing is
+// committed and this checkpoint's changes are carried into the next one.
+func (c *Container) Checkpoint(ctx context.Context, key, resource string) error {
+	if err := c.Stop(ctx); err != nil {
+		return err
+	}
+
+	sn := c.client.SnapshotService(c.snapshotter)
+	name := cacheSnapshotName(key)
+	now := time.Now().UTC().Format(time.RFC3339)
+	labels := map[string]string{
+		cacheLabel:                   key,
+		gcRootLabel:                  now,
+		cacheResourceLabel(resource): now,
+	}
+
+	err := sn.Commit(ctx, name, c.id, snapshots.WithLabels(labels))
+	switch {
+	case errdefs.IsAlreadyExists(err):
+		if err := claimCacheEntry(ctx, sn, name, resource); err != nil {
+			return crex.Wrapf(ErrRuntime, "checkpoint %s: %w", c.id, err)
+		}
+	case err != nil:
+		return crex.Wrapf(ErrRuntime, "checkpoint %s: %w", c.id, err)
+	default:
+		if _, err := sn.Prepare(ctx, c.id, name); err != nil {
+			return crex.Wrapf(ErrRuntime, "checkpoint %s: %w", c.id, err)
+		}
+	}
+
+	return c.resume(ctx)
+}
+
+// Reports whether the build cache has an entry for key, without touching
+// the container.
+//
+// A found entry is labeled as used by resource, so that clearing the
+// resource's cache with [Runtime.ClearCache] removes every entry its builds
+// rely on, including those another resource recorded.
+func (c *Container) Cached(ctx context.Context, key, resource string) (bool, error) {
+	sn := c.client.SnapshotService(c.snapshotter)
+	if err := claimCacheEntry(ctx, sn, cacheSnapshotName(key), resource); err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, crex.Wrap(ErrRuntime, err)
+	}
+	return true, nil
+}
+
+// Modifies snapshot labels. Satisfied by [snapshots.Snapshotter].
+type snapshotUpdater interface {
+	Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error)
+}
+
+// Labels the cache entry in the named snapshot as used by resource. Fails
+// with a not-found error when there is no such snapshot.
+func claimCacheEntry(ctx context.Context, sn snapshotUpdater, name, resource string) error {
+	label := cacheResourceLabel(resource)
+	info := snapshots.Info{
+		Name:   name,
+		Labels: map[string]string{label: time.Now().UTC().Format(time.RFC3339)},
+	}
+	_, err := sn.Update(ctx, info, "labels."+label)
+	return err
+}
+
+// Replaces the container's filesystem with the build cache entry for key.
+//
+// Returns false, leaving the container untouched, when there is no entry
+// for key. Otherwise the active snapshot is discarded and a new one is
+// prepared from the entry, restarting the task as [Container.Checkpoint]
+// does.
+func (c *Container) Restore(ctx context.Context, key string) (bool, error) {
+	sn := c.client.SnapshotService(c.snapshotter)
+	name := cacheSnapshotName(key)
+
+	if _, err := sn.Stat(ctx, name); err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, crex.Wrap(ErrRuntime, err)
+	}
+
+	if err := c.Stop(ctx); err != nil {
+		return false, err
+	}
+	if err := sn.Remove(ctx, c.id); err != nil && !errdefs.IsNotFound(err) {
+		return false, crex.Wrapf(ErrRuntime, "restore %s: %w", c.id, err)
+	}
+	if _, err := sn.Prepare(ctx, c.id, name); err != nil {
+		return false, crex.Wrapf(ErrRuntime, "restore %s: %w", c.id, err)
+	}
+
+	return true, c.resume(ctx)
+}
+
+// Starts the container's task again after its snapshot was replaced.
+// Containers without a task are left as they are.
+func (c *Container) resume(ctx context.Context) error {
+	if c.idle {
+		return nil
+	}
+	if err := c.Start(ctx); err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+	return nil
+}
+
+// Reads snapshot metadata. Satisfied by [snapshots.Snapshotter].
+type snapshotStatter interface {
+	Stat(ctx context.Context, key string) (snapshots.Info, error)
+}
+
+// Returns the snapshot a container's layer is diffed against, which is the
+// top of its base image.
+//
+// Checkpoints insert cache entries between the base image and the active
+// snapshot, so the direct parent is skipped over for as long as it is a
+// cache entry. Returns "" for a container whose base has no layers.
+func imageParent(ctx context.Context, sn snapshotStatter, key string) (string, error) {
+	info, err := sn.Stat(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	parent := info.Parent
+	for parent != "" {
+		info, err := sn.Stat(ctx, parent)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := info.Labels[cacheLabel]; !ok {
+			return parent, nil
+		}
+		parent = info.Parent
+	}
+	return "", nil
+}
+
+// Computes the layer holding every change between the container's base
+// image and its active snapshot.
+//
+// This is what [rootfs.CreateDiff] computes when the snapshot sits directly
+// on its base, but it also covers the changes committed to cache entries
+// in between, so the exported image has one layer per stage whether or not
+// the stage was checkpointed. The layer is written with the given media
+// type, which selects its compression. With squash the diff is taken
+// against an empty filesystem instead, so the layer holds the whole root
+// filesystem, base image included.
+func (c *Container) createDiff(ctx context.Context, key, snapshotter, mediaType string, squash bool) (ocispec.Descriptor, error) {
+	sn := c.client.SnapshotService(snapshotter)
+
+	var parent string
+	if !squash {
+		var err error
+		if parent, err = imageParent(ctx, sn, key); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	lowerKey := fmt.Sprintf("%s-export-view-%d", key, time.Now().UnixNano())
+	lower, err := sn.View(ctx, lowerKey, parent)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer sn.Remove(context.WithoutCancel(ctx), lowerKey)
+
+	upper, err := sn.Mounts(ctx, key)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	return c.client.DiffService().Compare(ctx, lower, upper, diff.WithMediaType(mediaType))
+}
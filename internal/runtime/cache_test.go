@@ -0,0 +1,66 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+// Snapshot metadata by key.
+type fakeSnapshots map[string]snapshots.Info
+
+func (f fakeSnapshots) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	info, ok := f[key]
+	if !ok {
+		return snapshots.Info{}, errdefs.ErrNotFound
+	}
+	return info, nil
+}
+
+func TestImageParent(t *testing.T) {
+	cached := map[string]string{cacheLabel: "k"}
+	sn := fakeSnapshots{
+		"sha256:layer1":  {Name: "sha256:layer1"},
+		"sha256:layer2":  {Name: "sha256:layer2", Parent: "sha256:layer1"},
+		"cruxd-cache-a":  {Name: "cruxd-cache-a", Parent: "sha256:layer2", Labels: cached},
+		"cruxd-cache-b":  {Name: "cruxd-cache-b", Parent: "cruxd-cache-a", Labels: cached},
+		"direct":         {Name: "direct", Parent: "sha256:layer2"},
+		"checkpointed":   {Name: "checkpointed", Parent: "cruxd-cache-b"},
+		"scratch-cache":  {Name: "scratch-cache", Labels: cached},
+		"on-scratch":     {Name: "on-scratch", Parent: "scratch-cache"},
+		"dangling-cache": {Name: "dangling-cache", Parent: "gone", Labels: cached},
+		"broken":         {Name: "broken", Parent: "dangling-cache"},
+	}
+
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "direct", want: "sha256:layer2"},
+		{key: "checkpointed", want: "sha256:layer2"},
+		{key: "on-scratch", want: ""},
+		{key: "broken", wantErr: true},
+		{key: "missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := imageParent(context.Background(), sn, tt.key)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("imageParent(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
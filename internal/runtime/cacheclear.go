@@ -0,0 +1,132 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Outcome of [Runtime.ClearCache].
+type CacheClearResult struct {
+	Removed   int   // Cache entries removed.
+	InUse     int   // Matching entries kept because a container's filesystem still sits on them.
+	Reclaimed int64 // Bytes of snapshot data held by the removed entries.
+}
+
+// Lists, measures, and removes snapshots. Satisfied by [snapshots.Snapshotter].
+type cacheSnapshotter interface {
+	Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) error
+	Usage(ctx context.Context, key string) (snapshots.Usage, error)
+	Remove(ctx context.Context, key string) error
+}
+
+// Removes the build cache entries of a resource from the runtime's
+// snapshotter, so that the resource's next build executes every step.
+//
+// An entry belongs to every resource whose builds recorded or reused it,
+// and resource matches the way [Runtime.DestroyByPrefix] matches container
+// IDs: "my-app" clears the entries of "my-app" and "my-app-worker" but not
+// those of "my-app2". An empty resource clears the whole cache. Entries
+// recorded on top of a removed entry are removed with it, since a snapshot
+// cannot outlive its parent, even when they belong to other resources.
+// Entries that a container's snapshot was prepared from, such as those of a
+// build still running, are left in place and counted as in use.
+func (rt *Runtime) ClearCache(ctx context.Context, resource string) (CacheClearResult, error) {
+	return clearCache(ctx, rt.client.SnapshotService(rt.snapshotter), resource)
+}
+
+// Removes the cache entries of resource from sn, or all of them when
+// resource is empty, children before their parents.
+func clearCache(ctx context.Context, sn cacheSnapshotter, resource string) (CacheClearResult, error) {
+	var res CacheClearResult
+
+	entries := make(map[string]snapshots.Info)
+	err := sn.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+		if _, ok := info.Labels[cacheLabel]; ok {
+			entries[info.Name] = info
+		}
+		return nil
+	}, fmt.Sprintf("labels.%q", cacheLabel))
+	if err != nil {
+		return res, crex.Wrapf(ErrRuntime, "list cache entries: %w", err)
+	}
+
+	for _, name := range cacheRemovalOrder(entries, resource) {
+		usage, err := sn.Usage(ctx, name)
+		if err != nil && !errdefs.IsNotFound(err) {
+			return res, crex.Wrapf(ErrRuntime, "cache entry %s: %w", name, err)
+		}
+		switch err := sn.Remove(ctx, name); {
+		case err == nil:
+			res.Removed++
+			res.Reclaimed += usage.Size
+		case errdefs.IsFailedPrecondition(err):
+			res.InUse++
+		case errdefs.IsNotFound(err):
+		default:
+			return res, crex.Wrapf(ErrRuntime, "cache entry %s: %w", name, err)
+		}
+	}
+	return res, nil
+}
+
+// Returns the names of the entries to remove for resource, each after the
+// entries recorded on top of it.
+//
+// The entries used by resource are selected along with every entry
+// descending from them, and ordered by their depth in the chain of cache
+// entries, deepest first.
+func cacheRemovalOrder(entries map[string]snapshots.Info, resource string) []string {
+	selected := make(map[string]bool)
+	for name, info := range entries {
+		if resource == "" || usedByResource(info, resource) {
+			selected[name] = true
+		}
+	}
+	for grew := true; grew; {
+		grew = false
+		for name, info := range entries {
+			if !selected[name] && selected[info.Parent] {
+				selected[name] = true
+				grew = true
+			}
+		}
+	}
+
+	depth := func(name string) int {
+		n := 0
+		for info, ok := entries[name]; ok; info, ok = entries[info.Parent] {
+			n++
+		}
+		return n
+	}
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if d := depth(b) - depth(a); d != 0 {
+			return d
+		}
+		return strings.Compare(a, b)
+	})
+	return names
+}
+
+// Reports whether a cache entry is labeled as used by resource or by a
+// resource whose container ID form continues it with a hyphen.
+func usedByResource(info snapshots.Info, resource string) bool {
+	prefix := strings.TrimSuffix(protocol.ContainerID(resource), "-")
+	for label := range info.Labels {
+		if owner, ok := strings.CutPrefix(label, cacheResourceLabelPrefix); ok && hasIDPrefix(owner, prefix) {
+			return true
+		}
+	}
+	return false
+}
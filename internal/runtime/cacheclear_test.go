@@ -0,0 +1,201 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/snapshots"
+	"github.com/containerd/errdefs"
+)
+
+// Snapshots held in memory, refusing to remove a snapshot with children as
+// containerd does.
+type fakeCacheSnapshotter struct {
+	infos map[string]snapshots.Info
+	sizes map[string]int64
+}
+
+func (f *fakeCacheSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) error {
+	for _, info := range f.infos {
+		if err := fn(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeCacheSnapshotter) Usage(_ context.Context, key string) (snapshots.Usage, error) {
+	if _, ok := f.infos[key]; !ok {
+		return snapshots.Usage{}, errdefs.ErrNotFound
+	}
+	return snapshots.Usage{Size: f.sizes[key]}, nil
+}
+
+func (f *fakeCacheSnapshotter) Remove(_ context.Context, key string) error {
+	if _, ok := f.infos[key]; !ok {
+		return errdefs.ErrNotFound
+	}
+	for _, info := range f.infos {
+		if info.Parent == key {
+			return errdefs.ErrFailedPrecondition
+		}
+	}
+	delete(f.infos, key)
+	return nil
+}
+
+func (f *fakeCacheSnapshotter) Update(_ context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+	current, ok := f.infos[info.Name]
+	if !ok {
+		return snapshots.Info{}, errdefs.ErrNotFound
+	}
+	current.Labels = maps.Clone(current.Labels)
+	if current.Labels == nil {
+		current.Labels = map[string]string{}
+	}
+	maps.Copy(current.Labels, info.Labels)
+	f.infos[info.Name] = current
+	return current, nil
+}
+
+// Returns a cache entry snapshot on parent used by the given resources.
+func cacheEntry(name, parent string, resources ...string) snapshots.Info {
+	labels := map[string]string{cacheLabel: name}
+	for _, resource := range resources {
+		labels[cacheResourceLabel(resource)] = "2026-01-01T00:00:00Z"
+	}
+	return snapshots.Info{Name: name, Parent: parent, Kind: snapshots.KindCommitted, Labels: labels}
+}
+
+// Returns a snapshotter holding a base image layer, the cache entries of
+// several resources, and the active snapshot of a container on one of them:
+//
+//	sha256:base
+//	├── a1 (my-app, other-app) ── a2 (my-app) ── a3 (other-app)
+//	├── w1 (my-app-worker)
+//	├── o1 (other-app) ── o2 (other-app) ── running
+//	└── s1 (crucible/runtime-go)
+func newCacheFixture() *fakeCacheSnapshotter {
+	infos := map[string]snapshots.Info{
+		"sha256:base": {Name: "sha256:base", Kind: snapshots.KindCommitted},
+		"a1":          cacheEntry("a1", "sha256:base", "my-app", "other-app"),
+		"a2":          cacheEntry("a2", "a1", "my-app"),
+		"a3":          cacheEntry("a3", "a2", "other-app"),
+		"w1":          cacheEntry("w1", "sha256:base", "my-app-worker"),
+		"o1":          cacheEntry("o1", "sha256:base", "other-app"),
+		"o2":          cacheEntry("o2", "o1", "other-app"),
+		"running":     {Name: "running", Parent: "o2", Kind: snapshots.KindActive},
+		"s1":          cacheEntry("s1", "sha256:base", "crucible/runtime-go"),
+	}
+	sizes := map[string]int64{"a1": 100, "a2": 20, "a3": 3, "w1": 4000, "o1": 50000, "o2": 600000, "s1": 7000000}
+	return &fakeCacheSnapshotter{infos: infos, sizes: sizes}
+}
+
+func TestClearCache(t *testing.T) {
+	tests := []struct {
+		resource string
+		want     CacheClearResult
+		wantLeft []string
+	}{
+		{
+			resource: "my-app",
+			want:     CacheClearResult{Removed: 4, Reclaimed: 4123},
+			wantLeft: []string{"o1", "o2", "s1"},
+		},
+		{
+			resource: "my-app-worker",
+			want:     CacheClearResult{Removed: 1, Reclaimed: 4000},
+			wantLeft: []string{"a1", "a2", "a3", "o1", "o2", "s1"},
+		},
+		{
+			resource: "other-app",
+			want:     CacheClearResult{Removed: 3, InUse: 2, Reclaimed: 123},
+			wantLeft: []string{"o1", "o2", "s1", "w1"},
+		},
+		{
+			resource: "crucible/runtime-go",
+			want:     CacheClearResult{Removed: 1, Reclaimed: 7000000},
+			wantLeft: []string{"a1", "a2", "a3", "o1", "o2", "w1"},
+		},
+		{
+			resource: "my-ap",
+			want:     CacheClearResult{},
+			wantLeft: []string{"a1", "a2", "a3", "o1", "o2", "s1", "w1"},
+		},
+		{
+			resource: "",
+			want:     CacheClearResult{Removed: 5, InUse: 2, Reclaimed: 7004123},
+			wantLeft: []string{"o1", "o2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.resource, func(t *testing.T) {
+			sn := newCacheFixture()
+			got, err := clearCache(context.Background(), sn, tt.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("clearCache(%q) = %+v, want %+v", tt.resource, got, tt.want)
+			}
+
+			var left []string
+			for name, info := range sn.infos {
+				if _, ok := info.Labels[cacheLabel]; ok {
+					left = append(left, name)
+				}
+			}
+			slices.Sort(left)
+			if !slices.Equal(left, tt.wantLeft) {
+				t.Errorf("entries left = %v, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestClearCacheRemoveError(t *testing.T) {
+	sn := &failingRemove{newCacheFixture()}
+	if _, err := clearCache(context.Background(), sn, "my-app-worker"); !errors.Is(err, ErrRuntime) {
+		t.Errorf("clearCache() = %v, want ErrRuntime", err)
+	}
+}
+
+// Fails every removal with an unexpected error.
+type failingRemove struct {
+	*fakeCacheSnapshotter
+}
+
+func (f *failingRemove) Remove(context.Context, string) error {
+	return errors.New("disk on fire")
+}
+
+func TestClaimCacheEntry(t *testing.T) {
+	ctx := context.Background()
+	sn := newCacheFixture()
+
+	if err := claimCacheEntry(ctx, sn, "o1", "my-app"); err != nil {
+		t.Fatal(err)
+	}
+	if !usedByResource(sn.infos["o1"], "my-app") || !usedByResource(sn.infos["o1"], "other-app") {
+		t.Errorf("claimed entry labels = %v", sn.infos["o1"].Labels)
+	}
+	if err := claimCacheEntry(ctx, sn, "gone", "my-app"); !errdefs.IsNotFound(err) {
+		t.Errorf("claiming a missing entry = %v, want not found", err)
+	}
+
+	// The claim makes the entry the resource's, so clearing the resource
+	// removes it and the next build of the resource misses it.
+	if _, err := clearCache(ctx, sn, "my-app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := claimCacheEntry(ctx, sn, "a1", "my-app"); !errdefs.IsNotFound(err) {
+		t.Errorf("entry recorded by the resource survived clearing: %v", err)
+	}
+	if _, ok := sn.infos["o1"]; !ok {
+		t.Errorf("entry claimed by the resource removed while a container uses it")
+	}
+}
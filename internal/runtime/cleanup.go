@@ -0,0 +1,37 @@
+package runtime
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+)
+
+// Longest time spent tearing down a process or task after its context is
+// cancelled.
+const cleanupTimeout = 30 * time.Second
+
+// Returns a context for cleaning up after an operation whose context may
+// have been cancelled.
+//
+// The returned context keeps the values of ctx, such as the containerd
+// namespace, but not its cancellation, and expires after [cleanupTimeout]
+// so that an unresponsive containerd cannot hold the caller forever.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+}
+
+// Kills a process and waits for it to exit, or for ctx to expire.
+//
+// statusC must come from a Wait call whose context outlives the kill, since
+// it is what reports the exit.
+func killProcess(ctx context.Context, process containerd.Process, statusC <-chan containerd.ExitStatus) {
+	if err := process.Kill(ctx, syscall.SIGKILL); err != nil {
+		return
+	}
+	select {
+	case <-statusC:
+	case <-ctx.Done():
+	}
+}
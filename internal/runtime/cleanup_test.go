@@ -0,0 +1,27 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCleanupContext(t *testing.T) {
+	type key struct{}
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), key{}, "ns"))
+	cancelParent()
+
+	ctx, cancel := cleanupContext(parent)
+	defer cancel()
+
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("cleanup context inherited cancellation: %v", err)
+	}
+	if ctx.Value(key{}) != "ns" {
+		t.Error("cleanup context lost the parent's values")
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > cleanupTimeout {
+		t.Errorf("deadline = %v, %v, want within %s", deadline, ok, cleanupTimeout)
+	}
+}
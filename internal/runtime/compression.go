@@ -0,0 +1,44 @@
+package runtime
+
+import (
+	"context"
+
+	"github.com/cruciblehq/crex"
+)
+
+// Bounds how many layers are compressed or decompressed at once.
+//
+// Each slot stands for one core: containerd's diff service compresses a
+// layer on a single thread, and docker save exports decompress one layer at
+// a time. A nil limit admits any number.
+type compressionLimit chan struct{}
+
+// Sets how many exports may compress or decompress layers at the same time.
+//
+// Compression dominates the CPU time of an export, so with n below the
+// number of concurrent exports some wait for a slot, trading export latency
+// for cores left to the builds that run alongside. Each waiting export
+// still holds its container and content lease. Zero or negative removes
+// the limit. Must be called before the runtime is used concurrently.
+func (rt *Runtime) SetCompressionWorkers(n int) {
+	if n <= 0 {
+		rt.compression = nil
+		return
+	}
+	rt.compression = make(compressionLimit, n)
+}
+
+// Waits for a free slot and returns a function that frees it again.
+//
+// Fails with the context's cause when ctx ends first.
+func (l compressionLimit) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, crex.Wrapf(ErrRuntime, "waiting for a compression worker: %w", context.Cause(ctx))
+	}
+}
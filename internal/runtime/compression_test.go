@@ -0,0 +1,57 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCompressionLimit(t *testing.T) {
+	rt := &Runtime{}
+	rt.SetCompressionWorkers(2)
+	limit := rt.compression
+
+	first, err := limit.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := limit.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limit.acquire(ctx); !errors.Is(err, ErrRuntime) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire with every worker busy = %v, want context canceled", err)
+	}
+
+	first()
+	third, err := limit.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire after a release: %v", err)
+	}
+	second()
+	third()
+	if len(limit) != 0 {
+		t.Errorf("%d workers still held", len(limit))
+	}
+}
+
+func TestCompressionLimitUnlimited(t *testing.T) {
+	rt := &Runtime{}
+	rt.SetCompressionWorkers(0)
+	if rt.compression != nil {
+		t.Fatal("zero workers should remove the limit")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range 10 {
+		done, err := rt.compression.acquire(ctx)
+		if err != nil {
+			t.Fatalf("unlimited acquire = %v", err)
+		}
+		done()
+	}
+}
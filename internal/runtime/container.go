@@ -3,6 +3,7 @@ package runtime
 import (
 	"context"
 	"log/slog"
+	"maps"
 	"syscall"
 
 	containerd "github.com/containerd/containerd/v2/client"
@@ -16,9 +17,32 @@ import (
 
 // A running build container backed by containerd.
 type Container struct {
-	client   *containerd.Client // Containerd client for managing the container.
-	id       string             // Unique identifier for the container, used as the containerd container ID.
-	platform string             // OCI platform (e.g., "linux/amd64").
+	client      *containerd.Client // Containerd client for managing the container.
+	id          string             // Unique identifier for the container, used as the containerd container ID.
+	platform    string             // OCI platform (e.g., "linux/amd64").
+	snapshotter string             // Snapshotter the container's snapshot is created with.
+	remote      bool               // Whether containerd runs on another host.
+	idle        bool               // Whether the container was created without a task; see [Runtime.CreateImage].
+	memLimit    bool               // Whether the container has a memory limit, so commands may be killed for exceeding it.
+	compression compressionLimit   // Slots shared with the runtime's other containers for compressing layers on export.
+}
+
+// Returns the container's identifier.
+func (c *Container) ID() string {
+	return c.id
+}
+
+// Labels the container as paused at a breakpoint, so that
+// [Runtime.DestroyBuildContainers] leaves it to the owner of the build.
+func (c *Container) MarkPaused(ctx context.Context) error {
+	ctr, err := c.client.LoadContainer(ctx, c.id)
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+	if _, err := ctr.SetLabels(ctx, map[string]string{pausedLabel: "true"}); err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+	return nil
 }
 
 // Queries the current state of the container.
@@ -56,6 +80,28 @@ func (c *Container) Status(ctx context.Context) (protocol.ContainerState, error)
 	}
 }
 
+// Reports whether the container exists.
+//
+// Unlike [Container.Status], only the container record is looked up, not its
+// task. A container that does not exist is reported as false with a nil
+// error; failing to look it up is an error.
+func (c *Container) Exists(ctx context.Context) (bool, error) {
+	_, err := c.client.LoadContainer(ctx, c.id)
+	return existence(err)
+}
+
+// Interprets the error of a container lookup as an existence check.
+func existence(err error) (bool, error) {
+	switch {
+	case err == nil:
+		return true, nil
+	case errdefs.IsNotFound(err):
+		return false, nil
+	default:
+		return false, crex.Wrap(ErrRuntime, err)
+	}
+}
+
 // Stops the container's task.
 //
 // The running task is killed and deleted. The container metadata is preserved.
@@ -99,7 +145,16 @@ func (c *Container) Destroy(ctx context.Context) {
 	}
 
 	if task, err := ctr.Task(ctx, nil); err == nil {
-		task.Kill(ctx, syscall.SIGKILL)
+		// Wait for the task to exit before deleting it, since a task that
+		// is still running keeps the container, and with it the snapshot,
+		// from being deleted.
+		if statusC, err := task.Wait(ctx); err == nil {
+			waitCtx, cancel := context.WithTimeout(ctx, cleanupTimeout)
+			killProcess(waitCtx, task, statusC)
+			cancel()
+		} else {
+			task.Kill(ctx, syscall.SIGKILL)
+		}
 		task.Delete(ctx, containerd.WithProcessKill)
 	}
 
@@ -108,6 +163,32 @@ func (c *Container) Destroy(ctx context.Context) {
 	}
 }
 
+// Returns the name of the image the container was created from.
+func (c *Container) imageName(ctx context.Context) (string, error) {
+	ctr, err := c.client.LoadContainer(ctx, c.id)
+	if err != nil {
+		return "", err
+	}
+	info, err := ctr.Info(ctx)
+	if err != nil {
+		return "", err
+	}
+	return info.Image, nil
+}
+
+// Returns the digest of the image the container was created from.
+func (c *Container) imageDigest(ctx context.Context) (string, error) {
+	ctr, err := c.client.LoadContainer(ctx, c.id)
+	if err != nil {
+		return "", err
+	}
+	img, err := ctr.Image(ctx)
+	if err != nil {
+		return "", err
+	}
+	return img.Target().Digest.String(), nil
+}
+
 // Starts a new task on an existing container.
 //
 // Any leftover task from a previous run is cleaned up first. The container
@@ -132,8 +213,9 @@ func (c *Container) Start(ctx context.Context) error {
 // Spec options are applied sequentially. Each one mutates the OCI spec in
 // place, so extraOpts appended after the base options can override values
 // set by WithImageConfig (last writer wins). Build containers use this to
-// replace the image entrypoint with "sleep infinity".
-func (c *Container) create(ctx context.Context, image containerd.Image, extraOpts ...oci.SpecOpts) (containerd.Container, error) {
+// replace the image entrypoint with "sleep infinity". The container record
+// carries labels along with the label marking it as the daemon's.
+func (c *Container) create(ctx context.Context, image containerd.Image, labels map[string]string, extraOpts ...oci.SpecOpts) (containerd.Container, error) {
 	specOpts := []oci.SpecOpts{
 		oci.WithDefaultSpecForPlatform(c.platform),
 		oci.WithImageConfig(image),
@@ -144,21 +226,44 @@ func (c *Container) create(ctx context.Context, image containerd.Image, extraOpt
 
 	return c.client.NewContainer(ctx, c.id,
 		containerd.WithImage(image),
-		containerd.WithSnapshotter(snapshotter),
+		containerd.WithSnapshotter(c.snapshotter),
 		containerd.WithNewSnapshot(c.id, image),
 		containerd.WithRuntime(ociRuntime, nil),
+		containerd.WithContainerLabels(containerLabels(labels)),
 		containerd.WithNewSpec(specOpts...),
 	)
 }
 
+// Returns the labels of a new container: labels plus [managedLabel].
+func containerLabels(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	maps.Copy(out, labels)
+	out[managedLabel] = "true"
+	return out
+}
+
 // Starts the container's long-running task with no attached IO.
+//
+// Task creation can fail transiently right after the snapshot is created on
+// a busy host, before the shim is ready. Such failures are retried with a
+// short backoff; errors that stem from the container's configuration fail
+// immediately. Callers remain responsible for removing the container when
+// this returns an error.
 func (c *Container) startTask(ctx context.Context, ctr containerd.Container) error {
+	return retryTransient(ctx, taskStartAttempts, taskStartBackoff, func() error {
+		return c.tryStartTask(ctx, ctr)
+	})
+}
+
+// Makes a single attempt at creating and starting the container's task,
+// deleting the task again if it does not start.
+func (c *Container) tryStartTask(ctx context.Context, ctr containerd.Container) error {
 	task, err := ctr.NewTask(ctx, cio.NullIO)
 	if err != nil {
 		return err
 	}
 	if err := task.Start(ctx); err != nil {
-		task.Delete(ctx)
+		task.Delete(ctx, containerd.WithProcessKill)
 		return err
 	}
 	return nil
@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"path/filepath"
 
@@ -10,23 +11,58 @@ import (
 
 // Creates a directory inside the container, including parents.
 func (c *Container) MkdirAll(ctx context.Context, path string) error {
+	if c.idle {
+		return c.mkdirHost(ctx, path)
+	}
 	return c.mustExec(ctx, "mkdir", nil, nil, "mkdir", "-p", path)
 }
 
+// Removes files or directories inside the container, including their contents.
+//
+// Missing paths are ignored.
+func (c *Container) RemoveAll(ctx context.Context, paths ...string) error {
+	if c.idle {
+		return c.removeHost(ctx, paths)
+	}
+	args := append([]string{"rm", "-rf", "--"}, paths...)
+	return c.mustExec(ctx, "rm", nil, nil, args...)
+}
+
 // Copies a tar stream into the container's filesystem.
 //
 // The contents of r are extracted into destDir by piping them to "tar xf - -C
-// destDir" inside the container.
+// destDir" inside the container. A failure reports destDir and tar's stderr.
+// A container without a task extracts on the host instead.
 func (c *Container) CopyTo(ctx context.Context, r io.Reader, destDir string) error {
-	return c.mustExec(ctx, "tar extract", r, nil, "tar", "xf", "-", "-C", destDir)
+	if c.idle {
+		return c.extractHost(ctx, r, destDir)
+	}
+	return c.mustExec(ctx, fmt.Sprintf("tar extract into %s", destDir), r, nil, "tar", "xf", "-", "-C", destDir)
 }
 
 // Copies a path from the container's filesystem as a tar stream.
 //
 // The file or directory at path is archived by running "tar cf - -C <dir>
-// <base>" inside the container and streaming the output to w.
+// <base>" inside the container and streaming the output to w. If tar fails
+// because path does not exist, the error is [ErrPathNotFound]; other
+// failures report path and tar's stderr. A container without a task is
+// archived on the host instead.
 func (c *Container) CopyFrom(ctx context.Context, w io.Writer, path string) error {
-	return c.mustExec(ctx, "tar archive", nil, w, "tar", "cf", "-", "-C", filepath.Dir(path), filepath.Base(path))
+	if c.idle {
+		return c.archiveHost(ctx, w, path)
+	}
+	err := c.mustExec(ctx, fmt.Sprintf("tar archive of %s", path), nil, w, "tar", "cf", "-", "-C", filepath.Dir(path), filepath.Base(path))
+	if err != nil && !c.pathExists(context.WithoutCancel(ctx), path) {
+		return crex.Wrapf(ErrPathNotFound, "%s", path)
+	}
+	return err
+}
+
+// Reports whether a path exists inside the container. Errors running the
+// check count as the path existing, so that the original failure is kept.
+func (c *Container) pathExists(ctx context.Context, path string) bool {
+	exitCode, _, err := c.execCommand(ctx, nil, nil, nil, "", "test", "-e", path)
+	return err != nil || exitCode == 0
 }
 
 // Helper method that runs a command inside the container, returning an error
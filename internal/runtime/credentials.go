@@ -0,0 +1,122 @@
+package runtime
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+
+	tregistry "github.com/containerd/containerd/v2/core/transfer/registry"
+	"github.com/cruciblehq/crex"
+)
+
+// Registry credentials read from a Docker client config file, as written
+// by "docker login".
+//
+// Only credentials stored in the file itself are used. Entries kept in a
+// credential store or helper and identity tokens are ignored, and registries
+// without usable credentials are accessed anonymously.
+type RegistryCredentials struct {
+	auths map[string]registryAuth // Credentials by normalized registry host.
+}
+
+// Username and password of a registry.
+type registryAuth struct {
+	username string
+	password string
+}
+
+// The parts of a Docker client config file that hold credentials.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`     // Base64 of "username:password".
+		Username string `json:"username"` // Used when auth is empty.
+		Password string `json:"password"` // Used when auth is empty.
+	} `json:"auths"`
+}
+
+// Reads registry credentials from a Docker client config file such as
+// ~/.docker/config.json.
+//
+// Errors name the file and registry but never include credentials.
+func LoadRegistryCredentials(path string) (*RegistryCredentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+	creds, err := parseRegistryCredentials(data)
+	if err != nil {
+		return nil, crex.Wrapf(ErrRuntime, "%s: %w", path, err)
+	}
+	return creds, nil
+}
+
+// Parses the "auths" section of a Docker client config file.
+func parseRegistryCredentials(data []byte) (*RegistryCredentials, error) {
+	var file dockerConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	creds := &RegistryCredentials{auths: make(map[string]registryAuth)}
+	for key, entry := range file.Auths {
+		auth := registryAuth{username: entry.Username, password: entry.Password}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, crex.Wrapf(ErrRuntime, "registry %q: auth is not valid base64", key)
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, crex.Wrapf(ErrRuntime, "registry %q: auth is not of the form username:password", key)
+			}
+			auth = registryAuth{username: user, password: pass}
+		}
+		if auth.username == "" {
+			continue
+		}
+		creds.auths[credentialHost(key)] = auth
+	}
+	return creds, nil
+}
+
+// Returns the registry host a config file key or a host contacted by
+// containerd refers to.
+//
+// Keys may be full URLs such as "https://index.docker.io/v1/", so any scheme
+// and path are dropped. The hosts Docker Hub is known by all map to
+// "docker.io".
+func credentialHost(key string) string {
+	host := key
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	host = strings.ToLower(host)
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// Returns the credentials for host, or none for anonymous access.
+// Satisfies [tregistry.CredentialHelper].
+func (c *RegistryCredentials) GetCredentials(ctx context.Context, ref, host string) (tregistry.Credentials, error) {
+	if c == nil {
+		return tregistry.Credentials{}, nil
+	}
+	auth, ok := c.auths[credentialHost(host)]
+	if !ok {
+		return tregistry.Credentials{}, nil
+	}
+	return tregistry.Credentials{Host: host, Username: auth.username, Secret: auth.password}, nil
+}
+
+// Sets the credentials used to authenticate with registries when pulling
+// and pushing images. Nil accesses every registry anonymously. Must be
+// called before the runtime is used concurrently.
+func (rt *Runtime) SetRegistryCredentials(creds *RegistryCredentials) {
+	rt.credentials = creds
+}
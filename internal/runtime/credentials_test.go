@@ -0,0 +1,84 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistryCredentials(t *testing.T) {
+	creds, err := parseRegistryCredentials([]byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "aHViOmh1Yi1zZWNyZXQ="},
+			"ghcr.io": {"username": "octo", "password": "gh-secret"},
+			"registry.lan:5000": {"auth": "bGFuOmxhbjpzZWNyZXQ="},
+			"helper.example.com": {}
+		},
+		"credsStore": "desktop"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host     string
+		username string
+		secret   string
+	}{
+		{host: "registry-1.docker.io", username: "hub", secret: "hub-secret"},
+		{host: "docker.io", username: "hub", secret: "hub-secret"},
+		{host: "GHCR.io", username: "octo", secret: "gh-secret"},
+		{host: "registry.lan:5000", username: "lan", secret: "lan:secret"},
+		{host: "registry.lan"},
+		{host: "helper.example.com"},
+		{host: "quay.io"},
+	}
+
+	for _, tt := range tests {
+		got, err := creds.GetCredentials(context.Background(), "ref", tt.host)
+		if err != nil {
+			t.Fatalf("GetCredentials(%q): %v", tt.host, err)
+		}
+		if got.Username != tt.username || got.Secret != tt.secret {
+			t.Errorf("GetCredentials(%q) = %q/%q, want %q/%q", tt.host, got.Username, got.Secret, tt.username, tt.secret)
+		}
+	}
+}
+
+func TestRegistryCredentialsNil(t *testing.T) {
+	var creds *RegistryCredentials
+	got, err := creds.GetCredentials(context.Background(), "ref", "docker.io")
+	if err != nil || got.Username != "" {
+		t.Fatalf("GetCredentials = %+v, %v, want anonymous", got, err)
+	}
+}
+
+func TestLoadRegistryCredentialsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "malformed", data: `{"auths":`},
+		{name: "bad base64", data: `{"auths": {"ghcr.io": {"auth": "c2VjcmV0!"}}}`},
+		{name: "no separator", data: `{"auths": {"ghcr.io": {"auth": "c2VjcmV0"}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadRegistryCredentials(path)
+			if !errors.Is(err, ErrRuntime) {
+				t.Fatalf("error = %v, want ErrRuntime", err)
+			}
+			if strings.Contains(err.Error(), "secret") {
+				t.Errorf("error %q leaks the credentials", err)
+			}
+		})
+	}
+}
@@ -11,15 +11,20 @@
 // as a new OCI archive. When the container is no longer needed it should
 // be destroyed to release its snapshot and task resources.
 //
+// Containerd is normally reached through its Unix socket. A daemon on another
+// host can be reached with a "tcp://host:port" address, but only operations
+// that exchange content over the API work then; executing commands and bind
+// mounts fail with [ErrRemote] (see [New]).
+//
 // Example usage:
 //
-//	rt, err := runtime.New("/run/containerd/containerd.sock", "crucible")
+//	rt, err := runtime.New("/run/containerd/containerd.sock", "cruxd")
 //	if err != nil {
 //	    return err
 //	}
 //	defer rt.Close()
 //
-//	ctr, err := rt.StartContainer(ctx, "image.tar", "build-1", "linux/amd64")
+//	ctr, err := rt.StartContainer(ctx, "image.tar", "build-1", "linux/amd64", runtime.ContainerOptions{})
 //	if err != nil {
 //	    return err
 //	}
@@ -30,7 +35,8 @@
 //	    return err
 //	}
 //
-//	if err := ctr.Export(ctx, "output", []string{"/entrypoint"}); err != nil {
+//	opts := runtime.ExportOptions{Entrypoint: []string{"/entrypoint"}}
+//	if _, err := ctr.Export(ctx, "output", opts); err != nil {
 //	    return err
 //	}
 package runtime
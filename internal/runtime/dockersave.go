@@ -0,0 +1,316 @@
+package runtime
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	"github.com/cruciblehq/crex"
+	dref "github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layout of an exported image archive.
+type ExportFormat string
+
+const (
+	FormatOCI    ExportFormat = "oci"    // OCI image layout, which Docker 25 and later also load. The default.
+	FormatDocker ExportFormat = "docker" // Legacy docker save layout (v1.2), for older Docker daemons.
+)
+
+// Checks that the format is one of the known values or empty.
+func (f ExportFormat) Validate() error {
+	switch f {
+	case "", FormatOCI, FormatDocker:
+		return nil
+	}
+	return crex.Wrapf(ErrRuntime, "unknown export format %q", f)
+}
+
+// Content of an image to write in the docker save layout.
+type dockerSave struct {
+	config       []byte        // Image config blob, written as is.
+	configDigest digest.Digest // Digest of config.
+	layers       []dockerLayer // Layers from the bottom up, matching the config's diff IDs.
+	tags         []string      // Familiar references the image is tagged with, such as "alpine:3.21".
+}
+
+// A layer of a [dockerSave].
+type dockerLayer struct {
+	diffID digest.Digest                 // Digest of the uncompressed layer.
+	open   func() (io.ReadCloser, error) // Opens the layer blob, compressed or not.
+}
+
+// Entry of the manifest.json file of the docker save layout.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Legacy per-layer metadata of the docker save layout. Loaders that read
+// manifest.json ignore it, but older daemons rebuild the layer chain from
+// the parent links.
+type legacyLayerConfig struct {
+	ID           string               `json:"id"`
+	Parent       string               `json:"parent,omitempty"`
+	Created      string               `json:"created,omitempty"`
+	Architecture string               `json:"architecture,omitempty"`
+	OS           string               `json:"os,omitempty"`
+	Config       *ocispec.ImageConfig `json:"config,omitempty"`
+}
+
+// Writes the image as a docker save archive to w.
+//
+// The image is the manifest for the container's platform within target,
+// tagged with every name that is a tagged reference. Its
+// layers are decompressed, since older daemons only load plain tar layers,
+// and checked against the config's diff IDs on the way. Decompressing holds
+// a compression worker until the archive is written.
+func (c *Container) exportDockerSave(ctx context.Context, target ocispec.Descriptor, names []string, w io.Writer) error {
+	// The export target holds only the committed manifest, so the fallback
+	// never picks a different one.
+	desc, _, _, err := c.resolveManifestDescriptor(ctx, target, names[0], true)
+	if err != nil {
+		return err
+	}
+	manifest, err := c.readManifest(ctx, desc)
+	if err != nil {
+		return err
+	}
+
+	store := c.client.ContentStore()
+	config, err := content.ReadBlob(ctx, store, manifest.Config)
+	if err != nil {
+		return err
+	}
+	var img ocispec.Image
+	if err := json.Unmarshal(config, &img); err != nil {
+		return err
+	}
+	if len(img.RootFS.DiffIDs) != len(manifest.Layers) {
+		return crex.Wrapf(ErrRuntime, "image has %d layers but %d diff IDs", len(manifest.Layers), len(img.RootFS.DiffIDs))
+	}
+
+	done, err := c.compression.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	save := dockerSave{config: config, configDigest: manifest.Config.Digest, tags: dockerTags(names...)}
+	for i, layer := range manifest.Layers {
+		save.layers = append(save.layers, dockerLayer{
+			diffID: img.RootFS.DiffIDs[i],
+			open: func() (io.ReadCloser, error) {
+				ra, err := store.ReaderAt(ctx, layer)
+				if err != nil {
+					return nil, err
+				}
+				return struct {
+					io.Reader
+					io.Closer
+				}{content.NewReader(ra), ra}, nil
+			},
+		})
+	}
+
+	return writeDockerSave(w, save)
+}
+
+// Returns the names of the image that are tagged references as familiar
+// references, without duplicates. Other names are left out.
+func dockerTags(names ...string) []string {
+	var tags []string
+	for _, name := range names {
+		named, err := dref.ParseDockerRef(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := named.(dref.Tagged); !ok {
+			continue
+		}
+		if tag := dref.FamiliarString(named); !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Returns the legacy IDs of a chain of layers. Each ID is derived from the
+// ID of the layer below and the layer's diff ID, so equal chains get equal
+// IDs and layers shared between images are loaded only once.
+func legacyLayerIDs(diffIDs []digest.Digest) []string {
+	ids := make([]string, len(diffIDs))
+	parent := ""
+	for i, diffID := range diffIDs {
+		sum := sha256.Sum256([]byte(parent + " " + diffID.String()))
+		ids[i] = hex.EncodeToString(sum[:])
+		parent = ids[i]
+	}
+	return ids
+}
+
+// Writes the docker save layout: a directory per layer with its plain tar,
+// legacy metadata, and version, the config as <hex>.json, manifest.json,
+// and, for a tagged image, the legacy repositories file.
+func writeDockerSave(w io.Writer, save dockerSave) error {
+	var img ocispec.Image
+	if err := json.Unmarshal(save.config, &img); err != nil {
+		return err
+	}
+
+	diffIDs := make([]digest.Digest, len(save.layers))
+	for i, layer := range save.layers {
+		diffIDs[i] = layer.diffID
+	}
+	ids := legacyLayerIDs(diffIDs)
+
+	tw := tar.NewWriter(w)
+	entry := dockerManifest{
+		Config:   save.configDigest.Encoded() + ".json",
+		RepoTags: save.tags,
+	}
+
+	for i, layer := range save.layers {
+		meta := legacyLayerConfig{ID: ids[i], OS: img.OS, Architecture: img.Architecture}
+		if i > 0 {
+			meta.Parent = ids[i-1]
+		}
+		if img.Created != nil {
+			meta.Created = img.Created.UTC().Format("2006-01-02T15:04:05.999999999Z")
+		}
+		if i == len(save.layers)-1 {
+			meta.Config = &img.Config
+		}
+		metaJSON, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: ids[i] + "/", Mode: 0755}); err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, path.Join(ids[i], "VERSION"), []byte("1.0")); err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, path.Join(ids[i], "json"), metaJSON); err != nil {
+			return err
+		}
+		name := path.Join(ids[i], "layer.tar")
+		if err := writeLayerTar(tw, name, layer); err != nil {
+			return err
+		}
+		entry.Layers = append(entry.Layers, name)
+	}
+
+	if err := writeTarFile(tw, entry.Config, save.config); err != nil {
+		return err
+	}
+	manifestJSON, err := json.Marshal([]dockerManifest{entry})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "manifest.json", manifestJSON); err != nil {
+		return err
+	}
+
+	if repos := legacyRepositories(save.tags, ids); len(repos) > 0 {
+		reposJSON, err := json.Marshal(repos)
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, "repositories", reposJSON); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// Returns the contents of the legacy repositories file, which maps each
+// repository and tag to the ID of the image's top layer.
+func legacyRepositories(tags, ids []string) map[string]map[string]string {
+	if len(ids) == 0 {
+		return nil
+	}
+	repos := make(map[string]map[string]string)
+	for _, tag := range tags {
+		named, err := dref.ParseNormalizedNamed(tag)
+		if err != nil {
+			continue
+		}
+		tagged, ok := named.(dref.Tagged)
+		if !ok {
+			continue
+		}
+		repo := dref.FamiliarName(named)
+		if repos[repo] == nil {
+			repos[repo] = make(map[string]string)
+		}
+		repos[repo][tagged.Tag()] = ids[len(ids)-1]
+	}
+	return repos
+}
+
+// Writes a regular file entry holding data.
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Writes a layer decompressed as a regular file entry.
+//
+// A tar header needs the size up front, which is unknown until the layer
+// has been decompressed, so the layer is spooled to a temporary file first.
+// The decompressed layer must match its diff ID.
+func writeLayerTar(tw *tar.Writer, name string, layer dockerLayer) error {
+	rc, err := layer.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	plain, err := compression.DecompressStream(rc)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	spool, err := os.CreateTemp("", "cruxd-layer-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	verifier := layer.diffID.Verifier()
+	size, err := io.Copy(io.MultiWriter(spool, verifier), plain)
+	if err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return crex.Wrapf(ErrRuntime, "layer does not match diff ID %s", layer.diffID)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, spool)
+	return err
+}
@@ -0,0 +1,189 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Returns a layer holding a single file, gzip-compressed when compress is
+// set, together with its diff ID.
+func testLayer(t *testing.T, name, data string, compress bool) (dockerLayer, []byte) {
+	t.Helper()
+	var plain bytes.Buffer
+	tw := tar.NewWriter(&plain)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte(data))
+	tw.Close()
+
+	blob := plain.Bytes()
+	if compress {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(plain.Bytes())
+		zw.Close()
+		blob = gz.Bytes()
+	}
+	return dockerLayer{
+		diffID: digest.FromBytes(plain.Bytes()),
+		open:   func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(blob)), nil },
+	}, plain.Bytes()
+}
+
+// Returns the contents of the entries of a tar archive by name.
+func readTarFiles(t *testing.T, archive []byte) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = data
+	}
+}
+
+func TestWriteDockerSave(t *testing.T) {
+	base, basePlain := testLayer(t, "etc/os-release", "ID=test", true)
+	app, appPlain := testLayer(t, "app/main", "binary", false)
+
+	config := []byte(`{"architecture":"amd64","os":"linux","config":{"Entrypoint":["/app/main"]},"rootfs":{"type":"layers","diff_ids":["` +
+		base.diffID.String() + `","` + app.diffID.String() + `"]}}`)
+	save := dockerSave{
+		config:       config,
+		configDigest: digest.FromBytes(config),
+		layers:       []dockerLayer{base, app},
+		tags:         []string{"example.com/team/app:1.0"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeDockerSave(&buf, save); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readTarFiles(t, buf.Bytes())
+
+	var manifest []dockerManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("manifest.json: %v", err)
+	}
+	if len(manifest) != 1 || len(manifest[0].Layers) != 2 {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+	entry := manifest[0]
+	if !bytes.Equal(files[entry.Config], config) {
+		t.Errorf("config %s = %s", entry.Config, files[entry.Config])
+	}
+	if len(entry.RepoTags) != 1 || entry.RepoTags[0] != "example.com/team/app:1.0" {
+		t.Errorf("repo tags = %v", entry.RepoTags)
+	}
+
+	ids := legacyLayerIDs([]digest.Digest{base.diffID, app.diffID})
+	for i, want := range [][]byte{basePlain, appPlain} {
+		if entry.Layers[i] != ids[i]+"/layer.tar" {
+			t.Errorf("layer %d = %s, want %s/layer.tar", i, entry.Layers[i], ids[i])
+		}
+		if !bytes.Equal(files[entry.Layers[i]], want) {
+			t.Errorf("layer %d is not the uncompressed layer", i)
+		}
+		if string(files[ids[i]+"/VERSION"]) != "1.0" {
+			t.Errorf("layer %d VERSION = %q", i, files[ids[i]+"/VERSION"])
+		}
+	}
+
+	var top legacyLayerConfig
+	if err := json.Unmarshal(files[ids[1]+"/json"], &top); err != nil {
+		t.Fatal(err)
+	}
+	if top.ID != ids[1] || top.Parent != ids[0] || top.Config == nil || top.Config.Entrypoint[0] != "/app/main" {
+		t.Errorf("top layer json = %s", files[ids[1]+"/json"])
+	}
+
+	var repos map[string]map[string]string
+	if err := json.Unmarshal(files["repositories"], &repos); err != nil {
+		t.Fatalf("repositories: %v", err)
+	}
+	if repos["example.com/team/app"]["1.0"] != ids[1] {
+		t.Errorf("repositories = %v", repos)
+	}
+}
+
+func TestWriteDockerSaveDiffIDMismatch(t *testing.T) {
+	layer, _ := testLayer(t, "f", "data", true)
+	layer.diffID = digest.FromString("something else")
+	config := []byte(`{"rootfs":{"type":"layers","diff_ids":["` + layer.diffID.String() + `"]}}`)
+
+	err := writeDockerSave(io.Discard, dockerSave{config: config, configDigest: digest.FromBytes(config), layers: []dockerLayer{layer}})
+	if err == nil {
+		t.Fatal("expected an error for a layer that does not match its diff ID")
+	}
+}
+
+func TestWriteDockerSaveMultipleTags(t *testing.T) {
+	layer, _ := testLayer(t, "f", "data", false)
+	config := []byte(`{"os":"linux","rootfs":{"type":"layers","diff_ids":["` + layer.diffID.String() + `"]}}`)
+
+	var buf bytes.Buffer
+	save := dockerSave{
+		config:       config,
+		configDigest: digest.FromBytes(config),
+		layers:       []dockerLayer{layer},
+		tags:         dockerTags("docker.io/library/app:latest", "docker.io/library/app:1.2.3", "example.com/app:1.2.3"),
+	}
+	if err := writeDockerSave(&buf, save); err != nil {
+		t.Fatal(err)
+	}
+	files := readTarFiles(t, buf.Bytes())
+
+	var manifest []dockerManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"app:latest", "app:1.2.3", "example.com/app:1.2.3"}
+	if len(manifest) != 1 || !slices.Equal(manifest[0].RepoTags, want) {
+		t.Fatalf("repo tags = %v, want %v", manifest, want)
+	}
+
+	var repos map[string]map[string]string
+	if err := json.Unmarshal(files["repositories"], &repos); err != nil {
+		t.Fatal(err)
+	}
+	if len(repos["app"]) != 2 || len(repos["example.com/app"]) != 1 {
+		t.Errorf("repositories = %v", repos)
+	}
+}
+
+func TestDockerTags(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "docker.io/library/alpine:3.21", want: []string{"alpine:3.21"}},
+		{name: "ghcr.io/org/app:v1", want: []string{"ghcr.io/org/app:v1"}},
+		{name: "alpine", want: []string{"alpine:latest"}},
+		{name: "alpine@sha256:" + digest.FromString("x").Encoded()},
+		{name: "Not A Reference"},
+	}
+	for _, tt := range tests {
+		got := dockerTags(tt.name)
+		if len(got) != len(tt.want) || (len(got) == 1 && got[0] != tt.want[0]) {
+			t.Errorf("dockerTags(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
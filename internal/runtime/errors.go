@@ -3,6 +3,16 @@ package runtime
 import "errors"
 
 var (
-	ErrRuntime    = errors.New("runtime error")
-	ErrEmptyIndex = errors.New("empty image index")
+	ErrRuntime             = errors.New("runtime error")
+	ErrEmptyIndex          = errors.New("empty image index")
+	ErrLayerTooLarge       = errors.New("layer too large")
+	ErrPlatformNotFound    = errors.New("platform not found in image index")
+	ErrLease               = errors.New("content lease error")
+	ErrBlobMissing         = errors.New("blob missing during export")
+	ErrRemote              = errors.New("operation requires a local containerd")
+	ErrRegistryNotAllowed  = errors.New("registry not allowed")
+	ErrRegistryTimeout     = errors.New("registry timed out")
+	ErrPathNotFound        = errors.New("path not found in container")
+	ErrSnapshotterNotFound = errors.New("snapshotter not available")
+	ErrNotReady            = errors.New("container not ready")
 )
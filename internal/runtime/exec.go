@@ -24,61 +24,146 @@ func nextExecID() string {
 
 // Output of a command execution inside a container.
 type ExecResult struct {
-	ExitCode int    // Exit code of the process.
-	Stdout   string // Captured standard output.
-	Stderr   string // Captured standard error.
+	ExitCode        int    // Exit code of the process.
+	Stdout          string // Captured standard output.
+	Stderr          string // Captured standard error.
+	StdoutTruncated bool   // Whether Stdout was cut at the capture limit.
+	StderrTruncated bool   // Whether Stderr was cut at the capture limit.
+	OOMKilled       bool   // Whether the kernel killed a process for exceeding the container's memory limit.
 }
 
 // Runs a command inside the container.
 //
 // The command is passed to the shell as a single argument via "shell -c
 // command". Environment variables and working directory override the
-// container's OCI spec for this execution only.
+// container's OCI spec for this execution only. In a container with a
+// memory limit, the result reports whether the kernel killed a process of
+// the command for exceeding it.
 func (c *Container) Exec(ctx context.Context, shell, command string, env []string, workdir string) (*ExecResult, error) {
-	var stdout bytes.Buffer
-	exitCode, stderr, err := c.execCommand(ctx, nil, &stdout, env, workdir, shell, "-c", command)
+	return c.ExecTee(ctx, shell, command, env, workdir, nil, nil)
+}
+
+// Runs a command inside the container like [Container.Exec], also copying
+// its output to stdout and stderr as the process produces it.
+//
+// The result still carries the complete output. Nil writers receive
+// nothing. Each writer is called from its own goroutine, so the two may be
+// called concurrently, but each sees its stream in order.
+func (c *Container) ExecTee(ctx context.Context, shell, command string, env []string, workdir string, stdout, stderr io.Writer) (*ExecResult, error) {
+	pspec, err := c.buildProcessSpec(ctx, env, workdir, shell, "-c", command)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	var before int
+	var counted bool
+	if c.memLimit {
+		before, counted = c.oomKills(ctx)
+	}
+
+	var outBuf, errBuf bytes.Buffer
+	exitCode, err := c.execProcess(ctx, pspec, nil, teeWriter(&outBuf, stdout), teeWriter(&errBuf, stderr))
 	if err != nil {
 		return nil, err
 	}
 
-	return &ExecResult{
+	result := &ExecResult{
 		ExitCode: exitCode,
-		Stdout:   stdout.String(),
-		Stderr:   stderr,
-	}, nil
+		Stdout:   outBuf.String(),
+		Stderr:   errBuf.String(),
+	}
+	if counted && exitCode != 0 {
+		after, ok := c.oomKills(ctx)
+		result.OOMKilled = ok && after > before
+	}
+	return result, nil
+}
+
+// Returns a writer that writes to buf and, when it is not nil, to w.
+func teeWriter(buf *bytes.Buffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
 }
 
 // Runs a command and arguments directly inside the container.
 //
 // Unlike [Exec], which passes a command string to a shell, ExecArgs runs the
 // command directly without shell wrapping. This is suitable for CLI-invoked
-// exec where the user provides the full command line.
-func (c *Container) ExecArgs(ctx context.Context, args []string) (*ExecResult, error) {
+// exec where the user provides the full command line. At most limit bytes
+// of each of stdout and stderr are kept; the rest is read and discarded so
+// the process is not blocked, and the result records the truncation. Zero
+// means unlimited.
+func (c *Container) ExecArgs(ctx context.Context, args []string, limit int64) (*ExecResult, error) {
 	pspec, err := c.buildProcessSpec(ctx, nil, "", args...)
 	if err != nil {
 		return nil, err
 	}
 
-	var stdout, stderr bytes.Buffer
-	exitCode, err := c.execProcess(ctx, pspec, nil, &stdout, &stderr)
+	stdout, stderr := &cappedBuffer{limit: limit}, &cappedBuffer{limit: limit}
+	exitCode, err := c.execProcess(ctx, pspec, nil, stdout, stderr)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ExecResult{
-		ExitCode: exitCode,
-		Stdout:   stdout.String(),
-		Stderr:   stderr.String(),
+		ExitCode:        exitCode,
+		Stdout:          stdout.buf.String(),
+		Stderr:          stderr.buf.String(),
+		StdoutTruncated: stdout.truncated,
+		StderrTruncated: stderr.truncated,
 	}, nil
 }
 
+// Buffers the first limit bytes written to it and discards the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer // Bytes kept so far.
+	limit     int64        // Most bytes kept. Zero means unlimited.
+	truncated bool         // Whether any bytes were discarded.
+}
+
+// Keeps what fits under the limit. Always reports p as fully written, so
+// the process writing it keeps running.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 {
+		room := b.limit - int64(b.buf.Len())
+		if int64(len(p)) > room {
+			p = p[:max(room, 0)]
+			b.truncated = true
+		}
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// Runs a command and arguments directly inside the container, streaming its
+// output.
+//
+// Behaves like [ExecArgs] but writes stdout and stderr to the given writers
+// as the process produces them instead of buffering. Returns the exit code
+// of the process. The writers may be called concurrently.
+func (c *Container) ExecStream(ctx context.Context, args []string, stdout, stderr io.Writer) (int, error) {
+	pspec, err := c.buildProcessSpec(ctx, nil, "", args...)
+	if err != nil {
+		return 0, crex.Wrap(ErrRuntime, err)
+	}
+	return c.execProcess(ctx, pspec, nil, stdout, stderr)
+}
+
 // Builds an OCI process spec for running a command inside the container.
 //
 // A process spec defines everything needed to start a process: the command
 // and arguments, environment variables, working directory, and terminal mode.
 // The base values are copied from the container's own OCI spec, then env and
-// workdir are overridden if provided.
+// workdir are overridden if provided. Fails with [ErrRemote] when containerd
+// is remote, because exec I/O cannot reach it.
 func (c *Container) buildProcessSpec(ctx context.Context, env []string, workdir string, args ...string) (*specs.Process, error) {
+	if err := c.requireLocal("exec"); err != nil {
+		return nil, err
+	}
+
 	ctr, err := c.client.LoadContainer(ctx, c.id)
 	if err != nil {
 		return nil, err
@@ -156,11 +241,25 @@ func (c *Container) execCommand(ctx context.Context, stdin io.Reader, stdout io.
 // required because the containerd shim holds both ends of the stdin FIFO open
 // and will not propagate EOF on its own.
 func (c *Container) execProcess(ctx context.Context, pspec *specs.Process, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return c.runProcess(ctx, pspec, ExecIO{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+}
+
+// Runs a process like [Container.execProcess], connected to streams.
+//
+// A process spec with Terminal set gets a pseudo-terminal: its stdin and
+// stdout are connected to the terminal, which carries stderr as well, and
+// the terminal follows the sizes sent on streams.Resize.
+func (c *Container) runProcess(ctx context.Context, pspec *specs.Process, streams ExecIO) (int, error) {
+	if c.idle {
+		return 0, crex.Wrapf(ErrRuntime, "container %s has no task to run commands in", c.id)
+	}
+
 	task, err := c.loadTask(ctx)
 	if err != nil {
 		return 0, err
 	}
 
+	stdin, stdout, stderr := streams.Stdin, streams.Stdout, streams.Stderr
 	if stdout == nil {
 		stdout = io.Discard
 	}
@@ -176,14 +275,20 @@ func (c *Container) execProcess(ctx context.Context, pspec *specs.Process, stdin
 		stdinDone = dr.done
 	}
 
-	process, err := task.Exec(ctx, nextExecID(), pspec, cio.NewCreator(
-		cio.WithStreams(stdin, stdout, stderr),
-	))
+	opts := []cio.Opt{cio.WithStreams(stdin, stdout, stderr)}
+	var resize <-chan TerminalSize
+	if pspec.Terminal {
+		// The terminal carries stderr along with stdout.
+		opts = []cio.Opt{cio.WithStreams(stdin, stdout, nil), cio.WithTerminal}
+		resize = streams.Resize
+	}
+
+	process, err := task.Exec(ctx, nextExecID(), pspec, cio.NewCreator(opts...))
 	if err != nil {
 		return 0, crex.Wrap(ErrRuntime, err)
 	}
 
-	return awaitProcess(ctx, process, stdinDone)
+	return awaitProcess(ctx, process, stdinDone, resize)
 }
 
 // Loads the container's running task.
@@ -205,12 +310,17 @@ func (c *Container) loadTask(ctx context.Context) (containerd.Task, error) {
 //
 // The process is started, then the function blocks until it exits. If
 // stdinDone is non-nil, the process stdin is closed when the channel fires
-// so the exec process receives EOF. The process is always deleted before
-// returning.
-func awaitProcess(ctx context.Context, process containerd.Process, stdinDone <-chan struct{}) (int, error) {
-	statusC, err := process.Wait(ctx)
+// so the exec process receives EOF. Sizes received on resize while the
+// process runs are applied to its terminal. When ctx is cancelled first, the
+// process is killed rather than left running in the container, and the
+// cause of the cancellation is returned. The process is always deleted
+// before returning, even after ctx is cancelled.
+func awaitProcess(ctx context.Context, process containerd.Process, stdinDone <-chan struct{}, resize <-chan TerminalSize) (int, error) {
+	// The wait outlives ctx so that it still reports the exit of a process
+	// killed because ctx was cancelled.
+	statusC, err := process.Wait(context.WithoutCancel(ctx))
 	if err != nil {
-		process.Delete(ctx)
+		process.Delete(context.WithoutCancel(ctx))
 		return 0, crex.Wrap(ErrRuntime, err)
 	}
 
@@ -229,8 +339,23 @@ func awaitProcess(ctx context.Context, process containerd.Process, stdinDone <-c
 		}()
 	}
 
-	exitStatus := <-statusC
-	process.Delete(ctx)
+	if resize != nil {
+		exited := make(chan struct{})
+		defer close(exited)
+		go forwardResize(ctx, process, resize, exited)
+	}
+
+	var exitStatus containerd.ExitStatus
+	select {
+	case exitStatus = <-statusC:
+	case <-ctx.Done():
+		cleanupCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+		killProcess(cleanupCtx, process, statusC)
+		process.Delete(cleanupCtx, containerd.WithProcessKill)
+		return 0, crex.Wrap(ErrRuntime, context.Cause(ctx))
+	}
+	process.Delete(context.WithoutCancel(ctx))
 
 	code, _, err := exitStatus.Result()
 	if err != nil {
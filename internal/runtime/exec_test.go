@@ -84,3 +84,36 @@ func TestNextExecID(t *testing.T) {
 		t.Fatal("nextExecID returned empty string")
 	}
 }
+
+func TestCappedBuffer(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int64
+		writes        []string
+		want          string
+		wantTruncated bool
+	}{
+		{name: "unlimited", writes: []string{"hello ", "world"}, want: "hello world"},
+		{name: "under limit", limit: 16, writes: []string{"hello ", "world"}, want: "hello world"},
+		{name: "exactly at limit", limit: 11, writes: []string{"hello ", "world"}, want: "hello world"},
+		{name: "cut within write", limit: 8, writes: []string{"hello ", "world"}, want: "hello wo", wantTruncated: true},
+		{name: "writes after limit", limit: 6, writes: []string{"hello ", "world", "again"}, want: "hello ", wantTruncated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &cappedBuffer{limit: tt.limit}
+			for _, w := range tt.writes {
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := b.buf.String(); got != tt.want {
+				t.Errorf("buffered %q, want %q", got, tt.want)
+			}
+			if b.truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v, want %v", b.truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package runtime
+
+import (
+	"context"
+	"slices"
+
+	"github.com/cruciblehq/crex"
+)
+
+// Output stream an [ExecEvent] was written to.
+type OutputStream string
+
+const (
+	StreamStdout OutputStream = "stdout" // Standard output of the process.
+	StreamStderr OutputStream = "stderr" // Standard error of the process.
+)
+
+// A chunk of process output, attributed to the stream it was written to.
+type ExecEvent struct {
+	Stream OutputStream // Stream the process wrote to.
+	Data   []byte       // Bytes written, owned by the receiver.
+}
+
+// Runs a command and arguments directly inside the container, sending its
+// output to events as it is produced.
+//
+// Behaves like [Container.ExecStream], except that each chunk of stdout and
+// stderr arrives as an [ExecEvent] on one channel, so the receiver sees the
+// two streams in the order the process wrote them and can tell which is
+// which. Sends block until the event is received or ctx is done, after
+// which output is dropped. events is closed once the process has exited and
+// all of its output was sent. Returns the exit code of the process.
+func (c *Container) ExecEvents(ctx context.Context, args []string, events chan<- ExecEvent) (int, error) {
+	defer close(events)
+
+	pspec, err := c.buildProcessSpec(ctx, nil, "", args...)
+	if err != nil {
+		return 0, crex.Wrap(ErrRuntime, err)
+	}
+	return c.execProcess(ctx, pspec, nil,
+		&eventWriter{ctx: ctx, stream: StreamStdout, events: events},
+		&eventWriter{ctx: ctx, stream: StreamStderr, events: events},
+	)
+}
+
+// Sends each Write to a channel as an [ExecEvent] of one stream.
+type eventWriter struct {
+	ctx    context.Context  // Stops sends once done.
+	stream OutputStream     // Stream the events are attributed to.
+	events chan<- ExecEvent // Receives the events.
+}
+
+// Sends a copy of p, since the caller may reuse it once Write returns.
+//
+// Writes never fail, so a receiver that went away does not make the process
+// fail; output written after ctx is done is discarded.
+func (w *eventWriter) Write(p []byte) (int, error) {
+	select {
+	case w.events <- ExecEvent{Stream: w.stream, Data: slices.Clone(p)}:
+	case <-w.ctx.Done():
+	}
+	return len(p), nil
+}
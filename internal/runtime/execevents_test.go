@@ -0,0 +1,34 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEventWriter(t *testing.T) {
+	events := make(chan ExecEvent, 2)
+	w := &eventWriter{ctx: context.Background(), stream: StreamStderr, events: events}
+
+	buf := []byte("oops")
+	if n, err := w.Write(buf); n != len(buf) || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	copy(buf, "xxxx")
+
+	ev := <-events
+	if ev.Stream != StreamStderr || string(ev.Data) != "oops" {
+		t.Errorf("event = {%s %q}, want {stderr \"oops\"}", ev.Stream, ev.Data)
+	}
+}
+
+func TestEventWriterCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nothing receives from events, so the write only returns because ctx
+	// is done.
+	w := &eventWriter{ctx: ctx, stream: StreamStdout, events: make(chan ExecEvent)}
+	if n, err := w.Write([]byte("late")); n != 4 || err != nil {
+		t.Errorf("Write = %d, %v", n, err)
+	}
+}
@@ -5,17 +5,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/containerd/containerd/v2/core/containers"
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/images"
 	"github.com/containerd/containerd/v2/core/images/archive"
-	"github.com/containerd/containerd/v2/pkg/rootfs"
+	"github.com/containerd/errdefs"
 	"github.com/containerd/platforms"
 	"github.com/cruciblehq/crex"
+	dref "github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -23,71 +28,398 @@ import (
 // Filename of the OCI archive produced by Export.
 const exportFilename = "image.tar"
 
+// Pattern of the names of archives being written, in the output directory.
+const partialArchivePattern = ".image-*.tar.partial"
+
+// Diff ID of a layer with no changes: an uncompressed tar holding only the
+// two zero blocks that end an archive.
+const emptyLayerDiffID digest.Digest = "sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
+
+// Controls how a container is exported.
+type ExportOptions struct {
+	Entrypoint       []string // OCI entrypoint replacing the base image's. Empty keeps the base image's.
+	AppendEntrypoint []string // Arguments appended to the entrypoint, after any replacement.
+	Cmd              []string // OCI cmd replacing the base image's. Empty keeps or clears it, see KeepCmd.
+	MaxLayerSize     int64    // Maximum size in bytes of the committed layer. Zero means unlimited.
+
+	// Keep the base image's cmd when Entrypoint replaces the entrypoint. By
+	// default the cmd is cleared, since it was written as arguments for the
+	// entrypoint being replaced.
+	KeepCmd bool
+
+	// Labels merged into the image config's, such as the
+	// org.opencontainers.image.* provenance labels. The base image's labels
+	// are kept unless a key is overridden. Nil adds none.
+	Labels map[string]string
+
+	// Annotations added to the committed layer's descriptor in the image
+	// manifest, typically describing what produced the layer. Nil adds none.
+	LayerAnnotations map[string]string
+
+	// Export the first manifest of a multi-platform base image when none
+	// matches the container's platform, instead of failing with
+	// [ErrPlatformNotFound]. The result may be for the wrong architecture.
+	AllowPlatformFallback bool
+
+	// Name the archive after the digest of the exported image, as
+	// sha256-<hex>.tar, instead of image.tar, so that content-addressed
+	// stores can deduplicate identical builds.
+	DigestFilename bool
+
+	// Layout of the archive. Empty writes [FormatOCI].
+	Format ExportFormat
+
+	// Algorithm the committed layer is compressed with. Empty uses
+	// [CompressionGzip].
+	Compression Compression
+
+	// Level the committed layer is compressed at, within the range of the
+	// algorithm. Zero uses containerd's default level.
+	CompressionLevel int
+
+	// References the image is named by in the archive, such as "app:latest"
+	// and "app:1.2.3", each of which docker load tags the image with. Empty
+	// names the image after its base.
+	Tags []string
+
+	// Replace every layer, the base image's included, with a single layer
+	// holding the container's whole root filesystem. Files that a layer
+	// added and a later one deleted are then left out of the image. The
+	// base image's history is dropped, since it no longer describes the
+	// layers, and MaxLayerSize applies to the squashed layer.
+	Squash bool
+}
+
+// Returns the names of an exported image: the normalized tags, or name
+// when there are none. Tags must be valid references and not digests.
+func exportNames(name string, tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return []string{name}, nil
+	}
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		named, err := dref.ParseNormalizedNamed(tag)
+		if err != nil {
+			return nil, crex.Wrapf(ErrRuntime, "invalid tag %q: %w", tag, err)
+		}
+		if _, ok := named.(dref.Canonical); ok {
+			return nil, crex.Wrapf(ErrRuntime, "invalid tag %q: must not include a digest", tag)
+		}
+		if full := dref.TagNameOnly(named).String(); !slices.Contains(names, full) {
+			names = append(names, full)
+		}
+	}
+	return names, nil
+}
+
 // Commits the container's filesystem changes and exports the result as an
-// OCI archive.
+// OCI archive at output/image.tar, or output/sha256-<hex>.tar with
+// opts.DigestFilename. Returns the path of the archive.
+//
+// See [Container.ExportTo] for how the archive is produced. If the export
+// fails, including when the layer exceeds opts.MaxLayerSize, no archive is
+// left in output.
+func (c *Container) Export(ctx context.Context, output string, opts ExportOptions) (string, error) {
+	ctx, release, err := c.acquireLease(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	target, imageName, err := c.commit(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+	names, err := exportNames(imageName, opts.Tags)
+	if err != nil {
+		return "", err
+	}
+
+	return writeArchive(output, archiveName(target.Digest, opts.DigestFilename), func(w io.Writer) error {
+		if err := c.writeImage(ctx, target, names, opts.Format, w); err != nil {
+			return classifyExportError(err)
+		}
+		return nil
+	})
+}
+
+// Returns the filename of the archive of an image. With byDigest the name
+// is the digest with its algorithm separated by a hyphen, which is valid on
+// every filesystem.
+func archiveName(dgst digest.Digest, byDigest bool) string {
+	if !byDigest {
+		return exportFilename
+	}
+	return dgst.Algorithm().String() + "-" + dgst.Encoded() + ".tar"
+}
+
+// Writes an archive to output/name and returns its path.
+//
+// The archive is written to a temporary file in output and renamed into
+// place once complete, so a reader never sees a partial archive under the
+// final name and a failed export leaves no file behind.
+func writeArchive(output, name string, write func(io.Writer) error) (string, error) {
+	exportPath := filepath.Join(output, name)
+
+	f, err := os.CreateTemp(output, partialArchivePattern)
+	if err != nil {
+		return "", crex.Wrap(ErrRuntime, err)
+	}
+	partial := f.Name()
+
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(partial)
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(partial)
+		return "", crex.Wrap(ErrRuntime, err)
+	}
+
+	if err := os.Chmod(partial, 0644); err != nil {
+		os.Remove(partial)
+		return "", crex.Wrap(ErrRuntime, err)
+	}
+
+	if err := os.Rename(partial, exportPath); err != nil {
+		os.Remove(partial)
+		return "", crex.Wrap(ErrRuntime, err)
+	}
+
+	slog.Info("image exported", "path", exportPath)
+	return exportPath, nil
+}
+
+// Commits the container's filesystem changes and streams the result as an
+// OCI archive to w.
 //
 // The diff between the container's snapshot and its parent is stored as a
-// new layer. If entrypoint is non-empty it is set on the image config. The
-// resulting image is written to output/image.tar. The stored image record
-// in containerd is never modified. The mutated manifest, config, and index
-// are written to the content store as ephemeral blobs and referenced only
-// during the export. A content lease protects these blobs from garbage
-// collection until the export completes.
-func (c *Container) Export(ctx context.Context, output string, entrypoint []string) error {
+// new layer, unless it holds no changes, in which case only the config is
+// updated. If the layer exceeds opts.MaxLayerSize the export fails with
+// [ErrLayerTooLarge] before anything is written to w. The layer's manifest
+// descriptor carries opts.LayerAnnotations. The entrypoint and cmd options
+// are applied to the image config as described by [applyProcessConfig].
+// The stored image record in containerd is never modified. The mutated
+// manifest, config, and index are written to the content store as
+// ephemeral blobs and referenced only during the export. A content lease
+// protects these blobs from garbage collection until the export completes.
+// Streaming lets callers push or scan the image without a round-trip
+// through the filesystem.
+func (c *Container) ExportTo(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	// Acquire a content lease so the layer written by snapshotDiff and the
+	// ephemeral blobs written by buildExportTarget survive until the archive
+	// export finishes. Without a lease, containerd's GC scheduler may collect
+	// them between the write and the export.
+	ctx, release, err := c.acquireLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	target, imageName, err := c.commit(ctx, opts)
+	if err != nil {
+		return err
+	}
+	names, err := exportNames(imageName, opts.Tags)
+	if err != nil {
+		return err
+	}
+
+	if err := c.writeImage(ctx, target, names, opts.Format, w); err != nil {
+		return classifyExportError(err)
+	}
+
+	return nil
+}
+
+// Writes the image as an archive in the given format to w, named by each of
+// names.
+func (c *Container) writeImage(ctx context.Context, target ocispec.Descriptor, names []string, format ExportFormat, w io.Writer) error {
+	if format == FormatDocker {
+		return c.exportDockerSave(ctx, target, names, w)
+	}
+	return c.exportImage(ctx, target, names, w)
+}
+
+// Writes the container's changes to the content store as a new image.
+//
+// Returns the root descriptor of the committed image and the name of the
+// container's base image. The blobs are only protected from garbage
+// collection by the lease carried in ctx, so the caller must hold one until
+// the image is exported or recorded.
+func (c *Container) commit(ctx context.Context, opts ExportOptions) (ocispec.Descriptor, string, error) {
 	loaded, err := c.client.LoadContainer(ctx, c.id)
 	if err != nil {
-		return crex.Wrap(ErrRuntime, err)
+		return ocispec.Descriptor{}, "", crex.Wrap(ErrRuntime, err)
 	}
 
 	info, err := loaded.Info(ctx)
 	if err != nil {
-		return crex.Wrap(ErrRuntime, err)
+		return ocispec.Descriptor{}, "", crex.Wrap(ErrRuntime, err)
 	}
 
-	layer, diffID, err := c.snapshotDiff(ctx, info)
+	layer, diffID, err := c.snapshotDiff(ctx, info, opts)
 	if err != nil {
-		return crex.Wrap(ErrRuntime, err)
+		return ocispec.Descriptor{}, "", classifyExportError(err)
+	}
+
+	if err := checkLayerSize(layer, opts.MaxLayerSize); err != nil {
+		return ocispec.Descriptor{}, "", err
 	}
+	layer = annotateLayer(layer, opts.LayerAnnotations)
 
-	// Acquire a content lease so the ephemeral blobs written by
-	// buildExportTarget survive until the archive export finishes.
-	// Without a lease, containerd's GC scheduler may collect them
-	// between the write and the export.
-	ctx, done, err := c.client.WithLease(ctx)
+	target, err := c.buildExportTarget(ctx, info.Image, opts.AllowPlatformFallback, commitLayer(layer, diffID, opts))
 	if err != nil {
-		return crex.Wrap(ErrRuntime, err)
+		return ocispec.Descriptor{}, "", classifyExportError(err)
 	}
-	defer done(context.Background())
 
-	target, err := c.buildExportTarget(ctx, info.Image, func(manifest *ocispec.Manifest, config *ocispec.Image) {
-		manifest.Layers = append(manifest.Layers, layer)
-		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
-		if len(entrypoint) > 0 {
-			config.Config.Entrypoint = entrypoint
-			config.Config.Cmd = nil
-		}
+	return target, info.Image, nil
+}
+
+// Creates a content lease for an export, retrying transient failures.
+//
+// Returns a context carrying the lease and a function that releases it.
+// Failures to create the lease are reported as [ErrLease].
+func (c *Container) acquireLease(ctx context.Context) (context.Context, func(), error) {
+	var (
+		leased context.Context
+		done   func(context.Context) error
+	)
+	err := retryTransient(ctx, leaseAttempts, leaseBackoff, func() error {
+		var err error
+		leased, done, err = c.client.WithLease(ctx)
+		return err
 	})
 	if err != nil {
-		return crex.Wrap(ErrRuntime, err)
+		return nil, nil, crex.Wrapf(ErrLease, "acquiring content lease: %w", err)
 	}
 
-	exportPath := filepath.Join(output, exportFilename)
-	if err := c.exportImage(ctx, target, info.Image, exportPath); err != nil {
-		return crex.Wrap(ErrRuntime, err)
+	release := func() {
+		if err := done(context.WithoutCancel(ctx)); err != nil {
+			slog.Warn("failed to release content lease", "id", c.id, "error", err)
+		}
 	}
+	return leased, release, nil
+}
 
-	slog.Info("image exported", "path", exportPath)
+// Classifies an error from the export pipeline.
+//
+// Blobs written during an export are only referenced by the export's content
+// lease. When one of them is missing the most likely cause is that
+// containerd's garbage collector removed it after the lease expired or was
+// deleted, so the error is reported as [ErrBlobMissing] with that hint.
+// Other errors are reported as [ErrRuntime].
+func classifyExportError(err error) error {
+	if errdefs.IsNotFound(err) {
+		return crex.Wrapf(ErrBlobMissing, "%v: content disappeared during export, likely garbage collected after the content lease was lost", err)
+	}
+	return crex.Wrap(ErrRuntime, err)
+}
+
+// Returns the mutation that adds the committed layer, the process settings,
+// and the labels of opts to the image.
+//
+// A layer whose diff has no changes, as produced by a stage that only sets
+// metadata, is left out so that the image carries no empty layer. With
+// opts.Squash the layer replaces the base image's layers and history rather
+// than being appended to them.
+func commitLayer(layer ocispec.Descriptor, diffID digest.Digest, opts ExportOptions) func(*ocispec.Manifest, *ocispec.Image) {
+	return func(manifest *ocispec.Manifest, config *ocispec.Image) {
+		if opts.Squash {
+			manifest.Layers = nil
+			config.RootFS.DiffIDs = nil
+			config.History = nil
+		}
+		if diffID != emptyLayerDiffID {
+			manifest.Layers = append(manifest.Layers, layer)
+			config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		}
+		applyProcessConfig(&config.Config, opts)
+		config.Config.Labels = mergeLabels(config.Config.Labels, opts.Labels)
+	}
+}
+
+// Returns the base image's labels with labels merged over them.
+//
+// The base map is copied rather than modified, since it may be shared with
+// the config it was decoded from.
+func mergeLabels(base, labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return base
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = make(map[string]string, len(labels))
+	}
+	maps.Copy(merged, labels)
+	return merged
+}
+
+// Applies the entrypoint and cmd options to an image config.
+//
+// In order: Entrypoint replaces the entrypoint and, unless KeepCmd is set,
+// clears the cmd; AppendEntrypoint is added to the end of the resulting
+// entrypoint; Cmd replaces the cmd. Options left empty keep the base
+// image's values, so a wrapper image can append to the base entrypoint or
+// set only the cmd.
+func applyProcessConfig(config *ocispec.ImageConfig, opts ExportOptions) {
+	if len(opts.Entrypoint) > 0 {
+		config.Entrypoint = slices.Clone(opts.Entrypoint)
+		if !opts.KeepCmd {
+			config.Cmd = nil
+		}
+	}
+	if len(opts.AppendEntrypoint) > 0 {
+		config.Entrypoint = append(slices.Clone(config.Entrypoint), opts.AppendEntrypoint...)
+	}
+	if len(opts.Cmd) > 0 {
+		config.Cmd = slices.Clone(opts.Cmd)
+	}
+}
+
+// Returns the layer descriptor with the given annotations added.
+//
+// Existing annotations are kept unless overridden. The descriptor's map is
+// copied rather than modified, so the original descriptor is left intact.
+func annotateLayer(layer ocispec.Descriptor, annotations map[string]string) ocispec.Descriptor {
+	if len(annotations) == 0 {
+		return layer
+	}
+	merged := maps.Clone(layer.Annotations)
+	if merged == nil {
+		merged = make(map[string]string, len(annotations))
+	}
+	maps.Copy(merged, annotations)
+	layer.Annotations = merged
+	return layer
+}
+
+// Checks the committed layer against the configured size limit.
+//
+// The size is that of the layer blob as stored in the content store, which
+// is the compressed size that ends up in the archive.
+func checkLayerSize(layer ocispec.Descriptor, max int64) error {
+	if max > 0 && layer.Size > max {
+		return crex.Wrapf(ErrLayerTooLarge, "layer is %d bytes, limit is %d bytes", layer.Size, max)
+	}
 	return nil
 }
 
-// Computes the diff between the container's snapshot and its parent, returning
-// the layer descriptor and its diff ID without modifying the image.
-func (c *Container) snapshotDiff(ctx context.Context, info containers.Container) (ocispec.Descriptor, digest.Digest, error) {
-	layer, err := rootfs.CreateDiff(ctx,
-		info.SnapshotKey,
-		c.client.SnapshotService(info.Snapshotter),
-		c.client.DiffService(),
-	)
+// Computes the diff between the container's snapshot and its base image,
+// or an empty filesystem with opts.Squash, returning the layer descriptor
+// and its diff ID without modifying the image. Writing the layer compresses
+// it as opts asks, so this waits for a compression worker.
+func (c *Container) snapshotDiff(ctx context.Context, info containers.Container, opts ExportOptions) (ocispec.Descriptor, digest.Digest, error) {
+	comp, level := opts.Compression, opts.CompressionLevel
+	done, err := c.compression.acquire(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer done()
+
+	layer, err := c.createDiff(ctx, info.SnapshotKey, info.Snapshotter, diffMediaType(comp, level), opts.Squash)
 	if err != nil {
 		return ocispec.Descriptor{}, "", err
 	}
@@ -97,32 +429,33 @@ func (c *Container) snapshotDiff(ctx context.Context, info containers.Container)
 		return ocispec.Descriptor{}, "", err
 	}
 
+	if level != 0 {
+		if layer, err = c.compressLayer(ctx, layer, comp, level); err != nil {
+			return ocispec.Descriptor{}, "", err
+		}
+	}
+
 	return layer, diffID, nil
 }
 
-// Writes the image to an OCI tar archive at the given path.
+// Writes the image as an OCI tar archive to w.
 //
 // The target descriptor is exported directly via [archive.WithManifest]
 // rather than looking up the image by name. This allows the caller to
 // export ephemeral content (e.g., a mutated manifest with an extra layer)
-// without modifying the stored image record. The image name is attached
-// as the OCI reference annotation on the archive entry. When the target
-// is a multi-platform index, only the manifest matching the container's
-// platform is included.
-func (c *Container) exportImage(ctx context.Context, target ocispec.Descriptor, imageName, path string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
+// without modifying the stored image record. The archive's index has an
+// entry for each name, carrying it as the OCI reference annotation, and its
+// manifest.json lists every name as a tag. When the target is a
+// multi-platform index, only the manifest matching the container's platform
+// is included.
+func (c *Container) exportImage(ctx context.Context, target ocispec.Descriptor, names []string, w io.Writer) error {
 	p, err := platforms.Parse(c.platform)
 	if err != nil {
 		return err
 	}
 
-	return c.client.Export(ctx, f,
-		archive.WithManifest(target, imageName),
+	return c.client.Export(ctx, w,
+		archive.WithManifest(target, names...),
 		archive.WithPlatform(platforms.Only(p)),
 	)
 }
@@ -133,8 +466,9 @@ func (c *Container) exportImage(ctx context.Context, target ocispec.Descriptor,
 // The mutated manifest, config, and (when the root is an index) a new
 // single-entry index are written to the content store as ephemeral blobs.
 // The stored image record is never modified, so subsequent builds always
-// see the original, clean image pulled from the registry.
-func (c *Container) buildExportTarget(ctx context.Context, imageName string, mutate func(*ocispec.Manifest, *ocispec.Image)) (ocispec.Descriptor, error) {
+// see the original, clean image pulled from the registry. allowFallback is
+// passed on to [Container.resolveManifestDescriptor].
+func (c *Container) buildExportTarget(ctx context.Context, imageName string, allowFallback bool, mutate func(*ocispec.Manifest, *ocispec.Image)) (ocispec.Descriptor, error) {
 	is := c.client.ImageService()
 
 	img, err := is.Get(ctx, imageName)
@@ -142,7 +476,7 @@ func (c *Container) buildExportTarget(ctx context.Context, imageName string, mut
 		return ocispec.Descriptor{}, err
 	}
 
-	target, index, manifestIdx, err := c.resolveManifestDescriptor(ctx, img.Target, imageName)
+	target, index, manifestIdx, err := c.resolveManifestDescriptor(ctx, img.Target, imageName, allowFallback)
 	if err != nil {
 		return ocispec.Descriptor{}, err
 	}
@@ -159,14 +493,15 @@ func (c *Container) buildExportTarget(ctx context.Context, imageName string, mut
 //
 // If the root is an OCI Image Index, the index is read and walked to find
 // the manifest matching the container's platform. Returns the manifest
-// descriptor, the index (nil when the root is al+,,ready a manifest), and the
-// position of the manifest within the index.
+// descriptor, the index (nil when the root is already a manifest), and the
+// position within the index of the entry that leads to the manifest.
 //
 // Some registries (notably Docker Hub) serve index entries without explicit
 // platform metadata. When a descriptor lacks a platform field, the manifest
 // and its config are read to extract the platform from the image config, the
-// same fallback that containerd's images.Manifest uses internally.
-func (c *Container) resolveManifestDescriptor(ctx context.Context, root ocispec.Descriptor, imageName string) (ocispec.Descriptor, *ocispec.Index, int, error) {
+// same fallback that containerd's images.Manifest uses internally. See
+// [selectManifest] for how entries that are not runnable images are handled.
+func (c *Container) resolveManifestDescriptor(ctx context.Context, root ocispec.Descriptor, imageName string, allowFallback bool) (ocispec.Descriptor, *ocispec.Index, int, error) {
 	if !images.IsIndexType(root.MediaType) {
 		return root, nil, 0, nil
 	}
@@ -181,38 +516,143 @@ func (c *Container) resolveManifestDescriptor(ctx context.Context, root ocispec.
 		return ocispec.Descriptor{}, nil, 0, err
 	}
 
-	i, ok := c.matchManifest(ctx, idx, platforms.OnlyStrict(p))
-	if ok {
-		return idx.Manifests[i], &idx, i, nil
+	i, desc, err := selectManifest(ctx, c, idx, imageName, p, allowFallback)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, 0, err
 	}
+	return desc, &idx, i, nil
+}
 
-	if len(idx.Manifests) == 0 {
-		return ocispec.Descriptor{}, nil, 0, crex.Wrapf(ErrEmptyIndex, "%s", imageName)
-	}
-	return idx.Manifests[0], &idx, 0, nil
+// Maximum depth of indexes nested inside an image index that are searched
+// for a manifest.
+const maxIndexDepth = 4
+
+// Annotation that marks BuildKit attestation manifests in an image index.
+const referenceTypeAnnotation = "vnd.docker.reference.type"
+
+// Content access needed to resolve a manifest in an image index.
+type indexContent interface {
+	readIndex(ctx context.Context, desc ocispec.Descriptor) (ocispec.Index, error)
+	configPlatform(ctx context.Context, desc ocispec.Descriptor) (ocispec.Platform, bool)
 }
 
-// Searches the index for a manifest matching the given platform.
+// Picks the manifest to export for the given platform.
+//
+// Only runnable image manifests are considered; attestations and other
+// artifacts that share the index are skipped. Entries that are themselves
+// indexes are searched after the image manifests of the enclosing index.
+// Returns the position of the top-level entry that leads to the manifest,
+// together with the manifest descriptor.
 //
-// Descriptors with an explicit platform field are checked first. If none
-// match, descriptors without a platform field are probed by reading the
-// image config to discover the platform (the "ConfigPlatform" fallback).
-// Returns the index position and true when a match is found.
-func (c *Container) matchManifest(ctx context.Context, idx ocispec.Index, matcher platforms.MatchComparer) (int, bool) {
+// Returns [ErrEmptyIndex] for an index without image manifests. When none
+// matches, returns [ErrPlatformNotFound] naming the platforms the index does
+// provide, unless allowFallback is set, in which case the first image
+// manifest is used and a warning is logged.
+func selectManifest(ctx context.Context, store indexContent, idx ocispec.Index, imageName string, p ocispec.Platform, allowFallback bool) (int, ocispec.Descriptor, error) {
+	matcher := platforms.OnlyStrict(p)
+
 	for i, m := range idx.Manifests {
-		if m.Platform != nil && matcher.Match(*m.Platform) {
-			return i, true
+		if desc, ok := findManifest(ctx, store, m, matcher, maxIndexDepth); ok {
+			return i, desc, nil
 		}
 	}
+
+	first := -1
 	for i, m := range idx.Manifests {
-		if m.Platform != nil || !images.IsManifestType(m.MediaType) {
-			continue
+		if isImageManifest(m) {
+			first = i
+			break
 		}
-		if p, ok := c.configPlatform(ctx, m); ok && matcher.Match(p) {
-			return i, true
+	}
+	if first < 0 {
+		return 0, ocispec.Descriptor{}, crex.Wrapf(ErrEmptyIndex, "%s", imageName)
+	}
+
+	available := indexPlatforms(ctx, store, idx, maxIndexDepth)
+	if !allowFallback {
+		return 0, ocispec.Descriptor{}, crex.Wrapf(ErrPlatformNotFound, "%s has no manifest for %s, available: %s", imageName, platforms.Format(p), strings.Join(available, ", "))
+	}
+
+	slog.Warn("no manifest matches platform, using the first index entry",
+		"image", imageName,
+		"platform", platforms.Format(p),
+		"available", available,
+	)
+	return first, idx.Manifests[first], nil
+}
+
+// Returns the image manifest for the platform reachable from an index entry.
+//
+// An image manifest matches on its platform field or, when that is missing,
+// on the platform declared in its config. A nested index is read and its
+// entries searched in turn, down to depth levels. Returns false when the
+// entry does not lead to a matching image manifest.
+func findManifest(ctx context.Context, store indexContent, desc ocispec.Descriptor, matcher platforms.MatchComparer, depth int) (ocispec.Descriptor, bool) {
+	switch {
+	case isImageManifest(desc):
+		if desc.Platform != nil {
+			return desc, matcher.Match(*desc.Platform)
+		}
+		p, ok := store.configPlatform(ctx, desc)
+		return desc, ok && matcher.Match(p)
+
+	case images.IsIndexType(desc.MediaType) && depth > 0:
+		if desc.Platform != nil && !matcher.Match(*desc.Platform) {
+			return ocispec.Descriptor{}, false
+		}
+		nested, err := store.readIndex(ctx, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, false
+		}
+		for _, m := range nested.Manifests {
+			if found, ok := findManifest(ctx, store, m, matcher, depth-1); ok {
+				return found, true
+			}
+		}
+	}
+	return ocispec.Descriptor{}, false
+}
+
+// Reports whether an index entry is a runnable image manifest rather than an
+// attestation, artifact, or nested index.
+func isImageManifest(desc ocispec.Descriptor) bool {
+	if !images.IsManifestType(desc.MediaType) || desc.ArtifactType != "" {
+		return false
+	}
+	return desc.Annotations[referenceTypeAnnotation] != "attestation-manifest"
+}
+
+// Lists the distinct platforms of the image manifests in an index, in index
+// order, including those of nested indexes down to depth levels.
+//
+// Manifests whose platform cannot be determined are listed as "unknown".
+func indexPlatforms(ctx context.Context, store indexContent, idx ocispec.Index, depth int) []string {
+	var list []string
+	add := func(name string) {
+		if !slices.Contains(list, name) {
+			list = append(list, name)
+		}
+	}
+
+	for _, m := range idx.Manifests {
+		switch {
+		case isImageManifest(m):
+			name := "unknown"
+			if m.Platform != nil {
+				name = platforms.Format(*m.Platform)
+			} else if p, ok := store.configPlatform(ctx, m); ok {
+				name = platforms.Format(p)
+			}
+			add(name)
+		case images.IsIndexType(m.MediaType) && depth > 0:
+			if nested, err := store.readIndex(ctx, m); err == nil {
+				for _, name := range indexPlatforms(ctx, store, nested, depth-1) {
+					add(name)
+				}
+			}
 		}
 	}
-	return 0, false
+	return list
 }
 
 // Reads the image config referenced by a manifest descriptor and returns the
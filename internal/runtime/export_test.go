@@ -1,8 +1,20 @@
 package runtime
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/containerd/errdefs"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -53,3 +65,404 @@ func TestManifestGCLabelsNoLayers(t *testing.T) {
 		t.Fatal("config label mismatch")
 	}
 }
+
+func TestCheckLayerSize(t *testing.T) {
+	layer := ocispec.Descriptor{Size: 1024}
+
+	if err := checkLayerSize(layer, 0); err != nil {
+		t.Fatalf("unlimited: unexpected error: %v", err)
+	}
+	if err := checkLayerSize(layer, 1024); err != nil {
+		t.Fatalf("at limit: unexpected error: %v", err)
+	}
+	if err := checkLayerSize(layer, 1023); !errors.Is(err, ErrLayerTooLarge) {
+		t.Fatalf("over limit: err = %v, want ErrLayerTooLarge", err)
+	}
+}
+
+// In-memory content for resolving manifests in an index.
+type fakeIndexContent struct {
+	indexes   map[digest.Digest]ocispec.Index    // Nested indexes by digest.
+	platforms map[digest.Digest]ocispec.Platform // Config platforms by manifest digest.
+}
+
+func (f fakeIndexContent) readIndex(_ context.Context, desc ocispec.Descriptor) (ocispec.Index, error) {
+	idx, ok := f.indexes[desc.Digest]
+	if !ok {
+		return ocispec.Index{}, errors.New("not found")
+	}
+	return idx, nil
+}
+
+func (f fakeIndexContent) configPlatform(_ context.Context, desc ocispec.Descriptor) (ocispec.Platform, bool) {
+	p, ok := f.platforms[desc.Digest]
+	return p, ok
+}
+
+func TestSelectManifest(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	riscv := ocispec.Platform{OS: "linux", Architecture: "riscv64"}
+
+	// The untagged entry reports arm64 through its config.
+	untagged := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("untagged")}
+	store := fakeIndexContent{platforms: map[digest.Digest]ocispec.Platform{untagged.Digest: arm64}}
+
+	idx := ocispec.Index{Manifests: []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("amd64"), Platform: &amd64},
+		untagged,
+	}}
+
+	tests := []struct {
+		name          string
+		idx           ocispec.Index
+		platform      ocispec.Platform
+		allowFallback bool
+		want          int
+		wantErr       error
+	}{
+		{name: "explicit platform", idx: idx, platform: amd64, want: 0},
+		{name: "config platform", idx: idx, platform: arm64, want: 1},
+		{name: "missing platform", idx: idx, platform: riscv, wantErr: ErrPlatformNotFound},
+		{name: "missing platform with fallback", idx: idx, platform: riscv, allowFallback: true, want: 0},
+		{name: "empty index", idx: ocispec.Index{}, platform: amd64, wantErr: ErrEmptyIndex},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, desc, err := selectManifest(context.Background(), store, tt.idx, "example:latest", tt.platform, tt.allowFallback)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want || desc.Digest != tt.idx.Manifests[tt.want].Digest {
+				t.Errorf("selectManifest = %d (%s), want %d", got, desc.Digest, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectManifestListsAvailablePlatforms(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	armv7 := ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	idx := ocispec.Index{Manifests: []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageManifest, Platform: &amd64},
+		{MediaType: ocispec.MediaTypeImageManifest, Platform: &armv7},
+	}}
+
+	_, _, err := selectManifest(context.Background(), fakeIndexContent{}, idx, "example:latest", ocispec.Platform{OS: "linux", Architecture: "s390x"}, false)
+	if !errors.Is(err, ErrPlatformNotFound) {
+		t.Fatalf("err = %v, want ErrPlatformNotFound", err)
+	}
+	for _, want := range []string{"linux/amd64", "linux/arm/v7"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not name available platform %s", err, want)
+		}
+	}
+}
+
+func TestSelectManifestSkipsAttestations(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	unknown := ocispec.Platform{OS: "unknown", Architecture: "unknown"}
+
+	attestation := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      digest.FromString("attestation"),
+		Platform:    &unknown,
+		Annotations: map[string]string{referenceTypeAnnotation: "attestation-manifest"},
+	}
+	artifact := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		Digest:       digest.FromString("sbom"),
+		ArtifactType: "application/spdx+json",
+	}
+	image := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image")}
+
+	// The attestation and artifact both report amd64 through their configs and
+	// come first, so they would be picked if they were not skipped.
+	store := fakeIndexContent{platforms: map[digest.Digest]ocispec.Platform{
+		attestation.Digest: amd64,
+		artifact.Digest:    amd64,
+		image.Digest:       amd64,
+	}}
+	idx := ocispec.Index{Manifests: []ocispec.Descriptor{attestation, artifact, image}}
+
+	i, desc, err := selectManifest(context.Background(), store, idx, "example:latest", amd64, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if i != 2 || desc.Digest != image.Digest {
+		t.Errorf("selectManifest = %d (%s), want the image manifest", i, desc.Digest)
+	}
+
+	// With fallback, an index of only attestations has nothing to export.
+	only := ocispec.Index{Manifests: []ocispec.Descriptor{attestation}}
+	if _, _, err := selectManifest(context.Background(), store, only, "example:latest", ocispec.Platform{OS: "linux", Architecture: "arm64"}, true); !errors.Is(err, ErrEmptyIndex) {
+		t.Errorf("err = %v, want ErrEmptyIndex", err)
+	}
+}
+
+func TestSelectManifestNestedIndex(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispec.Platform{OS: "linux", Architecture: "arm64"}
+
+	armImage := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("arm64"), Platform: &arm64}
+	nested := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString("nested")}
+	store := fakeIndexContent{indexes: map[digest.Digest]ocispec.Index{
+		nested.Digest: {Manifests: []ocispec.Descriptor{armImage}},
+	}}
+	idx := ocispec.Index{Manifests: []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("amd64"), Platform: &amd64},
+		nested,
+	}}
+
+	i, desc, err := selectManifest(context.Background(), store, idx, "example:latest", arm64, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if i != 1 || desc.Digest != armImage.Digest {
+		t.Errorf("selectManifest = %d (%s), want the nested arm64 manifest", i, desc.Digest)
+	}
+
+	_, _, err = selectManifest(context.Background(), store, idx, "example:latest", ocispec.Platform{OS: "linux", Architecture: "s390x"}, false)
+	if err == nil || !strings.Contains(err.Error(), "linux/arm64") {
+		t.Errorf("err = %v, want it to list the nested platform", err)
+	}
+}
+
+func TestEmptyLayerDiffID(t *testing.T) {
+	var buf bytes.Buffer
+	if err := tar.NewWriter(&buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := digest.FromBytes(buf.Bytes()); got != emptyLayerDiffID {
+		t.Fatalf("digest of empty tar = %s, want %s", got, emptyLayerDiffID)
+	}
+}
+
+func TestCommitLayer(t *testing.T) {
+	base := digest.FromString("base")
+	layer := ocispec.Descriptor{Digest: digest.FromString("layer"), Size: 512}
+	diffID := digest.FromString("diff")
+
+	tests := []struct {
+		name       string
+		diffID     digest.Digest
+		entrypoint []string
+		squash     bool
+		wantLayers int
+	}{
+		{name: "changes", diffID: diffID, wantLayers: 2},
+		{name: "no changes", diffID: emptyLayerDiffID, wantLayers: 1},
+		{name: "no changes with entrypoint", diffID: emptyLayerDiffID, entrypoint: []string{"/app"}, wantLayers: 1},
+		{name: "squash", diffID: diffID, squash: true, wantLayers: 1},
+		{name: "squash empty filesystem", diffID: emptyLayerDiffID, squash: true, wantLayers: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := ocispec.Manifest{Layers: []ocispec.Descriptor{{Digest: base}}}
+			config := ocispec.Image{
+				RootFS:  ocispec.RootFS{DiffIDs: []digest.Digest{base}},
+				Config:  ocispec.ImageConfig{Entrypoint: []string{"/bin/sh"}, Cmd: []string{"-c", "true"}},
+				History: []ocispec.History{{CreatedBy: "ADD rootfs.tar /"}},
+			}
+
+			commitLayer(layer, tt.diffID, ExportOptions{Entrypoint: tt.entrypoint, Squash: tt.squash})(&manifest, &config)
+
+			if len(manifest.Layers) != tt.wantLayers || len(config.RootFS.DiffIDs) != tt.wantLayers {
+				t.Errorf("layers = %d, diff IDs = %d, want %d", len(manifest.Layers), len(config.RootFS.DiffIDs), tt.wantLayers)
+			}
+			if tt.squash && (len(config.History) != 0 || (tt.wantLayers == 1 && config.RootFS.DiffIDs[0] != diffID)) {
+				t.Errorf("squashed config = %+v, want only diff ID %s and no history", config, diffID)
+			}
+			if len(tt.entrypoint) > 0 {
+				if len(config.Config.Entrypoint) != 1 || config.Config.Entrypoint[0] != "/app" || config.Config.Cmd != nil {
+					t.Errorf("config = %+v, want entrypoint /app and no cmd", config.Config)
+				}
+			} else if config.Config.Entrypoint[0] != "/bin/sh" {
+				t.Errorf("entrypoint changed to %v", config.Config.Entrypoint)
+			}
+		})
+	}
+}
+
+func TestApplyProcessConfig(t *testing.T) {
+	tests := []struct {
+		name           string
+		opts           ExportOptions
+		wantEntrypoint []string
+		wantCmd        []string
+	}{
+		{name: "unchanged", wantEntrypoint: []string{"/docker-entrypoint.sh"}, wantCmd: []string{"nginx"}},
+		{name: "replace entrypoint clears cmd", opts: ExportOptions{Entrypoint: []string{"/app"}}, wantEntrypoint: []string{"/app"}},
+		{name: "replace entrypoint keeping cmd", opts: ExportOptions{Entrypoint: []string{"/app"}, KeepCmd: true}, wantEntrypoint: []string{"/app"}, wantCmd: []string{"nginx"}},
+		{name: "replace both", opts: ExportOptions{Entrypoint: []string{"/app"}, Cmd: []string{"serve"}}, wantEntrypoint: []string{"/app"}, wantCmd: []string{"serve"}},
+		{name: "cmd only", opts: ExportOptions{Cmd: []string{"nginx", "-g", "daemon off;"}}, wantEntrypoint: []string{"/docker-entrypoint.sh"}, wantCmd: []string{"nginx", "-g", "daemon off;"}},
+		{name: "append to base", opts: ExportOptions{AppendEntrypoint: []string{"--verbose"}}, wantEntrypoint: []string{"/docker-entrypoint.sh", "--verbose"}, wantCmd: []string{"nginx"}},
+		{name: "append to replacement", opts: ExportOptions{Entrypoint: []string{"/tini", "--"}, AppendEntrypoint: []string{"/app"}}, wantEntrypoint: []string{"/tini", "--", "/app"}},
+		{name: "append and cmd", opts: ExportOptions{AppendEntrypoint: []string{"--"}, Cmd: []string{"worker"}}, wantEntrypoint: []string{"/docker-entrypoint.sh", "--"}, wantCmd: []string{"worker"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := []string{"/docker-entrypoint.sh"}
+			config := ocispec.ImageConfig{Entrypoint: base, Cmd: []string{"nginx"}}
+
+			applyProcessConfig(&config, tt.opts)
+
+			if !slices.Equal(config.Entrypoint, tt.wantEntrypoint) {
+				t.Errorf("entrypoint = %q, want %q", config.Entrypoint, tt.wantEntrypoint)
+			}
+			if !slices.Equal(config.Cmd, tt.wantCmd) {
+				t.Errorf("cmd = %q, want %q", config.Cmd, tt.wantCmd)
+			}
+			if base[0] != "/docker-entrypoint.sh" || len(base) != 1 {
+				t.Errorf("base entrypoint slice modified: %q", base)
+			}
+		})
+	}
+}
+
+func TestExportNames(t *testing.T) {
+	got, err := exportNames("docker.io/library/alpine:3.21", nil)
+	if err != nil || !slices.Equal(got, []string{"docker.io/library/alpine:3.21"}) {
+		t.Errorf("names without tags = %v, %v, want the base name", got, err)
+	}
+
+	got, err = exportNames("docker.io/library/alpine:3.21", []string{"app", "app:1.2.3", "docker.io/library/app:latest", "ghcr.io/org/app:1.2.3"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"docker.io/library/app:latest", "docker.io/library/app:1.2.3", "ghcr.io/org/app:1.2.3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("names = %v, want %v", got, want)
+	}
+
+	for _, tag := range []string{"Not A Tag", "app@" + digest.FromString("x").String()} {
+		if _, err := exportNames("alpine", []string{tag}); !errors.Is(err, ErrRuntime) {
+			t.Errorf("exportNames(%q) error = %v, want ErrRuntime", tag, err)
+		}
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	base := map[string]string{"maintainer": "ops", "org.opencontainers.image.version": "1.0"}
+
+	if got := mergeLabels(base, nil); !maps.Equal(got, base) {
+		t.Errorf("nil labels = %v, want base labels", got)
+	}
+
+	got := mergeLabels(base, map[string]string{
+		"org.opencontainers.image.version":  "2.0",
+		"org.opencontainers.image.revision": "abc123",
+	})
+	want := map[string]string{
+		"maintainer":                        "ops",
+		"org.opencontainers.image.version":  "2.0",
+		"org.opencontainers.image.revision": "abc123",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+	if base["org.opencontainers.image.version"] != "1.0" {
+		t.Errorf("base labels modified: %v", base)
+	}
+
+	if got := mergeLabels(nil, map[string]string{"a": "b"}); got["a"] != "b" {
+		t.Errorf("labels without a base = %v", got)
+	}
+}
+
+func TestAnnotateLayer(t *testing.T) {
+	layer := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Annotations: map[string]string{"keep": "yes", "stage": "old"},
+	}
+
+	if got := annotateLayer(layer, nil); len(got.Annotations) != 2 {
+		t.Errorf("nil annotations changed descriptor: %v", got.Annotations)
+	}
+
+	got := annotateLayer(layer, map[string]string{"stage": "build"})
+	if got.Annotations["stage"] != "build" || got.Annotations["keep"] != "yes" {
+		t.Errorf("annotations = %v", got.Annotations)
+	}
+	if layer.Annotations["stage"] != "old" {
+		t.Errorf("original descriptor modified: %v", layer.Annotations)
+	}
+
+	bare := annotateLayer(ocispec.Descriptor{}, map[string]string{"stage": "build"})
+	if bare.Annotations["stage"] != "build" {
+		t.Errorf("annotations = %v", bare.Annotations)
+	}
+}
+
+func TestClassifyExportError(t *testing.T) {
+	missing := classifyExportError(fmt.Errorf("content digest sha256:abc: %w", errdefs.ErrNotFound))
+	if !errors.Is(missing, ErrBlobMissing) {
+		t.Fatalf("missing blob: err = %v, want ErrBlobMissing", missing)
+	}
+	if !strings.Contains(missing.Error(), "lease") {
+		t.Errorf("missing blob: error %q does not mention the lease", missing)
+	}
+
+	other := classifyExportError(errors.New("disk full"))
+	if errors.Is(other, ErrBlobMissing) || !errors.Is(other, ErrRuntime) {
+		t.Fatalf("other: err = %v, want ErrRuntime", other)
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	dgst := digest.FromString("manifest")
+
+	if got := archiveName(dgst, false); got != exportFilename {
+		t.Errorf("archiveName(false) = %q, want %q", got, exportFilename)
+	}
+
+	got := archiveName(dgst, true)
+	if want := "sha256-" + dgst.Encoded() + ".tar"; got != want {
+		t.Errorf("archiveName(true) = %q, want %q", got, want)
+	}
+	parsed, err := digest.Parse(strings.Replace(strings.TrimSuffix(got, ".tar"), "-", ":", 1))
+	if err != nil || parsed != dgst {
+		t.Errorf("filename %q does not round-trip to %s: %v", got, dgst, err)
+	}
+}
+
+func TestWriteArchive(t *testing.T) {
+	dir := t.TempDir()
+	name := archiveName(digest.FromString("manifest"), true)
+
+	path, err := writeArchive(dir, name, func(w io.Writer) error {
+		_, err := io.WriteString(w, "archive")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if path != filepath.Join(dir, name) {
+		t.Errorf("path = %q, want %q", path, filepath.Join(dir, name))
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "archive" {
+		t.Errorf("archive = %q, %v", data, err)
+	}
+
+	errWrite := errors.New("write failed")
+	if _, err := writeArchive(dir, exportFilename, func(w io.Writer) error { return errWrite }); !errors.Is(err, errWrite) {
+		t.Errorf("expected write error, got %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		t.Errorf("output holds %v, want only %s", entries, name)
+	}
+}
@@ -0,0 +1,261 @@
+package runtime
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/containerd/containerd/v2/pkg/archive"
+	cfs "github.com/containerd/continuity/fs"
+	"github.com/cruciblehq/crex"
+)
+
+// Creates a container from a prepared image without starting its task.
+//
+// The container has a snapshot but no running process, so nothing can be
+// executed in it. [Container.MkdirAll], [Container.RemoveAll],
+// [Container.CopyTo], and [Container.CopyFrom] work on the snapshot from the
+// host instead, by mounting it in a temporary directory for the duration of
+// each call. This suits stages that only copy files: no shell or tar is
+// needed in the image, so minimal bases such as scratch images work, and no
+// shim is started. The snapshot is mounted by the daemon, so containerd
+// must run on the same host; a remote runtime fails with [ErrRemote].
+func (rt *Runtime) CreateImage(ctx context.Context, img *Image, id string, opts ContainerOptions) (*Container, error) {
+	c := &Container{
+		client:      rt.client,
+		id:          id,
+		platform:    img.platform,
+		snapshotter: img.snapshotter,
+		remote:      rt.remote,
+		idle:        true,
+		compression: rt.compression,
+	}
+
+	if err := c.requireLocal("containers without a task"); err != nil {
+		return nil, err
+	}
+
+	specOpts, err := opts.specOpts()
+	if err != nil {
+		return nil, err
+	}
+
+	c.remove(ctx)
+
+	if _, err := c.create(ctx, img.image, opts.Labels, specOpts...); err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	return c, nil
+}
+
+// Mounts the container's snapshot in a temporary directory and calls fn
+// with its path. The snapshot is unmounted when fn returns.
+func (c *Container) withRootfs(ctx context.Context, fn func(root string) error) error {
+	ctr, err := c.client.LoadContainer(ctx, c.id)
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+	info, err := ctr.Info(ctx)
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+	mounts, err := c.client.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+	return mount.WithTempMount(ctx, mounts, fn)
+}
+
+// Resolves a container path below a mounted root filesystem.
+//
+// Symbolic links in the directories leading to the path are resolved as
+// they would be inside the container, never leaving root. The last element
+// is not followed, so that links themselves can be removed or archived.
+func rootfsPath(root, p string) (string, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return root, nil
+	}
+	dir, err := cfs.RootPath(root, path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(p)), nil
+}
+
+// Creates a directory in the snapshot of a container without a task.
+func (c *Container) mkdirHost(ctx context.Context, p string) error {
+	return c.withRootfs(ctx, func(root string) error {
+		target, err := cfs.RootPath(root, p)
+		if err != nil {
+			return crex.Wrap(ErrRuntime, err)
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return crex.Wrap(ErrRuntime, err)
+		}
+		return nil
+	})
+}
+
+// Removes paths from the snapshot of a container without a task.
+func (c *Container) removeHost(ctx context.Context, paths []string) error {
+	return c.withRootfs(ctx, func(root string) error {
+		for _, p := range paths {
+			target, err := rootfsPath(root, p)
+			if err != nil {
+				return crex.Wrap(ErrRuntime, err)
+			}
+			if target == root {
+				return crex.Wrapf(ErrRuntime, "refusing to remove the root filesystem")
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return crex.Wrap(ErrRuntime, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Extracts a tar stream into the snapshot of a container without a task.
+//
+// Entry names are rebased onto destDir and the archive is applied at the
+// root of the snapshot, so that links in the archive and in the snapshot
+// resolve the way they would inside the container. Entries named like
+// overlay whiteouts are written as ordinary files, as tar would.
+func (c *Container) extractHost(ctx context.Context, r io.Reader, destDir string) error {
+	return c.withRootfs(ctx, func(root string) error {
+		return extractTree(ctx, root, r, destDir)
+	})
+}
+
+// Extracts a tar stream into destDir of the root filesystem at root.
+func extractTree(ctx context.Context, root string, r io.Reader, destDir string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rebaseTar(pw, r, destDir))
+	}()
+
+	_, err := archive.Apply(ctx, root, pr, archive.WithConvertWhiteout(keepWhiteouts))
+	pr.CloseWithError(err)
+	if err != nil {
+		return crex.Wrapf(ErrRuntime, "extract into %s: %w", destDir, err)
+	}
+	return nil
+}
+
+// Keeps whiteout-named entries as regular files.
+func keepWhiteouts(*tar.Header, string) (bool, error) {
+	return true, nil
+}
+
+// Copies a tar stream with every entry name, and every hard link target,
+// placed below dir.
+func rebaseTar(w io.Writer, r io.Reader, dir string) error {
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(dir, header.Name)
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = path.Join(dir, header.Linkname)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Archives a path in the snapshot of a container without a task.
+//
+// The archive has the same layout as [Container.CopyFrom] produces with tar:
+// entries are named from the base of p, symbolic links are stored as links,
+// and numeric ownership is kept. User and group names are omitted, since
+// the host's names do not apply to the container.
+func (c *Container) archiveHost(ctx context.Context, w io.Writer, p string) error {
+	return c.withRootfs(ctx, func(root string) error {
+		return archiveTree(w, root, p)
+	})
+}
+
+// Archives path p of the root filesystem at root.
+func archiveTree(w io.Writer, root, p string) error {
+	source, err := rootfsPath(root, p)
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+	if _, err := os.Lstat(source); errors.Is(err, fs.ErrNotExist) {
+		return crex.Wrapf(ErrPathNotFound, "%s", p)
+	}
+
+	tw := tar.NewWriter(w)
+	base := filepath.Dir(source)
+	err = filepath.WalkDir(source, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		return writeHostEntry(tw, file, filepath.ToSlash(rel), info)
+	})
+	if err != nil {
+		return crex.Wrapf(ErrRuntime, "archive of %s: %w", p, err)
+	}
+	return tw.Close()
+}
+
+// Writes one file, directory, or link of a mounted snapshot to a tar writer.
+func writeHostEntry(tw *tar.Writer, file, name string, info fs.FileInfo) error {
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Uname = ""
+	header.Gname = ""
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,125 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootfsPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// An absolute link resolves inside the root, as it would in the container.
+	if err := os.Symlink("/usr/lib", filepath.Join(root, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/", want: root},
+		{path: "/usr/lib/libc.so", want: filepath.Join(root, "usr", "lib", "libc.so")},
+		{path: "/lib/libc.so", want: filepath.Join(root, "usr", "lib", "libc.so")},
+		{path: "/lib", want: filepath.Join(root, "lib")},
+		{path: "/../../etc/passwd", want: filepath.Join(root, "etc", "passwd")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := rootfsPath(root, tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("rootfsPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebaseTar(t *testing.T) {
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	for _, h := range []*tar.Header{
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "app/main", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "app/alias", Typeflag: tar.TypeLink, Linkname: "app/main"},
+		{Name: "app/sym", Typeflag: tar.TypeSymlink, Linkname: "main"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	var out bytes.Buffer
+	if err := rebaseTar(&out, &in, "/srv/"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []struct{ name, link string }{
+		{"srv/app", ""},
+		{"srv/app/main", ""},
+		{"srv/app/alias", "srv/app/main"},
+		{"srv/app/sym", "main"},
+	}
+	tr := tar.NewReader(&out)
+	for _, w := range want {
+		h, err := tr.Next()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if h.Name != w.name || h.Linkname != w.link {
+			t.Errorf("entry = %q -> %q, want %q -> %q", h.Name, h.Linkname, w.name, w.link)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected end of archive, got %v", err)
+	}
+}
+
+func TestArchiveExtractTree(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "out", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "out", "bin", "app"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/app", filepath.Join(src, "out", "app")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := archiveTree(&buf, src, "/out"); err != nil {
+		t.Fatalf("archiveTree: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dst, "srv"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractTree(context.Background(), dst, &buf, "/srv"); err != nil {
+		t.Fatalf("extractTree: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dst, "srv", "out", "bin", "app"))
+	if err != nil || string(data) != "binary" {
+		t.Errorf("extracted file = %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "srv", "out", "app")); err != nil || link != "bin/app" {
+		t.Errorf("extracted link = %q, %v", link, err)
+	}
+
+	if err := archiveTree(io.Discard, src, "/missing"); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("expected ErrPathNotFound, got %v", err)
+	}
+}
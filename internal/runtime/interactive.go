@@ -0,0 +1,68 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"log/slog"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/cruciblehq/crex"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Size of a terminal in character cells.
+type TerminalSize struct {
+	Width  uint16 // Columns.
+	Height uint16 // Rows.
+}
+
+// Streams of a process started by [Container.ExecInteractive].
+type ExecIO struct {
+	Stdin  io.Reader           // Input of the process. Nil leaves stdin disconnected; EOF closes it.
+	Stdout io.Writer           // Standard output of the process, and standard error with a terminal.
+	Stderr io.Writer           // Standard error of the process. Unused with a terminal.
+	Resize <-chan TerminalSize // Sizes the terminal is resized to while the process runs. Unused without a terminal.
+}
+
+// Runs a command and arguments directly inside the container, connected to
+// the caller's streams, such as an interactive shell.
+//
+// Behaves like [Container.ExecStream], except that the process also reads
+// streams.Stdin. With tty set the process runs on a pseudo-terminal of the
+// given size, or containerd's default when size is zero, so programs that
+// check for a terminal behave as they would in a console. Returns the exit
+// code of the process.
+func (c *Container) ExecInteractive(ctx context.Context, args []string, tty bool, size TerminalSize, streams ExecIO) (int, error) {
+	pspec, err := c.buildProcessSpec(ctx, nil, "", args...)
+	if err != nil {
+		return 0, crex.Wrap(ErrRuntime, err)
+	}
+	if tty {
+		pspec.Terminal = true
+		if size.Width > 0 && size.Height > 0 {
+			pspec.ConsoleSize = &specs.Box{Width: uint(size.Width), Height: uint(size.Height)}
+		}
+	}
+	return c.runProcess(ctx, pspec, streams)
+}
+
+// Applies the sizes received on resize to the terminal of a started
+// process until resize is closed or exited is.
+//
+// A failed resize is only logged, since the process keeps running with
+// its previous size.
+func forwardResize(ctx context.Context, process containerd.Process, resize <-chan TerminalSize, exited <-chan struct{}) {
+	for {
+		select {
+		case size, ok := <-resize:
+			if !ok {
+				return
+			}
+			if err := process.Resize(ctx, uint32(size.Width), uint32(size.Height)); err != nil {
+				slog.Warn("failed to resize terminal", "process", process.ID(), "error", err)
+			}
+		case <-exited:
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package runtime
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/cruciblehq/crex"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Algorithm that layers committed by an export are compressed with.
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip" // Readable by every image consumer. The default.
+	CompressionZstd Compression = "zstd" // Smaller and faster to decompress, but needs Docker 23 or containerd 1.5 and later.
+)
+
+// Levels accepted for each algorithm, as passed to its encoder.
+var compressionLevels = map[Compression][2]int{
+	CompressionGzip: {gzip.BestSpeed, gzip.BestCompression},
+	CompressionZstd: {1, 22},
+}
+
+// Checks that the algorithm is known or empty and that level, unless zero,
+// is within the algorithm's range.
+func (c Compression) Validate(level int) error {
+	comp := c
+	if comp == "" {
+		comp = CompressionGzip
+	}
+	levels, ok := compressionLevels[comp]
+	if !ok {
+		return crex.Wrapf(ErrRuntime, "unknown layer compression %q", c)
+	}
+	if level != 0 && (level < levels[0] || level > levels[1]) {
+		return crex.Wrapf(ErrRuntime, "%s compression level %d is outside %d to %d", comp, level, levels[0], levels[1])
+	}
+	return nil
+}
+
+// Returns the media type of a layer compressed with the algorithm.
+func (c Compression) mediaType() string {
+	if c == CompressionZstd {
+		return ocispec.MediaTypeImageLayerZstd
+	}
+	return ocispec.MediaTypeImageLayerGzip
+}
+
+// Returns the media type containerd's diff service is asked to produce.
+//
+// The diff service compresses at its own default level. For any other level
+// the layer is requested uncompressed and compressed by [compressLayer].
+func diffMediaType(c Compression, level int) string {
+	if level != 0 {
+		return ocispec.MediaTypeImageLayer
+	}
+	return c.mediaType()
+}
+
+// Compresses an uncompressed layer blob at level and writes the result to
+// the content store, returning its descriptor.
+//
+// The compressed layer is spooled to a temporary file first, since its
+// digest must be known before it is written. It is labelled with its diff
+// ID, as containerd labels the layers its diff service compresses, so the
+// diff ID is not recomputed when the layer is read.
+func (c *Container) compressLayer(ctx context.Context, layer ocispec.Descriptor, comp Compression, level int) (ocispec.Descriptor, error) {
+	store := c.client.ContentStore()
+	ra, err := store.ReaderAt(ctx, layer)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+
+	spool, err := os.CreateTemp("", "cruxd-layer-*")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	digester := digest.Canonical.Digester()
+	if err := compressStream(io.MultiWriter(spool, digester.Hash()), content.NewReader(ra), comp, level); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType:   comp.mediaType(),
+		Digest:      digester.Digest(),
+		Size:        size,
+		Annotations: layer.Annotations,
+	}
+	ref := "cruxd-layer-" + desc.Digest.Encoded()
+	if err := content.WriteBlob(ctx, store, ref, spool, desc, content.WithLabels(map[string]string{labels.LabelUncompressed: layer.Digest.String()})); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// Copies src to dst compressed with the algorithm at level.
+func compressStream(dst io.Writer, src io.Reader, comp Compression, level int) error {
+	var w io.WriteCloser
+	switch comp {
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		if err != nil {
+			return err
+		}
+		w = zw
+	default:
+		gw, err := gzip.NewWriterLevel(dst, level)
+		if err != nil {
+			return err
+		}
+		w = gw
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
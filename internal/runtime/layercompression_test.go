@@ -0,0 +1,83 @@
+package runtime
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/archive/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCompressionValidate(t *testing.T) {
+	tests := []struct {
+		comp    Compression
+		level   int
+		wantErr bool
+	}{
+		{comp: ""},
+		{comp: "", level: 9},
+		{comp: CompressionGzip, level: 1},
+		{comp: CompressionGzip, level: 10, wantErr: true},
+		{comp: CompressionZstd},
+		{comp: CompressionZstd, level: 19},
+		{comp: CompressionZstd, level: 23, wantErr: true},
+		{comp: CompressionZstd, level: -1, wantErr: true},
+		{comp: "brotli", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := tt.comp.Validate(tt.level)
+		if tt.wantErr && !errors.Is(err, ErrRuntime) {
+			t.Errorf("Validate(%q, %d) error = %v, want ErrRuntime", tt.comp, tt.level, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("Validate(%q, %d): unexpected error: %v", tt.comp, tt.level, err)
+		}
+	}
+}
+
+func TestDiffMediaType(t *testing.T) {
+	tests := []struct {
+		comp  Compression
+		level int
+		want  string
+	}{
+		{comp: "", want: ocispec.MediaTypeImageLayerGzip},
+		{comp: CompressionGzip, want: ocispec.MediaTypeImageLayerGzip},
+		{comp: CompressionZstd, want: ocispec.MediaTypeImageLayerZstd},
+		{comp: CompressionZstd, level: 3, want: ocispec.MediaTypeImageLayer},
+		{comp: CompressionGzip, level: 9, want: ocispec.MediaTypeImageLayer},
+	}
+	for _, tt := range tests {
+		if got := diffMediaType(tt.comp, tt.level); got != tt.want {
+			t.Errorf("diffMediaType(%q, %d) = %s, want %s", tt.comp, tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestCompressStream(t *testing.T) {
+	data := strings.Repeat("layer contents ", 1000)
+
+	for _, comp := range []Compression{CompressionGzip, CompressionZstd} {
+		var buf bytes.Buffer
+		if err := compressStream(&buf, strings.NewReader(data), comp, compressionLevels[comp][1]); err != nil {
+			t.Fatalf("%s: %v", comp, err)
+		}
+		if buf.Len() >= len(data) {
+			t.Errorf("%s: compressed %d bytes to %d", comp, len(data), buf.Len())
+		}
+
+		rc, err := compression.DecompressStream(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", comp, err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != data {
+			t.Errorf("%s: round trip = %d bytes, %v", comp, len(got), err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package runtime
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/v2/core/mount"
+	"github.com/cruciblehq/crex"
+)
+
+// A mount that assembles a container's root filesystem on the host.
+type SnapshotMount struct {
+	Type    string   // Filesystem type, such as "overlay" or "bind".
+	Source  string   // Mount source on the host.
+	Options []string // Mount options, such as the overlay lowerdir and upperdir.
+}
+
+// Returns the snapshotter mounts for the container's active snapshot.
+//
+// The mounts describe the same snapshot that [Container.Export] diffs, and
+// can be passed to mount(8) to inspect the container's filesystem from the
+// host without running tar inside the container. Adding "ro" to the options
+// yields a read-only view. Mounting requires root or CAP_SYS_ADMIN on the
+// daemon's host. The running container keeps writing to the same upper
+// directory, so a mounted view taken while steps are executing may be
+// inconsistent.
+func (c *Container) Mounts(ctx context.Context) ([]SnapshotMount, error) {
+	ctr, err := c.client.LoadContainer(ctx, c.id)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	info, err := ctr.Info(ctx)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	mounts, err := c.client.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	return snapshotMounts(mounts), nil
+}
+
+// Converts containerd mounts into [SnapshotMount] values.
+func snapshotMounts(mounts []mount.Mount) []SnapshotMount {
+	out := make([]SnapshotMount, 0, len(mounts))
+	for _, m := range mounts {
+		out = append(out, SnapshotMount{Type: m.Type, Source: m.Source, Options: m.Options})
+	}
+	return out
+}
@@ -0,0 +1,27 @@
+package runtime
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/mount"
+)
+
+func TestSnapshotMounts(t *testing.T) {
+	got := snapshotMounts([]mount.Mount{{
+		Type:    "overlay",
+		Source:  "overlay",
+		Target:  "ignored",
+		Options: []string{"lowerdir=/a", "upperdir=/b", "workdir=/c"},
+	}})
+
+	if len(got) != 1 {
+		t.Fatalf("got %d mounts, want 1", len(got))
+	}
+	if got[0].Type != "overlay" || got[0].Source != "overlay" {
+		t.Errorf("mount = %+v", got[0])
+	}
+	if !slices.Equal(got[0].Options, []string{"lowerdir=/a", "upperdir=/b", "workdir=/c"}) {
+		t.Errorf("options = %v", got[0].Options)
+	}
+}
@@ -0,0 +1,325 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/v2/contrib/apparmor"
+	"github.com/containerd/containerd/v2/contrib/seccomp"
+	"github.com/containerd/containerd/v2/core/containers"
+	"github.com/containerd/containerd/v2/pkg/cap"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/cruciblehq/crex"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Resource limit names accepted in [Rlimit.Type], mapped to their OCI names.
+var rlimitTypes = map[string]string{
+	"as":         "RLIMIT_AS",
+	"core":       "RLIMIT_CORE",
+	"cpu":        "RLIMIT_CPU",
+	"data":       "RLIMIT_DATA",
+	"fsize":      "RLIMIT_FSIZE",
+	"locks":      "RLIMIT_LOCKS",
+	"memlock":    "RLIMIT_MEMLOCK",
+	"msgqueue":   "RLIMIT_MSGQUEUE",
+	"nice":       "RLIMIT_NICE",
+	"nofile":     "RLIMIT_NOFILE",
+	"nproc":      "RLIMIT_NPROC",
+	"rss":        "RLIMIT_RSS",
+	"rtprio":     "RLIMIT_RTPRIO",
+	"rttime":     "RLIMIT_RTTIME",
+	"sigpending": "RLIMIT_SIGPENDING",
+	"stack":      "RLIMIT_STACK",
+}
+
+// Valid container hostnames: dot-separated labels of letters, digits, and
+// inner hyphens, at most 63 characters each.
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// Longest hostname the kernel accepts.
+const maxHostnameLength = 64
+
+// Checks that a hostname can be set in a container. An empty hostname is
+// valid and keeps the default.
+func validateHostname(hostname string) error {
+	if hostname == "" {
+		return nil
+	}
+	if len(hostname) > maxHostnameLength || !hostnamePattern.MatchString(hostname) {
+		return crex.Wrapf(ErrRuntime, "invalid hostname %q", hostname)
+	}
+	return nil
+}
+
+// Value of [ContainerOptions.SeccompProfile] that disables seccomp filtering.
+const SeccompUnconfined = "unconfined"
+
+// Settings applied to the OCI spec of a container when it is created.
+//
+// The zero value keeps containerd's defaults. Exec processes copy the
+// container's process spec, so every setting applies to all commands run
+// inside the container as well as to its primary task.
+type ContainerOptions struct {
+	Rlimits          []Rlimit          // Resource limits for processes in the container.
+	AddCapabilities  []string          // Linux capabilities granted in addition to containerd's defaults.
+	DropCapabilities []string          // Linux capabilities removed from containerd's defaults.
+	SeccompProfile   string            // Seccomp profile as a file path, inline JSON, or "unconfined". Empty uses containerd's default profile.
+	AppArmorProfile  string            // Name of a loaded AppArmor profile, or "unconfined". Empty keeps containerd's default.
+	Mounts           []Mount           // Host paths bind-mounted into the container.
+	Hostname         string            // Hostname in the container's UTS namespace. Empty keeps containerd's default.
+	Labels           map[string]string // Labels of the container record, in addition to the daemon's own.
+	MemoryLimit      int64             // Most memory in bytes the container's processes may use together. Zero means unlimited.
+	CPUs             float64           // CPUs' worth of time the container may use, such as 1.5. Zero means unlimited.
+}
+
+// A host path bind-mounted into a container.
+//
+// Mounts are not part of the container's snapshot, so their contents are
+// never committed to an exported layer.
+type Mount struct {
+	Source      string // Absolute path on the daemon's host.
+	Destination string // Absolute path in the container.
+	ReadOnly    bool   // Whether the container may not write to the mount.
+}
+
+// A POSIX resource limit for processes in a container.
+//
+// Limits are applied by the OCI runtime, which inherits the limits of the
+// containerd shim. A hard limit above the shim's own hard limit cannot be
+// raised without CAP_SYS_RESOURCE and fails at container start.
+type Rlimit struct {
+	Type string // Limit name such as "nofile", "nproc", or "stack".
+	Soft uint64 // Soft limit, enforced by the kernel.
+	Hard uint64 // Hard limit, the ceiling for the soft limit.
+}
+
+// Checks the options for unknown names and inconsistent values.
+func (o ContainerOptions) Validate() error {
+	seen := make(map[string]bool, len(o.Rlimits))
+	for _, rl := range o.Rlimits {
+		name := strings.ToLower(rl.Type)
+		if _, ok := rlimitTypes[name]; !ok {
+			return crex.Wrapf(ErrRuntime, "unknown rlimit %q", rl.Type)
+		}
+		if seen[name] {
+			return crex.Wrapf(ErrRuntime, "duplicate rlimit %q", rl.Type)
+		}
+		seen[name] = true
+		if rl.Soft > rl.Hard {
+			return crex.Wrapf(ErrRuntime, "rlimit %q soft limit %d exceeds hard limit %d", rl.Type, rl.Soft, rl.Hard)
+		}
+	}
+
+	added, err := normalizeCapabilities(o.AddCapabilities)
+	if err != nil {
+		return err
+	}
+	dropped, err := normalizeCapabilities(o.DropCapabilities)
+	if err != nil {
+		return err
+	}
+	for _, c := range added {
+		if slices.Contains(dropped, c) {
+			return crex.Wrapf(ErrRuntime, "capability %s is both added and dropped", c)
+		}
+	}
+
+	if err := validateHostname(o.Hostname); err != nil {
+		return err
+	}
+
+	if o.MemoryLimit < 0 {
+		return crex.Wrapf(ErrRuntime, "memory limit %d must not be negative", o.MemoryLimit)
+	}
+	if o.CPUs < 0 || (o.CPUs > 0 && cpuQuota(o.CPUs) < 1000) {
+		return crex.Wrapf(ErrRuntime, "CPU limit %g must be zero or at least 0.01", o.CPUs)
+	}
+
+	for _, m := range o.Mounts {
+		if !filepath.IsAbs(m.Source) || !path.IsAbs(m.Destination) {
+			return crex.Wrapf(ErrRuntime, "mount %q -> %q: paths must be absolute", m.Source, m.Destination)
+		}
+	}
+
+	if o.SeccompProfile != SeccompUnconfined && o.SeccompProfile != "" {
+		if _, err := loadSeccompProfile(o.SeccompProfile); err != nil {
+			return err
+		}
+	}
+
+	if err := validateAppArmorProfile(o.AppArmorProfile); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the spec options implementing the settings.
+func (o ContainerOptions) specOpts() ([]oci.SpecOpts, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	var opts []oci.SpecOpts
+	if len(o.Rlimits) > 0 {
+		opts = append(opts, withRlimits(o.Rlimits))
+	}
+
+	// Validation has already checked the capability names.
+	if added, _ := normalizeCapabilities(o.AddCapabilities); len(added) > 0 {
+		opts = append(opts, oci.WithAddedCapabilities(added))
+	}
+	if dropped, _ := normalizeCapabilities(o.DropCapabilities); len(dropped) > 0 {
+		opts = append(opts, oci.WithDroppedCapabilities(dropped))
+	}
+
+	// A mount replaces any default mount at its destination, such as the
+	// host's /etc/resolv.conf, rather than being stacked on top of it.
+	if len(o.Mounts) > 0 {
+		opts = append(opts, oci.WithoutMounts(mountDestinations(o.Mounts)...), oci.WithMounts(specMounts(o.Mounts)))
+	}
+
+	if o.Hostname != "" {
+		opts = append(opts, oci.WithHostname(o.Hostname))
+	}
+
+	if o.MemoryLimit > 0 {
+		opts = append(opts, oci.WithMemoryLimit(uint64(o.MemoryLimit)))
+	}
+	if o.CPUs > 0 {
+		opts = append(opts, oci.WithCPUCFS(cpuQuota(o.CPUs), cpuPeriod))
+	}
+
+	// The default profile allows syscalls based on the process capabilities,
+	// so it must be applied after they are final.
+	switch o.SeccompProfile {
+	case "":
+		opts = append(opts, seccomp.WithDefaultProfile())
+	case SeccompUnconfined:
+		opts = append(opts, oci.WithSeccompUnconfined)
+	default:
+		opts = append(opts, withSeccompProfile(o.SeccompProfile))
+	}
+
+	if o.AppArmorProfile != "" {
+		opts = append(opts, apparmor.WithProfile(o.AppArmorProfile))
+	}
+
+	return opts, nil
+}
+
+// Converts bind mounts into OCI mount entries.
+func specMounts(mounts []Mount) []specs.Mount {
+	out := make([]specs.Mount, 0, len(mounts))
+	for _, m := range mounts {
+		mode := "rw"
+		if m.ReadOnly {
+			mode = "ro"
+		}
+		out = append(out, specs.Mount{
+			Destination: m.Destination,
+			Type:        "bind",
+			Source:      m.Source,
+			Options:     []string{"rbind", mode},
+		})
+	}
+	return out
+}
+
+// Returns the container paths of bind mounts.
+func mountDestinations(mounts []Mount) []string {
+	out := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		out = append(out, m.Destination)
+	}
+	return out
+}
+
+// Reads a seccomp profile given as inline JSON or as the path of a JSON file.
+//
+// A value whose first non-blank character is "{" is treated as inline JSON;
+// anything else is a path on the daemon's host.
+func loadSeccompProfile(profile string) (*specs.LinuxSeccomp, error) {
+	data := []byte(profile)
+	if !strings.HasPrefix(strings.TrimSpace(profile), "{") {
+		var err error
+		if data, err = os.ReadFile(profile); err != nil {
+			return nil, crex.Wrapf(ErrRuntime, "reading seccomp profile %q: %w", profile, err)
+		}
+	}
+
+	var sc specs.LinuxSeccomp
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, crex.Wrapf(ErrRuntime, "parsing seccomp profile: %w", err)
+	}
+	return &sc, nil
+}
+
+// Sets a custom seccomp profile on the container.
+func withSeccompProfile(profile string) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		sc, err := loadSeccompProfile(profile)
+		if err != nil {
+			return err
+		}
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		s.Linux.Seccomp = sc
+		return nil
+	}
+}
+
+// Converts capability names to their canonical "CAP_" form and checks that
+// each one is known to the kernel headers containerd was built with.
+//
+// Names are case-insensitive and the "CAP_" prefix is optional, so "net_raw"
+// and "CAP_NET_RAW" are equivalent.
+func normalizeCapabilities(names []string) ([]string, error) {
+	known := cap.Known()
+	caps := make([]string, 0, len(names))
+	for _, name := range names {
+		c := strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		if !slices.Contains(known, c) {
+			return nil, crex.Wrapf(ErrRuntime, "unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// Sets resource limits on the container's process, replacing any existing
+// limit of the same type.
+func withRlimits(rlimits []Rlimit) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Process == nil {
+			s.Process = &specs.Process{}
+		}
+		for _, rl := range rlimits {
+			typ := rlimitTypes[strings.ToLower(rl.Type)]
+			limit := specs.POSIXRlimit{Type: typ, Soft: rl.Soft, Hard: rl.Hard}
+
+			replaced := false
+			for i := range s.Process.Rlimits {
+				if s.Process.Rlimits[i].Type == typ {
+					s.Process.Rlimits[i] = limit
+					replaced = true
+				}
+			}
+			if !replaced {
+				s.Process.Rlimits = append(s.Process.Rlimits, limit)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,347 @@
+package runtime
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestContainerOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ContainerOptions
+		wantErr bool
+	}{
+		{name: "empty"},
+		{
+			name: "valid rlimits",
+			opts: ContainerOptions{Rlimits: []Rlimit{
+				{Type: "nofile", Soft: 65536, Hard: 65536},
+				{Type: "NPROC", Soft: 1024, Hard: 4096},
+			}},
+		},
+		{
+			name:    "unknown rlimit",
+			opts:    ContainerOptions{Rlimits: []Rlimit{{Type: "files", Soft: 1, Hard: 1}}},
+			wantErr: true,
+		},
+		{
+			name:    "soft above hard",
+			opts:    ContainerOptions{Rlimits: []Rlimit{{Type: "stack", Soft: 2, Hard: 1}}},
+			wantErr: true,
+		},
+		{
+			name: "capabilities",
+			opts: ContainerOptions{
+				AddCapabilities:  []string{"SYS_PTRACE"},
+				DropCapabilities: []string{"cap_net_raw", "CAP_MKNOD"},
+			},
+		},
+		{name: "hostname", opts: ContainerOptions{Hostname: "builder.example-1"}},
+		{name: "hostname with underscore", opts: ContainerOptions{Hostname: "build_1"}, wantErr: true},
+		{name: "hostname with leading hyphen", opts: ContainerOptions{Hostname: "-build"}, wantErr: true},
+		{name: "hostname too long", opts: ContainerOptions{Hostname: strings.Repeat("a", 65)}, wantErr: true},
+		{name: "resource limits", opts: ContainerOptions{MemoryLimit: 512 << 20, CPUs: 1.5}},
+		{name: "negative memory limit", opts: ContainerOptions{MemoryLimit: -1}, wantErr: true},
+		{name: "negative CPU limit", opts: ContainerOptions{CPUs: -1}, wantErr: true},
+		{name: "CPU limit below quota granularity", opts: ContainerOptions{CPUs: 0.001}, wantErr: true},
+		{
+			name:    "unknown capability",
+			opts:    ContainerOptions{DropCapabilities: []string{"CAP_TELEPORT"}},
+			wantErr: true,
+		},
+		{
+			name: "capability added and dropped",
+			opts: ContainerOptions{
+				AddCapabilities:  []string{"NET_RAW"},
+				DropCapabilities: []string{"CAP_NET_RAW"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unconfined seccomp",
+			opts: ContainerOptions{SeccompProfile: SeccompUnconfined},
+		},
+		{
+			name: "inline seccomp profile",
+			opts: ContainerOptions{SeccompProfile: `{"defaultAction":"SCMP_ACT_ALLOW"}`},
+		},
+		{
+			name:    "missing seccomp profile",
+			opts:    ContainerOptions{SeccompProfile: "/nonexistent/seccomp.json"},
+			wantErr: true,
+		},
+		{
+			name: "mount",
+			opts: ContainerOptions{Mounts: []Mount{{Source: "/tmp/secret", Destination: "/run/secrets/token", ReadOnly: true}}},
+		},
+		{
+			name:    "relative mount destination",
+			opts:    ContainerOptions{Mounts: []Mount{{Source: "/tmp/secret", Destination: "token"}}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate rlimit",
+			opts: ContainerOptions{Rlimits: []Rlimit{
+				{Type: "nofile", Soft: 1, Hard: 1},
+				{Type: "nofile", Soft: 2, Hard: 2},
+			}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWithRlimits(t *testing.T) {
+	spec := &oci.Spec{Process: &specs.Process{
+		Rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 1024}},
+	}}
+
+	opt := withRlimits([]Rlimit{
+		{Type: "nofile", Soft: 65536, Hard: 65536},
+		{Type: "stack", Soft: 8 << 20, Hard: 16 << 20},
+	})
+	if err := opt(context.Background(), nil, nil, spec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := make(map[string]specs.POSIXRlimit)
+	for _, rl := range spec.Process.Rlimits {
+		got[rl.Type] = rl
+	}
+	if len(got) != 2 {
+		t.Fatalf("rlimits = %+v, want 2 entries", spec.Process.Rlimits)
+	}
+	if got["RLIMIT_NOFILE"].Soft != 65536 {
+		t.Errorf("RLIMIT_NOFILE soft = %d, want 65536 (replaced)", got["RLIMIT_NOFILE"].Soft)
+	}
+	if got["RLIMIT_STACK"].Hard != 16<<20 {
+		t.Errorf("RLIMIT_STACK hard = %d, want %d", got["RLIMIT_STACK"].Hard, 16<<20)
+	}
+}
+
+func TestNormalizeCapabilities(t *testing.T) {
+	got, err := normalizeCapabilities([]string{"net_raw", "CAP_SYS_ADMIN", " Chown "})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"CAP_NET_RAW", "CAP_SYS_ADMIN", "CAP_CHOWN"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("normalizeCapabilities = %v, want %v", got, want)
+	}
+}
+
+func TestContainerOptionsSpecOptsCapabilities(t *testing.T) {
+	opts := ContainerOptions{
+		AddCapabilities:  []string{"SYS_PTRACE"},
+		DropCapabilities: []string{"NET_RAW"},
+	}
+	specOpts, err := opts.specOpts()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spec := &oci.Spec{
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{
+			Bounding:  []string{"CAP_CHOWN", "CAP_NET_RAW"},
+			Effective: []string{"CAP_CHOWN", "CAP_NET_RAW"},
+			Permitted: []string{"CAP_CHOWN", "CAP_NET_RAW"},
+		}},
+		Linux: &specs.Linux{},
+	}
+	for _, o := range specOpts {
+		if err := o(context.Background(), nil, nil, spec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	caps := spec.Process.Capabilities
+	if slices.Contains(caps.Bounding, "CAP_NET_RAW") || slices.Contains(caps.Effective, "CAP_NET_RAW") {
+		t.Errorf("CAP_NET_RAW not dropped: %+v", caps)
+	}
+	if !slices.Contains(caps.Effective, "CAP_SYS_PTRACE") {
+		t.Errorf("CAP_SYS_PTRACE not added: %+v", caps)
+	}
+	if !slices.Contains(caps.Effective, "CAP_CHOWN") {
+		t.Errorf("CAP_CHOWN removed unexpectedly: %+v", caps)
+	}
+}
+
+func TestLoadSeccompProfile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	if err := os.WriteFile(valid, []byte(`{"defaultAction":"SCMP_ACT_ERRNO"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		profile string
+		want    specs.LinuxSeccompAction
+		wantErr bool
+	}{
+		{name: "inline", profile: ` {"defaultAction":"SCMP_ACT_ALLOW"}`, want: specs.ActAllow},
+		{name: "file", profile: valid, want: specs.ActErrno},
+		{name: "missing file", profile: filepath.Join(dir, "missing.json"), wantErr: true},
+		{name: "invalid file", profile: invalid, wantErr: true},
+		{name: "invalid inline", profile: `{"defaultAction":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := loadSeccompProfile(tt.profile)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if sc.DefaultAction != tt.want {
+				t.Errorf("DefaultAction = %q, want %q", sc.DefaultAction, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerOptionsSpecOptsSeccomp(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    bool
+	}{
+		{name: "default", profile: "", want: true},
+		{name: "unconfined", profile: SeccompUnconfined, want: false},
+		{name: "inline", profile: `{"defaultAction":"SCMP_ACT_ALLOW"}`, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specOpts, err := ContainerOptions{SeccompProfile: tt.profile}.specOpts()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			spec := &oci.Spec{
+				Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{}},
+				Linux:   &specs.Linux{},
+			}
+			for _, o := range specOpts {
+				if err := o(context.Background(), nil, nil, spec); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if got := spec.Linux.Seccomp != nil; got != tt.want {
+				t.Errorf("seccomp set = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpecMounts(t *testing.T) {
+	got := specMounts([]Mount{
+		{Source: "/host/a", Destination: "/a", ReadOnly: true},
+		{Source: "/host/b", Destination: "/b"},
+	})
+	want := []specs.Mount{
+		{Destination: "/a", Type: "bind", Source: "/host/a", Options: []string{"rbind", "ro"}},
+		{Destination: "/b", Type: "bind", Source: "/host/b", Options: []string{"rbind", "rw"}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d mounts, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Destination != want[i].Destination || got[i].Source != want[i].Source ||
+			got[i].Type != want[i].Type || !slices.Equal(got[i].Options, want[i].Options) {
+			t.Errorf("mount %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestContainerOptionsSpecOptsMountsReplaceDefaults(t *testing.T) {
+	specOpts, err := ContainerOptions{Mounts: []Mount{
+		{Source: "/tmp/build/resolv.conf", Destination: "/etc/resolv.conf", ReadOnly: true},
+	}}.specOpts()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spec := &oci.Spec{
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{}},
+		Linux:   &specs.Linux{},
+	}
+	if err := oci.WithHostResolvconf(context.Background(), nil, nil, spec); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range specOpts {
+		if err := o(context.Background(), nil, nil, spec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	var sources []string
+	for _, m := range spec.Mounts {
+		if m.Destination == "/etc/resolv.conf" {
+			sources = append(sources, m.Source)
+		}
+	}
+	if !slices.Equal(sources, []string{"/tmp/build/resolv.conf"}) {
+		t.Errorf("resolv.conf mounts from %v, want only the custom file", sources)
+	}
+}
+
+func TestContainerOptionsSpecOptsHostname(t *testing.T) {
+	specOpts, err := ContainerOptions{Hostname: "builder"}.specOpts()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spec := &oci.Spec{
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{}},
+		Linux:   &specs.Linux{},
+	}
+	for _, o := range specOpts {
+		if err := o(context.Background(), nil, nil, spec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if spec.Hostname != "builder" {
+		t.Errorf("hostname = %q, want %q", spec.Hostname, "builder")
+	}
+}
+
+func TestContainerLabels(t *testing.T) {
+	extra := map[string]string{BuildLabel: "build-1"}
+	got := containerLabels(extra)
+	if got[managedLabel] != "true" || got[BuildLabel] != "build-1" || len(got) != 2 {
+		t.Errorf("containerLabels() = %v", got)
+	}
+	if _, ok := extra[managedLabel]; ok {
+		t.Error("caller's labels modified")
+	}
+	if got := containerLabels(nil); len(got) != 1 || got[managedLabel] != "true" {
+		t.Errorf("containerLabels(nil) = %v", got)
+	}
+}
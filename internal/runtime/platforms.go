@@ -0,0 +1,81 @@
+package runtime
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Directory where the kernel lists registered binfmt_misc handlers.
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// Compression algorithms layers committed by [Container.Export] can be
+// compressed with, the default first.
+var layerCompressions = []string{string(CompressionGzip), string(CompressionZstd)}
+
+// OCI platforms of the QEMU user-mode emulators registered by tools such
+// as tonistiigi/binfmt, keyed by the handler's architecture suffix.
+var qemuPlatforms = map[string]string{
+	"aarch64":     "linux/arm64",
+	"arm":         "linux/arm/v7",
+	"i386":        "linux/386",
+	"loongarch64": "linux/loong64",
+	"mips64el":    "linux/mips64le",
+	"ppc64le":     "linux/ppc64le",
+	"riscv64":     "linux/riscv64",
+	"s390x":       "linux/s390x",
+	"x86_64":      "linux/amd64",
+}
+
+// Returns the platforms that stage containers can run on.
+//
+// The host platform is always included. Other platforms are included when an
+// enabled QEMU binfmt_misc handler for them is registered, which is what
+// lets containerd run foreign binaries. The result is sorted.
+func SupportedPlatforms() []string {
+	return supportedPlatforms(binfmtDir)
+}
+
+// Returns the compression algorithms used for exported layers.
+func LayerCompressions() []string {
+	return slices.Clone(layerCompressions)
+}
+
+// Returns the host platform plus the platforms of the enabled QEMU handlers
+// in dir.
+func supportedPlatforms(dir string) []string {
+	list := []string{DefaultPlatform()}
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		arch, ok := strings.CutPrefix(e.Name(), "qemu-")
+		if !ok {
+			continue
+		}
+		p, ok := qemuPlatforms[arch]
+		if !ok || slices.Contains(list, p) {
+			continue
+		}
+		if binfmtEnabled(filepath.Join(dir, e.Name())) {
+			list = append(list, p)
+		}
+	}
+
+	slices.Sort(list)
+	return list
+}
+
+// Reports whether the binfmt_misc handler at path is enabled. The kernel
+// writes "enabled" or "disabled" as the first line of the entry.
+func binfmtEnabled(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	return s.Scan() && strings.TrimSpace(s.Text()) == "enabled"
+}
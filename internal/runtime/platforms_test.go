@@ -0,0 +1,42 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSupportedPlatforms(t *testing.T) {
+	dir := t.TempDir()
+	entries := map[string]string{
+		"qemu-aarch64": "enabled\ninterpreter /usr/bin/qemu-aarch64\n",
+		"qemu-riscv64": "disabled\ninterpreter /usr/bin/qemu-riscv64\n",
+		"qemu-unknown": "enabled\n",
+		"python3.12":   "enabled\n",
+		"status":       "enabled\n",
+	}
+	for name, content := range entries {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := supportedPlatforms(dir)
+
+	want := []string{DefaultPlatform()}
+	if DefaultPlatform() != "linux/arm64" {
+		want = append(want, "linux/arm64")
+	}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("supportedPlatforms() = %v, want %v", got, want)
+	}
+}
+
+func TestSupportedPlatformsWithoutBinfmt(t *testing.T) {
+	got := supportedPlatforms(filepath.Join(t.TempDir(), "missing"))
+	if !slices.Equal(got, []string{DefaultPlatform()}) {
+		t.Errorf("supportedPlatforms() = %v, want host only", got)
+	}
+}
@@ -0,0 +1,103 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	timage "github.com/containerd/containerd/v2/core/transfer/image"
+	"github.com/containerd/errdefs"
+	"github.com/cruciblehq/crex"
+	dref "github.com/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Commits a container's changes as a stored image and pushes it to a
+// registry.
+//
+// The image is committed as by [Container.ExportTo], but instead of living
+// only for the length of an export it is recorded in containerd under ref.
+// The transfer service then pushes it straight from the content store, so
+// the image never passes through an archive on disk. When output is not
+// empty the same image is also written to an archive in output, named as
+// by [Container.Export], and named by ref and opts.Tags. The record is
+// kept after the push and holds the image's blobs until it is replaced or
+// removed with [Runtime.DestroyImage].
+//
+// References to registries outside the allowlist set with
+// [Runtime.SetAllowedRegistries] fail with [ErrRegistryNotAllowed] before
+// anything is committed. Returns the digest of the pushed image and the path
+// of the archive, which is empty without an output.
+func (rt *Runtime) Push(ctx context.Context, c *Container, ref, output string, opts ExportOptions) (string, string, error) {
+	named, err := dref.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", "", crex.Wrapf(ErrRuntime, "invalid push reference %q: %w", ref, err)
+	}
+	if err := checkRegistry(named, rt.registries); err != nil {
+		return "", "", err
+	}
+	fullRef := dref.TagNameOnly(named).String()
+
+	// The lease covers the blobs until the image record references them.
+	ctx, release, err := c.acquireLease(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer release()
+
+	target, _, err := c.commit(ctx, opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := rt.storeImage(ctx, fullRef, target); err != nil {
+		return "", "", crex.Wrap(ErrRuntime, err)
+	}
+
+	var archive string
+	if output != "" {
+		names, err := exportNames(fullRef, append([]string{fullRef}, opts.Tags...))
+		if err != nil {
+			return "", "", err
+		}
+		archive, err = writeArchive(output, archiveName(target.Digest, opts.DigestFilename), func(w io.Writer) error {
+			if err := c.writeImage(ctx, target, names, opts.Format, w); err != nil {
+				return classifyExportError(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	start := time.Now()
+	err = withRegistryTimeout(ctx, rt.registryTimeout, fullRef, func(ctx context.Context) error {
+		dest, err := rt.ociRegistry(ctx, named, fullRef)
+		if err != nil {
+			return err
+		}
+		return rt.client.Transfer(ctx, timage.NewStore(fullRef), dest)
+	})
+	if err != nil {
+		return "", "", crex.Wrapf(ErrRuntime, "pushing %s: %w", fullRef, err)
+	}
+
+	slog.Info("image pushed", "ref", fullRef, "digest", target.Digest, "duration", time.Since(start))
+	return target.Digest.String(), archive, nil
+}
+
+// Records an image under name, replacing the target of any image already
+// stored under it.
+func (rt *Runtime) storeImage(ctx context.Context, name string, target ocispec.Descriptor) error {
+	is := rt.client.ImageService()
+	img := images.Image{Name: name, Target: target}
+
+	if _, err := is.Create(ctx, img); err == nil || !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	_, err := is.Update(ctx, img, "target")
+	return err
+}
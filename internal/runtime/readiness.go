@@ -0,0 +1,152 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Defaults of a [ReadinessProbe].
+const (
+	DefaultReadinessTimeout  = 30 * time.Second       // Time a service has to become ready.
+	DefaultReadinessInterval = 500 * time.Millisecond // Time between two probes.
+)
+
+// Longest output of a probe command kept for the error of a failed probe.
+const probeOutputLimit = 1024
+
+// Check that a started service container is ready, see
+// [StartOptions.Readiness].
+//
+// Exactly one of Command and Port is set. Containers share the host's
+// network namespace, so a port probe dials the port on the loopback
+// address, which requires containerd to run on the same host.
+type ReadinessProbe struct {
+	Command  []string      // Command run inside the container, ready once it exits 0.
+	Port     int           // TCP port of the service, ready once it accepts a connection.
+	Timeout  time.Duration // Time the service has to become ready. Zero uses [DefaultReadinessTimeout].
+	Interval time.Duration // Time between two probes. Zero uses [DefaultReadinessInterval].
+}
+
+// Checks that the probe names exactly one check and has sensible timings.
+func (p *ReadinessProbe) validate() error {
+	if p == nil {
+		return nil
+	}
+	switch {
+	case len(p.Command) == 0 && p.Port == 0:
+		return crex.Wrapf(ErrRuntime, "readiness probe needs a command or a port")
+	case len(p.Command) > 0 && p.Port != 0:
+		return crex.Wrapf(ErrRuntime, "readiness probe has both a command and a port")
+	case p.Port < 0 || p.Port > 65535:
+		return crex.Wrapf(ErrRuntime, "invalid readiness port %d", p.Port)
+	case p.Timeout < 0 || p.Interval < 0:
+		return crex.Wrapf(ErrRuntime, "readiness timeout and interval must not be negative")
+	}
+	return nil
+}
+
+// Runs the probe against the container until it succeeds.
+//
+// The container's task is checked before every probe, so a service that
+// exits fails the wait at once instead of when the timeout runs out. When
+// the timeout runs out the error wraps [ErrNotReady] and carries the error
+// of the last probe. The container is left running either way.
+func (c *Container) waitReady(ctx context.Context, p *ReadinessProbe) error {
+	probe := func(ctx context.Context) error {
+		status, err := c.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if status != protocol.ContainerRunning {
+			return errServiceExited
+		}
+		if p.Port != 0 {
+			return probePort(ctx, p.Port)
+		}
+		return c.probeCommand(ctx, p.Command)
+	}
+
+	if p.Port != 0 {
+		if err := c.requireLocal("readiness port probes"); err != nil {
+			return err
+		}
+	}
+	return pollReady(ctx, probe, p.Timeout, p.Interval)
+}
+
+// Error of a probe that found the service's task no longer running.
+var errServiceExited = errors.New("container is not running")
+
+// Calls probe every interval until it succeeds, the timeout runs out, or
+// the service exits. Zero timings use the defaults.
+func pollReady(ctx context.Context, probe func(context.Context) error, timeout, interval time.Duration) error {
+	if timeout == 0 {
+		timeout = DefaultReadinessTimeout
+	}
+	if interval == 0 {
+		interval = DefaultReadinessInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The error of a probe cut short by the timeout says nothing about the
+	// service, so the error of the last probe that ran to completion is kept.
+	var last error
+	for {
+		err := probe(ctx)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, errServiceExited):
+			return crex.Wrapf(ErrNotReady, "%w", err)
+		case last == nil || ctx.Err() == nil:
+			last = err
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return crex.Wrapf(ErrNotReady, "not ready after %s: %w", timeout, last)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks that a TCP port on the loopback address accepts connections.
+func probePort(ctx context.Context, port int) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Runs a probe command in the container and checks that it exits 0.
+func (c *Container) probeCommand(ctx context.Context, args []string) error {
+	res, err := c.ExecArgs(ctx, args, probeOutputLimit)
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		output := strings.TrimSpace(res.Stderr)
+		if output == "" {
+			output = strings.TrimSpace(res.Stdout)
+		}
+		return fmt.Errorf("probe %q exited %d: %s", strings.Join(args, " "), res.ExitCode, output)
+	}
+	return nil
+}
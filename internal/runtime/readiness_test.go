@@ -0,0 +1,90 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessProbeValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		probe   *ReadinessProbe
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "command", probe: &ReadinessProbe{Command: []string{"/healthcheck"}}},
+		{name: "port", probe: &ReadinessProbe{Port: 8080, Timeout: time.Minute, Interval: time.Second}},
+		{name: "empty", probe: &ReadinessProbe{}, wantErr: true},
+		{name: "command and port", probe: &ReadinessProbe{Command: []string{"true"}, Port: 8080}, wantErr: true},
+		{name: "port out of range", probe: &ReadinessProbe{Port: 70000}, wantErr: true},
+		{name: "negative timeout", probe: &ReadinessProbe{Port: 8080, Timeout: -time.Second}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.probe.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrRuntime) {
+				t.Errorf("error = %v, want ErrRuntime", err)
+			}
+		})
+	}
+}
+
+func TestPollReady(t *testing.T) {
+	failures := 0
+	flaky := func(context.Context) error {
+		if failures < 3 {
+			failures++
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name    string
+		probe   func(context.Context) error
+		wantErr string
+	}{
+		{name: "ready after retries", probe: flaky},
+		{name: "never ready", probe: func(context.Context) error { return errors.New("connection refused") }, wantErr: "connection refused"},
+		{name: "service exited", probe: func(context.Context) error { return errServiceExited }, wantErr: errServiceExited.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pollReady(context.Background(), tt.probe, 100*time.Millisecond, time.Millisecond)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("pollReady() = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNotReady) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("pollReady() = %v, want ErrNotReady with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProbePort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	if err := probePort(context.Background(), port); err != nil {
+		t.Errorf("probe of listening port = %v", err)
+	}
+	l.Close()
+	if err := probePort(context.Background(), port); err == nil {
+		t.Error("probe of closed port succeeded")
+	}
+}
@@ -0,0 +1,92 @@
+package runtime
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/pkg/oci"
+	"github.com/cruciblehq/crex"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Scratch directory mounted as tmpfs when writes are restricted. It is always
+// writable and its contents never reach the committed layer.
+const scratchDir = "/tmp"
+
+// Restricts writes to the container's root filesystem to the given paths.
+//
+// The OCI spec can only make the whole root filesystem read-only, and the
+// spec is fixed once the task is created. The writable paths are therefore
+// created while the root is still writable, then the task is stopped, the
+// spec is updated to mount the root read-only with each writable path
+// bind-mounted back on top of itself, and the task is restarted. Bind sources
+// are relative to the bundle, whose rootfs directory is the container's
+// snapshot, so writes to these paths land in the snapshot and are committed
+// on export. [scratchDir] is mounted as tmpfs for temporary files. Any other
+// write fails with EROFS.
+func (c *Container) RestrictWrites(ctx context.Context, writable []string) error {
+	if len(writable) > 0 {
+		args := append([]string{"mkdir", "-p", "--"}, writable...)
+		if err := c.mustExec(ctx, "mkdir", nil, nil, args...); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Stop(ctx); err != nil {
+		return err
+	}
+
+	ctr, err := c.client.LoadContainer(ctx, c.id)
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+
+	spec, err := ctr.Spec(ctx)
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+
+	applyReadonlyRootfs(spec, writable)
+
+	if err := ctr.Update(ctx, containerd.UpdateContainerOpts(containerd.WithSpec(spec))); err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+
+	if err := c.startTask(ctx, ctr); err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+
+	return nil
+}
+
+// Marks the spec's root filesystem read-only and mounts the writable paths.
+//
+// Paths inside [scratchDir] are skipped since the tmpfs already covers them.
+func applyReadonlyRootfs(spec *oci.Spec, writable []string) {
+	if spec.Root == nil {
+		spec.Root = &specs.Root{Path: "rootfs"}
+	}
+	spec.Root.Readonly = true
+
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: scratchDir,
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     []string{"nosuid", "nodev", "mode=1777"},
+	})
+
+	for _, p := range writable {
+		p = path.Clean(p)
+		if p == scratchDir || strings.HasPrefix(p, scratchDir+"/") {
+			continue
+		}
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: p,
+			Type:        "bind",
+			Source:      path.Join(spec.Root.Path, p),
+			Options:     []string{"rbind", "rw"},
+		})
+	}
+}
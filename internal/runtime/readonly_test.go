@@ -0,0 +1,51 @@
+package runtime
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestApplyReadonlyRootfs(t *testing.T) {
+	spec := &oci.Spec{Root: &specs.Root{Path: "rootfs"}}
+
+	applyReadonlyRootfs(spec, []string{"/app", "/tmp/build", "/usr/local/bin/"})
+
+	if !spec.Root.Readonly {
+		t.Fatal("root is not read-only")
+	}
+
+	want := map[string]specs.Mount{
+		"/tmp":           {Destination: "/tmp", Type: "tmpfs"},
+		"/app":           {Destination: "/app", Type: "bind", Source: "rootfs/app"},
+		"/usr/local/bin": {Destination: "/usr/local/bin", Type: "bind", Source: "rootfs/usr/local/bin"},
+	}
+
+	if len(spec.Mounts) != len(want) {
+		t.Fatalf("len(mounts) = %d, want %d: %+v", len(spec.Mounts), len(want), spec.Mounts)
+	}
+	for _, m := range spec.Mounts {
+		w, ok := want[m.Destination]
+		if !ok {
+			t.Fatalf("unexpected mount %q", m.Destination)
+		}
+		if m.Type != w.Type {
+			t.Errorf("mount %q type = %q, want %q", m.Destination, m.Type, w.Type)
+		}
+		if w.Type == "bind" && m.Source != w.Source {
+			t.Errorf("mount %q source = %q, want %q", m.Destination, m.Source, w.Source)
+		}
+	}
+}
+
+func TestApplyReadonlyRootfsNilRoot(t *testing.T) {
+	spec := &oci.Spec{}
+	applyReadonlyRootfs(spec, nil)
+	if spec.Root == nil || !spec.Root.Readonly {
+		t.Fatal("root not created as read-only")
+	}
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Destination != scratchDir {
+		t.Fatalf("mounts = %+v, want only the scratch tmpfs", spec.Mounts)
+	}
+}
@@ -0,0 +1,41 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cruciblehq/crex"
+)
+
+// Bounds the registry transfers of pulls and pushes.
+//
+// Each transfer runs under its own deadline, derived from the caller's
+// context, so that an unresponsive registry fails with [ErrRegistryTimeout]
+// instead of holding the build until its overall limit. The deadline covers
+// the whole transfer, including downloading and unpacking layers, and
+// should leave room for the largest images. Zero or negative disables it.
+// Must be called before the runtime is used concurrently.
+func (rt *Runtime) SetRegistryTimeout(d time.Duration) {
+	rt.registryTimeout = d
+}
+
+// Runs a registry operation under the registry timeout.
+//
+// An operation cut short by the timeout fails with [ErrRegistryTimeout]
+// naming ref; other failures, including the caller's context ending, are
+// returned as they are.
+func withRegistryTimeout(ctx context.Context, timeout time.Duration, ref string, op func(context.Context) error) error {
+	if timeout <= 0 {
+		return op(ctx)
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, ErrRegistryTimeout)
+	defer cancel()
+
+	err := op(ctx)
+	if err != nil && errors.Is(context.Cause(ctx), ErrRegistryTimeout) {
+		return crex.Wrapf(ErrRegistryTimeout, "%s: no result within %s: %w", ref, timeout, err)
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRegistryTimeout(t *testing.T) {
+	// Stands in for a registry that accepts the request and never answers.
+	unresponsive := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	t.Run("unresponsive registry", func(t *testing.T) {
+		start := time.Now()
+		err := withRegistryTimeout(context.Background(), 20*time.Millisecond, "docker.io/library/alpine:3.21", unresponsive)
+		if !errors.Is(err, ErrRegistryTimeout) {
+			t.Fatalf("expected ErrRegistryTimeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("timeout fired after %s", elapsed)
+		}
+	})
+
+	t.Run("caller cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := withRegistryTimeout(ctx, time.Hour, "alpine", unresponsive)
+		if !errors.Is(err, context.Canceled) || errors.Is(err, ErrRegistryTimeout) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("operation error", func(t *testing.T) {
+		want := errors.New("unauthorized")
+		err := withRegistryTimeout(context.Background(), time.Hour, "alpine", func(context.Context) error { return want })
+		if !errors.Is(err, want) || errors.Is(err, ErrRegistryTimeout) {
+			t.Fatalf("expected the operation's error, got %v", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		err := withRegistryTimeout(context.Background(), 0, "alpine", func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); ok {
+				t.Error("deadline set with the timeout disabled")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package runtime
+
+import (
+	"context"
+	"strings"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/defaults"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/cruciblehq/crex"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Prefix of containerd addresses reached over TCP instead of a Unix socket.
+const tcpScheme = "tcp://"
+
+// Splits a containerd address into its TCP target. Returns false for a
+// Unix socket path, which the containerd client dials directly.
+func remoteTarget(address string) (string, bool) {
+	target, ok := strings.CutPrefix(address, tcpScheme)
+	return target, ok && target != ""
+}
+
+// Connects to a containerd daemon listening on TCP.
+//
+// The containerd client only dials Unix sockets, so the gRPC connection is
+// created here and handed to it. Like the client's own connections, it is
+// unencrypted and scoped to the namespace by interceptors. Containerd has no
+// authentication of its own, so the endpoint must only be reachable over a
+// trusted network or a tunnel.
+func dialRemote(target, namespace string) (*containerd.Client, error) {
+	conn, err := grpc.NewClient("passthrough:///"+target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(namespaceUnary(namespace)),
+		grpc.WithChainStreamInterceptor(namespaceStream(namespace)),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(defaults.DefaultMaxRecvMsgSize),
+			grpc.MaxCallSendMsgSize(defaults.DefaultMaxSendMsgSize),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := containerd.NewWithConn(conn, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Returns an interceptor that applies the namespace to unary calls whose
+// context carries none.
+func namespaceUnary(namespace string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(withDefaultNamespace(ctx, namespace), method, req, reply, cc, opts...)
+	}
+}
+
+// Returns an interceptor that applies the namespace to streaming calls whose
+// context carries none.
+func namespaceStream(namespace string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(withDefaultNamespace(ctx, namespace), desc, cc, method, opts...)
+	}
+}
+
+// Sets the namespace on a context that does not already have one.
+func withDefaultNamespace(ctx context.Context, namespace string) context.Context {
+	if _, ok := namespaces.Namespace(ctx); ok {
+		return ctx
+	}
+	return namespaces.WithNamespace(ctx, namespace)
+}
+
+// Fails with [ErrRemote] when the container's containerd is remote.
+//
+// Exec I/O is attached through FIFOs that the containerd shim opens on its
+// own host, and bind mounts name paths on that host, so neither works when
+// containerd runs elsewhere.
+func (c *Container) requireLocal(op string) error {
+	if c.remote {
+		return crex.Wrapf(ErrRemote, "%s", op)
+	}
+	return nil
+}
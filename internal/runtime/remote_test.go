@@ -0,0 +1,62 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+)
+
+func TestRemoteTarget(t *testing.T) {
+	tests := []struct {
+		address string
+		target  string
+		remote  bool
+	}{
+		{address: "/run/containerd/containerd.sock"},
+		{address: "unix:///run/containerd/containerd.sock"},
+		{address: "tcp://10.0.0.5:2376", target: "10.0.0.5:2376", remote: true},
+		{address: "tcp://builder.internal:2376", target: "builder.internal:2376", remote: true},
+		{address: "tcp://"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			target, remote := remoteTarget(tt.address)
+			if remote != tt.remote || (remote && target != tt.target) {
+				t.Errorf("remoteTarget(%q) = (%q, %v), want (%q, %v)", tt.address, target, remote, tt.target, tt.remote)
+			}
+		})
+	}
+}
+
+func TestWithDefaultNamespace(t *testing.T) {
+	ctx := withDefaultNamespace(context.Background(), "cruxd")
+	if ns, _ := namespaces.Namespace(ctx); ns != "cruxd" {
+		t.Errorf("namespace = %q, want cruxd", ns)
+	}
+
+	ctx = withDefaultNamespace(namespaces.WithNamespace(context.Background(), "other"), "cruxd")
+	if ns, _ := namespaces.Namespace(ctx); ns != "other" {
+		t.Errorf("namespace = %q, want the caller's", ns)
+	}
+}
+
+func TestRemoteRequiresLocal(t *testing.T) {
+	ctx := context.Background()
+	ctr := &Container{id: "build-1", remote: true}
+
+	if _, err := ctr.ExecArgs(ctx, []string{"true"}, 0); !errors.Is(err, ErrRemote) {
+		t.Errorf("ExecArgs: err = %v, want ErrRemote", err)
+	}
+	if err := ctr.MkdirAll(ctx, "/app"); !errors.Is(err, ErrRemote) {
+		t.Errorf("MkdirAll: err = %v, want ErrRemote", err)
+	}
+
+	rt := &Runtime{remote: true}
+	opts := ContainerOptions{Mounts: []Mount{{Source: "/tmp/secret", Destination: "/run/secrets/token"}}}
+	if _, err := rt.StartImage(ctx, &Image{platform: "linux/amd64"}, "build-1", opts); !errors.Is(err, ErrRemote) {
+		t.Errorf("StartImage: err = %v, want ErrRemote", err)
+	}
+}
@@ -0,0 +1,78 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Root of the cgroup filesystem on the daemon's host.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// CFS period for [ContainerOptions.CPUs], the kernel's default of 100ms.
+const cpuPeriod = 100000
+
+// Returns the CFS quota that lets a container use cpus CPUs per period.
+func cpuQuota(cpus float64) int64 {
+	return int64(cpus * cpuPeriod)
+}
+
+// Returns the files recording the OOM kills of a cgroup: memory.events on
+// cgroup v2 and memory.oom_control on v1. A cgroups path that is not a
+// plain absolute path, such as a systemd slice, yields none.
+func oomEventFiles(cgroupsPath string) []string {
+	if !filepath.IsAbs(cgroupsPath) {
+		return nil
+	}
+	return []string{
+		filepath.Join(cgroupRoot, cgroupsPath, "memory.events"),
+		filepath.Join(cgroupRoot, "memory", cgroupsPath, "memory.oom_control"),
+	}
+}
+
+// Returns the oom_kill counter of a memory.events or memory.oom_control
+// file, and whether the file has one.
+func parseOOMKills(data []byte) (int, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || key != "oom_kill" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// Returns how many processes of the container the kernel has killed for
+// exceeding its memory limit.
+//
+// The count is read from the container's cgroup on the daemon's host.
+// Reports false when it cannot be determined, such as for a cgroup managed
+// by systemd or a kernel without the counter.
+func (c *Container) oomKills(ctx context.Context) (int, bool) {
+	ctr, err := c.client.LoadContainer(ctx, c.id)
+	if err != nil {
+		return 0, false
+	}
+	spec, err := ctr.Spec(ctx)
+	if err != nil || spec.Linux == nil {
+		return 0, false
+	}
+
+	for _, file := range oomEventFiles(spec.Linux.CgroupsPath) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if n, ok := parseOOMKills(data); ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
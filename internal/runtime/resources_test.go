@@ -0,0 +1,50 @@
+package runtime
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseOOMKills(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		want   int
+		wantOK bool
+	}{
+		{name: "cgroup v2", data: "low 0\nhigh 0\nmax 12\noom 3\noom_kill 2\n", want: 2, wantOK: true},
+		{name: "cgroup v1", data: "oom_kill_disable 0\nunder_oom 0\noom_kill 1\n", want: 1, wantOK: true},
+		{name: "no counter", data: "oom_kill_disable 0\nunder_oom 0\n"},
+		{name: "malformed", data: "oom_kill many\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseOOMKills([]byte(tt.data))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseOOMKills() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestOOMEventFiles(t *testing.T) {
+	got := oomEventFiles("/cruxd/build-1")
+	want := []string{
+		"/sys/fs/cgroup/cruxd/build-1/memory.events",
+		"/sys/fs/cgroup/memory/cruxd/build-1/memory.oom_control",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("oomEventFiles() = %v, want %v", got, want)
+	}
+
+	if got := oomEventFiles("system.slice:cruxd:build-1"); got != nil {
+		t.Errorf("systemd cgroup gave %v, want none", got)
+	}
+}
+
+func TestCPUQuota(t *testing.T) {
+	if got := cpuQuota(1.5); got != 150000 {
+		t.Errorf("cpuQuota(1.5) = %d, want 150000", got)
+	}
+}
@@ -0,0 +1,67 @@
+package runtime
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/containerd/errdefs"
+)
+
+// Number of attempts made to create and start a container task.
+const taskStartAttempts = 3
+
+// Delay before the first retry of a task start. Each further retry waits
+// twice as long as the previous one.
+const taskStartBackoff = 250 * time.Millisecond
+
+// Number of attempts made to create a content lease.
+const leaseAttempts = 3
+
+// Delay before the first retry of a content lease, doubled for each further
+// retry.
+const leaseBackoff = 100 * time.Millisecond
+
+// Calls fn until it succeeds, fails with a non-transient error, or the
+// attempts are used up.
+//
+// The wait between attempts starts at backoff and doubles after each retry.
+// Returns the last error from fn, or the context's error if it is cancelled
+// while waiting.
+func retryTransient(ctx context.Context, attempts int, backoff time.Duration, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= attempts || !isTransient(ctx, err) {
+			return err
+		}
+
+		slog.Debug("retrying after transient error", "attempt", attempt, "backoff", backoff, "error", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// Reports whether err is likely to clear up on retry.
+//
+// Containerd reports a shim that is not ready yet as unavailable or aborted.
+// Errors that describe the request itself, such as an invalid spec, are
+// returned as other classes and are not retried. A deadline error only counts
+// as transient when it did not come from ctx.
+func isTransient(ctx context.Context, err error) bool {
+	switch {
+	case ctx.Err() != nil:
+		return false
+	case errdefs.IsUnavailable(err), errdefs.IsAborted(err), errdefs.IsDeadlineExceeded(err):
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,61 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/errdefs"
+)
+
+func TestRetryTransient(t *testing.T) {
+	transient := fmt.Errorf("shim not ready: %w", errdefs.ErrUnavailable)
+	invalid := fmt.Errorf("bad spec: %w", errdefs.ErrInvalidArgument)
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{name: "transient then success", errs: []error{transient, nil}, wantCalls: 2},
+		{name: "transient exhausted", errs: []error{transient, transient, transient}, wantCalls: 3, wantErr: transient},
+		{name: "not transient", errs: []error{invalid, nil}, wantCalls: 1, wantErr: invalid},
+		{name: "transient then not transient", errs: []error{transient, invalid, nil}, wantCalls: 2, wantErr: invalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryTransient(context.Background(), 3, 0, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryTransientCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := retryTransient(ctx, 3, 0, func() error {
+		calls++
+		cancel()
+		return errdefs.ErrUnavailable
+	})
+	if !errors.Is(err, errdefs.ErrUnavailable) {
+		t.Errorf("err = %v, want the last attempt's error", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
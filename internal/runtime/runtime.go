@@ -8,7 +8,9 @@ import (
 	"log/slog"
 	"os"
 	goruntime "runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	containerd "github.com/containerd/containerd/v2/client"
 	"github.com/containerd/containerd/v2/core/transfer/archive"
@@ -24,29 +26,105 @@ import (
 
 const (
 
-	// Snapshotter used for container filesystems. containerd runs as root
-	// inside the VM, so the native overlayfs kernel module is available.
-	snapshotter = "overlayfs"
+	// Default snapshotter for container filesystems. containerd runs as
+	// root inside the VM, so the native overlayfs kernel module is available.
+	defaultSnapshotter = "overlayfs"
 
 	// OCI runtime shim for running containers.
 	ociRuntime = "io.containerd.runc.v2"
+
+	// Label set on every container the daemon creates, so that bulk
+	// operations such as [Runtime.DestroyByPrefix] leave other containers in
+	// the namespace alone.
+	managedLabel = "io.cruciblehq.cruxd.managed"
+
+	// Label holding the ID of the build a stage container belongs to.
+	BuildLabel = "io.cruciblehq.cruxd.build"
+
+	// Label holding the socket path of the daemon that runs the build a
+	// stage container belongs to, so that daemons sharing a namespace only
+	// remove their own orphans.
+	DaemonLabel = "io.cruciblehq.cruxd.daemon"
+
+	// Label set on a stage container left paused at a breakpoint, which
+	// outlives its build.
+	pausedLabel = "io.cruciblehq.cruxd.paused"
 )
 
 // Manages the containerd client and provides image and container operations.
 type Runtime struct {
 	client *containerd.Client // Containerd client for managing containers and images.
+	remote bool               // Whether containerd is reached over TCP.
+
+	snapshotter string // Snapshotter images are unpacked into and containers are created with.
+
+	registries      []string             // Registry hosts base images may be pulled from. Empty allows any.
+	insecure        []string             // Registry hosts reached over plain HTTP.
+	registryTimeout time.Duration        // Longest a registry transfer may take. Zero means unlimited.
+	credentials     *RegistryCredentials // Registry credentials, nil for anonymous access.
+
+	compression compressionLimit // Slots for compressing and decompressing layers on export. Nil is unlimited.
+
+	progress TransferProgressFunc // Receives the progress of image pulls and imports. Nil reports none.
 }
 
-// Creates a runtime connected to the containerd socket at the given address.
+// Creates a runtime connected to the containerd daemon at the given address.
+//
+// The address is either the path of containerd's Unix socket or, for a
+// daemon on another host, "tcp://host:port". The namespace scopes all
+// containerd operations to a single tenant. The runtime must be closed when
+// no longer needed.
 //
-// The namespace scopes all containerd operations to a single tenant. The
-// runtime must be closed when no longer needed.
+// A remote containerd supports the operations that only exchange content
+// over the API: pulling, importing (archives are streamed from this host),
+// exporting, and starting, stopping, inspecting, and destroying containers.
+// Running commands in a container, and anything built on it such as copies
+// and recipe steps, needs the FIFOs containerd creates on its own host, and
+// bind mounts name paths on that host. Those fail with [ErrRemote].
 func New(address, namespace string) (*Runtime, error) {
+	if target, ok := remoteTarget(address); ok {
+		client, err := dialRemote(target, namespace)
+		if err != nil {
+			return nil, crex.Wrap(ErrRuntime, err)
+		}
+		return &Runtime{client: client, remote: true, snapshotter: defaultSnapshotter}, nil
+	}
+
 	client, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
 	if err != nil {
 		return nil, crex.Wrap(ErrRuntime, err)
 	}
-	return &Runtime{client: client}, nil
+	return &Runtime{client: client, snapshotter: defaultSnapshotter}, nil
+}
+
+// Reports whether containerd runs on another host. See [New] for the
+// operations that are unavailable then.
+func (rt *Runtime) Remote() bool {
+	return rt.remote
+}
+
+// Restricts the registries that images may be pulled from.
+//
+// Hosts are compared against the registry of each normalized reference, so
+// "docker.io" covers bare names such as "alpine". An empty list lifts the
+// restriction. Must be called before the runtime is used concurrently.
+func (rt *Runtime) SetAllowedRegistries(hosts []string) {
+	rt.registries = hosts
+}
+
+// Marks registries that serve plain HTTP instead of HTTPS.
+//
+// Hosts are matched like those of [Runtime.SetAllowedRegistries], exactly
+// and including any port, so only the named hosts lose TLS; every other
+// registry, Docker Hub included, still requires it. Must be called before
+// the runtime is used concurrently.
+func (rt *Runtime) SetInsecureRegistries(hosts []string) {
+	rt.insecure = hosts
+}
+
+// Returns the name of the snapshotter used for container filesystems.
+func (rt *Runtime) Snapshotter() string {
+	return rt.snapshotter
 }
 
 // Closes the containerd client connection.
@@ -54,80 +132,128 @@ func (rt *Runtime) Close() error {
 	return rt.client.Close()
 }
 
+// A base image that has been imported or pulled and unpacked for a platform,
+// ready for containers to be started from it.
+//
+// Preparing an image is separate from starting a container so that callers
+// can unpack the next base image while a container from the previous one is
+// still busy.
+type Image struct {
+	image       containerd.Image // Image resolved for the platform.
+	platform    string           // OCI platform the image was unpacked for.
+	snapshotter string           // Snapshotter the image was unpacked into.
+}
+
+// Returns the digest of the image's root descriptor, such as its index.
+func (img *Image) Digest() string {
+	return img.image.Target().Digest.String()
+}
+
 // Imports an OCI archive, unpacks it for the target platform, and starts
-// a container.
+// a container configured with opts.
+//
+// Equivalent to [Runtime.PrepareImage] followed by [Runtime.StartImage].
+// Building for a platform other than the host requires QEMU / binfmt_misc
+// support in the kernel.
+func (rt *Runtime) StartContainer(ctx context.Context, path string, id string, platform string, opts ContainerOptions) (*Container, error) {
+	img, err := rt.PrepareImage(ctx, path, platform)
+	if err != nil {
+		return nil, err
+	}
+	return rt.StartImage(ctx, img, id, opts)
+}
+
+// Pulls a remote OCI image and starts a container from it, configured with
+// opts.
+//
+// Equivalent to [Runtime.PrepareImageFromOCI] followed by
+// [Runtime.StartImage].
+func (rt *Runtime) StartContainerFromOCI(ctx context.Context, ref string, id string, platform string, opts ContainerOptions) (*Container, error) {
+	img, err := rt.PrepareImageFromOCI(ctx, ref, platform)
+	if err != nil {
+		return nil, err
+	}
+	return rt.StartImage(ctx, img, id, opts)
+}
+
+// Imports an OCI archive and unpacks it for the target platform.
 //
 // The archive is transferred server-side into containerd's content store,
 // tagged with a deterministic name derived from the path, and the layers
-// for the target platform are unpacked into the snapshotter. A container
-// is created with a fresh snapshot and a long-running task (sleep infinity)
-// is started so that subsequent Exec calls have a running process to attach
-// to. Any existing container with the same ID is removed before the new one
-// is created. Building for a platform other than the host requires
-// QEMU / binfmt_misc support in the kernel.
-func (rt *Runtime) StartContainer(ctx context.Context, path string, id string, platform string) (*Container, error) {
+// for the target platform are unpacked into the snapshotter.
+func (rt *Runtime) PrepareImage(ctx context.Context, path string, platform string) (*Image, error) {
 	tag := imageTag(path)
 
 	if err := rt.transferImage(ctx, path, tag, platform); err != nil {
 		return nil, crex.Wrap(ErrRuntime, err)
 	}
 
-	c := &Container{
-		client:   rt.client,
-		id:       id,
-		platform: platform,
-	}
-
-	// Remove any stale container from a previous build with the same ID.
-	c.remove(ctx)
-
 	image, err := rt.resolveImage(ctx, tag, platform)
 	if err != nil {
 		return nil, crex.Wrap(ErrRuntime, err)
 	}
 
-	ctr, err := c.create(ctx, image, oci.WithProcessArgs("sleep", "infinity"))
-	if err != nil {
-		return nil, crex.Wrap(ErrRuntime, err)
-	}
-
-	if err := c.startTask(ctx, ctr); err != nil {
-		ctr.Delete(ctx, containerd.WithSnapshotCleanup)
-		return nil, crex.Wrap(ErrRuntime, err)
-	}
-
-	return c, nil
+	return &Image{image: image, platform: platform, snapshotter: rt.snapshotter}, nil
 }
 
-// Pulls a remote OCI image and starts a container from it.
+// Pulls a remote OCI image and unpacks it for the target platform.
 //
 // The reference is a single-token OCI image name such as "alpine:3.21" or
 // "docker.io/library/alpine:3.21", normalized to include the default
-// registry and tag when omitted. The image is pulled into containerd's
-// content store, unpacked for the target platform, and a container with a
-// long-running task is started. Any existing container with the same ID is
-// removed before the new one is created.
-func (rt *Runtime) StartContainerFromOCI(ctx context.Context, ref string, id string, platform string) (*Container, error) {
+// registry and tag when omitted. The pull is skipped when the image is
+// already unpacked for the platform.
+func (rt *Runtime) PrepareImageFromOCI(ctx context.Context, ref string, platform string) (*Image, error) {
 	image, err := rt.pullImage(ctx, ref, platform)
 	if err != nil {
 		return nil, crex.Wrap(ErrRuntime, err)
 	}
 
+	return &Image{image: image, platform: platform, snapshotter: rt.snapshotter}, nil
+}
+
+// Starts a container from a prepared image, configured with opts.
+//
+// A container is created with a fresh snapshot and a long-running task
+// (sleep infinity) is started so that subsequent Exec calls have a running
+// process to attach to. Any existing container with the same ID is removed
+// before the new one is created.
+func (rt *Runtime) StartImage(ctx context.Context, img *Image, id string, opts ContainerOptions) (*Container, error) {
 	c := &Container{
-		client:   rt.client,
-		id:       id,
-		platform: platform,
+		client:      rt.client,
+		id:          id,
+		platform:    img.platform,
+		snapshotter: img.snapshotter,
+		remote:      rt.remote,
+		memLimit:    opts.MemoryLimit > 0,
+		compression: rt.compression,
+	}
+
+	if len(opts.Mounts) > 0 {
+		if err := c.requireLocal("bind mounts"); err != nil {
+			return nil, err
+		}
 	}
 
+	specOpts, err := opts.specOpts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove any stale container with the same ID. Orphans of earlier
+	// builds have other IDs and are removed by [Runtime.DestroyBuildContainers].
 	c.remove(ctx)
 
-	ctr, err := c.create(ctx, image, oci.WithProcessArgs("sleep", "infinity"))
+	ctr, err := c.create(ctx, img.image, opts.Labels, append(specOpts, oci.WithProcessArgs("sleep", "infinity"))...)
 	if err != nil {
 		return nil, crex.Wrap(ErrRuntime, err)
 	}
 
 	if err := c.startTask(ctx, ctr); err != nil {
-		ctr.Delete(ctx, containerd.WithSnapshotCleanup)
+		// Start fails when ctx is cancelled too, and the snapshot must not
+		// be left behind then either.
+		cleanupCtx, cancel := cleanupContext(ctx)
+		defer cancel()
+		ctr.Delete(cleanupCtx, containerd.WithSnapshotCleanup)
 		return nil, crex.Wrap(ErrRuntime, err)
 	}
 
@@ -148,6 +274,10 @@ func (rt *Runtime) StartContainerFromOCI(ctx context.Context, ref string, id str
 // correctly, including index entries whose descriptors lack explicit platform
 // metadata (as seen in some Docker Official Images).
 //
+// References to registries outside the allowlist set with
+// [Runtime.SetAllowedRegistries] fail with [ErrRegistryNotAllowed] before
+// anything is pulled or reused.
+//
 // If the image is already present and unpacked for the target platform the
 // pull is skipped, avoiding unnecessary registry requests (e.g. when
 // Docker Hub rate limits are in effect).
@@ -156,6 +286,9 @@ func (rt *Runtime) pullImage(ctx context.Context, ref string, platform string) (
 	if err != nil {
 		return nil, err
 	}
+	if err := checkRegistry(named, rt.registries); err != nil {
+		return nil, err
+	}
 	fullRef := dref.TagNameOnly(named).String()
 
 	p, err := platforms.Parse(platform)
@@ -165,7 +298,7 @@ func (rt *Runtime) pullImage(ctx context.Context, ref string, platform string) (
 
 	// Fast path: reuse an image that is already unpacked locally.
 	if img, err := rt.resolveImage(ctx, fullRef, platform); err == nil {
-		unpacked, err := img.IsUnpacked(ctx, snapshotter)
+		unpacked, err := img.IsUnpacked(ctx, rt.snapshotter)
 		if err == nil && unpacked {
 			slog.Info("image already unpacked, skipping pull", "ref", fullRef, "platform", platform)
 			return img, nil
@@ -174,21 +307,67 @@ func (rt *Runtime) pullImage(ctx context.Context, ref string, platform string) (
 
 	slog.Info("pulling image", "ref", fullRef, "platform", platform)
 
-	src, err := tregistry.NewOCIRegistry(ctx, fullRef)
+	err = withRegistryTimeout(ctx, rt.registryTimeout, fullRef, func(ctx context.Context) error {
+		src, err := rt.ociRegistry(ctx, named, fullRef)
+		if err != nil {
+			return err
+		}
+
+		dest := timage.NewStore(fullRef,
+			timage.WithPlatforms(p),
+			timage.WithUnpack(p, rt.snapshotter),
+		)
+
+		return rt.client.Transfer(ctx, src, dest, rt.transferOpts(fullRef)...)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	dest := timage.NewStore(fullRef,
-		timage.WithPlatforms(p),
-		timage.WithUnpack(p, snapshotter),
-	)
+	return rt.resolveImage(ctx, fullRef, platform)
+}
 
-	if err := rt.client.Transfer(ctx, src, dest); err != nil {
-		return nil, err
+// Checks that a normalized reference names an allowed registry.
+//
+// Matching is by exact host, ignoring case, and includes any port. An empty
+// allowlist allows every registry.
+func checkRegistry(named dref.Named, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	host := dref.Domain(named)
+	for _, a := range allowed {
+		if strings.EqualFold(host, a) {
+			return nil
+		}
 	}
+	return crex.Wrapf(ErrRegistryNotAllowed, "%s: registry %q is not in the allowlist", named, host)
+}
 
-	return rt.resolveImage(ctx, fullRef, platform)
+// Creates the transfer endpoint of a registry reference.
+//
+// The registry is contacted by containerd, which uses HTTPS unless the
+// reference's host is marked insecure. With credentials set, containerd
+// asks for them when the registry requires authentication.
+func (rt *Runtime) ociRegistry(ctx context.Context, named dref.Named, ref string) (*tregistry.OCIRegistry, error) {
+	opts := []tregistry.Opt{tregistry.WithDefaultScheme(registryScheme(named, rt.insecure))}
+	if rt.credentials != nil {
+		opts = append(opts, tregistry.WithCredentials(rt.credentials))
+	}
+	return tregistry.NewOCIRegistry(ctx, ref, opts...)
+}
+
+// Returns the URL scheme for the registry of a normalized reference:
+// "http" when its host is in insecure, compared as by [checkRegistry], and
+// "https" otherwise.
+func registryScheme(named dref.Named, insecure []string) string {
+	host := dref.Domain(named)
+	for _, h := range insecure {
+		if strings.EqualFold(host, h) {
+			return "http"
+		}
+	}
+	return "https"
 }
 
 // Transfers an OCI archive into containerd's content store server-side.
@@ -210,9 +389,9 @@ func (rt *Runtime) transferImage(ctx context.Context, path, tag, platform string
 	}
 
 	src := archive.NewImageImportStream(fh, "")
-	dest := timage.NewStore(tag, timage.WithUnpack(p, snapshotter))
+	dest := timage.NewStore(tag, timage.WithUnpack(p, rt.snapshotter))
 
-	return rt.client.Transfer(ctx, src, dest)
+	return rt.client.Transfer(ctx, src, dest, rt.transferOpts(path)...)
 }
 
 // Looks up a tagged image and selects the manifest for the given platform.
@@ -243,72 +422,231 @@ func imageTag(path string) string {
 	return fmt.Sprintf("import/%s:latest", hex.EncodeToString(h[:]))
 }
 
-// Returns the default OCI platform for the host architecture.
-func defaultPlatform() string {
+// Returns the default OCI platform for the host architecture, which builds
+// and run commands use when neither the request nor the daemon names one.
+func DefaultPlatform() string {
 	return "linux/" + goruntime.GOARCH
 }
 
+// What an image operation did.
+type ImageAction string
+
+const (
+	ImageImported ImageAction = "imported" // The archive was stored under the tag.
+	ImageReused   ImageAction = "reused"   // The tag or container was already in the requested state.
+	ImageStarted  ImageAction = "started"  // A task was started on an existing, stopped container.
+	ImageCreated  ImageAction = "created"  // A new container was created and started.
+	ImageReplaced ImageAction = "replaced" // An existing container was removed and a new one created and started.
+	ImageDeleted  ImageAction = "deleted"  // The image and its containers were removed.
+	ImageAbsent   ImageAction = "absent"   // There was no image to remove.
+)
+
+// Describes the outcome of importing, starting, or destroying an image.
+type ImageResult struct {
+	Digest     string      // Digest of the image's root descriptor. Empty when the image is absent.
+	Action     ImageAction // What the operation did.
+	Containers int         // Number of containers removed with the image.
+}
+
+// Returns the digest of a tagged image, or an empty string if the tag does
+// not exist.
+func (rt *Runtime) imageDigest(ctx context.Context, tag string) (string, error) {
+	img, err := rt.client.ImageService().Get(ctx, tag)
+	if errdefs.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return img.Target.Digest.String(), nil
+}
+
+// Returns the action of an import that moved a tag from the before digest
+// to the after digest. Re-importing the image a tag already points at is
+// reported as a reuse.
+func importAction(before, after string) ImageAction {
+	if before != "" && before == after {
+		return ImageReused
+	}
+	return ImageImported
+}
+
 // Imports an OCI archive, tags it under the given name, and unpacks it for
 // the host platform.
 //
 // The archive is transferred server-side into containerd's content store,
 // tagged with the provided name, and the layers are unpacked into the
-// snapshotter.
-func (rt *Runtime) ImportImage(ctx context.Context, path, tag string) error {
-	platform := defaultPlatform()
+// snapshotter. The result carries the digest the tag points at afterwards.
+func (rt *Runtime) ImportImage(ctx context.Context, path, tag string) (*ImageResult, error) {
+	before, err := rt.imageDigest(ctx, tag)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	platform := DefaultPlatform()
 	if err := rt.transferImage(ctx, path, tag, platform); err != nil {
-		return crex.Wrap(ErrRuntime, err)
+		return nil, crex.Wrap(ErrRuntime, err)
 	}
-	return nil
+
+	after, err := rt.imageDigest(ctx, tag)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	return &ImageResult{Digest: after, Action: importAction(before, after)}, nil
+}
+
+// Reports whether an image tag exists and is unpacked for the host platform.
+//
+// This is the same lookup [Runtime.StartFromTag] performs, so a missing or
+// packed image here explains why starting from the tag fails. A tag that is
+// not found is reported as absent rather than as an error.
+func (rt *Runtime) ImageStatus(ctx context.Context, tag string) (present, unpacked bool, err error) {
+	img, err := rt.resolveImage(ctx, tag, DefaultPlatform())
+	if errdefs.IsNotFound(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, crex.Wrap(ErrRuntime, err)
+	}
+
+	unpacked, err = img.IsUnpacked(ctx, rt.snapshotter)
+	if err != nil {
+		return true, false, crex.Wrap(ErrRuntime, err)
+	}
+	return true, unpacked, nil
+}
+
+// Settings for [Runtime.StartFromTag].
+type StartOptions struct {
+	Hostname  string          // Hostname of a newly created container. Empty keeps containerd's default.
+	Recreate  bool            // Replace an existing container even when it runs the requested image.
+	Readiness *ReadinessProbe // Check the service must pass before the start succeeds. Nil reports success once the task starts.
 }
 
 // Starts a container from a previously imported image tag.
 //
-// The operation is idempotent: if the container is already running it is
-// left untouched; if the container exists but has no active task a new
-// task is started on the existing snapshot; otherwise a new container is
-// created from the image.
-func (rt *Runtime) StartFromTag(ctx context.Context, tag, id string) (*Container, error) {
-	platform := defaultPlatform()
+// The operation is idempotent: if the container is already running the
+// image tag it is left untouched; if it exists with that tag but has no
+// active task a new task is started on the existing snapshot; otherwise a
+// new container is created from the image. A container created from a
+// different tag, or any existing container when opts.Recreate is set, is
+// removed and replaced. The result reports which of these happened and
+// the digest of the image the container runs. The hostname is set only on
+// a newly created container.
+//
+// With a readiness probe the call returns only once the probe passes, and
+// fails with [ErrNotReady] when it does not pass in time. A reused
+// container is probed as well.
+func (rt *Runtime) StartFromTag(ctx context.Context, tag, id string, opts StartOptions) (*Container, *ImageResult, error) {
+	if err := validateHostname(opts.Hostname); err != nil {
+		return nil, nil, err
+	}
+	if err := opts.Readiness.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	c, res, err := rt.startFromTag(ctx, tag, id, opts)
+	if err != nil || opts.Readiness == nil {
+		return c, res, err
+	}
+	if err := c.waitReady(ctx, opts.Readiness); err != nil {
+		return nil, nil, err
+	}
+	return c, res, nil
+}
+
+// Brings up the container for [Runtime.StartFromTag], without waiting for
+// it to become ready.
+func (rt *Runtime) startFromTag(ctx context.Context, tag, id string, opts StartOptions) (*Container, *ImageResult, error) {
+	platform := DefaultPlatform()
 
 	c := &Container{
-		client:   rt.client,
-		id:       id,
-		platform: platform,
+		client:      rt.client,
+		id:          id,
+		platform:    platform,
+		snapshotter: rt.snapshotter,
+		remote:      rt.remote,
+		compression: rt.compression,
 	}
 
 	status, err := c.Status(ctx)
 	if err != nil {
-		return nil, crex.Wrap(ErrRuntime, err)
+		return nil, nil, crex.Wrap(ErrRuntime, err)
 	}
 
-	switch status {
-	case protocol.ContainerRunning:
-		return c, nil
+	var current string
+	if status != protocol.ContainerNotCreated {
+		if current, err = c.imageName(ctx); err != nil {
+			return nil, nil, crex.Wrap(ErrRuntime, err)
+		}
+	}
+
+	action := startAction(status, current, tag, opts.Recreate)
+	if action == ImageReplaced {
+		slog.Info("replacing container", "id", id, "image", current, "tag", tag)
+		c.remove(ctx)
+	}
 
-	case protocol.ContainerStopped:
+	switch action {
+	case ImageReused:
+		digest, err := c.imageDigest(ctx)
+		if err != nil {
+			return nil, nil, crex.Wrap(ErrRuntime, err)
+		}
+		return c, &ImageResult{Digest: digest, Action: ImageReused}, nil
+
+	case ImageStarted:
 		if err := c.Start(ctx); err != nil {
-			return nil, crex.Wrap(ErrRuntime, err)
+			return nil, nil, crex.Wrap(ErrRuntime, err)
+		}
+		digest, err := c.imageDigest(ctx)
+		if err != nil {
+			return nil, nil, crex.Wrap(ErrRuntime, err)
 		}
-		return c, nil
+		return c, &ImageResult{Digest: digest, Action: ImageStarted}, nil
 
 	default:
 		image, err := rt.resolveImage(ctx, tag, platform)
 		if err != nil {
-			return nil, crex.Wrap(ErrRuntime, err)
+			return nil, nil, crex.Wrap(ErrRuntime, err)
+		}
+
+		var specOpts []oci.SpecOpts
+		if opts.Hostname != "" {
+			specOpts = append(specOpts, oci.WithHostname(opts.Hostname))
 		}
 
-		ctr, err := c.create(ctx, image)
+		ctr, err := c.create(ctx, image, nil, specOpts...)
 		if err != nil {
-			return nil, crex.Wrap(ErrRuntime, err)
+			return nil, nil, crex.Wrap(ErrRuntime, err)
 		}
 
 		if err := c.startTask(ctx, ctr); err != nil {
 			ctr.Delete(ctx, containerd.WithSnapshotCleanup)
-			return nil, crex.Wrap(ErrRuntime, err)
+			return nil, nil, crex.Wrap(ErrRuntime, err)
 		}
 
-		return c, nil
+		return c, &ImageResult{Digest: image.Target().Digest.String(), Action: action}, nil
+	}
+}
+
+// Decides how [Runtime.StartFromTag] brings up a container.
+//
+// The status and image are those of the existing container, if any. The
+// result is [ImageReused] for a running container of the tag,
+// [ImageStarted] for a stopped one, [ImageCreated] when there is no
+// container, and [ImageReplaced] when the container must be removed first.
+func startAction(status protocol.ContainerState, image, tag string, recreate bool) ImageAction {
+	switch {
+	case status == protocol.ContainerNotCreated:
+		return ImageCreated
+	case recreate || image != tag:
+		return ImageReplaced
+	case status == protocol.ContainerRunning:
+		return ImageReused
+	default:
+		return ImageStarted
 	}
 }
 
@@ -316,27 +654,136 @@ func (rt *Runtime) StartFromTag(ctx context.Context, tag, id string) (*Container
 //
 // Containers are discovered by querying containerd for records whose image
 // field matches the tag. Each container's task is killed before the container
-// and its snapshot are deleted.
-func (rt *Runtime) DestroyImage(ctx context.Context, tag string) error {
+// and its snapshot are deleted. Destroying a tag that does not exist is not
+// an error; the result reports it as [ImageAbsent].
+func (rt *Runtime) DestroyImage(ctx context.Context, tag string) (*ImageResult, error) {
+	digest, err := rt.imageDigest(ctx, tag)
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
 	ctrs, err := rt.client.Containers(ctx, fmt.Sprintf("image==%s", tag))
 	if err != nil {
-		return crex.Wrap(ErrRuntime, err)
+		return nil, crex.Wrap(ErrRuntime, err)
 	}
 
 	for _, ctr := range ctrs {
-		if task, taskErr := ctr.Task(ctx, nil); taskErr == nil {
-			task.Kill(ctx, syscall.SIGKILL)
-			task.Delete(ctx, containerd.WithProcessKill)
-		}
-		if err := ctr.Delete(ctx, containerd.WithSnapshotCleanup); err != nil && !errdefs.IsNotFound(err) {
-			return crex.Wrap(ErrRuntime, err)
+		if err := deleteContainer(ctx, ctr); err != nil {
+			return nil, crex.Wrap(ErrRuntime, err)
 		}
 	}
 
 	if err := rt.client.ImageService().Delete(ctx, tag); err != nil && !errdefs.IsNotFound(err) {
-		return crex.Wrap(ErrRuntime, err)
+		return nil, crex.Wrap(ErrRuntime, err)
 	}
 
+	result := &ImageResult{Digest: digest, Action: ImageDeleted, Containers: len(ctrs)}
+	if digest == "" && len(ctrs) == 0 {
+		result.Action = ImageAbsent
+	}
+	return result, nil
+}
+
+// Removes every daemon-created container whose ID starts with prefix.
+//
+// The prefix is matched on whole hyphen-separated parts of the ID, the way
+// build containers are named from their resource and platform: "my-app"
+// matches "my-app" and "my-app-linux-amd64-stage-1" but not
+// "my-app2-linux-amd64-stage-1". Only containers carrying the daemon's
+// label are considered, so containers created by other tools in the same
+// namespace, or by daemons predating the label, are never touched. Each
+// container's task is killed before the container and its snapshot are
+// deleted. Returns the IDs of the destroyed containers.
+func (rt *Runtime) DestroyByPrefix(ctx context.Context, prefix string) ([]string, error) {
+	prefix = strings.TrimSuffix(prefix, "-")
+	if prefix == "" {
+		return nil, crex.Wrapf(ErrRuntime, "empty container prefix")
+	}
+
+	ctrs, err := rt.client.Containers(ctx, fmt.Sprintf("labels.%q==true", managedLabel))
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	var destroyed []string
+	for _, ctr := range ctrs {
+		if !hasIDPrefix(ctr.ID(), prefix) {
+			continue
+		}
+		if err := deleteContainer(ctx, ctr); err != nil {
+			return destroyed, crex.Wrapf(ErrRuntime, "container %s: %w", ctr.ID(), err)
+		}
+		destroyed = append(destroyed, ctr.ID())
+	}
+	return destroyed, nil
+}
+
+// Destroys the stage containers of every build the given daemon ran, and
+// returns the IDs of the destroyed containers.
+//
+// Stage container IDs end with their build's ID, so a container orphaned
+// by a daemon that stopped mid-build never collides with a later build's
+// and is never replaced. Called before the daemon starts any build, this
+// removes such orphans by [BuildLabel] rather than by ID. Only containers
+// whose [DaemonLabel] names daemon are removed, and of those not the ones
+// left paused at a breakpoint (see [Container.MarkPaused]).
+func (rt *Runtime) DestroyBuildContainers(ctx context.Context, daemon string) ([]string, error) {
+	ctrs, err := rt.client.Containers(ctx, fmt.Sprintf("labels.%q", BuildLabel))
+	if err != nil {
+		return nil, crex.Wrap(ErrRuntime, err)
+	}
+
+	var destroyed []string
+	for _, ctr := range ctrs {
+		labels, err := ctr.Labels(ctx)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return destroyed, crex.Wrapf(ErrRuntime, "container %s: %w", ctr.ID(), err)
+		}
+		if !orphanedBuild(labels, daemon) {
+			continue
+		}
+		if err := deleteContainer(ctx, ctr); err != nil {
+			return destroyed, crex.Wrapf(ErrRuntime, "container %s: %w", ctr.ID(), err)
+		}
+		destroyed = append(destroyed, ctr.ID())
+	}
+	return destroyed, nil
+}
+
+// Reports whether a container with the given labels is a stage container
+// of a build daemon ran that nobody owns any more. Containers without a
+// [DaemonLabel] belong to no daemon in particular and are kept.
+func orphanedBuild(labels map[string]string, daemon string) bool {
+	if _, ok := labels[BuildLabel]; !ok {
+		return false
+	}
+	if owner, ok := labels[DaemonLabel]; !ok || owner != daemon {
+		return false
+	}
+	_, paused := labels[pausedLabel]
+	return !paused
+}
+
+// Reports whether a container ID is prefix itself or continues it with a
+// hyphen.
+func hasIDPrefix(id, prefix string) bool {
+	rest, ok := strings.CutPrefix(id, prefix)
+	return ok && (rest == "" || strings.HasPrefix(rest, "-"))
+}
+
+// Kills a container's task, if any, and deletes the container with its
+// snapshot. A container that is already gone is not an error.
+func deleteContainer(ctx context.Context, ctr containerd.Container) error {
+	if task, err := ctr.Task(ctx, nil); err == nil {
+		task.Kill(ctx, syscall.SIGKILL)
+		task.Delete(ctx, containerd.WithProcessKill)
+	}
+	if err := ctr.Delete(ctx, containerd.WithSnapshotCleanup); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
 	return nil
 }
 
@@ -346,8 +793,10 @@ func (rt *Runtime) DestroyImage(ctx context.Context, tag string) error {
 // reference that resolves the container lazily on subsequent calls.
 func (rt *Runtime) Container(id string) *Container {
 	return &Container{
-		client:   rt.client,
-		id:       id,
-		platform: defaultPlatform(),
+		client:      rt.client,
+		id:          id,
+		platform:    DefaultPlatform(),
+		remote:      rt.remote,
+		compression: rt.compression,
 	}
 }
@@ -1,8 +1,14 @@
 package runtime
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/containerd/errdefs"
+	"github.com/cruciblehq/spec/protocol"
+	dref "github.com/distribution/reference"
 )
 
 func TestImageTag(t *testing.T) {
@@ -25,12 +31,207 @@ func TestImageTag(t *testing.T) {
 }
 
 func TestDefaultPlatform(t *testing.T) {
-	p := defaultPlatform()
+	p := DefaultPlatform()
 	if !strings.HasPrefix(p, "linux/") {
-		t.Fatalf("defaultPlatform = %q, want linux/<arch>", p)
+		t.Fatalf("DefaultPlatform() = %q, want linux/<arch>", p)
 	}
 	parts := strings.Split(p, "/")
 	if len(parts) != 2 || parts[1] == "" {
-		t.Fatalf("defaultPlatform = %q, want linux/<arch>", p)
+		t.Fatalf("DefaultPlatform() = %q, want linux/<arch>", p)
+	}
+}
+
+func TestCheckRegistry(t *testing.T) {
+	allowed := []string{"docker.io", "ghcr.io", "registry.internal:5000"}
+
+	tests := []struct {
+		ref     string
+		allowed []string
+		wantErr bool
+	}{
+		{ref: "alpine:3.21", allowed: allowed},
+		{ref: "library/alpine", allowed: allowed},
+		{ref: "docker.io/library/alpine:3.21", allowed: allowed},
+		{ref: "ghcr.io/cruciblehq/runtime-go:1.0", allowed: allowed},
+		{ref: "GHCR.io/cruciblehq/runtime-go:1.0", allowed: allowed},
+		{ref: "registry.internal:5000/base:1", allowed: allowed},
+		{ref: "registry.internal/base:1", allowed: allowed, wantErr: true},
+		{ref: "quay.io/prometheus/busybox", allowed: allowed, wantErr: true},
+		{ref: "ghcr.io.evil.example/base", allowed: allowed, wantErr: true},
+		{ref: "quay.io/prometheus/busybox"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			named, err := dref.ParseNormalizedNamed(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkRegistry(named, tt.allowed)
+			if tt.wantErr && !errors.Is(err, ErrRegistryNotAllowed) {
+				t.Fatalf("expected ErrRegistryNotAllowed, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRegistryScheme(t *testing.T) {
+	insecure := []string{"registry.lan:5000", "mirror.lan"}
+
+	tests := []struct {
+		ref      string
+		insecure []string
+		want     string
+	}{
+		{ref: "registry.lan:5000/base:1", insecure: insecure, want: "http"},
+		{ref: "REGISTRY.lan:5000/base:1", insecure: insecure, want: "http"},
+		{ref: "mirror.lan/tools/go:1.24", insecure: insecure, want: "http"},
+		{ref: "registry.lan/base:1", insecure: insecure, want: "https"},
+		{ref: "registry.lan:5001/base:1", insecure: insecure, want: "https"},
+		{ref: "ghcr.io/cruciblehq/runtime-go:1.0", insecure: insecure, want: "https"},
+		{ref: "alpine:3.21", insecure: insecure, want: "https"},
+		{ref: "docker.io/library/alpine:3.21", insecure: insecure, want: "https"},
+		{ref: "registry.lan:5000/base:1", want: "https"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			named, err := dref.ParseNormalizedNamed(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := registryScheme(named, tt.insecure); got != tt.want {
+				t.Errorf("registryScheme(%q) = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportAction(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		want          ImageAction
+	}{
+		{name: "new tag", after: "sha256:aaa", want: ImageImported},
+		{name: "same image", before: "sha256:aaa", after: "sha256:aaa", want: ImageReused},
+		{name: "retagged", before: "sha256:aaa", after: "sha256:bbb", want: ImageImported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := importAction(tt.before, tt.after); got != tt.want {
+				t.Errorf("importAction(%q, %q) = %q, want %q", tt.before, tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExistence(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		want    bool
+		wantErr bool
+	}{
+		{name: "exists", want: true},
+		{name: "not found", err: fmt.Errorf("container \"build-1\": %w", errdefs.ErrNotFound)},
+		{name: "lookup failed", err: errdefs.ErrUnavailable, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := existence(tt.err)
+			if tt.wantErr {
+				if !errors.Is(err, ErrRuntime) {
+					t.Fatalf("expected ErrRuntime, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("existence(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasIDPrefix(t *testing.T) {
+	tests := []struct {
+		id     string
+		prefix string
+		want   bool
+	}{
+		{id: "my-app-linux-amd64-stage-1", prefix: "my-app", want: true},
+		{id: "my-app-linux-amd64-stage-build", prefix: "my-app-linux-amd64", want: true},
+		{id: "my-app", prefix: "my-app", want: true},
+		{id: "my-app2-linux-amd64-stage-1", prefix: "my-app", want: false},
+		{id: "my-app-linux-arm64-stage-1", prefix: "my-app-linux-amd64", want: false},
+		{id: "other-my-app-linux-amd64-stage-1", prefix: "my-app", want: false},
+		{id: "my", prefix: "my-app", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id+"/"+tt.prefix, func(t *testing.T) {
+			if got := hasIDPrefix(tt.id, tt.prefix); got != tt.want {
+				t.Errorf("hasIDPrefix(%q, %q) = %v, want %v", tt.id, tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrphanedBuild(t *testing.T) {
+	const daemon = "/run/cruxd/cruxd.sock"
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   bool
+	}{
+		{"own build", map[string]string{BuildLabel: "b1", DaemonLabel: daemon}, true},
+		{"other daemon", map[string]string{BuildLabel: "b1", DaemonLabel: "/tmp/cruxd.sock"}, false},
+		{"no daemon", map[string]string{BuildLabel: "b1"}, false},
+		{"paused", map[string]string{BuildLabel: "b1", DaemonLabel: daemon, pausedLabel: "true"}, false},
+		{"not a build", map[string]string{DaemonLabel: daemon, managedLabel: "true"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orphanedBuild(tt.labels, daemon); got != tt.want {
+				t.Errorf("orphanedBuild(%v) = %v, want %v", tt.labels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartAction(t *testing.T) {
+	const tag = "registry.example.com/app:1.2.0"
+
+	tests := []struct {
+		name     string
+		status   protocol.ContainerState
+		image    string
+		recreate bool
+		want     ImageAction
+	}{
+		{name: "no container", status: protocol.ContainerNotCreated, want: ImageCreated},
+		{name: "no container with recreate", status: protocol.ContainerNotCreated, recreate: true, want: ImageCreated},
+		{name: "running same image", status: protocol.ContainerRunning, image: tag, want: ImageReused},
+		{name: "stopped same image", status: protocol.ContainerStopped, image: tag, want: ImageStarted},
+		{name: "running other image", status: protocol.ContainerRunning, image: "registry.example.com/app:1.1.0", want: ImageReplaced},
+		{name: "stopped other image", status: protocol.ContainerStopped, image: "registry.example.com/app:1.1.0", want: ImageReplaced},
+		{name: "running same image with recreate", status: protocol.ContainerRunning, image: tag, recreate: true, want: ImageReplaced},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := startAction(tt.status, tt.image, tag, tt.recreate); got != tt.want {
+				t.Errorf("startAction() = %q, want %q", got, tt.want)
+			}
+		})
 	}
 }
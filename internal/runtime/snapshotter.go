@@ -0,0 +1,50 @@
+package runtime
+
+import (
+	"context"
+	"slices"
+
+	"github.com/containerd/containerd/v2/plugins"
+	"github.com/cruciblehq/crex"
+)
+
+// Returns a runtime that unpacks images into and creates containers with
+// the named snapshotter, sharing the containerd connection and settings of
+// rt.
+//
+// The name is not checked; use [Runtime.CheckSnapshotter] first. Images
+// prepared by the returned runtime start containers on the same
+// snapshotter regardless of which runtime starts them.
+func (rt *Runtime) WithSnapshotter(name string) *Runtime {
+	view := *rt
+	view.snapshotter = name
+	return &view
+}
+
+// Checks that containerd has a snapshotter plugin with the given name that
+// initialized successfully.
+//
+// Fails with [ErrSnapshotterNotFound] otherwise, which lets a build that
+// asks for a missing snapshotter be rejected before any image is pulled.
+func (rt *Runtime) CheckSnapshotter(ctx context.Context, name string) error {
+	resp, err := rt.client.IntrospectionService().Plugins(ctx, "type=="+string(plugins.SnapshotPlugin))
+	if err != nil {
+		return crex.Wrap(ErrRuntime, err)
+	}
+
+	var available []string
+	for _, p := range resp.Plugins {
+		if p.InitErr == nil {
+			available = append(available, p.ID)
+		}
+	}
+	return checkSnapshotter(name, available)
+}
+
+// Checks that name is one of the available snapshotters.
+func checkSnapshotter(name string, available []string) error {
+	if slices.Contains(available, name) {
+		return nil
+	}
+	return crex.Wrapf(ErrSnapshotterNotFound, "snapshotter %q is not available, have %v", name, available)
+}
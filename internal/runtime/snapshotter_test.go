@@ -0,0 +1,46 @@
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckSnapshotter(t *testing.T) {
+	available := []string{"native", "overlayfs"}
+
+	tests := []struct {
+		name      string
+		available []string
+		wantErr   bool
+	}{
+		{name: "overlayfs", available: available},
+		{name: "native", available: available},
+		{name: "zfs", available: available, wantErr: true},
+		{name: "Overlayfs", available: available, wantErr: true},
+		{name: "overlayfs", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSnapshotter(tt.name, tt.available)
+			if tt.wantErr && !errors.Is(err, ErrSnapshotterNotFound) {
+				t.Fatalf("expected ErrSnapshotterNotFound, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWithSnapshotter(t *testing.T) {
+	rt := &Runtime{remote: true, snapshotter: defaultSnapshotter}
+
+	view := rt.WithSnapshotter("native")
+	if view.Snapshotter() != "native" || !view.Remote() {
+		t.Errorf("view = %+v", view)
+	}
+	if rt.Snapshotter() != defaultSnapshotter {
+		t.Errorf("original snapshotter changed to %q", rt.Snapshotter())
+	}
+}
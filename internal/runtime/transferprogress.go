@@ -0,0 +1,71 @@
+package runtime
+
+import (
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/transfer"
+)
+
+// Shortest time between two reports of the same transfer item, unless
+// what is happening to it changes.
+const transferProgressInterval = 500 * time.Millisecond
+
+// Progress of one item of an image pull or import, such as a layer being
+// downloaded.
+type TransferProgress struct {
+	Image   string // Reference or archive path of the image being transferred.
+	Item    string // Item being transferred, such as a layer digest.
+	Event   string // What is happening to the item, such as "downloading" or "complete".
+	Current int64  // Bytes of the item transferred so far.
+	Total   int64  // Size of the item in bytes. Zero when unknown.
+}
+
+// Receives the progress of image transfers. It is called from containerd's
+// progress stream and must return quickly.
+type TransferProgressFunc func(TransferProgress)
+
+// Returns a runtime that reports the progress of the image pulls and
+// imports it makes to fn, sharing the containerd connection and settings of
+// rt. Updates about the same item are reported at most every
+// [transferProgressInterval] while nothing but the byte count changes.
+func (rt *Runtime) WithTransferProgress(fn TransferProgressFunc) *Runtime {
+	view := *rt
+	view.progress = fn
+	return &view
+}
+
+// Returns the options of a transfer of the named image, which report its
+// progress when the runtime has a progress function.
+func (rt *Runtime) transferOpts(image string) []transfer.Opt {
+	if rt.progress == nil {
+		return nil
+	}
+	return []transfer.Opt{transfer.WithProgress(throttleProgress(image, rt.progress, transferProgressInterval))}
+}
+
+// Adapts containerd's progress updates to fn, dropping the updates of an
+// item that arrive within interval of its last report and change only its
+// byte count.
+func throttleProgress(image string, fn TransferProgressFunc, interval time.Duration) transfer.ProgressFunc {
+	type report struct {
+		event string
+		at    time.Time
+	}
+	var mu sync.Mutex
+	last := make(map[string]report)
+
+	return func(p transfer.Progress) {
+		mu.Lock()
+		prev, seen := last[p.Name]
+		now := time.Now()
+		if seen && prev.event == p.Event && now.Sub(prev.at) < interval {
+			mu.Unlock()
+			return
+		}
+		last[p.Name] = report{event: p.Event, at: now}
+		mu.Unlock()
+
+		fn(TransferProgress{Image: image, Item: p.Name, Event: p.Event, Current: p.Progress, Total: p.Total})
+	}
+}
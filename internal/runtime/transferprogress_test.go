@@ -0,0 +1,54 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/transfer"
+)
+
+func TestThrottleProgress(t *testing.T) {
+	var got []TransferProgress
+	progress := throttleProgress("alpine:3.21", func(p TransferProgress) { got = append(got, p) }, time.Hour)
+
+	progress(transfer.Progress{Event: "downloading", Name: "sha256:layer1", Progress: 10, Total: 100})
+	progress(transfer.Progress{Event: "downloading", Name: "sha256:layer1", Progress: 50, Total: 100})
+	progress(transfer.Progress{Event: "downloading", Name: "sha256:layer2", Progress: 5, Total: 200})
+	progress(transfer.Progress{Event: "complete", Name: "sha256:layer1", Progress: 100, Total: 100})
+
+	want := []TransferProgress{
+		{Image: "alpine:3.21", Item: "sha256:layer1", Event: "downloading", Current: 10, Total: 100},
+		{Image: "alpine:3.21", Item: "sha256:layer2", Event: "downloading", Current: 5, Total: 200},
+		{Image: "alpine:3.21", Item: "sha256:layer1", Event: "complete", Current: 100, Total: 100},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("reports = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("report %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	unthrottled := throttleProgress("alpine:3.21", func(p TransferProgress) { got = append(got, p) }, 0)
+	got = nil
+	unthrottled(transfer.Progress{Event: "downloading", Name: "sha256:layer1", Progress: 10})
+	unthrottled(transfer.Progress{Event: "downloading", Name: "sha256:layer1", Progress: 20})
+	if len(got) != 2 {
+		t.Errorf("reports without interval = %d, want 2", len(got))
+	}
+}
+
+func TestTransferOpts(t *testing.T) {
+	rt := &Runtime{}
+	if opts := rt.transferOpts("alpine:3.21"); opts != nil {
+		t.Errorf("options without progress = %v", opts)
+	}
+	view := rt.WithTransferProgress(func(TransferProgress) {})
+	if opts := view.transferOpts("alpine:3.21"); len(opts) != 1 {
+		t.Errorf("options with progress = %d, want 1", len(opts))
+	}
+	if rt.progress != nil {
+		t.Error("WithTransferProgress modified the original runtime")
+	}
+}
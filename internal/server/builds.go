@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/build"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+const (
+
+	// Number of recent events kept per build for clients that attach late.
+	buildEventBacklog = 256
+
+	// Number of events buffered for each attached client. A client that
+	// falls further behind misses events, which it can detect from gaps in
+	// [buildEvent.Seq].
+	buildEventBuffer = 64
+
+	// How long a finished build can still be attached to for its result.
+	finishedBuildRetention = 5 * time.Minute
+)
+
+// Progress of one build, fanned out to every attached client.
+//
+// The feed keeps a bounded backlog of recent events so that a client that
+// attaches while the build runs first sees what it missed. Once the build
+// finishes the feed holds its final response, which attached clients
+// receive after the last event.
+type buildFeed struct {
+	id       string                       // Build ID.
+	cancel   context.CancelCauseFunc      // Cancels the build's context. Nil for feeds that cannot be canceled.
+	finished chan struct{}                // Closed when the build finishes.
+	mu       sync.Mutex                   // Protects the fields below.
+	seq      int                          // Sequence number of the last event.
+	events   []buildEvent                 // Most recent events, oldest first.
+	subs     map[chan buildEvent]struct{} // Channels of attached clients.
+	done     bool                         // Whether the build has finished.
+	cmd      protocol.Command             // Command of the final response.
+	result   any                          // Payload of the final response.
+}
+
+// Creates an empty feed for a build, whose context cancel cancels. A nil
+// cancel makes the build impossible to cancel through the feed.
+func newBuildFeed(id string, cancel context.CancelCauseFunc) *buildFeed {
+	return &buildFeed{
+		id:       id,
+		cancel:   cancel,
+		finished: make(chan struct{}),
+		subs:     make(map[chan buildEvent]struct{}),
+	}
+}
+
+// Records an event and sends it to every attached client.
+//
+// Clients whose buffer is full miss the event rather than slowing the build
+// down.
+func (f *buildFeed) publish(ev build.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	msg := buildEvent{
+		ID:       f.id,
+		Seq:      f.seq,
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Kind:     string(ev.Kind),
+		Platform: ev.Platform,
+		Stage:    ev.Stage,
+		Message:  ev.Message,
+		Stream:   ev.Stream,
+		Current:  ev.Current,
+		Total:    ev.Total,
+	}
+
+	f.events = append(f.events, msg)
+	if len(f.events) > buildEventBacklog {
+		f.events = f.events[len(f.events)-buildEventBacklog:]
+	}
+
+	for ch := range f.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// Records the build's final response and detaches every client.
+func (f *buildFeed) finish(cmd protocol.Command, result any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.done = true
+	f.cmd = cmd
+	f.result = result
+	for ch := range f.subs {
+		close(ch)
+		delete(f.subs, ch)
+	}
+	close(f.finished)
+}
+
+// Cancels the build with cause, which the build's error is classified by.
+//
+// Returns false when the build has already finished, or cannot be canceled.
+func (f *buildFeed) abort(cause error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done || f.cancel == nil {
+		return false
+	}
+	f.cancel(cause)
+	return true
+}
+
+// Attaches a client to the feed.
+//
+// Returns the backlog of events so far and a channel receiving the events
+// that follow, which is closed when the build finishes. The returned
+// function detaches the client early.
+func (f *buildFeed) subscribe() ([]buildEvent, <-chan buildEvent, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	backlog := append([]buildEvent(nil), f.events...)
+	ch := make(chan buildEvent, buildEventBuffer)
+	if f.done {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+
+	f.subs[ch] = struct{}{}
+	unsubscribe := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, unsubscribe
+}
+
+// Returns the final response, or false while the build is running.
+func (f *buildFeed) response() (protocol.Command, any, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cmd, f.result, f.done
+}
+
+// Streams a build's events to a client and ends with its final response.
+//
+// Starts with the backlog, then forwards events until the build finishes
+// or ctx is cancelled. A cancelled ctx, such as a client disconnect, only
+// detaches the client; the build keeps running.
+func (s *Server) streamBuild(ctx context.Context, conn net.Conn, feed *buildFeed) {
+	backlog, events, unsubscribe := feed.subscribe()
+	defer unsubscribe()
+
+	for _, ev := range backlog {
+		s.respond(conn, cmdBuildEvent, &ev)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				if cmd, result, done := feed.response(); done {
+					s.respond(conn, cmd, result)
+				}
+				return
+			}
+			s.respond(conn, cmdBuildEvent, &ev)
+		}
+	}
+}
+
+// Registers the feed of a new build.
+//
+// Fails with [ErrDraining] while the daemon is draining. The check is made
+// under the same lock as [Server.drain], so a build either registers before
+// the drain and is canceled by it, or is refused.
+func (s *Server) registerBuild(feed *buildFeed) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return crex.Wrapf(ErrDraining, "build %s refused", feed.id)
+	}
+	if s.feeds == nil {
+		s.feeds = make(map[string]*buildFeed)
+	}
+	s.feeds[feed.id] = feed
+	return nil
+}
+
+// Stops accepting new builds and returns the feeds of the builds still
+// running.
+func (s *Server) drain() []*buildFeed {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+
+	var running []*buildFeed
+	for _, feed := range s.feeds {
+		if _, _, done := feed.response(); !done {
+			running = append(running, feed)
+		}
+	}
+	return running
+}
+
+// Returns the feed of a running or recently finished build.
+func (s *Server) buildFeed(id string) (*buildFeed, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	feed, ok := s.feeds[id]
+	return feed, ok
+}
+
+// Completes a build's feed and forgets it once the retention period ends.
+func (s *Server) finishBuild(feed *buildFeed, cmd protocol.Command, result any) {
+	feed.finish(cmd, result)
+	time.AfterFunc(finishedBuildRetention, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.feeds, feed.id)
+	})
+}
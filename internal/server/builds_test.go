@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/build"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+func TestBuildFeedBacklog(t *testing.T) {
+	feed := newBuildFeed("build-test", nil)
+	for range buildEventBacklog + 10 {
+		feed.publish(build.Event{Kind: build.EventStep})
+	}
+
+	backlog, _, unsubscribe := feed.subscribe()
+	defer unsubscribe()
+
+	if len(backlog) != buildEventBacklog {
+		t.Fatalf("backlog has %d events, want %d", len(backlog), buildEventBacklog)
+	}
+	if backlog[0].Seq != 11 {
+		t.Errorf("oldest event seq = %d, want 11", backlog[0].Seq)
+	}
+	if last := backlog[len(backlog)-1]; last.Seq != buildEventBacklog+10 || last.ID != "build-test" {
+		t.Errorf("newest event = %+v", last)
+	}
+}
+
+func TestBuildFeedFinish(t *testing.T) {
+	feed := newBuildFeed("build-test", nil)
+	_, events, unsubscribe := feed.subscribe()
+	defer unsubscribe()
+
+	feed.publish(build.Event{Kind: build.EventStage, Stage: "build"})
+	if ev := <-events; ev.Kind != string(build.EventStage) || ev.Stage != "build" || ev.Seq != 1 {
+		t.Errorf("event = %+v", ev)
+	}
+
+	if _, _, done := feed.response(); done {
+		t.Fatal("response available before finish")
+	}
+	feed.finish(protocol.CmdOK, &buildResult{ID: "build-test"})
+	if _, ok := <-events; ok {
+		t.Error("channel still open after finish")
+	}
+	cmd, result, done := feed.response()
+	if !done || cmd != protocol.CmdOK || result.(*buildResult).ID != "build-test" {
+		t.Errorf("response = %q, %+v, %v", cmd, result, done)
+	}
+
+	backlog, late, _ := feed.subscribe()
+	if len(backlog) != 1 {
+		t.Errorf("late backlog has %d events, want 1", len(backlog))
+	}
+	if _, ok := <-late; ok {
+		t.Error("late subscriber channel is open")
+	}
+}
+
+func TestStreamBuild(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	feed := newBuildFeed("build-test", nil)
+	feed.publish(build.Event{Kind: buildStarted})
+
+	s := &Server{}
+	go func() {
+		feed.publish(build.Event{Kind: build.EventStep, Message: "run make"})
+		feed.finish(protocol.CmdOK, &buildResult{ID: "build-test"})
+	}()
+	go s.streamBuild(context.Background(), server, feed)
+
+	reader := bufio.NewReader(client)
+	var kinds []string
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		env, payload, err := protocol.Decode(line)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if env.Command != cmdBuildEvent {
+			if env.Command != protocol.CmdOK {
+				t.Fatalf("final command = %q, want %q", env.Command, protocol.CmdOK)
+			}
+			break
+		}
+		ev, err := protocol.DecodePayload[buildEvent](payload)
+		if err != nil {
+			t.Fatalf("decode payload: %v", err)
+		}
+		kinds = append(kinds, ev.Kind)
+	}
+
+	// The step may arrive through the backlog or live, but never twice.
+	if len(kinds) != 2 || kinds[0] != string(buildStarted) || kinds[1] != string(build.EventStep) {
+		t.Errorf("events = %v", kinds)
+	}
+}
+
+func TestBuildFeedAbort(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	feed := newBuildFeed("build-test", cancel)
+	if !feed.abort(ErrBuildCanceled) {
+		t.Fatal("abort of a running build returned false")
+	}
+	if !errors.Is(context.Cause(ctx), ErrBuildCanceled) {
+		t.Errorf("cause = %v, want ErrBuildCanceled", context.Cause(ctx))
+	}
+
+	feed.finish(protocol.CmdError, nil)
+	if feed.abort(ErrBuildCanceled) {
+		t.Error("abort of a finished build returned true")
+	}
+	if newBuildFeed("build-test", nil).abort(ErrBuildCanceled) {
+		t.Error("abort without a cancel func returned true")
+	}
+}
+
+func TestHandleBuildCancel(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	s := &Server{}
+	feed := newBuildFeed("build-test", cancel)
+	if err := s.registerBuild(feed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stands in for the build, which finishes once its context ends.
+	go func() {
+		<-ctx.Done()
+		s.finishBuild(feed, protocol.CmdError, newErrorResult(classifyBuildError(ctx, ctx.Err(), 0, 0)))
+	}()
+
+	tests := []struct {
+		name string
+		id   string
+		want protocol.Command
+	}{
+		{name: "running", id: "build-test", want: protocol.CmdOK},
+		{name: "finished", id: "build-test", want: protocol.CmdError},
+		{name: "unknown", id: "build-other", want: protocol.CmdError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			payload, err := json.Marshal(buildCancelRequest{ID: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.handleBuildCancel(context.Background(), server, payload)
+
+			line, err := bufio.NewReader(client).ReadBytes('\n')
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			env, _, err := protocol.Decode(line)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if env.Command != tt.want {
+				t.Errorf("command = %q, want %q", env.Command, tt.want)
+			}
+		})
+	}
+
+	_, result, _ := feed.response()
+	if code := result.(*errorResult).Code; code != codeBuildCanceled {
+		t.Errorf("build error code = %q, want %q", code, codeBuildCanceled)
+	}
+}
+
+func TestHandleDrain(t *testing.T) {
+	s := &Server{queue: newBuildQueue(1)}
+
+	// Stands in for a build, which waits for a slot and then runs until its
+	// context ends, finishing with the error the daemon would send.
+	startBuild := func(id string) *buildFeed {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		t.Cleanup(func() { cancel(nil) })
+		feed := newBuildFeed(id, cancel)
+		if err := s.registerBuild(feed); err != nil {
+			t.Fatal(err)
+		}
+		waiting := make(chan struct{}, 1)
+		signal := func() {
+			select {
+			case waiting <- struct{}{}:
+			default:
+			}
+		}
+		go func() {
+			release, err := s.queue.acquire(ctx, func(int) { signal() })
+			if err == nil {
+				signal()
+				<-ctx.Done()
+				release()
+				err = ctx.Err()
+			}
+			s.finishBuild(feed, protocol.CmdError, newErrorResult(classifyBuildError(ctx, err, 0, 0)))
+		}()
+		<-waiting
+		return feed
+	}
+	running := startBuild("build-running")
+	queued := startBuild("build-queued")
+	if s.queue.queued() != 1 {
+		t.Fatalf("queued builds = %d, want 1", s.queue.queued())
+	}
+
+	finished := newBuildFeed("build-finished", nil)
+	if err := s.registerBuild(finished); err != nil {
+		t.Fatal(err)
+	}
+	finished.finish(protocol.CmdOK, &buildResult{ID: "build-finished"})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go s.handleDrain(context.Background(), server)
+
+	result := readResponse[drainResult](t, client, protocol.CmdOK)
+	slices.Sort(result.Canceled)
+	if !slices.Equal(result.Canceled, []string{"build-queued", "build-running"}) {
+		t.Errorf("canceled = %v, want [build-queued build-running]", result.Canceled)
+	}
+	for _, feed := range []*buildFeed{running, queued} {
+		_, res, _ := feed.response()
+		if code := res.(*errorResult).Code; code != codeDraining {
+			t.Errorf("%s error code = %q, want %q", feed.id, code, codeDraining)
+		}
+	}
+
+	err := s.registerBuild(newBuildFeed("build-new", nil))
+	if !errors.Is(err, ErrDraining) || errorCode(err) != codeDraining {
+		t.Errorf("register while draining = %v, want ErrDraining", err)
+	}
+
+	go s.handleResume(context.Background(), server)
+	readResponse[json.RawMessage](t, client, protocol.CmdOK)
+	if err := s.registerBuild(newBuildFeed("build-new", nil)); err != nil {
+		t.Errorf("register after resume = %v", err)
+	}
+}
+
+// Reads one response from conn, checks its command, and decodes its payload.
+func readResponse[T any](t *testing.T, conn net.Conn, want protocol.Command) *T {
+	t.Helper()
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	env, payload, err := protocol.Decode(line)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if env.Command != want {
+		t.Fatalf("command = %q, want %q", env.Command, want)
+	}
+	var v T
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &v); err != nil {
+			t.Fatalf("payload: %v", err)
+		}
+	}
+	return &v
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/build"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Types of the entries in a [contextRequest].
+const (
+	contextFile    = "file"    // Regular file.
+	contextDir     = "dir"     // Directory.
+	contextSymlink = "symlink" // Symbolic link.
+)
+
+// Checks that the build context a request carries can be received.
+//
+// A context sent by the client replaces the root on the daemon's host, so
+// the request cannot name both. A detached build outlives the connection it
+// would fetch files over, so it must send its context as an archive.
+func checkContextRequest(req *buildRequest) error {
+	switch {
+	case req.Context == nil:
+		return nil
+	case req.Root != "":
+		return crex.Wrapf(build.ErrInvalidOptions, "a build context sent by the client replaces the root %q", req.Root)
+	case req.Detach && !req.Context.Archive:
+		return crex.Wrapf(build.ErrInvalidOptions, "a detached build cannot fetch its context from the client, send it as an archive")
+	case req.Context.Archive && len(req.Context.Entries) > 0:
+		return crex.Wrapf(build.ErrInvalidOptions, "a build context sent as an archive advertises no entries")
+	}
+	return nil
+}
+
+// Build context received from the client for one build.
+type clientContext struct {
+	dir    string               // Staging directory standing in for the context root.
+	remote *build.RemoteContext // Fetches files as copy steps read them, nil for a context sent as an archive.
+	stats  build.ContextStats   // Transfer of a context sent as an archive.
+}
+
+// Stages the build context a request carries in a new temporary directory.
+//
+// An advertised context gets its tree recreated there, and its files are
+// fetched over conn as the build reads them. A context sent as an archive
+// is fetched whole and extracted before this returns. A nil request stages
+// nothing and returns nil.
+func (s *Server) stageContext(ctx context.Context, conn net.Conn, messages *messageReader, req *contextRequest) (*clientContext, error) {
+	if req == nil {
+		return nil, nil
+	}
+	dir, err := os.MkdirTemp("", "cruxd-context-")
+	if err != nil {
+		return nil, crex.Wrap(ErrServer, err)
+	}
+	c := &clientContext{dir: dir}
+	fetcher := &connFetcher{s: s, conn: conn, messages: messages}
+
+	if req.Archive {
+		archive := fetcher.fetch(ctx, &contextFetchRequest{All: true})
+		c.stats, err = build.ExtractContext(dir, archive)
+		archive.Close()
+	} else {
+		var entries []build.ContextEntry
+		if entries, err = newContextEntries(req.Entries); err == nil {
+			c.remote, err = build.NewRemoteContext(dir, entries, fetcher)
+		}
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns the transfer of the context so far, as reported to the client.
+func (c *clientContext) transfer() *contextTransfer {
+	stats := c.stats
+	if c.remote != nil {
+		stats = c.remote.Stats()
+	}
+	return &contextTransfer{
+		Files:       stats.Files,
+		Size:        stats.Size,
+		Fetched:     stats.Fetched,
+		Transferred: stats.Transferred,
+		Saved:       stats.Saved(),
+	}
+}
+
+// Removes the staging directory.
+func (c *clientContext) close() {
+	if err := os.RemoveAll(c.dir); err != nil {
+		slog.Warn("failed to remove build context", "dir", c.dir, "error", err)
+	}
+}
+
+// Converts the entries of a [contextRequest] for [build.NewRemoteContext].
+func newContextEntries(entries []contextEntry) ([]build.ContextEntry, error) {
+	out := make([]build.ContextEntry, len(entries))
+	for i, e := range entries {
+		mode := unixMode(e.Mode)
+		switch e.Type {
+		case contextFile:
+		case contextDir:
+			mode |= fs.ModeDir
+		case contextSymlink:
+			mode |= fs.ModeSymlink
+		default:
+			return nil, crex.Wrapf(build.ErrInvalidOptions, "build context entry %q has unknown type %q", e.Path, e.Type)
+		}
+		out[i] = build.ContextEntry{
+			Path:    e.Path,
+			Mode:    mode,
+			Size:    e.Size,
+			Digest:  e.Digest,
+			Link:    e.Link,
+			ModTime: e.ModTime,
+		}
+	}
+	return out, nil
+}
+
+// Converts permission bits as given to chmod into a file mode.
+func unixMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode) & fs.ModePerm
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// Fetches files of a build context from the client over the build's
+// connection, as a [build.ContextFetcher].
+//
+// Each fetch sends a [cmdContextFetch] message and reads the archive from
+// the [cmdContextData] messages that answer it. Fetches are not run
+// concurrently, since they share the connection.
+type connFetcher struct {
+	s        *Server        // Server used to encode messages.
+	conn     net.Conn       // Client connection.
+	messages *messageReader // Messages of the connection.
+}
+
+// Asks the client for the files at paths.
+func (f *connFetcher) Fetch(ctx context.Context, paths []string) (io.ReadCloser, error) {
+	return f.fetch(ctx, &contextFetchRequest{Paths: paths}), nil
+}
+
+// Sends a fetch request and returns the archive answering it.
+func (f *connFetcher) fetch(ctx context.Context, req *contextFetchRequest) *chunkReader {
+	f.s.respond(f.conn, cmdContextFetch, req)
+	return &chunkReader{ctx: ctx, messages: f.messages}
+}
+
+// Archive the client sends as [cmdContextData] chunks, read from the
+// connection's messages as the reader asks for more.
+//
+// Other commands and malformed messages are logged and dropped, since the
+// connection carries no other command until the build finishes. A chunk
+// dropped for its size fails the read, as the archive would be missing it.
+type chunkReader struct {
+	ctx      context.Context // Ends the wait for the next chunk.
+	messages *messageReader  // Messages of the connection.
+	pending  []byte          // Unread bytes of the last chunk.
+	final    bool            // Whether the last chunk of the archive was read.
+	err      error           // Error returned once pending is read, [io.EOF] at the end of the archive.
+}
+
+// Reads the next bytes of the archive.
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 && r.err == nil {
+		r.next()
+	}
+	if len(r.pending) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Drops the rest of the archive, so that the connection's next message is
+// not one of its chunks.
+func (r *chunkReader) Close() error {
+	r.pending = nil
+	for !r.final {
+		r.next()
+	}
+	return nil
+}
+
+// Reads the next message of the archive.
+func (r *chunkReader) next() {
+	var msg message
+	select {
+	case msg = <-r.messages.lines:
+	case <-r.messages.closed:
+		r.fail(fmt.Errorf("client closed the connection"))
+		r.final = true
+		return
+	case <-r.ctx.Done():
+		r.fail(context.Cause(r.ctx))
+		r.final = true
+		return
+	}
+	if msg.err != nil {
+		r.fail(msg.err)
+		return
+	}
+
+	env, payload, err := protocol.Decode(msg.line)
+	if err != nil {
+		slog.Warn("ignoring malformed message during build context transfer", "error", err)
+		return
+	}
+	if env.Command != cmdContextData {
+		slog.Warn("ignoring message during build context transfer", "command", env.Command)
+		return
+	}
+	chunk, err := protocol.DecodePayload[contextChunk](payload)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+
+	if r.err == nil {
+		r.pending = chunk.Data
+	}
+	switch {
+	case chunk.Error != "":
+		r.fail(errors.New(chunk.Error))
+		r.final = true
+	case chunk.Done:
+		r.fail(io.EOF)
+		r.final = true
+	}
+}
+
+// Records the first error of the archive.
+func (r *chunkReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
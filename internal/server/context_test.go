@@ -0,0 +1,290 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cruciblehq/cruxd/internal/build"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Returns a tar archive of regular files, by name.
+func contextArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+// Answers each context-fetch message read from conn with the chunks reply
+// returns for it, until conn is closed.
+func serveFetches(conn net.Conn, reply func(req *contextFetchRequest) []contextChunk) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		env, payload, err := protocol.Decode(line)
+		if err != nil || env.Command != cmdContextFetch {
+			continue
+		}
+		req, _ := protocol.DecodePayload[contextFetchRequest](payload)
+		for _, chunk := range reply(req) {
+			data, _ := protocol.Encode(cmdContextData, chunk)
+			conn.Write(append(data, '\n'))
+		}
+	}
+}
+
+// Splits data into chunks of at most n bytes, ending with a done chunk.
+func splitChunks(data []byte, n int) []contextChunk {
+	var chunks []contextChunk
+	for len(data) > 0 {
+		size := min(n, len(data))
+		chunks = append(chunks, contextChunk{Data: data[:size]})
+		data = data[size:]
+	}
+	return append(chunks, contextChunk{Done: true})
+}
+
+func TestConnFetcher(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	messages := readMessages(server, stop, DefaultMaxMessageSize)
+
+	files := map[string]string{"src/app.go": "package app\n", "go.mod": "module app\n"}
+	go serveFetches(client, func(req *contextFetchRequest) []contextChunk {
+		if !slices.Equal(req.Paths, []string{"go.mod", "src/app.go"}) {
+			t.Errorf("fetch request = %+v", req)
+		}
+		// A stray command in the middle of the archive is dropped.
+		data, _ := protocol.Encode(protocol.CmdStatus, nil)
+		client.Write(append(data, '\n'))
+		return splitChunks(contextArchive(t, files), 100)
+	})
+
+	fetcher := &connFetcher{s: &Server{}, conn: server, messages: messages}
+	r, err := fetcher.Fetch(context.Background(), []string{"go.mod", "src/app.go"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tr := tar.NewReader(r)
+	got := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read archive: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		got[header.Name] = string(data)
+	}
+	r.Close()
+	if len(got) != len(files) || got["src/app.go"] != files["src/app.go"] || got["go.mod"] != files["go.mod"] {
+		t.Errorf("archive = %v", got)
+	}
+}
+
+func TestConnFetcherErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		chunks     []contextChunk
+		disconnect bool
+		want       string
+	}{
+		{"client error", []contextChunk{{Data: []byte("partial")}, {Error: "open app.go: permission denied"}}, false, "permission denied"},
+		{"disconnect", []contextChunk{{Data: []byte("partial")}}, true, "closed the connection"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			stop := make(chan struct{})
+			defer close(stop)
+			messages := readMessages(server, stop, DefaultMaxMessageSize)
+
+			go func() {
+				reader := bufio.NewReader(client)
+				if _, err := reader.ReadBytes('\n'); err != nil {
+					return
+				}
+				for _, chunk := range tt.chunks {
+					data, _ := protocol.Encode(cmdContextData, chunk)
+					client.Write(append(data, '\n'))
+				}
+				if tt.disconnect {
+					client.Close()
+				}
+			}()
+
+			fetcher := &connFetcher{s: &Server{}, conn: server, messages: messages}
+			r, _ := fetcher.Fetch(context.Background(), []string{"app.go"})
+			data, err := io.ReadAll(r)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("read = %v, want an error containing %q", err, tt.want)
+			}
+			if string(data) != "partial" {
+				t.Errorf("data = %q", data)
+			}
+			r.Close()
+		})
+	}
+}
+
+func TestChunkReaderCloseDrains(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	messages := readMessages(server, stop, DefaultMaxMessageSize)
+
+	go func() {
+		for _, chunk := range splitChunks([]byte("0123456789"), 2) {
+			data, _ := protocol.Encode(cmdContextData, chunk)
+			client.Write(append(data, '\n'))
+		}
+		data, _ := protocol.Encode(protocol.CmdStatus, nil)
+		client.Write(append(data, '\n'))
+	}()
+
+	r := &chunkReader{ctx: context.Background(), messages: messages}
+	if _, err := io.ReadFull(r, make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// The message after the archive is the connection's next one.
+	msg := <-messages.lines
+	if env, _, err := protocol.Decode(msg.line); err != nil || env.Command != protocol.CmdStatus {
+		t.Errorf("next message = %q, %v", msg.line, err)
+	}
+}
+
+func TestStageContextArchive(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	messages := readMessages(server, stop, DefaultMaxMessageSize)
+
+	archive := contextArchive(t, map[string]string{"go.mod": "module app\n", "main.go": "package main\n"})
+	go serveFetches(client, func(req *contextFetchRequest) []contextChunk {
+		if !req.All {
+			t.Errorf("fetch request = %+v, want the whole context", req)
+		}
+		return splitChunks(archive, 512)
+	})
+
+	source, err := (&Server{}).stageContext(context.Background(), server, messages, &contextRequest{Archive: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source.remote != nil {
+		t.Error("archive context fetches files")
+	}
+	if data, err := os.ReadFile(filepath.Join(source.dir, "main.go")); err != nil || string(data) != "package main\n" {
+		t.Errorf("main.go = %q, %v", data, err)
+	}
+	if got := source.transfer(); got.Files != 2 || got.Fetched != 2 || got.Transferred != int64(len(archive)) || got.Saved != 0 {
+		t.Errorf("transfer = %+v", got)
+	}
+
+	source.close()
+	if _, err := os.Stat(source.dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("staging directory left behind: %v", err)
+	}
+}
+
+func TestStageContextEntries(t *testing.T) {
+	source, err := (&Server{}).stageContext(context.Background(), nil, nil, &contextRequest{Entries: []contextEntry{
+		{Path: "src", Type: contextDir, Mode: 0o2750, ModTime: time.Unix(0, 0)},
+		{Path: "src/app.go", Type: contextFile, Mode: 0o644, Size: 12, Digest: "sha256:" + strings.Repeat("0", 64)},
+		{Path: "app", Type: contextSymlink, Link: "src"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer source.close()
+
+	if source.remote == nil {
+		t.Fatal("advertised context does not fetch files")
+	}
+	info, err := os.Stat(filepath.Join(source.dir, "src"))
+	if err != nil || info.Mode()&(fs.ModePerm|fs.ModeSetgid) != 0o750|fs.ModeSetgid {
+		t.Errorf("src: info = %v, err = %v", info, err)
+	}
+	if link, err := os.Readlink(filepath.Join(source.dir, "app")); err != nil || link != "src" {
+		t.Errorf("app = %q, %v", link, err)
+	}
+	if got := source.transfer(); got.Files != 1 || got.Size != 12 || got.Fetched != 0 {
+		t.Errorf("transfer = %+v", got)
+	}
+
+	if _, err := (&Server{}).stageContext(context.Background(), nil, nil, &contextRequest{Entries: []contextEntry{
+		{Path: "dev", Type: "device"},
+	}}); !errors.Is(err, build.ErrInvalidOptions) {
+		t.Errorf("unknown entry type: err = %v, want ErrInvalidOptions", err)
+	}
+}
+
+func TestCheckContextRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   buildRequest
+		valid bool
+	}{
+		{"none", buildRequest{BuildRequest: protocol.BuildRequest{Root: "/src"}}, true},
+		{"entries", buildRequest{Context: &contextRequest{}}, true},
+		{"archive", buildRequest{Context: &contextRequest{Archive: true}}, true},
+		{"detached archive", buildRequest{Detach: true, Context: &contextRequest{Archive: true}}, true},
+		{"with a root", buildRequest{BuildRequest: protocol.BuildRequest{Root: "/src"}, Context: &contextRequest{}}, false},
+		{"detached fetch", buildRequest{Detach: true, Context: &contextRequest{}}, false},
+		{"archive with entries", buildRequest{Context: &contextRequest{Archive: true, Entries: []contextEntry{{Path: "a"}}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkContextRequest(&tt.req)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, build.ErrInvalidOptions) {
+				t.Errorf("err = %v, want ErrInvalidOptions", err)
+			}
+		})
+	}
+}
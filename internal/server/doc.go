@@ -1,10 +1,15 @@
 // Package server implements the cruxd daemon.
 //
 // The daemon listens on a Unix domain socket for JSON-encoded commands
-// from the crux CLI. Each connection carries a single request-response
-// exchange: the client sends a newline-delimited JSON envelope, the
-// server dispatches the command, and writes the result back before
-// closing the connection.
+// from the crux CLI. The client sends a newline-delimited JSON envelope,
+// and the server dispatches the command and writes the result back. A
+// connection can carry any number of these exchanges, one after the other,
+// and is closed by the client when it is done. Commands that stream, such
+// as run, send a sequence of messages before the final result. An
+// interactive container-exec also reads input and resize messages from the
+// client until it finishes, and a build whose context the client holds asks
+// it for files with context-fetch messages, reading them from context-data
+// messages.
 //
 // Supported commands include building resources, querying daemon status,
 // and initiating shutdown. Build commands are delegated to the build
@@ -15,7 +20,7 @@
 //
 //	srv, err := server.New(server.Config{
 //	    ContainerdAddress:   "/run/containerd/containerd.sock",
-//	    ContainerdNamespace: "crucible",
+//	    ContainerdNamespace: server.DefaultContainerdNamespace,
 //	})
 //	if err != nil {
 //	    return err
@@ -3,5 +3,14 @@ package server
 import "errors"
 
 var (
-	ErrServer = errors.New("server error")
+	ErrServer            = errors.New("server error")
+	ErrBuildTimeout      = errors.New("build exceeded maximum duration")
+	ErrBuildCanceled     = errors.New("build canceled")
+	ErrContainerNotFound = errors.New("container not found")
+	ErrBuildNotFound     = errors.New("build not found")
+	ErrBuildFinished     = errors.New("build already finished")
+	ErrDraining          = errors.New("daemon is draining")
+	ErrMessageTooLarge   = errors.New("message too large")
+	ErrInvalidReference  = errors.New("invalid reference")
+	ErrInvalidRequest    = errors.New("invalid request")
 )
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/paths"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Number of finished builds kept in the history.
+const buildHistoryLimit = 100
+
+// Outcomes of a [buildRecord].
+const (
+	buildSucceeded = "succeeded" // The build finished, or paused at a breakpoint.
+	buildFailed    = "failed"    // The build failed, including by running out of time.
+	buildCanceled  = "canceled"  // The build was canceled, by request, drain, or disconnect.
+)
+
+// Recent finished builds, oldest first, bounded by [buildHistoryLimit].
+//
+// With a file the history is written to it after every build and read back
+// when the daemon starts, so that it survives restarts. A nil history
+// records nothing.
+type buildHistory struct {
+	mu      sync.Mutex    // Protects records.
+	path    string        // File the history is kept in. Empty keeps it in memory only.
+	records []buildRecord // Finished builds, oldest first.
+}
+
+// Creates a history kept in the file at path, or in memory only when path
+// is empty.
+//
+// A missing file starts an empty history. A file that cannot be parsed is
+// logged and replaced once the next build finishes, since losing the
+// history is no reason to refuse to start.
+func newBuildHistory(path string) (*buildHistory, error) {
+	h := &buildHistory{path: path}
+	if path == "" {
+		return h, nil
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return h, nil
+	case err != nil:
+		return nil, crex.Wrapf(ErrServer, "build history: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.records); err != nil {
+		slog.Warn("ignoring unreadable build history", "path", path, "error", err)
+		h.records = nil
+	}
+	h.trim()
+	return h, nil
+}
+
+// Records a finished build, dropping the oldest once the history is full.
+//
+// Failing to write the history file is only logged, so that the build's
+// own result is unaffected.
+func (h *buildHistory) add(rec buildRecord) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, rec)
+	h.trim()
+	if err := h.save(); err != nil {
+		slog.Warn("failed to write build history", "path", h.path, "error", err)
+	}
+}
+
+// Returns the recorded builds, most recent first.
+func (h *buildHistory) list() []buildRecord {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := slices.Clone(h.records)
+	slices.Reverse(records)
+	return records
+}
+
+// Drops the oldest records beyond [buildHistoryLimit]. Must be called with
+// h.mu held.
+func (h *buildHistory) trim() {
+	if n := len(h.records) - buildHistoryLimit; n > 0 {
+		h.records = slices.Delete(h.records, 0, n)
+	}
+}
+
+// Writes the history to its file, if it has one, replacing the file
+// atomically so that a crash never leaves half a history behind. Must be
+// called with h.mu held.
+func (h *buildHistory) save() error {
+	if h.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(h.records)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(h.path)
+	if err := os.MkdirAll(dir, paths.DefaultDirMode); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".build-history-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), h.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Returns the history record of a build from its request, when it started,
+// and its final response.
+func newBuildRecord(id string, req *buildRequest, platforms []string, started time.Time, cmd protocol.Command, response any) buildRecord {
+	rec := buildRecord{
+		ID:        id,
+		Resource:  req.Resource,
+		Platforms: platforms,
+		Started:   started.UTC().Format(time.RFC3339),
+		Finished:  time.Now().UTC().Format(time.RFC3339),
+		Result:    buildSucceeded,
+	}
+	if cmd == protocol.CmdOK {
+		return rec
+	}
+
+	rec.Result = buildFailed
+	if res, ok := response.(*errorResult); ok {
+		rec.Error = res.Message
+		rec.Code = res.Code
+		switch res.Code {
+		case codeBuildCanceled, codeDraining:
+			rec.Result = buildCanceled
+		}
+	}
+	return rec
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+func TestBuildHistoryLimit(t *testing.T) {
+	h, err := newBuildHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range buildHistoryLimit + 5 {
+		h.add(buildRecord{ID: fmt.Sprintf("build-%d", i)})
+	}
+
+	records := h.list()
+	if len(records) != buildHistoryLimit {
+		t.Fatalf("history has %d records, want %d", len(records), buildHistoryLimit)
+	}
+	if first := records[0].ID; first != fmt.Sprintf("build-%d", buildHistoryLimit+4) {
+		t.Errorf("most recent record = %s", first)
+	}
+	if last := records[len(records)-1].ID; last != "build-5" {
+		t.Errorf("oldest record = %s, want build-5", last)
+	}
+}
+
+func TestBuildHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "history.json")
+
+	h, err := newBuildHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.list()) != 0 {
+		t.Fatal("history without a file is not empty")
+	}
+	h.add(buildRecord{ID: "build-1", Result: buildSucceeded})
+	h.add(buildRecord{ID: "build-2", Result: buildFailed, Error: "step failed"})
+
+	reloaded, err := newBuildHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := reloaded.list()
+	if len(records) != 2 || records[0].ID != "build-2" || records[0].Error != "step failed" || records[1].ID != "build-1" {
+		t.Errorf("reloaded history = %+v", records)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := newBuildHistory(path)
+	if err != nil {
+		t.Fatalf("unreadable history: %v", err)
+	}
+	if len(corrupt.list()) != 0 {
+		t.Errorf("unreadable history kept %d records", len(corrupt.list()))
+	}
+}
+
+func TestNewBuildRecord(t *testing.T) {
+	req := &buildRequest{}
+	req.Resource = "my-app"
+	started := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name       string
+		cmd        protocol.Command
+		response   any
+		wantResult string
+		wantCode   string
+	}{
+		{name: "succeeded", cmd: protocol.CmdOK, response: &buildResult{ID: "build-test"}, wantResult: buildSucceeded},
+		{name: "failed", cmd: protocol.CmdError, response: newErrorResult(crex.Wrapf(ErrBuildTimeout, "limit 1m0s")), wantResult: buildFailed, wantCode: codeBuildTimeout},
+		{name: "canceled", cmd: protocol.CmdError, response: newErrorResult(crex.Wrapf(ErrBuildCanceled, "by request")), wantResult: buildCanceled, wantCode: codeBuildCanceled},
+		{name: "drained", cmd: protocol.CmdError, response: newErrorResult(crex.Wrapf(ErrDraining, "build canceled")), wantResult: buildCanceled, wantCode: codeDraining},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := newBuildRecord("build-test", req, []string{"linux/amd64"}, started, tt.cmd, tt.response)
+			if rec.Result != tt.wantResult || rec.Code != tt.wantCode {
+				t.Errorf("result = %q (%q), want %q (%q)", rec.Result, rec.Code, tt.wantResult, tt.wantCode)
+			}
+			if (rec.Error != "") != (tt.wantResult != buildSucceeded) {
+				t.Errorf("error = %q", rec.Error)
+			}
+			if rec.ID != "build-test" || rec.Resource != "my-app" || rec.Started >= rec.Finished {
+				t.Errorf("record = %+v", rec)
+			}
+		})
+	}
+}
+
+func TestBuildHistoryDrain(t *testing.T) {
+	h, err := newBuildHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{queue: newBuildQueue(1), history: h}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	feed := newBuildFeed("build-running", cancel)
+	if err := s.registerBuild(feed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stands in for a running build, which finishes once its context ends
+	// and is recorded as the daemon records it.
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		<-ctx.Done()
+		cmd, response := protocol.CmdError, newErrorResult(classifyBuildError(ctx, ctx.Err(), 0, 0))
+		s.finishBuild(feed, cmd, response)
+		s.history.add(newBuildRecord(feed.id, &buildRequest{}, nil, time.Now(), cmd, response))
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go s.handleDrain(context.Background(), server)
+	readResponse[drainResult](t, client, protocol.CmdOK)
+	<-recorded
+
+	records := h.list()
+	if len(records) != 1 || records[0].Result != buildCanceled || records[0].Code != codeDraining {
+		t.Errorf("history = %+v, want one canceled build", records)
+	}
+}
@@ -0,0 +1,726 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal/build"
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Machine-readable error codes attached to [errorResult] payloads.
+const (
+	codeInvalidRecipe            = "invalid-recipe"             // The recipe could not be parsed or failed validation.
+	codeUnsupportedRecipeVersion = "unsupported-recipe-version" // The recipe schema version is outside the supported range.
+	codeInvalidOptions           = "invalid-options"            // The build options failed validation.
+	codeSecretUnavailable        = "secret-unavailable"         // A referenced secret could not be resolved.
+	codeBuildTimeout             = "build-timeout"              // The build ran longer than its maximum duration.
+	codeBuildCanceled            = "build-canceled"             // The build was canceled before it finished.
+	codeMemoryLimitExceeded      = "memory-limit-exceeded"      // A step was killed for exceeding its stage's memory limit.
+	codeVerifyFailed             = "verify-failed"              // A stage's verification command failed.
+	codeRegistryNotAllowed       = "registry-not-allowed"       // A base image comes from a registry outside the allowlist.
+	codeRegistryTimeout          = "registry-timeout"           // A pull or push ran longer than the registry timeout.
+	codeDraining                 = "draining"                   // The daemon is draining and accepts no new builds.
+	codeNotReady                 = "not-ready"                  // A started container did not pass its readiness probe in time.
+	codeMessageTooLarge          = "message-too-large"          // A message exceeded the daemon's message size limit and was dropped.
+	codeInvalidReference         = "invalid-reference"          // A Crucible reference or version is missing.
+	codeContextTransfer          = "context-transfer"           // The build context could not be received from the client.
+	codeRemoteContainerd         = "remote-containerd"          // The command needs containerd on the daemon's host.
+)
+
+// Commands handled by the daemon that are not part of [protocol].
+const (
+	cmdRun    protocol.Command = "run"    // Run a command in a throwaway container.
+	cmdOutput protocol.Command = "output" // A chunk of streamed process output.
+	cmdInput  protocol.Command = "input"  // A chunk of input for an interactive exec.
+	cmdResize protocol.Command = "resize" // A new terminal size for an interactive exec.
+
+	cmdContainerMounts        protocol.Command = "container-mounts"         // Report the snapshot mounts of a container.
+	cmdContainerDestroyPrefix protocol.Command = "container-destroy-prefix" // Destroy the containers whose ID starts with a prefix.
+	cmdCacheClear             protocol.Command = "cache-clear"              // Remove the build cache entries of a resource, or all of them.
+	cmdResolveTag             protocol.Command = "resolve-tag"              // Report the image tag a reference resolves to.
+	cmdCapabilities           protocol.Command = "capabilities"             // Report what the daemon supports.
+	cmdConfig                 protocol.Command = "config"                   // Report the daemon's effective configuration.
+	cmdBuildEvent             protocol.Command = "build-event"              // A progress event of a running build.
+	cmdBuildAttach            protocol.Command = "build-attach"             // Stream the progress of a running build.
+	cmdBuildCancel            protocol.Command = "build-cancel"             // Cancel a running build and wait for its teardown.
+	cmdDrain                  protocol.Command = "drain"                    // Cancel every running build and stop accepting new ones.
+	cmdResume                 protocol.Command = "resume"                   // Accept new builds again after a drain.
+	cmdBuildList              protocol.Command = "build-list"               // Report the recently finished builds.
+	cmdShutdown               protocol.Command = "shutdown"                 // Stop the daemon once in-flight commands finish.
+	cmdContextFetch           protocol.Command = "context-fetch"            // Ask the client for files of the build context it holds.
+	cmdContextData            protocol.Command = "context-data"             // A chunk of a tar archive of build context files.
+)
+
+// Build request accepted by the daemon.
+//
+// Extends [protocol.BuildRequest] with fields that older clients omit. When
+// RecipeDocument is set it takes precedence over the pre-parsed Recipe, which
+// lets thin clients send the recipe as written without depending on the
+// manifest schema.
+type buildRequest struct {
+	protocol.BuildRequest
+	RecipeDocument        string                 `json:"recipeDocument,omitempty"`        // Raw YAML or JSON recipe, parsed by the daemon.
+	RecipeVersion         int                    `json:"recipeVersion,omitempty"`         // Recipe schema version. Zero means unspecified.
+	AppendEntrypoint      []string               `json:"appendEntrypoint,omitempty"`      // Arguments appended to the output image's entrypoint.
+	Cmd                   []string               `json:"cmd,omitempty"`                   // OCI cmd for the output image.
+	KeepCmd               bool                   `json:"keepCmd,omitempty"`               // Keep the base image's cmd when the entrypoint is replaced.
+	PlatformConfig        platformConfigRequest  `json:"platformConfig,omitempty"`        // Entrypoint and cmd settings per target platform, overriding the ones above.
+	Args                  map[string]string      `json:"args,omitempty"`                  // Build arguments, overriding those in ArgsFile.
+	ArgsFile              string                 `json:"argsFile,omitempty"`              // KEY=VALUE file of build arguments relative to the build context.
+	SourceDateEpoch       *int64                 `json:"sourceDateEpoch,omitempty"`       // Unix time set as SOURCE_DATE_EPOCH for run steps.
+	ReadOnlyRootfs        bool                   `json:"readOnlyRootfs,omitempty"`        // Run steps with a read-only root filesystem.
+	StrictStderr          bool                   `json:"strictStderr,omitempty"`          // Fail run steps that write to stderr.
+	AnnotateLayers        bool                   `json:"annotateLayers,omitempty"`        // Annotate exported layers with their source stage.
+	Labels                map[string]string      `json:"labels,omitempty"`                // Labels of the output image's config.
+	Tags                  []string               `json:"tags,omitempty"`                  // References the output image is named by in its archives.
+	Compression           string                 `json:"compression,omitempty"`           // Layer compression, "gzip" (the default) or "zstd".
+	CompressionLevel      int                    `json:"compressionLevel,omitempty"`      // Layer compression level. Zero uses containerd's default.
+	Squash                bool                   `json:"squash,omitempty"`                // Export the output image as a single layer.
+	MemoryContext         bool                   `json:"memoryContext,omitempty"`         // Copy the build context to the daemon's tmpfs before the build.
+	AllowPlatformFallback bool                   `json:"allowPlatformFallback,omitempty"` // Export the first manifest when the base image lacks the target platform.
+	Snapshotter           string                 `json:"snapshotter,omitempty"`           // containerd snapshotter for the build, instead of the daemon's.
+	NoCache               bool                   `json:"noCache,omitempty"`               // Execute every step instead of reusing cached results.
+	CacheClear            bool                   `json:"cacheClear,omitempty"`            // Remove the resource's cached results before building.
+	DNSSearch             []string               `json:"dnsSearch,omitempty"`             // Search domains of build containers, replacing the host's.
+	DNSOptions            []string               `json:"dnsOptions,omitempty"`            // Resolver options of build containers, such as "ndots:2".
+	DigestFilename        bool                   `json:"digestFilename,omitempty"`        // Name archives sha256-<hex>.tar after the image digest instead of image.tar.
+	ExportFormat          string                 `json:"exportFormat,omitempty"`          // Archive layout, "oci" (the default) or "docker" for the legacy docker save layout.
+	Rlimits               []rlimitRequest        `json:"rlimits,omitempty"`               // Resource limits for processes in build containers.
+	AddCapabilities       []string               `json:"addCapabilities,omitempty"`       // Linux capabilities granted to build containers.
+	DropCapabilities      []string               `json:"dropCapabilities,omitempty"`      // Linux capabilities removed from build containers.
+	SeccompProfile        string                 `json:"seccompProfile,omitempty"`        // Seccomp profile for build containers.
+	AppArmorProfile       string                 `json:"appArmorProfile,omitempty"`       // AppArmor profile for build containers.
+	CopyChown             string                 `json:"copyChown,omitempty"`             // Default "UID:GID" ownership of copied files.
+	CopySymlinks          string                 `json:"copySymlinks,omitempty"`          // "preserve" (default) or "follow" symbolic links inside copied directories.
+	StrictCopyModes       bool                   `json:"strictCopyModes,omitempty"`       // Fail copies of setuid, setgid, or world-writable files.
+	AllowUndefinedVars    bool                   `json:"allowUndefinedVars,omitempty"`    // Expand undefined variables in commands, copy paths, and workdirs to nothing.
+	Hostname              string                 `json:"hostname,omitempty"`              // Hostname of every stage container. Defaults to the stage name.
+	Events                bool                   `json:"events,omitempty"`                // Stream [cmdBuildEvent] messages before the result.
+	OutputSampling        *outputSamplingRequest `json:"outputSampling,omitempty"`        // Limits the run output streamed as events. Omitted streams all of it.
+	Detach                bool                   `json:"detach,omitempty"`                // Keep building if the client disconnects.
+	Push                  string                 `json:"push,omitempty"`                  // Registry reference the output image is pushed to.
+	PushOnly              bool                   `json:"pushOnly,omitempty"`              // Push without writing image.tar.
+	Secrets               []secretRequest        `json:"secrets,omitempty"`               // Secrets mounted into build containers, by ID.
+	BreakAt               *breakpointRequest     `json:"breakAt,omitempty"`               // Stage and step at which to pause the build.
+	ExportStages          []string               `json:"exportStages,omitempty"`          // Stages, by name or 1-based index, also exported to the output's debug directory.
+	MaxDuration           string                 `json:"maxDuration,omitempty"`           // Go duration such as "30m". Can only lower the daemon's limit.
+	Context               *contextRequest        `json:"context,omitempty"`               // Build context kept on the client's host, replacing Root.
+
+	Stages map[string]stageRequest `json:"stages,omitempty"` // Per-stage settings keyed by stage name or 1-based index.
+}
+
+// A resource limit carried by a [buildRequest].
+type rlimitRequest struct {
+	Type string `json:"type"` // Limit name such as "nofile".
+	Soft uint64 `json:"soft"` // Soft limit.
+	Hard uint64 `json:"hard"` // Hard limit.
+}
+
+// A secret reference carried by a [buildRequest].
+//
+// Only the ID travels in the request. The daemon resolves the value from its
+// configured secret source.
+type secretRequest struct {
+	ID     string `json:"id"`               // Secret identifier.
+	Target string `json:"target,omitempty"` // Absolute path in the container. Defaults to /run/secrets/<id>.
+}
+
+// Entrypoint and cmd settings of a [buildRequest] by target platform.
+type platformConfigRequest map[string]imageConfigRequest
+
+// Entrypoint and cmd settings of the output image for one platform. See
+// [build.ImageConfig].
+type imageConfigRequest struct {
+	Entrypoint       []string `json:"entrypoint,omitempty"`       // Replaces the request's entrypoint.
+	AppendEntrypoint []string `json:"appendEntrypoint,omitempty"` // Replaces the request's appendEntrypoint.
+	Cmd              []string `json:"cmd,omitempty"`              // Replaces the request's cmd.
+	KeepCmd          *bool    `json:"keepCmd,omitempty"`          // Replaces the request's keepCmd.
+}
+
+// Output sampling thresholds of a build request. See [build.OutputSampling].
+type outputSamplingRequest struct {
+	HeadLines int   `json:"headLines,omitempty"` // Lines of each stream streamed before sampling starts.
+	HeadBytes int64 `json:"headBytes,omitempty"` // Bytes of each stream streamed before sampling starts.
+	TailLines int   `json:"tailLines,omitempty"` // Last lines of each stream streamed when the step ends.
+}
+
+// A debugging breakpoint carried by a [buildRequest].
+type breakpointRequest struct {
+	Stage string `json:"stage"` // Stage name, or 1-based index for unnamed stages.
+	Step  int    `json:"step"`  // 1-based index of the last step to execute.
+}
+
+// Build context kept on the client's host, carried by a [buildRequest] in
+// place of a root on the daemon's host.
+//
+// The client advertises the context's tree in Entries, and the daemon asks
+// for the files copy steps read with [cmdContextFetch] messages as the
+// build reaches them. With Archive the tree is not advertised, and the
+// daemon asks for the whole context once, before the build starts. Either
+// way the client answers each fetch with a tar archive of the files, sent
+// as [cmdContextData] chunks.
+type contextRequest struct {
+	Entries []contextEntry `json:"entries,omitempty"` // Files, directories, and symbolic links of the context.
+	Archive bool           `json:"archive,omitempty"` // Send the whole context up front instead of the files copy steps read.
+}
+
+// File, directory, or symbolic link advertised in a [contextRequest].
+type contextEntry struct {
+	Path    string    `json:"path"`             // Slash-separated path from the context root.
+	Type    string    `json:"type"`             // "file", "dir", or "symlink".
+	Mode    uint32    `json:"mode,omitempty"`   // Permission bits as given to chmod, including setuid, setgid, and sticky.
+	Size    int64     `json:"size,omitempty"`   // Size of a file in bytes.
+	Digest  string    `json:"digest,omitempty"` // SHA-256 of a file's contents, as "sha256:<hex>".
+	Link    string    `json:"link,omitempty"`   // Target of a symbolic link.
+	ModTime time.Time `json:"modTime"`          // Modification time of a file or directory.
+}
+
+// Payload of a [cmdContextFetch] message.
+type contextFetchRequest struct {
+	Paths []string `json:"paths,omitempty"` // Files to send, relative to the context root and slash-separated.
+	All   bool     `json:"all,omitempty"`   // Send the whole context instead of Paths.
+}
+
+// Payload of a [cmdContextData] message.
+//
+// Data is base64-encoded on the wire, like the data of an [outputChunk].
+// The chunk with Done or Error set is the last of its archive.
+type contextChunk struct {
+	Data  []byte `json:"data,omitempty"`  // Next bytes of the archive.
+	Done  bool   `json:"done,omitempty"`  // The archive is complete.
+	Error string `json:"error,omitempty"` // Why the client could not send the archive.
+}
+
+// How much of the build context sent by the client was transferred, as
+// reported in a [buildResult]. See [build.ContextStats].
+type contextTransfer struct {
+	Files       int   `json:"files"`       // Regular files in the context.
+	Size        int64 `json:"size"`        // Bytes of file data in the context.
+	Fetched     int   `json:"fetched"`     // Files transferred to the daemon.
+	Transferred int64 `json:"transferred"` // Bytes of archive received.
+	Saved       int64 `json:"saved"`       // Bytes of archive not transferred because no step read the files.
+}
+
+// Build result returned by the daemon.
+//
+// Extends [protocol.BuildResult] with the ID of the container left running
+// when the build paused at a breakpoint.
+type buildResult struct {
+	protocol.BuildResult
+	ID        string   `json:"id"`                  // Build ID, as given to [cmdBuildAttach].
+	Container string   `json:"container,omitempty"` // Paused container ID, if any.
+	Pushed    string   `json:"pushed,omitempty"`    // Reference and digest of the pushed image, if any.
+	Archives  []string `json:"archives,omitempty"`  // Paths of the exported archives, one per platform.
+
+	Context  *contextTransfer `json:"context,omitempty"`  // Transfer of the build context sent by the client, if any.
+	Warnings []buildWarning   `json:"warnings,omitempty"` // Non-fatal issues found during the build.
+}
+
+// Non-fatal issue reported in a [buildResult].
+type buildWarning struct {
+	Code    string            `json:"code"`              // Kind of issue, such as "unsafe-file-mode".
+	Message string            `json:"message"`           // Human-readable description.
+	Context map[string]string `json:"context,omitempty"` // Details such as the path, stage, or platform concerned.
+}
+
+// Converts the warnings of a build result for the wire.
+func newBuildWarnings(warnings []build.Warning) []buildWarning {
+	if len(warnings) == 0 {
+		return nil
+	}
+	out := make([]buildWarning, len(warnings))
+	for i, w := range warnings {
+		out[i] = buildWarning{Code: w.Code, Message: w.Message, Context: w.Context}
+	}
+	return out
+}
+
+// Progress event of a build, sent as a [cmdBuildEvent] message.
+//
+// The first event of every build has kind "started" and carries the build
+// ID. Events are numbered from 1; a gap in the numbers means the client
+// fell behind and missed events.
+type buildEvent struct {
+	ID       string `json:"id"`                 // Build ID.
+	Seq      int    `json:"seq"`                // Sequence number within the build.
+	Time     string `json:"time"`               // RFC 3339 timestamp.
+	Kind     string `json:"kind"`               // "started" or one of the [build.EventKind] values.
+	Platform string `json:"platform,omitempty"` // Platform being built.
+	Stage    string `json:"stage,omitempty"`    // Stage label.
+	Message  string `json:"message,omitempty"`  // Detail such as the step being run, or a line of step output.
+	Stream   string `json:"stream,omitempty"`   // Stream of an output event, "stdout" or "stderr".
+	Current  int64  `json:"current,omitempty"`  // Bytes of a pull event's item transferred so far.
+	Total    int64  `json:"total,omitempty"`    // Size of a pull event's item in bytes. Zero when unknown.
+}
+
+// Result of a [cmdDrain] command.
+type drainResult struct {
+	Canceled []string `json:"canceled,omitempty"` // IDs of the builds the drain canceled.
+}
+
+// A finished build in a [buildListResult].
+type buildRecord struct {
+	ID        string   `json:"id"`                  // Build ID.
+	Resource  string   `json:"resource,omitempty"`  // Resource name of the request.
+	Platforms []string `json:"platforms,omitempty"` // Target platforms. Empty means the host's.
+	Started   string   `json:"started"`             // RFC 3339 time the daemon received the build.
+	Finished  string   `json:"finished"`            // RFC 3339 time the build finished.
+	Result    string   `json:"result"`              // "succeeded", "failed", or "canceled".
+	Error     string   `json:"error,omitempty"`     // Error message of a build that did not succeed.
+	Code      string   `json:"code,omitempty"`      // Machine-readable code of the error, see [errorCode].
+}
+
+// Result of a [cmdBuildList] command.
+type buildListResult struct {
+	Builds []buildRecord `json:"builds"` // Finished builds, most recent first.
+}
+
+// Daemon status returned by the daemon.
+//
+// Extends [protocol.StatusResult] with whether new builds are refused
+// because of a [cmdDrain], and how many builds wait for a free slot.
+type statusResult struct {
+	protocol.StatusResult
+	Draining bool `json:"draining,omitempty"` // Whether new builds are refused until [cmdResume].
+	Queued   int  `json:"queued,omitempty"`   // Builds waiting for a free slot.
+}
+
+// Request to cancel a running build.
+type buildCancelRequest struct {
+	ID string `json:"id"` // Build ID from the build's first event.
+}
+
+// Request to follow a running build.
+type buildAttachRequest struct {
+	ID string `json:"id"` // Build ID from the build's first event.
+}
+
+// Per-stage settings carried by a [buildRequest].
+type stageRequest struct {
+	Cleanup     []string          `json:"cleanup,omitempty"`     // Absolute paths removed before the stage is committed.
+	AllowStderr []int             `json:"allowStderr,omitempty"` // 1-based steps exempt from strictStderr.
+	From        map[string]string `json:"from,omitempty"`        // Base image per target platform, overriding the recipe's from.
+	MemoryLimit int64             `json:"memoryLimit,omitempty"` // Most memory in bytes the stage's steps may use together.
+	CPUs        float64           `json:"cpus,omitempty"`        // CPUs' worth of time the stage's steps may use.
+	Verify      []string          `json:"verify,omitempty"`      // Commands that must succeed in the finished stage before it is exported.
+}
+
+// Extends [protocol.ContainerExecRequest] with streamed output.
+type containerExecRequest struct {
+	protocol.ContainerExecRequest
+	Stream      bool          `json:"stream,omitempty"`      // Send output as [cmdOutput] messages while the command runs.
+	Interactive bool          `json:"interactive,omitempty"` // Also read the command's input from [cmdInput] messages. Implies Stream.
+	TTY         bool          `json:"tty,omitempty"`         // Run an interactive command on a terminal, resized by [cmdResize] messages.
+	Size        *terminalSize `json:"size,omitempty"`        // Initial size of the terminal. Nil uses containerd's default.
+}
+
+// Size of a terminal, sent in a [containerExecRequest] and as the payload of
+// a [cmdResize] message.
+type terminalSize struct {
+	Width  uint16 `json:"width"`  // Columns.
+	Height uint16 `json:"height"` // Rows.
+}
+
+// Extends [protocol.ContainerExecResult] with whether the buffered output
+// was cut at the daemon's limit.
+type containerExecResult struct {
+	protocol.ContainerExecResult
+	StdoutTruncated bool `json:"stdoutTruncated,omitempty"` // Stdout holds only the first bytes of the output.
+	StderrTruncated bool `json:"stderrTruncated,omitempty"` // Stderr holds only the first bytes of the output.
+}
+
+// Run request accepted by the daemon.
+//
+// Runs a single command in a fresh container started from an OCI image
+// reference, without a recipe. The container is destroyed once the command
+// exits.
+type runRequest struct {
+	Ref      string   `json:"ref"`                // OCI image reference, such as "alpine:3.21".
+	Platform string   `json:"platform,omitempty"` // Target platform. Defaults to the first default platform, else the host's.
+	Command  []string `json:"command"`            // Command and arguments to run.
+}
+
+// Final payload of a run command, sent after all output.
+type runResult struct {
+	ExitCode int `json:"exitCode"` // Exit code of the command.
+}
+
+// Request for the snapshot mounts of a container.
+type containerMountsRequest struct {
+	ID string `json:"id"` // Container ID.
+}
+
+// Result of a [cmdContainerMounts] command.
+type containerMountsResult struct {
+	Mounts []mountResult `json:"mounts"` // Mounts that assemble the container's root filesystem.
+}
+
+// Request to destroy the containers of a resource.
+type containerDestroyPrefixRequest struct {
+	Prefix string `json:"prefix"` // Resource name or container ID prefix, such as "my-app" or "my-app-linux-amd64".
+}
+
+// Result of a [cmdContainerDestroyPrefix] command.
+type containerDestroyPrefixResult struct {
+	Destroyed []string `json:"destroyed"` // IDs of the destroyed containers.
+}
+
+// Request to remove build cache entries.
+type cacheClearRequest struct {
+	Resource    string `json:"resource,omitempty"`    // Resource name or prefix, such as "my-app". Empty clears the whole cache.
+	Snapshotter string `json:"snapshotter,omitempty"` // containerd snapshotter holding the entries, instead of the daemon's.
+}
+
+// Result of a [cmdCacheClear] command.
+type cacheClearResult struct {
+	Removed   int   `json:"removed"`         // Cache entries removed.
+	InUse     int   `json:"inUse,omitempty"` // Matching entries kept because a container still uses them.
+	Reclaimed int64 `json:"reclaimed"`       // Bytes freed by the removed entries.
+}
+
+// A single snapshot mount in a [containerMountsResult].
+type mountResult struct {
+	Type    string   `json:"type"`              // Filesystem type.
+	Source  string   `json:"source"`            // Mount source on the host.
+	Options []string `json:"options,omitempty"` // Mount options.
+}
+
+// Image-start request extended with container settings.
+type imageStartRequest struct {
+	protocol.ImageStartRequest
+	Hostname  string            `json:"hostname,omitempty"`  // Hostname of a newly created container. Empty keeps containerd's default.
+	Recreate  bool              `json:"recreate,omitempty"`  // Replace the container even when it already runs the image.
+	Readiness *readinessRequest `json:"readiness,omitempty"` // Check the service must pass before the command succeeds. Nil succeeds once the task starts.
+}
+
+// Readiness probe of an image-start request, see [runtime.ReadinessProbe].
+type readinessRequest struct {
+	Command  []string `json:"command,omitempty"`  // Command run in the container, ready once it exits 0.
+	Port     int      `json:"port,omitempty"`     // TCP port of the service, ready once it accepts a connection.
+	Timeout  string   `json:"timeout,omitempty"`  // Go duration the service has to become ready, such as "1m". Empty uses the default.
+	Interval string   `json:"interval,omitempty"` // Go duration between two probes. Empty uses the default.
+}
+
+// Converts the readiness probe of a request into start options. A request
+// without one has no probe.
+func (r *imageStartRequest) readiness() (*runtime.ReadinessProbe, error) {
+	if r.Readiness == nil {
+		return nil, nil
+	}
+	probe := &runtime.ReadinessProbe{Command: r.Readiness.Command, Port: r.Readiness.Port}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"timeout", r.Readiness.Timeout, &probe.Timeout},
+		{"interval", r.Readiness.Interval, &probe.Interval},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return nil, crex.Wrapf(runtime.ErrRuntime, "invalid readiness %s %q: must be a positive duration", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	return probe, nil
+}
+
+// Result of an image-import, image-start, or image-destroy command.
+//
+// Earlier daemons answered these commands with an empty [protocol.CmdOK],
+// so clients must tolerate a missing payload.
+type imageResult struct {
+	Tag        string `json:"tag"`                  // Containerd image tag computed by [protocol.ImageTag].
+	Digest     string `json:"digest,omitempty"`     // Digest of the image. Empty when a destroyed tag did not exist.
+	Action     string `json:"action"`               // What the command did, one of the [runtime.ImageAction] values.
+	ID         string `json:"id,omitempty"`         // Container ID (image-start only).
+	Containers int    `json:"containers,omitempty"` // Containers removed with the image (image-destroy only).
+}
+
+// Returns the wire form of a runtime image result.
+func newImageResult(tag string, res *runtime.ImageResult) *imageResult {
+	return &imageResult{
+		Tag:        tag,
+		Digest:     res.Digest,
+		Action:     string(res.Action),
+		Containers: res.Containers,
+	}
+}
+
+// Request for the image tag of a Crucible reference.
+type resolveTagRequest struct {
+	Ref     string `json:"ref"`     // Crucible resource reference.
+	Version string `json:"version"` // Resource version.
+}
+
+// Result of a [cmdResolveTag] command.
+type resolveTagResult struct {
+	Tag      string `json:"tag"`      // Containerd image tag computed by [protocol.ImageTag].
+	Present  bool   `json:"present"`  // Whether an image with the tag exists.
+	Unpacked bool   `json:"unpacked"` // Whether the image is unpacked for the host platform.
+}
+
+// Version of the [capabilitiesResult] document. It is incremented only when
+// a field changes meaning; new fields and features are added without a bump,
+// so clients should ignore what they do not recognize.
+const capabilitiesVersion = 1
+
+// Optional features reported in a [capabilitiesResult]. A feature that is
+// absent from the list is not supported by the daemon.
+const (
+	featureRecipeDocument   = "recipe-document"          // Builds accept raw recipe documents.
+	featureRun              = "run"                      // The run command is available.
+	featureOutputStreaming  = "output-streaming"         // Process output is streamed as output messages.
+	featureContainerMounts  = "container-mounts"         // The container-mounts command is available.
+	featureResolveTag       = "resolve-tag"              // The resolve-tag command is available.
+	featureBreakpoints      = "breakpoints"              // Builds can pause at a breakpoint.
+	featureStrictStderr     = "strict-stderr"            // Run steps can fail when they write to stderr.
+	featureReadOnlyRootfs   = "read-only-rootfs"         // Steps can run with a read-only root filesystem.
+	featureContainerLimits  = "container-limits"         // Builds accept rlimits, capabilities, and seccomp profiles.
+	featurePlatformFallback = "platform-fallback"        // Exports can fall back to another platform's manifest.
+	featureLayerAnnotations = "layer-annotations"        // Exported layers can be annotated with their source stage.
+	featureCopyChown        = "copy-chown"               // Copies can set the ownership of copied files.
+	featureBuildTimeout     = "build-timeout"            // Builds accept a maximum duration.
+	featureCopySymlinks     = "copy-symlinks"            // Copies can follow symbolic links inside directories.
+	featureStrictCopyModes  = "strict-copy-modes"        // Copies can fail on setuid, setgid, or world-writable files.
+	featurePush             = "push"                     // Builds can push the output image to a registry.
+	featureBuildAttach      = "build-attach"             // Builds stream progress events and can be attached to.
+	featureDestroyPrefix    = "container-destroy-prefix" // Containers can be destroyed by ID prefix.
+	featureDebugExport      = "debug-export"             // Builds can export transient stages for debugging.
+	featureStartRecreate    = "image-start-recreate"     // Image-start checks the container's image and can force a new container.
+	featureDigestFilename   = "digest-filename"          // Archives can be named after the image digest.
+	featureSnapshotter      = "build-snapshotter"        // Builds can choose the containerd snapshotter.
+	featureExecStreaming    = "exec-streaming"           // Container-exec can stream output as output messages.
+	featureExecOutputLimit  = "exec-output-limit"        // Buffered container-exec output is capped and flags truncation.
+	featureDNSOptions       = "dns-options"              // Builds can set DNS search domains and resolver options.
+	featureStageLimits      = "stage-limits"             // Stages accept memory and CPU limits.
+	featureStepOutput       = "step-output"              // Build events include the output of run steps.
+	featureInlineFiles      = "inline-files"             // Copy steps can write heredoc contents to a file.
+	featureSourceDateEpoch  = "source-date-epoch"        // Builds can set SOURCE_DATE_EPOCH for run steps.
+	featureBuildCancel      = "build-cancel"             // Running builds can be canceled by ID.
+	featureStageVerify      = "stage-verify"             // Stages accept commands that verify them before export.
+	featureStepCache        = "step-cache"               // Steps are cached by content, and builds can opt out with noCache.
+	featureDockerSave       = "docker-save"              // Builds can export archives in the legacy docker save layout.
+	featureCopyChmod        = "copy-chmod"               // Copies can set the permissions of copied files.
+	featureCruxignore       = "cruxignore"               // Host copies skip paths listed in the context's .cruxignore.
+	featureBuildWarnings    = "build-warnings"           // Build results list non-fatal issues as warnings.
+	featureCopyGlobs        = "copy-globs"               // Copies accept several sources and glob patterns.
+	featureInterpolation    = "env-interpolation"        // Commands, copy paths, and workdirs expand "${NAME}" variables.
+	featureDeclaredArgs     = "declared-args"            // Recipe documents may declare the build arguments they accept.
+	featureImageLabels      = "image-labels"             // Builds can set labels on the output image's config.
+	featureOutputSampling   = "output-sampling"          // Streamed run output can be cut to its head and tail.
+	featureImageTags        = "image-tags"               // Builds can name the output image by several tags.
+	featureDrain            = "drain"                    // Running builds can be canceled at once with drain, and builds refused until resume.
+	featureSquash           = "squash"                   // Builds can export the output image as a single layer.
+	featureBuildQueue       = "build-queue"              // Builds beyond the concurrency limit wait in a queue and report their position.
+	featurePlatformConfig   = "platform-config"          // Builds can set the entrypoint and cmd per target platform.
+	featureBuildHistory     = "build-history"            // The build-list command reports recently finished builds.
+	featureShutdown         = "shutdown"                 // The shutdown command stops the daemon once in-flight commands finish.
+	featureSessions         = "sessions"                 // A connection can carry several commands, one after the other.
+	featureRecipeLabels     = "recipe-labels"            // Recipe documents may set labels on the output image.
+	featureReadiness        = "readiness"                // Image-start can wait for the service to pass a readiness probe.
+	featureInteractiveExec  = "interactive-exec"         // Container-exec can feed the command's stdin and run it on a terminal.
+	featureAppArmor         = "apparmor"                 // Builds accept an AppArmor profile for their containers.
+	featurePullProgress     = "pull-progress"            // Build events report the transfer progress of base images.
+	featureCacheClear       = "cache-clear"              // The build cache can be cleared by resource, and builds can clear it with cacheClear.
+	featureSecrets          = "secrets"                  // Builds can mount secrets. Only reported when a secret source is configured.
+	featureContextFetch     = "context-fetch"            // Builds can fetch the files copy steps read from a context the client advertises.
+	featureContextArchive   = "context-archive"          // Builds can receive the whole context from the client as a tar archive.
+)
+
+// Where the value of a [configSetting] came from.
+const (
+	sourceConfigured = "configured" // Set in the startup configuration, usually by a flag.
+	sourceDefault    = "default"    // Not set, so the daemon's default applies.
+	sourceDerived    = "derived"    // Determined by the daemon from its environment.
+)
+
+// A single value of the daemon's effective configuration.
+type configSetting struct {
+	Name     string `json:"name"`               // Setting name, matching the flag without dashes where there is one.
+	Value    any    `json:"value"`              // Effective value after defaults are applied.
+	Source   string `json:"source"`             // One of sourceConfigured, sourceDefault, or sourceDerived.
+	Redacted bool   `json:"redacted,omitempty"` // Whether sensitive parts of the value were removed.
+}
+
+// Result of a [cmdConfig] command.
+type configResult struct {
+	Settings []configSetting `json:"settings"` // Settings in a fixed order.
+}
+
+// Result of a [cmdCapabilities] command.
+type capabilitiesResult struct {
+	Version             int                `json:"version"`                       // Document version, see [capabilitiesVersion].
+	Features            []string           `json:"features"`                      // Supported optional features.
+	RecipeVersions      recipeVersionRange `json:"recipeVersions"`                // Accepted recipe schema versions.
+	Compressions        []string           `json:"compressions"`                  // Compression algorithms of exported layers.
+	Platforms           []string           `json:"platforms"`                     // Platforms stage containers can run on.
+	DefaultPlatforms    []string           `json:"defaultPlatforms,omitempty"`    // Platforms built when a request names none. Empty means the host.
+	MaxMessageSize      int64              `json:"maxMessageSize"`                // Largest accepted message in bytes, newline included.
+	MaxLayerSize        int64              `json:"maxLayerSize,omitempty"`        // Largest committed layer in bytes. Zero means unlimited.
+	MaxBuildDuration    string             `json:"maxBuildDuration,omitempty"`    // Longest a build may run. Empty means unlimited.
+	MaxConcurrentBuilds int                `json:"maxConcurrentBuilds,omitempty"` // Most builds run at once; others wait in a queue. Zero means unlimited.
+	RemoteContainerd    bool               `json:"remoteContainerd,omitempty"`    // Containerd runs on another host, so build, run, and container-exec are refused.
+}
+
+// Range of recipe schema versions in a [capabilitiesResult].
+type recipeVersionRange struct {
+	Min int `json:"min"` // Oldest accepted version.
+	Max int `json:"max"` // Newest accepted version.
+}
+
+// Payload of a [cmdOutput] message.
+//
+// Data is base64-encoded on the wire, so output that is not valid UTF-8,
+// such as binary output or a multibyte character split across two writes,
+// reaches the client unchanged.
+type outputChunk struct {
+	Stream string `json:"stream"` // Either "stdout" or "stderr".
+	Data   []byte `json:"data"`   // Output bytes as written by the process.
+}
+
+// Payload of a [cmdInput] message.
+//
+// Data is base64-encoded on the wire, like the data of an [outputChunk], so
+// binary input and terminal control bytes reach the command unchanged.
+type inputChunk struct {
+	Data  []byte `json:"data,omitempty"`  // Bytes written to the command's stdin.
+	Close bool   `json:"close,omitempty"` // Close the command's stdin after Data.
+}
+
+// Converts the resource limits of a request into runtime limits.
+func (r *buildRequest) rlimits() []runtime.Rlimit {
+	rlimits := make([]runtime.Rlimit, 0, len(r.Rlimits))
+	for _, rl := range r.Rlimits {
+		rlimits = append(rlimits, runtime.Rlimit{Type: rl.Type, Soft: rl.Soft, Hard: rl.Hard})
+	}
+	return rlimits
+}
+
+// Converts the secret references of a request into build options.
+func (r *buildRequest) secrets() []build.SecretMount {
+	secrets := make([]build.SecretMount, 0, len(r.Secrets))
+	for _, s := range r.Secrets {
+		secrets = append(secrets, build.SecretMount{ID: s.ID, Target: s.Target})
+	}
+	return secrets
+}
+
+// Converts the output sampling of a request into build options. A request
+// without it samples nothing.
+func (r *buildRequest) outputSampling() build.OutputSampling {
+	if r.OutputSampling == nil {
+		return build.OutputSampling{}
+	}
+	return build.OutputSampling{HeadLines: r.OutputSampling.HeadLines, HeadBytes: r.OutputSampling.HeadBytes, TailLines: r.OutputSampling.TailLines}
+}
+
+// Converts the breakpoint of a request into build options.
+func (r *buildRequest) breakpoint() *build.Breakpoint {
+	if r.BreakAt == nil {
+		return nil
+	}
+	return &build.Breakpoint{Stage: r.BreakAt.Stage, Step: r.BreakAt.Step}
+}
+
+// Converts the per-platform image settings of a request into build options.
+func (r *buildRequest) platformConfigs() map[string]build.ImageConfig {
+	if len(r.PlatformConfig) == 0 {
+		return nil
+	}
+	configs := make(map[string]build.ImageConfig, len(r.PlatformConfig))
+	for platform, cfg := range r.PlatformConfig {
+		configs[platform] = build.ImageConfig{
+			Entrypoint:       cfg.Entrypoint,
+			AppendEntrypoint: cfg.AppendEntrypoint,
+			Cmd:              cfg.Cmd,
+			KeepCmd:          cfg.KeepCmd,
+		}
+	}
+	return configs
+}
+
+// Converts the per-stage settings of a request into build options.
+func (r *buildRequest) stageOptions() map[string]build.StageOptions {
+	if len(r.Stages) == 0 {
+		return nil
+	}
+	opts := make(map[string]build.StageOptions, len(r.Stages))
+	for key, stage := range r.Stages {
+		opts[key] = build.StageOptions{
+			Cleanup:     stage.Cleanup,
+			AllowStderr: stage.AllowStderr,
+			From:        stage.From,
+			MemoryLimit: stage.MemoryLimit,
+			CPUs:        stage.CPUs,
+			Verify:      stage.Verify,
+		}
+	}
+	return opts
+}
+
+// Error payload returned by the daemon.
+//
+// Extends [protocol.ErrorResult] with a code so that clients can react to
+// specific failures without matching on the message text. Clients that only
+// know about [protocol.ErrorResult] still receive the message.
+type errorResult struct {
+	protocol.ErrorResult
+	Code string `json:"code,omitempty"` // Machine-readable error code, if any.
+}
+
+// Builds an error payload for a failed command, attaching the code that
+// matches the error's classification.
+func newErrorResult(err error) *errorResult {
+	return &errorResult{
+		ErrorResult: protocol.ErrorResult{Message: err.Error()},
+		Code:        errorCode(err),
+	}
+}
+
+// Returns the machine-readable code for an error, or an empty string when
+// the error has no dedicated classification.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, build.ErrUnsupportedRecipeVersion):
+		return codeUnsupportedRecipeVersion
+	case errors.Is(err, build.ErrInvalidRecipe):
+		return codeInvalidRecipe
+	case errors.Is(err, build.ErrInvalidOptions):
+		return codeInvalidOptions
+	case errors.Is(err, build.ErrSecret):
+		return codeSecretUnavailable
+	case errors.Is(err, ErrBuildTimeout):
+		return codeBuildTimeout
+	case errors.Is(err, ErrBuildCanceled):
+		return codeBuildCanceled
+	case errors.Is(err, build.ErrVerifyFailed):
+		return codeVerifyFailed
+	case errors.Is(err, build.ErrMemoryLimitExceeded):
+		return codeMemoryLimitExceeded
+	case errors.Is(err, runtime.ErrRegistryNotAllowed):
+		return codeRegistryNotAllowed
+	case errors.Is(err, runtime.ErrRegistryTimeout):
+		return codeRegistryTimeout
+	case errors.Is(err, ErrDraining):
+		return codeDraining
+	case errors.Is(err, runtime.ErrNotReady):
+		return codeNotReady
+	case errors.Is(err, ErrMessageTooLarge):
+		return codeMessageTooLarge
+	case errors.Is(err, ErrInvalidReference):
+		return codeInvalidReference
+	case errors.Is(err, build.ErrContextTransfer):
+		return codeContextTransfer
+	case errors.Is(err, runtime.ErrRemote):
+		return codeRemoteContainerd
+	default:
+		return ""
+	}
+}
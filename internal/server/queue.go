@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/cruciblehq/cruxd/internal/build"
+)
+
+// Kind of the event sent while a build waits for a free slot. Its message
+// is the build's 1-based position in the queue.
+const buildQueued build.EventKind = "queued"
+
+// Bounds how many builds run at once, admitting waiting builds in the order
+// they arrived.
+//
+// A nil queue admits any number of builds right away.
+type buildQueue struct {
+	mu      sync.Mutex     // Protects the fields below.
+	limit   int            // Most builds running at once.
+	running int            // Builds holding a slot.
+	waiting []*queuedBuild // Builds waiting for a slot, first in line first.
+}
+
+// A build waiting in a [buildQueue].
+type queuedBuild struct {
+	ready chan struct{} // Closed when the build is handed a slot.
+	moved chan struct{} // Signalled when the build moves up the queue.
+}
+
+// Creates a queue running at most limit builds at once. Returns nil, which
+// admits any number, when limit is zero or negative.
+func newBuildQueue(limit int) *buildQueue {
+	if limit <= 0 {
+		return nil
+	}
+	return &buildQueue{limit: limit}
+}
+
+// Waits for a free slot and returns a function that frees it again.
+//
+// While the build waits, position is called with its 1-based position in
+// the queue when it joins and each time it moves up. Fails with the
+// context's cause when ctx ends first, leaving the queue as if the build
+// had never joined it.
+func (q *buildQueue) acquire(ctx context.Context, position func(int)) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	b := &queuedBuild{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	q.waiting = append(q.waiting, b)
+	pos := len(q.waiting)
+	q.mu.Unlock()
+
+	position(pos)
+	for {
+		select {
+		case <-b.ready:
+			return q.release, nil
+		case <-b.moved:
+			q.mu.Lock()
+			moved := slices.Index(q.waiting, b) + 1
+			q.mu.Unlock()
+			if moved == 0 {
+				<-b.ready
+				return q.release, nil
+			}
+			if moved != pos {
+				pos = moved
+				position(pos)
+			}
+		case <-ctx.Done():
+			if !q.leave(b) {
+				// The slot was handed over as the context ended.
+				q.release()
+			}
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// Frees a slot, handing it to the first waiting build if there is one.
+func (q *buildQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.ready)
+	q.notifyMoved(0)
+}
+
+// Removes a waiting build from the queue. Returns false when it was
+// already handed a slot.
+func (q *buildQueue) leave(b *queuedBuild) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.waiting, b)
+	if i < 0 {
+		return false
+	}
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	q.notifyMoved(i)
+	return true
+}
+
+// Tells the builds from position i on that they moved up. Must be called
+// with q.mu held.
+func (q *buildQueue) notifyMoved(i int) {
+	for _, b := range q.waiting[i:] {
+		select {
+		case b.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns the number of builds waiting for a slot.
+func (q *buildQueue) queued() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Joins q in the background, sending each reported position to positions.
+// Once admitted the build frees its slot right away, and the result of the
+// wait is sent to done.
+func waitInQueue(ctx context.Context, q *buildQueue, positions chan<- int, done chan<- error) {
+	go func() {
+		release, err := q.acquire(ctx, func(pos int) { positions <- pos })
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+}
+
+// Returns the next value from ch, failing the test if none arrives in time.
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	var v T
+	select {
+	case v = <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+	return v
+}
+
+func TestBuildQueue(t *testing.T) {
+	q := newBuildQueue(1)
+	first, err := q.acquire(context.Background(), func(int) { t.Error("first build was queued") })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secondPos, secondDone := make(chan int, 4), make(chan error, 1)
+	waitInQueue(context.Background(), q, secondPos, secondDone)
+	if pos := receive(t, secondPos); pos != 1 {
+		t.Errorf("second position = %d, want 1", pos)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	thirdPos, thirdDone := make(chan int, 4), make(chan error, 1)
+	waitInQueue(ctx, q, thirdPos, thirdDone)
+	if pos := receive(t, thirdPos); pos != 2 {
+		t.Errorf("third position = %d, want 2", pos)
+	}
+
+	fourthPos, fourthDone := make(chan int, 4), make(chan error, 1)
+	waitInQueue(context.Background(), q, fourthPos, fourthDone)
+	if pos := receive(t, fourthPos); pos != 3 {
+		t.Errorf("fourth position = %d, want 3", pos)
+	}
+	if n := q.queued(); n != 3 {
+		t.Errorf("queued = %d, want 3", n)
+	}
+
+	cancel(ErrBuildCanceled)
+	if err := receive(t, thirdDone); !errors.Is(err, ErrBuildCanceled) {
+		t.Errorf("canceled wait = %v, want ErrBuildCanceled", err)
+	}
+	if pos := receive(t, fourthPos); pos != 2 {
+		t.Errorf("fourth position after cancel = %d, want 2", pos)
+	}
+
+	first()
+	if err := receive(t, secondDone); err != nil {
+		t.Errorf("second build = %v", err)
+	}
+	if err := receive(t, fourthDone); err != nil {
+		t.Errorf("fourth build = %v", err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running != 0 || len(q.waiting) != 0 {
+		t.Errorf("running = %d, queued = %d after every build finished", q.running, len(q.waiting))
+	}
+}
+
+func TestBuildQueueUnlimited(t *testing.T) {
+	q := newBuildQueue(0)
+	if q != nil {
+		t.Fatal("zero limit should admit any number of builds")
+	}
+	for range 10 {
+		if _, err := q.acquire(context.Background(), func(int) { t.Error("build was queued") }); err != nil {
+			t.Fatalf("unlimited acquire = %v", err)
+		}
+	}
+	if n := q.queued(); n != 0 {
+		t.Errorf("queued = %d, want 0", n)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -11,11 +12,17 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	goruntime "runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/containerd/containerd/v2/pkg/identifiers"
+	"github.com/containerd/platforms"
 	"github.com/cruciblehq/crex"
+	"github.com/cruciblehq/cruxd/internal"
+	"github.com/cruciblehq/cruxd/internal/build"
 	"github.com/cruciblehq/cruxd/internal/runtime"
 	"github.com/cruciblehq/spec/paths"
 	"github.com/cruciblehq/spec/protocol"
@@ -29,35 +36,112 @@ const (
 	// Default containerd namespace for images and containers.
 	DefaultContainerdNamespace = "cruxd"
 
-	// Group name used to grant socket access. Members of this group can
-	// connect to the daemon socket without owning the process.
-	socketGroup = "cruxd"
+	// Default group name used to grant socket access. Members of this group
+	// can connect to the daemon socket without owning the process.
+	DefaultSocketGroup = "cruxd"
 
-	// File mode applied to the Unix socket. Owner and group get read-write
-	// (required for connect); others get no access.
-	socketMode = 0660
+	// Default file mode applied to the Unix socket. Owner and group get
+	// read-write (required for connect); others get no access.
+	DefaultSocketMode os.FileMode = 0660
+
+	// Default limit on the size of a build context copied into memory.
+	DefaultMemoryContextLimit int64 = 512 << 20
+
+	// Default limit on each of stdout and stderr returned by a container-exec
+	// that does not stream its output.
+	DefaultMaxExecOutput int64 = 16 << 20
+
+	// Default limit on the size of a single message a client sends, which
+	// bounds the memory a connection can make the daemon hold.
+	DefaultMaxMessageSize int64 = 16 << 20
+
+	// Default time a shutdown command waits for the commands being handled
+	// to finish before the runtime is closed under them.
+	DefaultShutdownGracePeriod = 30 * time.Second
+
+	// Time allowed for removing the build containers left by a previous
+	// daemon before the socket starts accepting connections.
+	orphanCleanupTimeout = 30 * time.Second
 )
 
+// Returns the default number of compression workers: half the CPUs, and
+// at least one.
+//
+// Compressing a layer keeps a core busy for the length of the export, so
+// leaving the other half free keeps exports from starving the builds that
+// run alongside them, at the cost of exports queueing when many finish at
+// once.
+func DefaultCompressionWorkers() int {
+	return max(1, goruntime.NumCPU()/2)
+}
+
 // Holds server configuration.
 type Config struct {
-	SocketPath          string // Override for the Unix socket path. Empty uses the default.
-	PIDFilePath         string // Override for the PID file path. Empty uses the default.
-	ContainerdAddress   string // Containerd socket address. Empty uses [DefaultContainerdAddress].
-	ContainerdNamespace string // Containerd namespace for images and containers. Empty uses [DefaultContainerdNamespace].
-	ReadyFD             int    // File descriptor to signal readiness on. Negative means disabled.
+	SocketPath          string        // Override for the Unix socket path. Empty uses the default.
+	PIDFilePath         string        // Override for the PID file path. Empty derives it from SocketPath when set, or uses the default.
+	SocketGroup         string        // Group granted access to the socket. Empty uses [DefaultSocketGroup].
+	SocketMode          os.FileMode   // File mode applied to the socket. Zero uses [DefaultSocketMode].
+	ContainerdAddress   string        // Containerd socket path, or "tcp://host:port" for a remote daemon. Empty uses [DefaultContainerdAddress].
+	ContainerdNamespace string        // Containerd namespace for images and containers. Empty uses [DefaultContainerdNamespace].
+	ReadyFD             int           // File descriptor to signal readiness on. Negative means disabled.
+	MaxLayerSize        int64         // Maximum size in bytes of a layer committed by a build. Zero means unlimited.
+	SecretDir           string        // Directory holding build secrets, one file per secret ID.
+	SecretEnvPrefix     string        // Prefix of environment variables holding build secrets.
+	DefaultPlatforms    []string      // Target platforms for builds that do not specify any. Empty builds for the host platform.
+	MaxBuildDuration    time.Duration // Longest a build may run before it is cancelled. Zero means unlimited.
+	AllowedRegistries   []string      // Registry hosts base images may be pulled from. Empty allows any.
+	InsecureRegistries  []string      // Registry hosts reached over plain HTTP instead of HTTPS.
+	RequireDigest       bool          // Reject builds whose OCI base images are not pinned by digest.
+	MemoryContextDir    string        // Tmpfs directory that builds may copy their context into. Empty disables the option.
+	MemoryContextLimit  int64         // Largest context in bytes copied to MemoryContextDir. Zero uses [DefaultMemoryContextLimit].
+	StageRetries        int           // Times a stage is rebuilt after an infrastructure error. Zero disables retries.
+	RegistryTimeout     time.Duration // Longest a single pull or push may take. Zero means unlimited.
+	MaxExecOutput       int64         // Most bytes of each of stdout and stderr returned by a buffered container-exec. Zero uses [DefaultMaxExecOutput].
+	CompressionWorkers  int           // Most layers compressed or decompressed at once by exports. Zero uses [DefaultCompressionWorkers].
+	RegistryAuthFile    string        // Docker client config file whose registry credentials are used for pulls and pushes. Empty pulls anonymously.
+	MaxConcurrentBuilds int           // Most builds run at once; later builds wait in a queue. Zero means unlimited.
+	BuildHistoryFile    string        // File the history of recent builds is kept in across restarts. Empty keeps it in memory only.
+	ShutdownGracePeriod time.Duration // Longest a shutdown command waits for in-flight commands. Zero uses [DefaultShutdownGracePeriod].
+	MaxMessageSize      int64         // Largest message in bytes a client may send, newline included. Zero uses [DefaultMaxMessageSize].
 }
 
 // Listens on a Unix domain socket and dispatches commands.
 type Server struct {
-	socketPath  string           // Path to the Unix socket file.
-	pidFilePath string           // Path to the PID file.
-	readyFD     int              // File descriptor for readiness signaling (-1 = disabled).
-	runtime     *runtime.Runtime // Containerd-backed container runtime.
-	listener    net.Listener     // Listener for incoming connections.
-	startedAt   time.Time        // Timestamp when the server started.
-	builds      int              // Total number of build commands processed.
-	done        chan struct{}    // Channel to signal server shutdown.
-	mu          sync.Mutex       // Mutex to protect shared state.
+	socketPath  string                // Path to the Unix socket file.
+	pidFilePath string                // Path to the PID file.
+	socketGroup string                // Group granted access to the socket.
+	socketMode  os.FileMode           // File mode applied to the socket.
+	address     string                // Containerd socket address.
+	namespace   string                // Containerd namespace for images and containers.
+	readyFD     int                   // File descriptor for readiness signaling (-1 = disabled).
+	maxLayer    int64                 // Maximum size in bytes of a committed layer (0 = unlimited).
+	secrets     build.SecretSource    // Where build secret IDs are resolved.
+	platforms   []string              // Default target platforms for builds.
+	maxBuild    time.Duration         // Longest a build may run (0 = unlimited).
+	pinned      bool                  // Whether base images must be pinned by digest.
+	memContext  string                // Tmpfs directory for build contexts (empty = disabled).
+	memLimit    int64                 // Largest build context copied to memContext.
+	retries     int                   // Times a stage is rebuilt after an infrastructure error.
+	maxExecOut  int64                 // Most bytes of each output stream returned by a buffered exec.
+	maxMessage  int64                 // Largest message a client may send.
+	workers     int                   // Most layers compressed at once by exports.
+	queue       *buildQueue           // Builds running and waiting to run (nil = unlimited).
+	history     *buildHistory         // Recently finished builds.
+	grace       time.Duration         // Longest a shutdown waits for in-flight commands.
+	cfg         Config                // Configuration the server was created with, before defaults.
+	runtime     *runtime.Runtime      // Containerd-backed container runtime.
+	listener    net.Listener          // Listener for incoming connections.
+	startedAt   time.Time             // Timestamp when the server started.
+	builds      int                   // Total number of build commands processed.
+	feeds       map[string]*buildFeed // Progress of running and recently finished builds, by build ID.
+	draining    bool                  // Whether new builds are refused after a drain.
+	done        chan struct{}         // Channel to signal server shutdown.
+	stopped     chan struct{}         // Closed once the server has shut down.
+	accepting   chan struct{}         // Closed when the accept loop returns. Nil before [Server.Start].
+	handlers    sync.WaitGroup        // Connections being handled.
+	closeOnce   sync.Once             // Guards closing the listener.
+	stopOnce    sync.Once             // Guards releasing the runtime and files.
+	mu          sync.Mutex            // Mutex to protect shared state.
 }
 
 // Creates a new server instance.
@@ -69,9 +153,19 @@ func New(cfg Config) (*Server, error) {
 		socketPath = paths.Socket("default")
 	}
 
-	pidFilePath := cfg.PIDFilePath
-	if pidFilePath == "" {
-		pidFilePath = paths.PIDFile("default")
+	pidFilePath := pidFileFor(cfg)
+
+	socketGroup := cfg.SocketGroup
+	if socketGroup == "" {
+		socketGroup = DefaultSocketGroup
+	}
+
+	socketMode := cfg.SocketMode
+	if socketMode == 0 {
+		socketMode = DefaultSocketMode
+	}
+	if err := validateSocketMode(socketMode); err != nil {
+		return nil, err
 	}
 
 	containerdAddress := cfg.ContainerdAddress
@@ -83,41 +177,184 @@ func New(cfg Config) (*Server, error) {
 	if containerdNamespace == "" {
 		containerdNamespace = DefaultContainerdNamespace
 	}
+	if err := validateNamespace(containerdNamespace); err != nil {
+		return nil, err
+	}
+	if err := validatePlatforms(cfg.DefaultPlatforms); err != nil {
+		return nil, err
+	}
+	memoryContextLimit := cfg.MemoryContextLimit
+	if memoryContextLimit == 0 {
+		memoryContextLimit = DefaultMemoryContextLimit
+	}
+
+	if cfg.MaxBuildDuration < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid maximum build duration %s: must not be negative", cfg.MaxBuildDuration)
+	}
+	if cfg.RegistryTimeout < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid registry timeout %s: must not be negative", cfg.RegistryTimeout)
+	}
+	if cfg.StageRetries < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid stage retries %d: must not be negative", cfg.StageRetries)
+	}
+	if cfg.MaxExecOutput < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid maximum exec output %d: must not be negative", cfg.MaxExecOutput)
+	}
+	maxExecOutput := cfg.MaxExecOutput
+	if maxExecOutput == 0 {
+		maxExecOutput = DefaultMaxExecOutput
+	}
+	if cfg.MaxMessageSize < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid maximum message size %d: must not be negative", cfg.MaxMessageSize)
+	}
+	maxMessage := cfg.MaxMessageSize
+	if maxMessage == 0 {
+		maxMessage = DefaultMaxMessageSize
+	}
+	if cfg.CompressionWorkers < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid compression workers %d: must not be negative", cfg.CompressionWorkers)
+	}
+	if cfg.MaxConcurrentBuilds < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid maximum concurrent builds %d: must not be negative", cfg.MaxConcurrentBuilds)
+	}
+	compressionWorkers := cfg.CompressionWorkers
+	if compressionWorkers == 0 {
+		compressionWorkers = DefaultCompressionWorkers()
+	}
+
+	if cfg.ShutdownGracePeriod < 0 {
+		return nil, crex.Wrapf(ErrServer, "invalid shutdown grace period %s: must not be negative", cfg.ShutdownGracePeriod)
+	}
+	grace := cfg.ShutdownGracePeriod
+	if grace == 0 {
+		grace = DefaultShutdownGracePeriod
+	}
+
+	history, err := newBuildHistory(cfg.BuildHistoryFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials *runtime.RegistryCredentials
+	if cfg.RegistryAuthFile != "" {
+		loaded, err := runtime.LoadRegistryCredentials(cfg.RegistryAuthFile)
+		if err != nil {
+			return nil, crex.Wrap(ErrServer, err)
+		}
+		credentials = loaded
+	}
+
+	slog.Info("connecting to containerd", "address", containerdAddress, "namespace", containerdNamespace)
 
 	rt, err := runtime.New(containerdAddress, containerdNamespace)
 	if err != nil {
 		return nil, crex.Wrap(ErrServer, err)
 	}
+	rt.SetAllowedRegistries(cfg.AllowedRegistries)
+	rt.SetInsecureRegistries(cfg.InsecureRegistries)
+	rt.SetRegistryTimeout(cfg.RegistryTimeout)
+	rt.SetCompressionWorkers(compressionWorkers)
+	rt.SetRegistryCredentials(credentials)
 
 	return &Server{
 		socketPath:  socketPath,
 		pidFilePath: pidFilePath,
+		socketGroup: socketGroup,
+		socketMode:  socketMode,
+		address:     containerdAddress,
+		namespace:   containerdNamespace,
 		readyFD:     cfg.ReadyFD,
+		maxLayer:    cfg.MaxLayerSize,
+		secrets:     build.SecretSource{Dir: cfg.SecretDir, EnvPrefix: cfg.SecretEnvPrefix},
+		platforms:   cfg.DefaultPlatforms,
+		maxBuild:    cfg.MaxBuildDuration,
+		pinned:      cfg.RequireDigest,
+		memContext:  cfg.MemoryContextDir,
+		memLimit:    memoryContextLimit,
+		retries:     cfg.StageRetries,
+		maxExecOut:  maxExecOutput,
+		maxMessage:  maxMessage,
+		workers:     compressionWorkers,
+		queue:       newBuildQueue(cfg.MaxConcurrentBuilds),
+		history:     history,
+		grace:       grace,
+		cfg:         cfg,
 		runtime:     rt,
 		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}, nil
 }
 
-// Opens the Unix socket and begins accepting connections.
+// Opens the Unix socket and begins accepting connections, after removing
+// the build containers a previous daemon left behind.
 func (s *Server) Start() error {
-	listener, err := listen(s.socketPath)
+	listener, err := listen(s.socketPath, socketAccess{
+		group:       s.socketGroup,
+		mode:        s.socketMode,
+		groupForced: s.cfg.SocketGroup != "",
+		modeForced:  s.cfg.SocketMode != 0,
+	})
 	if err != nil {
 		return err
 	}
 
-	s.listener = listener
 	s.startedAt = time.Now()
+	s.removeOrphanedBuilds()
 
 	if err := writePID(s.pidFilePath); err != nil {
 		slog.Error("failed to write PID file", "error", err)
 	}
 
-	slog.Info("server listening on socket", "path", s.socketPath)
-
+	s.serve(listener)
+	s.logReady()
 	s.signalReady()
+	return nil
+}
+
+// Removes the stage containers that builds of a previous daemon process
+// left behind when it stopped mid-build.
+//
+// No build of this process has started yet, so every container labeled
+// with a build of this daemon's socket is an orphan. Other daemons sharing
+// the namespace keep their containers, and so do builds paused at a
+// breakpoint, which their clients destroy. A failure is logged rather than
+// returned, since leftover containers must not keep the daemon from
+// starting.
+func (s *Server) removeOrphanedBuilds() {
+	ctx, cancel := context.WithTimeout(context.Background(), orphanCleanupTimeout)
+	defer cancel()
 
+	removed, err := s.runtime.DestroyBuildContainers(ctx, s.socketPath)
+	if len(removed) > 0 {
+		slog.Info("removed orphaned build containers", "count", len(removed))
+	}
+	if err != nil {
+		slog.Warn("failed to remove orphaned build containers", "error", err)
+	}
+}
+
+// Begins accepting connections on listener.
+func (s *Server) serve(listener net.Listener) {
+	s.listener = listener
+	s.accepting = make(chan struct{})
 	go s.accept()
-	return nil
+}
+
+// Emits a single structured record confirming the server is accepting
+// connections and describing its effective configuration.
+//
+// Supervisors that do not speak the ready-fd protocol can watch the log for
+// this record instead. Every field is an attribute rather than part of the
+// message, so the record parses the same way regardless of the formatter.
+func (s *Server) logReady() {
+	slog.Info("ready",
+		"socket", s.socketPath,
+		"containerd", s.address,
+		"namespace", s.namespace,
+		"snapshotter", s.runtime.Snapshotter(),
+		"version", internal.VersionString(),
+		"pid", os.Getpid(),
+	)
 }
 
 // Signals readiness to the parent process via the ready-fd.
@@ -158,7 +395,10 @@ func (s *Server) signalReady() {
 
 // Creates the Unix socket listener, removes any stale socket from a previous
 // run, and applies permissions.
-func listen(socketPath string) (net.Listener, error) {
+//
+// If the permissions cannot be applied as requested, the listener is closed
+// and the socket removed so that no half-configured socket is left behind.
+func listen(socketPath string, access socketAccess) (net.Listener, error) {
 	dir := filepath.Dir(socketPath)
 	if err := os.MkdirAll(dir, paths.DefaultDirMode); err != nil {
 		return nil, crex.Wrap(ErrServer, err)
@@ -171,58 +411,182 @@ func listen(socketPath string) (net.Listener, error) {
 		return nil, crex.Wrapf(ErrServer, "failed to listen on %s", socketPath)
 	}
 
-	setSocketPermissions(socketPath)
+	if err := setSocketPermissions(socketPath, access); err != nil {
+		listener.Close()
+		os.Remove(socketPath)
+		return nil, err
+	}
 
 	return listener, nil
 }
 
+// Group and file mode applied to the daemon's socket.
+type socketAccess struct {
+	group       string      // Group granted access to the socket.
+	mode        os.FileMode // File mode of the socket.
+	groupForced bool        // Whether the group was configured rather than defaulted.
+	modeForced  bool        // Whether the mode was configured rather than defaulted.
+}
+
 // Restricts socket access to owner and group where supported.
 //
 // On virtiofs mounts (used by Lima on Darwin), permission changes may fail
-// because the host filesystem controls access. This is non-fatal since the
-// socket is already usable by the creating process.
-func setSocketPermissions(socketPath string) {
-	if err := os.Chmod(socketPath, socketMode); err != nil {
+// because the host filesystem controls access. With the default mode and
+// group this is non-fatal, since the socket is already usable by the
+// creating process, and a missing [DefaultSocketGroup] is tolerated for
+// single-user installs, leaving the socket accessible to the owner only.
+// A mode or group the operator configured that cannot be applied is an
+// error instead, so the daemon never runs with access other than the one
+// asked for.
+func setSocketPermissions(socketPath string, access socketAccess) error {
+	if err := os.Chmod(socketPath, access.mode); err != nil {
+		if access.modeForced {
+			return crex.Wrapf(ErrServer, "failed to set socket mode %#o: %w", access.mode, err)
+		}
 		slog.Debug("failed to chmod socket, filesystem may not support it", "path", socketPath, "error", err)
-		return
 	}
 
-	if g, err := user.LookupGroup(socketGroup); err == nil {
-		if gid, err := strconv.Atoi(g.Gid); err == nil {
-			if err := os.Chown(socketPath, -1, gid); err != nil {
-				slog.Warn("failed to chgrp socket", "group", socketGroup, "error", err)
-			}
+	g, err := user.LookupGroup(access.group)
+	if err != nil {
+		if access.groupForced {
+			return crex.Wrapf(ErrServer, "socket group %q not found", access.group)
+		}
+		slog.Warn("socket group not found, socket accessible to owner only", "group", access.group)
+		return nil
+	}
+
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return crex.Wrapf(ErrServer, "invalid gid %q for socket group %q", g.Gid, access.group)
+	}
+
+	if err := os.Chown(socketPath, -1, gid); err != nil {
+		if access.groupForced {
+			return crex.Wrapf(ErrServer, "failed to set socket group %q: %w", access.group, err)
 		}
-	} else {
-		slog.Warn("socket group not found, socket accessible to owner only", "group", socketGroup)
+		slog.Warn("failed to chgrp socket", "group", access.group, "error", err)
 	}
+
+	return nil
 }
 
-// Shuts down the server and cleans up resources.
-func (s *Server) Stop() error {
-	close(s.done)
+// Checks that a socket file mode is usable and free of surprising bits.
+//
+// Connecting to a Unix socket requires write permission, so the owner must
+// always have read-write access. Execute, setuid, setgid, and sticky bits
+// have no meaning on a socket and are rejected. Anything between 0600 (owner
+// only) and 0666 (any local user) is accepted. Loosening the mode beyond the
+// default grants every matching user full control over the daemon, including
+// running arbitrary commands in build containers, so 0666 should be reserved
+// for single-tenant hosts such as disposable CI runners.
+func validateSocketMode(mode os.FileMode) error {
+	if mode&^0666 != 0 {
+		return crex.Wrapf(ErrServer, "invalid socket mode %#o: only read-write bits are allowed", mode)
+	}
+	if mode&0600 != 0600 {
+		return crex.Wrapf(ErrServer, "invalid socket mode %#o: owner must have read-write access", mode)
+	}
+	return nil
+}
 
-	if s.listener != nil {
-		s.listener.Close()
+// Checks a containerd namespace name.
+//
+// Containerd accepts namespaces made of alphanumeric components joined by
+// single ".", "_", or "-" separators, at most 76 characters long. Rejecting
+// an invalid name here reports it before connecting, instead of as a failure
+// of the first containerd operation.
+func validateNamespace(namespace string) error {
+	if err := identifiers.Validate(namespace); err != nil {
+		return crex.Wrapf(ErrServer, "invalid containerd namespace %q: %w", namespace, err)
 	}
+	return nil
+}
 
-	if s.runtime != nil {
-		s.runtime.Close()
+// Checks that each configured default platform is a valid platform
+// specifier such as "linux/amd64" or "linux/arm/v7".
+func validatePlatforms(list []string) error {
+	for _, p := range list {
+		if _, err := platforms.Parse(p); err != nil {
+			return crex.Wrapf(ErrServer, "invalid default platform %q: %w", p, err)
+		}
 	}
+	return nil
+}
 
-	os.Remove(s.socketPath)
-	os.Remove(s.pidFilePath)
+// Shuts down the server and cleans up resources.
+//
+// Commands still being handled are cut off as the runtime closes under
+// them; [Server.Shutdown] lets them finish first. Stopping a server that is
+// already stopped does nothing.
+func (s *Server) Stop() error {
+	s.stopAccepting()
+
+	s.stopOnce.Do(func() {
+		if s.runtime != nil {
+			s.runtime.Close()
+		}
+
+		os.Remove(s.socketPath)
+		os.Remove(s.pidFilePath)
 
+		close(s.stopped)
+	})
 	return nil
 }
 
+// Shuts down the server once the commands being handled have finished.
+//
+// New connections are refused right away. The commands already received
+// have up to grace to finish, after which the server stops as with
+// [Server.Stop] regardless.
+func (s *Server) Shutdown(grace time.Duration) error {
+	s.stopAccepting()
+
+	idle := make(chan struct{})
+	go func() {
+		if s.accepting != nil {
+			<-s.accepting
+		}
+		s.handlers.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+	case <-time.After(grace):
+		slog.Warn("shutdown grace period expired with commands still running", "grace", grace)
+	}
+	return s.Stop()
+}
+
+// Closes the listener, so that no further connections are accepted.
+func (s *Server) stopAccepting() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+}
+
 // Blocks until the server stops.
 func (s *Server) Wait() {
-	<-s.done
+	<-s.stopped
+}
+
+// Returns a channel that is closed once the server has stopped, such as
+// after a shutdown command.
+func (s *Server) Stopped() <-chan struct{} {
+	return s.stopped
 }
 
 // Accepts connections in a loop until the server shuts down.
+//
+// Each connection is counted in s.handlers before the loop accepts the
+// next, and the loop has returned before [Server.Shutdown] waits for them,
+// so that no connection is added to a wait already in progress.
 func (s *Server) accept() {
+	defer close(s.accepting)
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -235,44 +599,76 @@ func (s *Server) accept() {
 			}
 		}
 
-		go s.handle(conn)
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handle(conn)
+		}()
 	}
 }
 
 // Processes a single connection.
 //
-// Reads one newline-delimited JSON message, dispatches the command, and
-// writes the response. The connection is closed after one exchange.
+// Reads newline-delimited JSON messages until the client closes the
+// connection, dispatching each command and writing its response before the
+// next is handled, so that one connection can run several commands in
+// turn. Clients that send a single command and close the connection once
+// they have their response work as before. A message that cannot be
+// decoded, or that is larger than the message size limit, is answered with
+// an error and the connection stays open. Once the server shuts down, the
+// connection is closed as soon as the command in progress, if any, has
+// finished.
 func (s *Server) handle(conn net.Conn) {
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
+	stop := make(chan struct{})
+	defer close(stop)
+	messages := readMessages(conn, stop, s.maxMessage)
 
-	line, err := reader.ReadBytes(byte(10))
-	if err != nil {
-		slog.Error("read error", "error", err)
-		return
-	}
-
-	env, payload, err := protocol.Decode(line)
-	if err != nil {
-		s.respond(conn, protocol.CmdError, &protocol.ErrorResult{Message: err.Error()})
-		return
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-messages.closed:
+			cancel()
+		case <-stop:
+		}
+	}()
 
-	slog.Info("command received", "command", env.Command)
+	for {
+		var msg message
+		select {
+		case <-s.done:
+			return
+		case msg = <-messages.lines:
+		case <-messages.closed:
+			return
+		}
+		if msg.err != nil {
+			s.respond(conn, protocol.CmdError, newErrorResult(msg.err))
+			continue
+		}
 
-	ctx, cancel := contextWithDisconnect(context.Background(), reader)
-	defer cancel()
+		env, payload, err := protocol.Decode(msg.line)
+		if err != nil {
+			s.respond(conn, protocol.CmdError, &protocol.ErrorResult{Message: err.Error()})
+			continue
+		}
 
-	s.dispatch(ctx, conn, env.Command, payload)
+		slog.Info("command received", "command", env.Command)
+		s.dispatch(ctx, conn, messages, env.Command, payload)
+	}
 }
 
 // Routes a command to the appropriate handler.
-func (s *Server) dispatch(ctx context.Context, conn net.Conn, cmd protocol.Command, payload json.RawMessage) {
+//
+// Handlers reply on conn. An interactive exec, and a build whose context
+// the client sends, also read the connection's further messages while they
+// run, which is why they are passed along.
+func (s *Server) dispatch(ctx context.Context, conn net.Conn, messages *messageReader, cmd protocol.Command, payload json.RawMessage) {
 	switch cmd {
 	case protocol.CmdBuild:
-		s.handleBuild(ctx, conn, payload)
+		s.handleBuild(ctx, conn, messages, payload)
 	case protocol.CmdImageImport:
 		s.handleImageImport(ctx, conn, payload)
 	case protocol.CmdImageStart:
@@ -286,11 +682,37 @@ func (s *Server) dispatch(ctx context.Context, conn net.Conn, cmd protocol.Comma
 	case protocol.CmdContainerStatus:
 		s.handleContainerStatus(ctx, conn, payload)
 	case protocol.CmdContainerExec:
-		s.handleContainerExec(ctx, conn, payload)
+		s.handleContainerExec(ctx, conn, messages, payload)
 	case protocol.CmdContainerUpdate:
 		s.handleContainerUpdate(ctx, conn, payload)
 	case protocol.CmdStatus:
 		s.handleStatus(ctx, conn)
+	case cmdRun:
+		s.handleRun(ctx, conn, payload)
+	case cmdCapabilities:
+		s.handleCapabilities(ctx, conn)
+	case cmdConfig:
+		s.handleConfig(ctx, conn)
+	case cmdBuildAttach:
+		s.handleBuildAttach(ctx, conn, payload)
+	case cmdBuildCancel:
+		s.handleBuildCancel(ctx, conn, payload)
+	case cmdDrain:
+		s.handleDrain(ctx, conn)
+	case cmdResume:
+		s.handleResume(ctx, conn)
+	case cmdBuildList:
+		s.handleBuildList(ctx, conn)
+	case cmdShutdown:
+		s.handleShutdown(ctx, conn)
+	case cmdResolveTag:
+		s.handleResolveTag(ctx, conn, payload)
+	case cmdContainerMounts:
+		s.handleContainerMounts(ctx, conn, payload)
+	case cmdContainerDestroyPrefix:
+		s.handleContainerDestroyPrefix(ctx, conn, payload)
+	case cmdCacheClear:
+		s.handleCacheClear(ctx, conn, payload)
 	default:
 		s.respond(conn, protocol.CmdError, &protocol.ErrorResult{
 			Message: fmt.Sprintf("unknown command: %s", cmd),
@@ -309,6 +731,23 @@ func (s *Server) respond(conn net.Conn, cmd protocol.Command, payload any) {
 	conn.Write(data)
 }
 
+// Returns the PID file path of a configuration.
+//
+// An explicit path is used as is. Without one, a daemon on a custom socket
+// keeps its PID file next to the socket, named after it with a ".pid"
+// extension, so that instances on different sockets do not share a PID
+// file. Otherwise the default path is used.
+func pidFileFor(cfg Config) string {
+	switch {
+	case cfg.PIDFilePath != "":
+		return cfg.PIDFilePath
+	case cfg.SocketPath != "":
+		return strings.TrimSuffix(cfg.SocketPath, filepath.Ext(cfg.SocketPath)) + ".pid"
+	default:
+		return paths.PIDFile("default")
+	}
+}
+
 // Writes the daemon PID to the PID file so the CLI can detect whether the
 // daemon is already running and send it signals.
 func writePID(pidFilePath string) error {
@@ -319,24 +758,88 @@ func writePID(pidFilePath string) error {
 	return os.WriteFile(pidFilePath, []byte(fmt.Sprintf("%d", os.Getpid())), paths.DefaultFileMode)
 }
 
-// Returns a derived context that is cancelled when the remote end of the
-// connection closes.
+// Messages read from a connection in the background by [readMessages].
+type messageReader struct {
+	lines  chan message  // Newline-terminated messages, in the order received.
+	closed chan struct{} // Closed when the client closes the connection or a read fails.
+}
+
+// A message read by a [messageReader].
+type message struct {
+	line []byte // Newline-terminated message. Nil when err is set.
+	err  error  // Why the message was dropped, such as [ErrMessageTooLarge].
+}
+
+// Reads newline-delimited messages from r in a background goroutine until
+// the connection ends or stop is closed.
 //
-// Detection works by reading from r in a background goroutine. The read blocks
-// until the peer closes the connection, at which point it returns an error and
-// the derived context is cancelled. The caller must ensure that no further data
-// is expected on r for the lifetime of the returned context. If data arrives
-// unexpectedly, it will be discarded and the context will be cancelled
-// prematurely. The returned [context.CancelFunc] must always be called to
-// release resources, even if the connection closes on its own.
-func contextWithDisconnect(parent context.Context, r io.Reader) (context.Context, context.CancelFunc) {
-	ctx, cancel := context.WithCancel(parent)
+// Reading carries on while a command runs, so that the end of the
+// connection is noticed right away and can cancel the command, without
+// mistaking the client's next command for a disconnect. The next message
+// waits in the reader until it is taken, and reading resumes after that,
+// so a client that sends a command and disconnects while an earlier one
+// runs is only noticed once the earlier one finishes. A message cut off by
+// the end of the connection is discarded.
+//
+// A message longer than limit bytes is read to its end without being kept
+// and handed on as an [ErrMessageTooLarge] error in its place, so the
+// connection stays in step with the client.
+func readMessages(r io.Reader, stop <-chan struct{}, limit int64) *messageReader {
+	m := &messageReader{
+		lines:  make(chan message),
+		closed: make(chan struct{}),
+	}
 
 	go func() {
-		buf := make([]byte, 1)
-		r.Read(buf)
-		cancel()
+		defer close(m.closed)
+		reader := bufio.NewReader(r)
+		for {
+			line, err := readMessage(reader, limit)
+			msg := message{line: line}
+			switch {
+			case errors.Is(err, ErrMessageTooLarge):
+				msg = message{err: err}
+			case err != nil:
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					slog.Error("read error", "error", err)
+				}
+				return
+			}
+			select {
+			case m.lines <- msg:
+			case <-stop:
+				return
+			}
+		}
 	}()
 
-	return ctx, cancel
+	return m
+}
+
+// Reads one newline-terminated message of at most limit bytes.
+//
+// A longer message is consumed up to its newline and discarded, holding no
+// more than the reader's buffer at a time, and fails with
+// [ErrMessageTooLarge].
+func readMessage(reader *bufio.Reader, limit int64) ([]byte, error) {
+	var line []byte
+	var size int64
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		size += int64(len(chunk))
+		if size <= limit {
+			line = append(line, chunk...)
+		} else {
+			line = nil
+		}
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case err != nil:
+			return nil, err
+		case size > limit:
+			return nil, crex.Wrapf(ErrMessageTooLarge, "message of %d bytes exceeds the limit of %d", size, limit)
+		}
+		return line, nil
+	}
 }
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cruciblehq/spec/protocol"
+)
+
+func TestConnectionCarriesSeveralCommands(t *testing.T) {
+	s := newTestServer(t)
+	conn, responses := sendCommand(t, s, protocol.CmdStatus, nil)
+
+	for _, line := range []string{`{"command":"capabilities"}`, `not json`, `{"command":"status"}`} {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	for _, want := range []protocol.Command{protocol.CmdOK, protocol.CmdOK, protocol.CmdError, protocol.CmdOK} {
+		expectResponse(t, responses, want)
+	}
+}
+
+func TestNextCommandIsNotADisconnect(t *testing.T) {
+	s := newTestServer(t)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	feed := newBuildFeed("build-test", cancel)
+	if err := s.registerBuild(feed); err != nil {
+		t.Fatal(err)
+	}
+
+	// The status is sent while the cancel waits for the build to finish.
+	conn, responses := sendCommand(t, s, cmdBuildCancel, buildCancelRequest{ID: "build-test"})
+	<-ctx.Done()
+	if _, err := conn.Write([]byte(`{"command":"status"}` + "\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := responses.Peek(1); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("cancel responded before the build finished: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.finishBuild(feed, protocol.CmdError, newErrorResult(ErrBuildCanceled))
+	expectResponse(t, responses, protocol.CmdOK)
+	expectResponse(t, responses, protocol.CmdOK)
+}
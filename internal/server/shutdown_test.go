@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Returns a server accepting connections on a socket in a temporary
+// directory, without a runtime.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	s := &Server{
+		socketPath:  filepath.Join(dir, "cruxd.sock"),
+		pidFilePath: filepath.Join(dir, "cruxd.pid"),
+		maxMessage:  DefaultMaxMessageSize,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serve(listener)
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+// Sends a command to the server and returns a reader for its responses.
+func sendCommand(t *testing.T, s *Server, cmd protocol.Command, payload any) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("unix", s.socketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	data, err := protocol.Encode(cmd, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+// Reads one response and checks its command.
+func expectResponse(t *testing.T, r *bufio.Reader, want protocol.Command) {
+	t.Helper()
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	env, _, err := protocol.Decode(line)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if env.Command != want {
+		t.Fatalf("command = %q, want %q", env.Command, want)
+	}
+}
+
+func TestShutdownWaitsForInFlightCommands(t *testing.T) {
+	s := newTestServer(t)
+	s.grace = time.Minute
+
+	// A build-cancel stays in flight until the build it canceled finishes.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	feed := newBuildFeed("build-test", cancel)
+	if err := s.registerBuild(feed); err != nil {
+		t.Fatal(err)
+	}
+	_, inFlight := sendCommand(t, s, cmdBuildCancel, buildCancelRequest{ID: "build-test"})
+	<-ctx.Done()
+
+	_, shutdown := sendCommand(t, s, cmdShutdown, nil)
+	expectResponse(t, shutdown, protocol.CmdOK)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", s.socketPath)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("new connections still accepted after shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-s.Stopped():
+		t.Fatal("server stopped with a command in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.finishBuild(feed, protocol.CmdError, newErrorResult(ErrBuildCanceled))
+	expectResponse(t, inFlight, protocol.CmdOK)
+
+	select {
+	case <-s.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after the in-flight command finished")
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	s := newTestServer(t)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	if err := s.registerBuild(newBuildFeed("build-test", cancel)); err != nil {
+		t.Fatal(err)
+	}
+	sendCommand(t, s, cmdBuildCancel, buildCancelRequest{ID: "build-test"})
+	<-ctx.Done()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(50 * time.Millisecond) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("shutdown = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not give up after its grace period")
+	}
+	if err := s.Stop(); err != nil {
+		t.Errorf("second stop = %v", err)
+	}
+}
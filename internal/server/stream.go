@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+// Forwards process output to a client as [cmdOutput] messages.
+//
+// Each Write is sent as one message tagged with the stream name. Writers that
+// share a lock can be used concurrently for stdout and stderr without
+// interleaving messages on the connection.
+type outputWriter struct {
+	s      *Server     // Server used to encode messages.
+	conn   net.Conn    // Client connection.
+	stream string      // Stream name reported to the client.
+	mu     *sync.Mutex // Serializes writes to conn.
+}
+
+// Creates stdout and stderr writers for a connection that share a lock.
+func newOutputWriters(s *Server, conn net.Conn) (stdout, stderr *outputWriter) {
+	mu := &sync.Mutex{}
+	stdout = &outputWriter{s: s, conn: conn, stream: "stdout", mu: mu}
+	stderr = &outputWriter{s: s, conn: conn, stream: "stderr", mu: mu}
+	return stdout, stderr
+}
+
+// Sends p to the client as a single output message.
+//
+// Write errors on the connection are not reported back, so a client that
+// disconnects does not make the process fail. The disconnect is detected
+// separately and cancels the command.
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.s.respond(w.conn, cmdOutput, &outputChunk{Stream: w.stream, Data: p})
+	return len(p), nil
+}
+
+// Sends process output events to a client as [cmdOutput] messages until
+// events is closed. The bytes of each event are sent as the process wrote
+// them, whether or not they are valid UTF-8.
+func (s *Server) forwardOutput(conn net.Conn, events <-chan runtime.ExecEvent) {
+	for ev := range events {
+		s.respond(conn, cmdOutput, &outputChunk{Stream: string(ev.Stream), Data: ev.Data})
+	}
+}
+
+// Feeds the [cmdInput] and [cmdResize] messages of an interactive exec to
+// the command until done is closed.
+//
+// Input is written to stdin, which is closed when the client asks for it or
+// disconnects. Resizes are dropped when resize is nil, as for a command
+// without a terminal. Malformed messages and other commands are logged and
+// dropped, since the connection carries no other command until the exec
+// finishes.
+func forwardInput(messages *messageReader, stdin *io.PipeWriter, resize chan<- runtime.TerminalSize, done <-chan struct{}) {
+	for {
+		var msg message
+		select {
+		case msg = <-messages.lines:
+		case <-messages.closed:
+			stdin.Close()
+			return
+		case <-done:
+			return
+		}
+		if msg.err != nil {
+			slog.Warn("ignoring message during interactive exec", "error", msg.err)
+			continue
+		}
+
+		env, payload, err := protocol.Decode(msg.line)
+		if err != nil {
+			slog.Warn("ignoring malformed message during interactive exec", "error", err)
+			continue
+		}
+
+		switch env.Command {
+		case cmdInput:
+			chunk, err := protocol.DecodePayload[inputChunk](payload)
+			if err != nil {
+				slog.Warn("ignoring malformed input", "error", err)
+				continue
+			}
+			if len(chunk.Data) > 0 {
+				stdin.Write(chunk.Data)
+			}
+			if chunk.Close {
+				stdin.Close()
+			}
+		case cmdResize:
+			size, err := protocol.DecodePayload[terminalSize](payload)
+			if err != nil || resize == nil {
+				continue
+			}
+			select {
+			case resize <- runtime.TerminalSize{Width: size.Width, Height: size.Height}:
+			case <-done:
+				return
+			}
+		default:
+			slog.Warn("ignoring command during interactive exec", "command", env.Command)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cruciblehq/cruxd/internal/runtime"
+	"github.com/cruciblehq/spec/protocol"
+)
+
+func TestOutputWriter(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	stdout, stderr := newOutputWriters(&Server{}, server)
+
+	go func() {
+		stdout.Write([]byte("hello\n"))
+		stderr.Write([]byte("oops"))
+		stdout.Write([]byte{0xe2, 0x82})
+		stdout.Write([]byte{0xac, 0x00, 0xff})
+	}()
+
+	reader := bufio.NewReader(client)
+	want := []outputChunk{
+		{Stream: "stdout", Data: []byte("hello\n")},
+		{Stream: "stderr", Data: []byte("oops")},
+		{Stream: "stdout", Data: []byte{0xe2, 0x82}},
+		{Stream: "stdout", Data: []byte{0xac, 0x00, 0xff}},
+	}
+	for _, w := range want {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		env, payload, err := protocol.Decode(line)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if env.Command != cmdOutput {
+			t.Errorf("command = %q, want %q", env.Command, cmdOutput)
+		}
+		got, err := protocol.DecodePayload[outputChunk](payload)
+		if err != nil {
+			t.Fatalf("decode payload: %v", err)
+		}
+		if got.Stream != w.Stream || !bytes.Equal(got.Data, w.Data) {
+			t.Errorf("chunk = %+v, want %+v", *got, w)
+		}
+	}
+}
+
+func TestForwardOutput(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	events := make(chan runtime.ExecEvent, 4)
+	events <- runtime.ExecEvent{Stream: runtime.StreamStdout, Data: []byte("building\n")}
+	events <- runtime.ExecEvent{Stream: runtime.StreamStderr, Data: []byte("warning\n")}
+	events <- runtime.ExecEvent{Stream: runtime.StreamStdout, Data: []byte{0x1f, 0x8b, 0x08, 0xff, 0xfe}}
+	events <- runtime.ExecEvent{Stream: runtime.StreamStdout, Data: []byte("done\n")}
+	close(events)
+
+	go (&Server{}).forwardOutput(server, events)
+
+	reader := bufio.NewReader(client)
+	want := []outputChunk{
+		{Stream: "stdout", Data: []byte("building\n")},
+		{Stream: "stderr", Data: []byte("warning\n")},
+		{Stream: "stdout", Data: []byte{0x1f, 0x8b, 0x08, 0xff, 0xfe}},
+		{Stream: "stdout", Data: []byte("done\n")},
+	}
+	for _, w := range want {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		_, payload, err := protocol.Decode(line)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		got, err := protocol.DecodePayload[outputChunk](payload)
+		if err != nil {
+			t.Fatalf("decode payload: %v", err)
+		}
+		if got.Stream != w.Stream || !bytes.Equal(got.Data, w.Data) {
+			t.Errorf("chunk = %+v, want %+v", *got, w)
+		}
+	}
+}
+
+func TestForwardInput(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	messages := readMessages(server, stop, DefaultMaxMessageSize)
+
+	stdin, input := io.Pipe()
+	resize := make(chan runtime.TerminalSize, 1)
+	done := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		forwardInput(messages, input, resize, done)
+		close(forwarded)
+	}()
+
+	go func() {
+		for _, msg := range []struct {
+			cmd     protocol.Command
+			payload any
+		}{
+			{cmdResize, terminalSize{Width: 120, Height: 40}},
+			{cmdInput, inputChunk{Data: []byte("echo hi\n")}},
+			{protocol.CmdStatus, nil},
+			{cmdInput, inputChunk{Data: []byte{0x1b, 0x5b, 0x41, 0xc3, 0xff}}},
+			{cmdInput, inputChunk{Data: []byte("exit\n"), Close: true}},
+		} {
+			data, _ := protocol.Encode(msg.cmd, msg.payload)
+			client.Write(append(data, '\n'))
+		}
+	}()
+
+	got, err := io.ReadAll(stdin)
+	if err != nil {
+		t.Fatalf("read stdin: %v", err)
+	}
+	if string(got) != "echo hi\n\x1b[A\xc3\xffexit\n" {
+		t.Errorf("stdin = %q", got)
+	}
+	if size := <-resize; size != (runtime.TerminalSize{Width: 120, Height: 40}) {
+		t.Errorf("resize = %+v", size)
+	}
+
+	close(done)
+	<-forwarded
+}